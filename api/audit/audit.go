@@ -0,0 +1,74 @@
+// Package audit keeps every security event in the append-only audit_log
+// table. It is an outbox sink, so the log holds each event exactly once even
+// when the dispatcher delivers it again. Entries form a hash chain whose head
+// is signed periodically, so that changes to the table can be detected.
+package audit
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/arrogantworm/jwt_auth/api/events"
+	"github.com/arrogantworm/jwt_auth/api/outbox"
+	"github.com/arrogantworm/jwt_auth/db"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const SinkName = "audit"
+
+// Widths of the audit_log columns that hold what the client sent
+const (
+	ipAddressWidth = 45
+	userAgentWidth = 255
+)
+
+// Sink records events in the audit log
+type Sink struct {
+	db *db.Postgres
+}
+
+func New(pg *db.Postgres) *Sink {
+	return &Sink{db: pg}
+}
+
+func (s *Sink) Name() string {
+	return SinkName
+}
+
+func (s *Sink) Deliver(ctx context.Context, e *events.Event) error {
+	entry := &db.AuditLogEntry{
+		EventID:    e.ID,
+		EventType:  e.Type,
+		SessionID:  e.SessionID,
+		IPAddress:  fitColumn(e.IP, ipAddressWidth),
+		UserAgent:  fitColumn(e.UserAgent, userAgentWidth),
+		Data:       e.Data,
+		OccurredAt: e.Time,
+	}
+	if e.UserID != 0 {
+		entry.UserID = &e.UserID
+	}
+
+	err := s.db.AppendAuditLogEntry(ctx, entry, Hash)
+
+	// Data exceptions come back the same on every attempt
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && strings.HasPrefix(pgErr.Code, "22") {
+		return outbox.Permanent(err)
+	}
+
+	return err
+}
+
+// fitColumn makes s valid text of at most width characters, as Postgres
+// refuses anything else
+func fitColumn(s string, width int) string {
+	s = strings.ReplaceAll(strings.ToValidUTF8(s, "\uFFFD"), "\x00", "")
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+
+	return string([]rune(s)[:width])
+}
@@ -0,0 +1,64 @@
+package audit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/arrogantworm/jwt_auth/db"
+)
+
+// canonical encodes e with sorted keys and no insignificant whitespace. Data is
+// decoded and encoded again so that the JSONB round trip, which reorders keys
+// and drops whitespace, doesn't change the result.
+func canonical(e *db.AuditLogEntry) ([]byte, error) {
+	var data any
+	if len(e.Data) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(e.Data))
+		dec.UseNumber()
+		if err := dec.Decode(&data); err != nil {
+			return nil, err
+		}
+	}
+
+	// Maps are encoded with sorted keys
+	return json.Marshal(map[string]any{
+		"eventId":    e.EventID,
+		"type":       e.EventType,
+		"userId":     e.UserID,
+		"sessionId":  e.SessionID,
+		"ip":         e.IPAddress,
+		"userAgent":  e.UserAgent,
+		"data":       data,
+		"occurredAt": e.OccurredAt.UTC().Format(time.RFC3339Nano),
+		"prevHash":   e.PrevHash,
+	})
+}
+
+// Hash returns the hex SHA-256 of the canonical JSON of e, which includes the
+// hash of the entry before it
+func Hash(e *db.AuditLogEntry) (string, error) {
+	b, err := canonical(e)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// checkpointDigest is what a checkpoint signature covers
+func checkpointDigest(entryID int64, hash string) ([]byte, error) {
+	b, err := json.Marshal(map[string]any{
+		"entryId": entryID,
+		"hash":    hash,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(b)
+	return sum[:], nil
+}
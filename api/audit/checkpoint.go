@@ -0,0 +1,103 @@
+package audit
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/arrogantworm/jwt_auth/api/token"
+	"github.com/arrogantworm/jwt_auth/db"
+	"github.com/jackc/pgx/v5"
+	"github.com/spf13/viper"
+)
+
+type Config struct {
+	CheckpointInterval time.Duration `mapstructure:"checkpointInterval"`
+}
+
+// Checkpointer signs the head of the chain with the service's signing key
+type Checkpointer struct {
+	db     *db.Postgres
+	signer *token.RSASigner
+	config Config
+
+	lastEntryID int64
+}
+
+func NewCheckpointer(pg *db.Postgres, signer *token.RSASigner) (*Checkpointer, error) {
+	var cfg Config
+	if err := viper.UnmarshalKey("audit", &cfg); err != nil {
+		return nil, fmt.Errorf("error reading audit config: %w", err)
+	}
+
+	if cfg.CheckpointInterval == 0 {
+		cfg.CheckpointInterval = time.Hour
+	}
+
+	return &Checkpointer{
+		db:     pg,
+		signer: signer,
+		config: cfg,
+	}, nil
+}
+
+// Run signs a checkpoint every interval, while new entries keep coming, until
+// ctx is done
+func (c *Checkpointer) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.config.CheckpointInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := c.Checkpoint(ctx); err != nil && ctx.Err() == nil {
+			log.Println("[AUDIT] error signing checkpoint:", err)
+		}
+	}
+}
+
+// Checkpoint signs the latest entry unless it is already signed
+func (c *Checkpointer) Checkpoint(ctx context.Context) error {
+	e, err := c.db.LatestAuditLogEntry(ctx)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Entries from before the chain have no hash to vouch for
+	if e.ID == c.lastEntryID || e.Hash == "" {
+		return nil
+	}
+
+	digest, err := checkpointDigest(e.ID, e.Hash)
+	if err != nil {
+		return err
+	}
+
+	sig, err := c.signer.SignDigest(digest)
+	if err != nil {
+		return err
+	}
+
+	err = c.db.CreateAuditCheckpoint(ctx, &db.AuditCheckpoint{
+		EntryID:   e.ID,
+		Hash:      e.Hash,
+		KeyID:     c.signer.KeyID,
+		Signature: base64.RawURLEncoding.EncodeToString(sig),
+	})
+	if err != nil {
+		return err
+	}
+
+	c.lastEntryID = e.ID
+	return nil
+}
@@ -0,0 +1,138 @@
+package audit
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/arrogantworm/jwt_auth/db"
+)
+
+// Report is the outcome of Verify. BrokenEntryID is the first entry that
+// doesn't follow from the ones before it, 0 when the chain is intact.
+type Report struct {
+	Entries       int
+	Unchained     int
+	Checkpoints   int
+	BrokenEntryID int64
+	Problem       string
+}
+
+func (r *Report) broken(entryID int64, format string, args ...any) error {
+	r.BrokenEntryID = entryID
+	r.Problem = fmt.Sprintf(format, args...)
+	return errStop
+}
+
+// errStop ends the walk at a broken link
+var errStop = errors.New("stop")
+
+// Verify walks the chain from the oldest entry and stops at the first broken
+// link. Every checkpoint has to be signed by keyID, and is checked against pub.
+// Without pub no checkpoint can be verified, so any checkpoint breaks the chain.
+func Verify(ctx context.Context, pg *db.Postgres, pub *rsa.PublicKey, keyID string) (*Report, error) {
+	checkpoints, err := pg.ListAuditCheckpoints(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	byEntry := map[int64]*db.AuditCheckpoint{}
+	for _, c := range checkpoints {
+		byEntry[c.EntryID] = c
+	}
+
+	r := &Report{}
+	var prev *db.AuditLogEntry
+
+	err = pg.ExportAuditLog(ctx, db.AuditLogFilter{}, func(e *db.AuditLogEntry) error {
+		r.Entries++
+
+		// Entries recorded before the chain existed can only come first
+		if e.Hash == "" {
+			if prev != nil && prev.Hash != "" {
+				return r.broken(e.ID, "entry has no hash but follows chained entry %d", prev.ID)
+			}
+			r.Unchained++
+			prev = e
+			return nil
+		}
+
+		var prevHash string
+		if prev != nil {
+			prevHash = prev.Hash
+		}
+		if e.PrevHash != prevHash {
+			return r.broken(e.ID, "previous hash does not match the entry before it, which may have been removed")
+		}
+
+		hash, err := Hash(e)
+		if err != nil {
+			return r.broken(e.ID, "entry can't be hashed: %v", err)
+		}
+		if hash != e.Hash {
+			return r.broken(e.ID, "entry was changed after it was recorded")
+		}
+
+		if c, ok := byEntry[e.ID]; ok {
+			if c.Hash != e.Hash {
+				return r.broken(e.ID, "hash does not match checkpoint %d", c.ID)
+			}
+
+			if pub == nil {
+				return r.broken(e.ID, "checkpoint %d can't be verified without a signing key", c.ID)
+			}
+			// A checkpoint under a made up key could have been added with the
+			// rest of a rebuilt chain
+			if c.KeyID != keyID {
+				return r.broken(e.ID, "checkpoint %d was signed by unknown key %q", c.ID, c.KeyID)
+			}
+			if err := verifyCheckpoint(c, pub); err != nil {
+				return r.broken(e.ID, "checkpoint %d: %v", c.ID, err)
+			}
+
+			r.Checkpoints++
+			delete(byEntry, e.ID)
+		}
+
+		prev = e
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStop) {
+		return nil, err
+	}
+	if r.BrokenEntryID != 0 {
+		return r, nil
+	}
+
+	// A checkpoint without its entry means the end of the chain was cut off
+	for _, c := range checkpoints {
+		if _, ok := byEntry[c.EntryID]; ok {
+			r.BrokenEntryID = c.EntryID
+			r.Problem = fmt.Sprintf("entry signed by checkpoint %d is missing", c.ID)
+			return r, nil
+		}
+	}
+
+	return r, nil
+}
+
+func verifyCheckpoint(c *db.AuditCheckpoint, pub *rsa.PublicKey) error {
+	sig, err := base64.RawURLEncoding.DecodeString(c.Signature)
+	if err != nil {
+		return errors.New("malformed signature")
+	}
+
+	digest, err := checkpointDigest(c.EntryID, c.Hash)
+	if err != nil {
+		return err
+	}
+
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, sig); err != nil {
+		return errors.New("invalid signature")
+	}
+
+	return nil
+}
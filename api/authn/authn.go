@@ -0,0 +1,134 @@
+// Package authn checks username and password credentials against the local
+// user store or an external directory.
+package authn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/arrogantworm/jwt_auth/api/utils"
+	"github.com/arrogantworm/jwt_auth/db"
+	"github.com/jackc/pgx/v5"
+	"github.com/spf13/viper"
+)
+
+const (
+	AuthenticatorLocal = "local"
+	AuthenticatorLDAP  = "ldap"
+)
+
+var (
+	ErrWrongPassword = errors.New("wrong password")
+	// ErrUserDisabled is returned for valid credentials of a deactivated user
+	ErrUserDisabled = errors.New("user is disabled")
+	// ErrPasswordResetRequired is returned for valid credentials of a user who
+	// reported a signin, until a new password is set through the alert email
+	ErrPasswordResetRequired = errors.New("a new password has to be chosen through the link in the new sign-in email")
+)
+
+type Authenticator interface {
+	// Authenticate returns the local user for valid credentials. Invalid
+	// credentials are reported as ErrWrongPassword or pgx.ErrNoRows.
+	Authenticate(ctx context.Context, username string, password string) (*db.User, error)
+}
+
+// New builds the authenticators listed in auth.authenticators, in order.
+// The local bcrypt store is used when none are configured.
+func New(pg *db.Postgres) (Authenticator, error) {
+	names := viper.GetStringSlice("auth.authenticators")
+	if len(names) == 0 {
+		names = []string{AuthenticatorLocal}
+	}
+
+	var chain Chain
+	for _, name := range names {
+		switch name {
+		case AuthenticatorLocal:
+			chain = append(chain, NewLocal(pg))
+		case AuthenticatorLDAP:
+			l, err := NewLDAP(pg)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, l)
+		default:
+			return nil, fmt.Errorf("unknown authenticator %q", name)
+		}
+	}
+
+	if len(chain) == 1 {
+		return resetGuard{chain[0]}, nil
+	}
+
+	return resetGuard{chain}, nil
+}
+
+// resetGuard refuses users whose password may be known to someone else, for
+// every authenticator
+type resetGuard struct {
+	Authenticator
+}
+
+func (g resetGuard) Authenticate(ctx context.Context, username string, password string) (*db.User, error) {
+	u, err := g.Authenticator.Authenticate(ctx, username, password)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.PasswordResetRequired {
+		return nil, ErrPasswordResetRequired
+	}
+
+	return u, nil
+}
+
+// Local checks passwords against the bcrypt hashes in the users table
+type Local struct {
+	db *db.Postgres
+}
+
+func NewLocal(pg *db.Postgres) *Local {
+	return &Local{db: pg}
+}
+
+func (l *Local) Authenticate(ctx context.Context, username string, password string) (*db.User, error) {
+	// Check if user exists
+	u, err := l.db.GetUserByUsername(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check is password is valid
+	if err := utils.CheckPassword(password, u.Password); err != nil {
+		return nil, ErrWrongPassword
+	}
+
+	if !u.Active {
+		return nil, ErrUserDisabled
+	}
+
+	return u, nil
+}
+
+// Chain tries each authenticator in order until one accepts the credentials.
+// Any error other than invalid credentials stops the chain.
+type Chain []Authenticator
+
+func (c Chain) Authenticate(ctx context.Context, username string, password string) (*db.User, error) {
+	err := ErrWrongPassword
+
+	for _, a := range c {
+		u, aerr := a.Authenticate(ctx, username, password)
+		if aerr == nil {
+			return u, nil
+		}
+
+		if !errors.Is(aerr, ErrWrongPassword) && !errors.Is(aerr, pgx.ErrNoRows) {
+			return nil, aerr
+		}
+		err = aerr
+	}
+
+	return nil, err
+}
@@ -0,0 +1,221 @@
+package authn
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/arrogantworm/jwt_auth/db"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/jackc/pgx/v5"
+	"github.com/spf13/viper"
+)
+
+type (
+	// LDAPConfig is the ldap config section. For Active Directory use
+	// sAMAccountName as the username attribute and in the search filter.
+	LDAPConfig struct {
+		URL                string        `mapstructure:"url"`
+		StartTLS           bool          `mapstructure:"startTLS"`
+		InsecureSkipVerify bool          `mapstructure:"insecureSkipVerify"`
+		BindDN             string        `mapstructure:"bindDN"`
+		BindPasswordEnv    string        `mapstructure:"bindPasswordEnv"`
+		SearchBase         string        `mapstructure:"searchBase"`
+		SearchFilter       string        `mapstructure:"searchFilter"`
+		UsernameAttribute  string        `mapstructure:"usernameAttribute"`
+		NameAttribute      string        `mapstructure:"nameAttribute"`
+		GroupAttribute     string        `mapstructure:"groupAttribute"`
+		GroupRoles         []GroupRole   `mapstructure:"groupRoles"`
+		Timeout            time.Duration `mapstructure:"timeout"`
+	}
+
+	// GroupRole grants a role to members of a directory group
+	GroupRole struct {
+		Group string `mapstructure:"group"`
+		Role  string `mapstructure:"role"`
+	}
+
+	// LDAP verifies credentials with a search and bind against a directory and
+	// provisions a local user on first login. Name and roles are synced from the
+	// directory on every login.
+	LDAP struct {
+		db           *db.Postgres
+		config       LDAPConfig
+		bindPassword string
+	}
+)
+
+func NewLDAP(pg *db.Postgres) (*LDAP, error) {
+	var cfg LDAPConfig
+	if err := viper.UnmarshalKey("ldap", &cfg); err != nil {
+		return nil, fmt.Errorf("error reading ldap config: %w", err)
+	}
+
+	if cfg.URL == "" || cfg.SearchBase == "" {
+		return nil, errors.New("ldap.url and ldap.searchBase are required")
+	}
+
+	if cfg.SearchFilter == "" {
+		cfg.SearchFilter = "(uid=%s)"
+	}
+	if strings.Count(cfg.SearchFilter, "%s") != 1 {
+		return nil, errors.New("ldap.searchFilter must contain one %s for the username")
+	}
+	if cfg.UsernameAttribute == "" {
+		cfg.UsernameAttribute = "uid"
+	}
+	if cfg.NameAttribute == "" {
+		cfg.NameAttribute = "cn"
+	}
+	if cfg.GroupAttribute == "" {
+		cfg.GroupAttribute = "memberOf"
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+
+	return &LDAP{
+		db:           pg,
+		config:       cfg,
+		bindPassword: os.Getenv(cfg.BindPasswordEnv),
+	}, nil
+}
+
+func (l *LDAP) Authenticate(ctx context.Context, username string, password string) (*db.User, error) {
+	// An empty password would be an unauthenticated bind, which most servers accept
+	if username == "" || password == "" {
+		return nil, ErrWrongPassword
+	}
+
+	entry, err := l.verify(username, password)
+	if err != nil {
+		return nil, err
+	}
+
+	// The directory's spelling of the username, so "Alice" and "alice" are one user
+	if v := entry.GetAttributeValue(l.config.UsernameAttribute); v != "" {
+		username = v
+	}
+
+	name := entry.GetAttributeValue(l.config.NameAttribute)
+	if name == "" {
+		name = username
+	}
+
+	return l.syncUser(ctx, username, name, l.roles(entry.GetAttributeValues(l.config.GroupAttribute)))
+}
+
+// verify finds the user's entry with the service account and binds as it with password
+func (l *LDAP) verify(username string, password string) (*ldap.Entry, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: l.config.InsecureSkipVerify}
+
+	conn, err := ldap.DialURL(l.config.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: l.config.Timeout}),
+		ldap.DialWithTLSConfig(tlsConfig),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to ldap: %w", err)
+	}
+	defer conn.Close()
+
+	conn.SetTimeout(l.config.Timeout)
+
+	if l.config.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			return nil, fmt.Errorf("error starting tls: %w", err)
+		}
+	}
+
+	if l.config.BindDN != "" {
+		if err := conn.Bind(l.config.BindDN, l.bindPassword); err != nil {
+			return nil, fmt.Errorf("error binding ldap service account: %w", err)
+		}
+	}
+
+	req := ldap.NewSearchRequest(
+		l.config.SearchBase,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		2,
+		int(l.config.Timeout.Seconds()),
+		false,
+		fmt.Sprintf(l.config.SearchFilter, ldap.EscapeFilter(username)),
+		[]string{l.config.UsernameAttribute, l.config.NameAttribute, l.config.GroupAttribute},
+		nil,
+	)
+
+	res, err := conn.Search(req)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("error searching ldap: %w", err)
+	}
+
+	// Unknown and ambiguous usernames are both rejected
+	if res == nil || len(res.Entries) != 1 {
+		return nil, ErrWrongPassword
+	}
+
+	entry := res.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrWrongPassword
+		}
+
+		return nil, fmt.Errorf("error binding ldap user: %w", err)
+	}
+
+	return entry, nil
+}
+
+// roles maps the user's group DNs to roles. DNs are compared case-insensitively.
+func (l *LDAP) roles(groups []string) []string {
+	roles := []string{}
+
+	for _, gr := range l.config.GroupRoles {
+		if slices.ContainsFunc(groups, func(g string) bool { return strings.EqualFold(g, gr.Group) }) && !slices.Contains(roles, gr.Role) {
+			roles = append(roles, gr.Role)
+		}
+	}
+
+	slices.Sort(roles)
+	return roles
+}
+
+func (l *LDAP) syncUser(ctx context.Context, username string, name string, roles []string) (*db.User, error) {
+	u, err := l.db.GetUserByUsername(ctx, username)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// Directory users have no local password
+		return l.db.CreateUser(ctx, &db.User{
+			Name:       name,
+			Username:   username,
+			Roles:      roles,
+			AuthSource: db.AuthSourceLDAP,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// A local account with the same username is not taken over by the directory
+	if u.AuthSource != db.AuthSourceLDAP {
+		return nil, ErrWrongPassword
+	}
+
+	if !u.Active {
+		return nil, ErrUserDisabled
+	}
+
+	if err := l.db.UpdateUserProfile(ctx, u.ID, name, roles); err != nil {
+		return nil, err
+	}
+	u.Name = name
+	u.Roles = roles
+
+	return u, nil
+}
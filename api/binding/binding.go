@@ -0,0 +1,217 @@
+// Package binding decides what happens when a session is renewed from
+// elsewhere than it was last used. Each property a session can be bound to has
+// its own action, and OAuth clients can override them.
+package binding
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+
+	"github.com/arrogantworm/jwt_auth/api/utils"
+	"github.com/spf13/viper"
+)
+
+// Actions, from the mildest
+const (
+	ActionOff    = "off"
+	ActionNotify = "notify"
+	// The renewal is refused and the client has to sign in again, the session
+	// stays usable from where it was bound to
+	ActionStepUp = "step-up"
+	ActionRevoke = "revoke"
+)
+
+// Bindings
+const (
+	IP        = "ip"
+	Subnet    = "subnet"
+	ASN       = "asn"
+	UserAgent = "userAgent"
+)
+
+var severity = map[string]int{
+	ActionOff:    0,
+	ActionNotify: 1,
+	ActionStepUp: 2,
+	ActionRevoke: 3,
+}
+
+// Rules has the action of every binding. Empty ones are inherited.
+type Rules struct {
+	IP        string `mapstructure:"ip"`
+	Subnet    string `mapstructure:"subnet"`
+	ASN       string `mapstructure:"asn"`
+	UserAgent string `mapstructure:"userAgent"`
+}
+
+type ClientRules struct {
+	ClientID string `mapstructure:"clientId"`
+	Rules    `mapstructure:",squash"`
+}
+
+type Config struct {
+	Rules   `mapstructure:",squash"`
+	Clients []ClientRules `mapstructure:"clients"`
+}
+
+// Policy is the configured binding
+type Policy struct {
+	rules   Rules
+	clients map[string]Rules
+}
+
+// New reads the policy from binding. Without it, sessions are bound to their
+// user agent and IP changes are only reported.
+func New() (*Policy, error) {
+	var cfg Config
+	if err := viper.UnmarshalKey("binding", &cfg); err != nil {
+		return nil, fmt.Errorf("error reading binding config: %w", err)
+	}
+
+	p := &Policy{
+		rules: Rules{
+			IP:        ActionNotify,
+			Subnet:    ActionOff,
+			ASN:       ActionOff,
+			UserAgent: ActionRevoke,
+		}.override(cfg.Rules),
+		clients: map[string]Rules{},
+	}
+	if err := p.rules.validate(); err != nil {
+		return nil, err
+	}
+
+	for _, c := range cfg.Clients {
+		if c.ClientID == "" {
+			return nil, fmt.Errorf("binding.clients: clientId is required")
+		}
+		if err := c.Rules.validate(); err != nil {
+			return nil, fmt.Errorf("binding.clients %s: %w", c.ClientID, err)
+		}
+		p.clients[c.ClientID] = c.Rules
+	}
+
+	return p, nil
+}
+
+func (r Rules) override(o Rules) Rules {
+	if o.IP != "" {
+		r.IP = o.IP
+	}
+	if o.Subnet != "" {
+		r.Subnet = o.Subnet
+	}
+	if o.ASN != "" {
+		r.ASN = o.ASN
+	}
+	if o.UserAgent != "" {
+		r.UserAgent = o.UserAgent
+	}
+
+	return r
+}
+
+func (r Rules) validate() error {
+	for name, action := range map[string]string{IP: r.IP, Subnet: r.Subnet, ASN: r.ASN, UserAgent: r.UserAgent} {
+		if _, ok := severity[action]; !ok && action != "" {
+			return fmt.Errorf("unknown binding action %q for %s", action, name)
+		}
+	}
+
+	return nil
+}
+
+// Rules returns the actions for sessions of clientID, which is empty for
+// first-party sessions
+func (p *Policy) Rules(clientID string) Rules {
+	if c, ok := p.clients[clientID]; ok && clientID != "" {
+		return p.rules.override(c)
+	}
+
+	return p.rules
+}
+
+// Context is what a session is bound to, or what a renewal comes with. ASN is
+// 0 when unknown.
+type Context struct {
+	IP        string
+	ASN       int
+	UserAgent string
+}
+
+// Mismatch is a binding a renewal broke
+type Mismatch struct {
+	Binding  string
+	Expected string
+	Actual   string
+	Action   string
+}
+
+// Check compares a renewal with what the session of clientID is bound to and
+// returns the mismatches that have an action
+func (p *Policy) Check(clientID string, bound, actual Context) []Mismatch {
+	rules := p.Rules(clientID)
+	var mismatches []Mismatch
+
+	add := func(binding, action, expected, got string) {
+		if action != ActionOff && expected != got {
+			mismatches = append(mismatches, Mismatch{binding, expected, got, action})
+		}
+	}
+
+	add(IP, rules.IP, bound.IP, actual.IP)
+	add(Subnet, rules.Subnet, SubnetOf(bound.IP), SubnetOf(actual.IP))
+	// An unknown network can't be told apart from a known one
+	if bound.ASN != 0 && actual.ASN != 0 {
+		add(ASN, rules.ASN, strconv.Itoa(bound.ASN), strconv.Itoa(actual.ASN))
+	}
+	add(UserAgent, rules.UserAgent, NormalizeUserAgent(bound.UserAgent), NormalizeUserAgent(actual.UserAgent))
+
+	return mismatches
+}
+
+// Strictest returns the mismatch with the strictest action, or nil
+func Strictest(mismatches []Mismatch) *Mismatch {
+	var strictest *Mismatch
+	for i := range mismatches {
+		if strictest == nil || severity[mismatches[i].Action] > severity[strictest.Action] {
+			strictest = &mismatches[i]
+		}
+	}
+
+	return strictest
+}
+
+// SubnetOf returns the /24 of IPv4 and the /48 of IPv6 addresses. Anything
+// else is returned as it is.
+func SubnetOf(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap()
+
+	bits := 48
+	if addr.Is4() {
+		bits = 24
+	}
+
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return ip
+	}
+
+	return prefix.String()
+}
+
+// NormalizeUserAgent keeps the browser family and major version, which stay
+// the same across minor updates. Unrecognized user agents are kept whole.
+func NormalizeUserAgent(userAgent string) string {
+	ua := utils.ParseUserAgent(userAgent)
+	if ua.Browser == "" {
+		return userAgent
+	}
+
+	return ua.Family()
+}
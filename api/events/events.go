@@ -0,0 +1,285 @@
+// Package events defines the security events published by the service. Every
+// event shares one envelope, and the shape of Data depends on Type.
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/arrogantworm/jwt_auth/api/geoip"
+	"github.com/arrogantworm/jwt_auth/api/utils"
+	"github.com/arrogantworm/jwt_auth/db"
+)
+
+// Version is the schema version of the envelope and of every data type.
+// Fields are only ever added within a version.
+const Version = 1
+
+const (
+	TypeLoginSucceeded      = "auth.login_succeeded"
+	TypeLoginFailed         = "auth.login_failed"
+	TypeSessionCreated      = "session.created"
+	TypeSessionRenewed      = "session.renewed"
+	TypeSessionRevoked      = "session.revoked"
+	TypeSessionIPChanged    = "session.ip_changed"
+	TypeUserAgentMismatch   = "session.user_agent_mismatch"
+	TypeImpossibleTravel    = "session.impossible_travel"
+	TypeBindingMismatch     = "session.binding_mismatch"
+	TypeUserSessionsRevoked = "user.sessions_revoked"
+	TypePasswordChanged     = "user.password_changed"
+	TypeMFAEnrolled         = "user.mfa_enrolled"
+	TypeAccountLocked       = "user.account_locked"
+	TypeAdminAction         = "admin.action"
+	TypeRiskAssessed        = "risk.assessed"
+)
+
+// Types lists every event type
+var Types = []string{
+	TypeLoginSucceeded,
+	TypeLoginFailed,
+	TypeSessionCreated,
+	TypeSessionRenewed,
+	TypeSessionRevoked,
+	TypeSessionIPChanged,
+	TypeUserAgentMismatch,
+	TypeImpossibleTravel,
+	TypeBindingMismatch,
+	TypeUserSessionsRevoked,
+	TypePasswordChanged,
+	TypeMFAEnrolled,
+	TypeAccountLocked,
+	TypeAdminAction,
+	TypeRiskAssessed,
+}
+
+// Event is the common envelope. IP and UserAgent are those of the request that
+// caused the event. ID stays the same across redeliveries, so consumers can
+// use it to drop duplicates.
+type Event struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	Version   int             `json:"version"`
+	Time      time.Time       `json:"time"`
+	UserID    int             `json:"userId,omitempty"`
+	SessionID string          `json:"sessionId,omitempty"`
+	IP        string          `json:"ip,omitempty"`
+	UserAgent string          `json:"userAgent,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+}
+
+// Subject says who an event is about and where the request came from
+type Subject struct {
+	UserID    int
+	SessionID string
+	IP        string
+	UserAgent string
+}
+
+// New builds an event of eventType. data is one of the types below, or nil.
+func New(eventType string, subject Subject, data any) (*Event, error) {
+	id, err := utils.RandomHex(16)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Event{
+		ID:        id,
+		Type:      eventType,
+		Version:   Version,
+		Time:      time.Now().UTC(),
+		UserID:    subject.UserID,
+		SessionID: subject.SessionID,
+		IP:        subject.IP,
+		UserAgent: subject.UserAgent,
+	}
+
+	if data != nil {
+		e.Data, err = json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return e, nil
+}
+
+// Publisher is how the handlers emit events. Events that describe a database
+// change are staged and saved in the transaction of that change, the rest are
+// published on their own. Either way they reach every sink.
+type Publisher interface {
+	Publish(ctx context.Context, events ...*Event) error
+	Stage(events ...*Event) ([]*db.OutboxEvent, error)
+}
+
+// Login methods
+const (
+	MethodPassword  = "password"
+	MethodMagicLink = "magic_link"
+	MethodPhone     = "phone"
+	MethodExternal  = "external"
+	MethodSAML      = "saml"
+	MethodOAuth     = "oauth"
+)
+
+// Login failure reasons
+const (
+	ReasonWrongPassword         = "wrong_password"
+	ReasonUnknownUser           = "unknown_user"
+	ReasonUserDisabled          = "user_disabled"
+	ReasonInvalidCode           = "invalid_code"
+	ReasonPasswordResetRequired = "password_reset_required"
+)
+
+// Risk decisions that refused a signin or ended a session, also used as
+// session revocation reasons
+const (
+	ReasonRiskReauth = "risk_reauth"
+	ReasonRiskDenied = "risk_denied"
+)
+
+// Account lock reasons. ReasonNotMe locks a local account after a reported
+// sign-in, until a new password is chosen.
+const (
+	ReasonDeactivated = "deactivated"
+)
+
+// Session revocation reasons
+const (
+	ReasonLogout            = "logout"
+	ReasonRevoked           = "revoked"
+	ReasonExpired           = "expired"
+	ReasonUserAgentMismatch = "user_agent_mismatch"
+	ReasonNotMe             = "not_me"
+	ReasonImpossibleTravel  = "impossible_travel"
+	ReasonBindingMismatch   = "binding_mismatch"
+)
+
+// LoginSucceeded is the data of TypeLoginSucceeded. Provider is set for
+// external logins, ClientID for logins through an OAuth client. Location,
+// here and below, is where the envelope's IP is, when GeoIP is enabled.
+type LoginSucceeded struct {
+	Method   string          `json:"method"`
+	Provider string          `json:"provider,omitempty"`
+	ClientID string          `json:"clientId,omitempty"`
+	Location *geoip.Location `json:"location,omitempty"`
+}
+
+// LoginFailed is the data of TypeLoginFailed. Identifier is what the caller
+// signed in with, a username or phone number.
+type LoginFailed struct {
+	Method     string          `json:"method"`
+	Identifier string          `json:"identifier"`
+	Reason     string          `json:"reason"`
+	Location   *geoip.Location `json:"location,omitempty"`
+}
+
+// SessionCreated is the data of TypeSessionCreated
+type SessionCreated struct {
+	ClientID  string          `json:"clientId,omitempty"`
+	Scope     string          `json:"scope,omitempty"`
+	ExpiresAt time.Time       `json:"expiresAt"`
+	Location  *geoip.Location `json:"location,omitempty"`
+}
+
+// SessionRenewed is the data of TypeSessionRenewed. A renewed session gets a
+// new ID, the envelope carries the new one.
+type SessionRenewed struct {
+	PreviousSessionID string          `json:"previousSessionId"`
+	Location          *geoip.Location `json:"location,omitempty"`
+}
+
+// SessionRevoked is the data of TypeSessionRevoked
+type SessionRevoked struct {
+	Reason string `json:"reason"`
+}
+
+// SessionIPChanged is the data of TypeSessionIPChanged, recorded when a session
+// is renewed from another IP address than the envelope's
+type SessionIPChanged struct {
+	PreviousIP       string          `json:"previousIp"`
+	PreviousLocation *geoip.Location `json:"previousLocation,omitempty"`
+	Location         *geoip.Location `json:"location,omitempty"`
+}
+
+// UserAgentMismatch is the data of TypeUserAgentMismatch, recorded when the
+// binding policy ends a session renewed from another browser or major version
+// than it is bound to.
+type UserAgentMismatch struct {
+	ExpectedUserAgent string `json:"expectedUserAgent"`
+}
+
+// BindingMismatch is the data of TypeBindingMismatch, recorded when a session
+// is renewed from another IP address, subnet, network or user agent than it is
+// bound to. Action is what the binding policy did: notify, step-up or revoke.
+type BindingMismatch struct {
+	Binding  string `json:"binding"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+	Action   string `json:"action"`
+}
+
+// ImpossibleTravel is the data of TypeImpossibleTravel, recorded when a
+// session is renewed from farther away than could have been travelled since
+// its last use. Action is what was done about it: notify, reauth or revoke.
+type ImpossibleTravel struct {
+	PreviousIP       string          `json:"previousIp"`
+	PreviousLocation *geoip.Location `json:"previousLocation"`
+	Location         *geoip.Location `json:"location"`
+	DistanceKm       float64         `json:"distanceKm"`
+	ElapsedSeconds   float64         `json:"elapsedSeconds"`
+	SpeedKmh         float64         `json:"speedKmh"`
+	Action           string          `json:"action"`
+}
+
+// UserSessionsRevoked is the data of TypeUserSessionsRevoked. The envelope's
+// session, if any, is the one that stayed signed in.
+type UserSessionsRevoked struct {
+	ByAdmin bool   `json:"byAdmin"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// PasswordChanged is the data of TypePasswordChanged. The envelope's session,
+// if any, is the one that stayed signed in.
+type PasswordChanged struct {
+	OtherSessionsRevoked bool `json:"otherSessionsRevoked"`
+}
+
+// MFAEnrolled is the data of TypeMFAEnrolled
+type MFAEnrolled struct {
+	Method string `json:"method"`
+}
+
+// AccountLocked is the data of TypeAccountLocked. Until is empty for locks
+// that last until they are lifted, by an admin or by choosing a new password.
+type AccountLocked struct {
+	Reason string     `json:"reason"`
+	Until  *time.Time `json:"until,omitempty"`
+}
+
+// AdminAction is the data of TypeAdminAction, recorded for every request that
+// changes something through the admin or SCIM API. The envelope's user is the
+// admin making it, ClientID is set instead for SCIM clients. Route is the
+// pattern that matched, with the path parameters in Params.
+type AdminAction struct {
+	ClientID string            `json:"clientId,omitempty"`
+	Method   string            `json:"method"`
+	Route    string            `json:"route"`
+	Params   map[string]string `json:"params,omitempty"`
+	Status   int               `json:"status"`
+}
+
+// RiskAssessed is the data of TypeRiskAssessed, recorded for every signin and
+// renewal the risk engine scores. Kind is signin or renew, Decision is allow,
+// reauth or deny, and Signals are the ones that added to Score.
+type RiskAssessed struct {
+	Kind     string       `json:"kind"`
+	Score    int          `json:"score"`
+	Signals  []RiskSignal `json:"signals"`
+	Decision string       `json:"decision"`
+}
+
+type RiskSignal struct {
+	Name  string `json:"name"`
+	Score int    `json:"score"`
+}
@@ -0,0 +1,367 @@
+// Package federation signs users in through upstream OAuth2 and OpenID Connect
+// identity providers.
+package federation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	TypeOIDC   = "oidc"
+	TypeOAuth2 = "oauth2"
+)
+
+type (
+	// Config describes one upstream provider in the federation.providers section.
+	// OIDC providers only need an issuer, endpoints are discovered.
+	Config struct {
+		Type            string   `mapstructure:"type"`
+		DisplayName     string   `mapstructure:"displayName"`
+		Issuer          string   `mapstructure:"issuer"`
+		AuthURL         string   `mapstructure:"authURL"`
+		TokenURL        string   `mapstructure:"tokenURL"`
+		UserInfoURL     string   `mapstructure:"userInfoURL"`
+		ClientID        string   `mapstructure:"clientID"`
+		ClientSecretEnv string   `mapstructure:"clientSecretEnv"`
+		Scopes          []string `mapstructure:"scopes"`
+		AutoProvision   bool     `mapstructure:"autoProvision"`
+
+		// Userinfo fields of OAuth2 providers, GitHub's names by default
+		SubjectField  string `mapstructure:"subjectField"`
+		UsernameField string `mapstructure:"usernameField"`
+		NameField     string `mapstructure:"nameField"`
+		EmailField    string `mapstructure:"emailField"`
+	}
+
+	// Identity is the user as the upstream provider knows them
+	Identity struct {
+		Subject  string
+		Username string
+		Name     string
+		Email    string
+	}
+
+	Provider struct {
+		Name         string
+		config       Config
+		clientSecret string
+
+		// HTTPClient is used for every call to the provider
+		HTTPClient *http.Client
+
+		mu        sync.Mutex
+		discovery *discoveryDocument
+		keys      map[string]any
+	}
+
+	discoveryDocument struct {
+		Issuer                string   `json:"issuer"`
+		AuthorizationEndpoint string   `json:"authorization_endpoint"`
+		TokenEndpoint         string   `json:"token_endpoint"`
+		JWKSURI               string   `json:"jwks_uri"`
+		TokenAuthMethods      []string `json:"token_endpoint_auth_methods_supported"`
+	}
+
+	tokenResponse struct {
+		AccessToken      string `json:"access_token"`
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+)
+
+// LoadProviders reads federation.providers from the config. Client secrets are
+// read from the environment variable named by clientSecretEnv.
+func LoadProviders() (map[string]*Provider, error) {
+	var configs map[string]Config
+	if err := viper.UnmarshalKey("federation.providers", &configs); err != nil {
+		return nil, fmt.Errorf("error reading federation providers: %w", err)
+	}
+
+	providers := make(map[string]*Provider, len(configs))
+	for name, cfg := range configs {
+		if name == SAMLProviderName {
+			return nil, fmt.Errorf("provider name %q is reserved", name)
+		}
+
+		p, err := NewProvider(name, cfg, os.Getenv(cfg.ClientSecretEnv))
+		if err != nil {
+			return nil, err
+		}
+		providers[name] = p
+	}
+
+	return providers, nil
+}
+
+func NewProvider(name string, cfg Config, clientSecret string) (*Provider, error) {
+	if cfg.ClientID == "" {
+		return nil, fmt.Errorf("provider %s: clientID is required", name)
+	}
+
+	switch cfg.Type {
+	case TypeOIDC:
+		if cfg.Issuer == "" {
+			return nil, fmt.Errorf("provider %s: issuer is required", name)
+		}
+		cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+		if len(cfg.Scopes) == 0 {
+			cfg.Scopes = []string{"openid", "profile", "email"}
+		}
+	case TypeOAuth2:
+		if cfg.AuthURL == "" || cfg.TokenURL == "" || cfg.UserInfoURL == "" {
+			return nil, fmt.Errorf("provider %s: authURL, tokenURL and userInfoURL are required", name)
+		}
+		if cfg.SubjectField == "" {
+			cfg.SubjectField = "id"
+		}
+		if cfg.UsernameField == "" {
+			cfg.UsernameField = "login"
+		}
+		if cfg.NameField == "" {
+			cfg.NameField = "name"
+		}
+		if cfg.EmailField == "" {
+			cfg.EmailField = "email"
+		}
+	default:
+		return nil, fmt.Errorf("provider %s: unsupported type %q", name, cfg.Type)
+	}
+
+	if cfg.DisplayName == "" {
+		cfg.DisplayName = name
+	}
+
+	return &Provider{
+		Name:         name,
+		config:       cfg,
+		clientSecret: clientSecret,
+		HTTPClient:   &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (p *Provider) DisplayName() string {
+	return p.config.DisplayName
+}
+
+// AutoProvision reports whether unknown identities get a new local user
+func (p *Provider) AutoProvision() bool {
+	return p.config.AutoProvision
+}
+
+// AuthCodeURL returns the upstream authorization URL for a login using PKCE (S256).
+// nonce is only sent to OIDC providers.
+func (p *Provider) AuthCodeURL(ctx context.Context, redirectURI, state, nonce, codeChallenge string) (string, error) {
+	authURL := p.config.AuthURL
+
+	if p.config.Type == TypeOIDC {
+		d, err := p.discover(ctx)
+		if err != nil {
+			return "", err
+		}
+		authURL = d.AuthorizationEndpoint
+	}
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid authorization endpoint: %w", err)
+	}
+
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.config.ClientID)
+	q.Set("redirect_uri", redirectURI)
+	q.Set("scope", strings.Join(p.config.Scopes, " "))
+	q.Set("state", state)
+	q.Set("code_challenge", codeChallenge)
+	q.Set("code_challenge_method", "S256")
+	if p.config.Type == TypeOIDC {
+		q.Set("nonce", nonce)
+	}
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// Exchange redeems an authorization code and returns the upstream identity.
+// OIDC identities come from the verified ID token, OAuth2 ones from the userinfo endpoint.
+func (p *Provider) Exchange(ctx context.Context, redirectURI, code, codeVerifier, nonce string) (*Identity, error) {
+	if p.config.Type == TypeOIDC {
+		return p.exchangeOIDC(ctx, redirectURI, code, codeVerifier, nonce)
+	}
+
+	tok, err := p.redeemCode(ctx, p.config.TokenURL, true, redirectURI, code, codeVerifier)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.userInfo(ctx, tok.AccessToken)
+}
+
+func (p *Provider) exchangeOIDC(ctx context.Context, redirectURI, code, codeVerifier, nonce string) (*Identity, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// client_secret_basic is the default when the provider doesn't list its methods
+	post := len(d.TokenAuthMethods) > 0 && !slices.Contains(d.TokenAuthMethods, "client_secret_basic")
+
+	tok, err := p.redeemCode(ctx, d.TokenEndpoint, post, redirectURI, code, codeVerifier)
+	if err != nil {
+		return nil, err
+	}
+
+	if tok.IDToken == "" {
+		return nil, errors.New("provider did not return an id_token")
+	}
+
+	return p.verifyIDToken(ctx, d, tok.IDToken, nonce)
+}
+
+func (p *Provider) redeemCode(ctx context.Context, tokenURL string, post bool, redirectURI, code, codeVerifier string) (*tokenResponse, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {codeVerifier},
+	}
+	if post {
+		form.Set("client_id", p.config.ClientID)
+		form.Set("client_secret", p.clientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	// GitHub answers with a form encoded body unless JSON is asked for
+	req.Header.Set("Accept", "application/json")
+	if !post {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.clientSecret))
+	}
+
+	var tok tokenResponse
+	if err := p.doJSON(req, &tok); err != nil && tok.Error == "" {
+		return nil, fmt.Errorf("error redeeming code: %w", err)
+	}
+
+	// Some providers report errors with a 200 status
+	if tok.Error != "" {
+		return nil, fmt.Errorf("error redeeming code: %s", strings.TrimSpace(tok.Error+" "+tok.ErrorDescription))
+	}
+
+	if tok.AccessToken == "" {
+		return nil, errors.New("provider did not return an access token")
+	}
+
+	return &tok, nil
+}
+
+func (p *Provider) userInfo(ctx context.Context, accessToken string) (*Identity, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.config.UserInfoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+
+	var info map[string]any
+	if err := p.doJSON(req, &info); err != nil {
+		return nil, fmt.Errorf("error getting user info: %w", err)
+	}
+
+	i := &Identity{
+		Subject:  stringField(info, p.config.SubjectField),
+		Username: stringField(info, p.config.UsernameField),
+		Name:     stringField(info, p.config.NameField),
+		Email:    stringField(info, p.config.EmailField),
+	}
+	if i.Subject == "" {
+		return nil, fmt.Errorf("user info has no %q field", p.config.SubjectField)
+	}
+
+	return i, nil
+}
+
+// discover fetches and caches the provider's OpenID configuration
+func (p *Provider) discover(ctx context.Context) (*discoveryDocument, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.config.Issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var d discoveryDocument
+	if err := p.doJSON(req, &d); err != nil {
+		return nil, fmt.Errorf("error discovering provider %s: %w", p.Name, err)
+	}
+
+	if strings.TrimSuffix(d.Issuer, "/") != p.config.Issuer {
+		return nil, fmt.Errorf("provider %s: discovered issuer %q does not match", p.Name, d.Issuer)
+	}
+
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("provider %s: discovery document is incomplete", p.Name)
+	}
+
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// doJSON decodes the response body into v, even for an error status,
+// so OAuth error responses can be reported
+func (p *Provider) doJSON(req *http.Request, v any) error {
+	res, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	decodeErr := decoder.Decode(v)
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+
+	return decodeErr
+}
+
+func stringField(m map[string]any, field string) string {
+	switch v := m[field].(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	default:
+		return ""
+	}
+}
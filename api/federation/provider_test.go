@@ -0,0 +1,293 @@
+package federation
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testClientID     = "jwt-auth"
+	testClientSecret = "secret"
+	testCode         = "code-1"
+	testVerifier     = "verifier-1"
+	testRedirectURI  = "https://auth.example.com/auth/external/idp/callback"
+)
+
+// fakeIdP is an upstream provider serving discovery, token, JWKS and userinfo
+type fakeIdP struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	// Claims of the ID token the token endpoint returns, signed with signer
+	claims idTokenClaims
+	signer *rsa.PrivateKey
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &fakeIdP{t: t, key: key, signer: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("POST /token", idp.token)
+	mux.HandleFunc("GET /jwks", idp.jwks)
+	mux.HandleFunc("GET /userinfo", idp.userInfo)
+
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+
+	idp.claims = idTokenClaims{
+		Nonce:             "nonce-1",
+		PreferredUsername: "jdoe",
+		Name:              "Jane Doe",
+		Email:             "jdoe@example.com",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    idp.server.URL,
+			Subject:   "subject-1",
+			Audience:  jwt.ClaimStrings{testClientID},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+
+	return idp
+}
+
+func (idp *fakeIdP) writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		idp.t.Error(err)
+	}
+}
+
+func (idp *fakeIdP) discovery(w http.ResponseWriter, r *http.Request) {
+	idp.writeJSON(w, discoveryDocument{
+		Issuer:                idp.server.URL,
+		AuthorizationEndpoint: idp.server.URL + "/authorize",
+		TokenEndpoint:         idp.server.URL + "/token",
+		JWKSURI:               idp.server.URL + "/jwks",
+	})
+}
+
+func (idp *fakeIdP) token(w http.ResponseWriter, r *http.Request) {
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	if clientID != testClientID || secret != testClientSecret {
+		w.WriteHeader(http.StatusUnauthorized)
+		idp.writeJSON(w, tokenResponse{Error: "invalid_client"})
+		return
+	}
+
+	if r.PostFormValue("code") != testCode || r.PostFormValue("code_verifier") != testVerifier || r.PostFormValue("redirect_uri") != testRedirectURI {
+		w.WriteHeader(http.StatusBadRequest)
+		idp.writeJSON(w, tokenResponse{Error: "invalid_grant"})
+		return
+	}
+
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, idp.claims)
+	tok.Header["kid"] = "key-1"
+
+	idToken, err := tok.SignedString(idp.signer)
+	if err != nil {
+		idp.t.Error(err)
+		return
+	}
+
+	idp.writeJSON(w, tokenResponse{AccessToken: "access-1", IDToken: idToken})
+}
+
+func (idp *fakeIdP) jwks(w http.ResponseWriter, r *http.Request) {
+	idp.writeJSON(w, map[string]any{
+		"keys": []jsonWebKey{{
+			Kty: "RSA",
+			Kid: "key-1",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (idp *fakeIdP) userInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer access-1" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	// GitHub style, with a numeric id
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"id": 4242, "login": "octocat", "name": "The Octocat", "email": "octocat@example.com"}`))
+}
+
+func (idp *fakeIdP) oidcProvider(t *testing.T) *Provider {
+	t.Helper()
+
+	p, err := NewProvider("idp", Config{
+		Type:     TypeOIDC,
+		Issuer:   idp.server.URL + "/",
+		ClientID: testClientID,
+	}, testClientSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func TestExchangeOIDC(t *testing.T) {
+	idp := newFakeIdP(t)
+	p := idp.oidcProvider(t)
+
+	authURL, err := p.AuthCodeURL(context.Background(), testRedirectURI, "state-1", "nonce-1", "challenge-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(authURL, idp.server.URL+"/authorize?") || !strings.Contains(authURL, "nonce=nonce-1") {
+		t.Errorf("unexpected authorization URL %s", authURL)
+	}
+
+	identity, err := p.Exchange(context.Background(), testRedirectURI, testCode, testVerifier, "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Identity{Subject: "subject-1", Username: "jdoe", Name: "Jane Doe", Email: "jdoe@example.com"}
+	if *identity != want {
+		t.Errorf("got identity %+v, want %+v", *identity, want)
+	}
+}
+
+func TestExchangeOIDCRejectsIDToken(t *testing.T) {
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(idp *fakeIdP)
+		nonce  string
+	}{
+		{
+			name:   "nonce does not match",
+			modify: func(idp *fakeIdP) { idp.claims.Nonce = "nonce-2" },
+			nonce:  "nonce-1",
+		},
+		{
+			name:   "nonce missing",
+			modify: func(idp *fakeIdP) { idp.claims.Nonce = "" },
+			nonce:  "nonce-1",
+		},
+		{
+			name:   "signed with another key",
+			modify: func(idp *fakeIdP) { idp.signer = otherKey },
+			nonce:  "nonce-1",
+		},
+		{
+			name:   "other audience",
+			modify: func(idp *fakeIdP) { idp.claims.Audience = jwt.ClaimStrings{"someone-else"} },
+			nonce:  "nonce-1",
+		},
+		{
+			name:   "other issuer",
+			modify: func(idp *fakeIdP) { idp.claims.Issuer = "https://evil.example.com" },
+			nonce:  "nonce-1",
+		},
+		{
+			name:   "expired",
+			modify: func(idp *fakeIdP) { idp.claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute)) },
+			nonce:  "nonce-1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := newFakeIdP(t)
+			tt.modify(idp)
+			p := idp.oidcProvider(t)
+
+			if _, err := p.Exchange(context.Background(), testRedirectURI, testCode, testVerifier, tt.nonce); err == nil {
+				t.Fatal("id_token was accepted")
+			}
+		})
+	}
+}
+
+func TestExchangeOIDCWrongCode(t *testing.T) {
+	idp := newFakeIdP(t)
+	p := idp.oidcProvider(t)
+
+	_, err := p.Exchange(context.Background(), testRedirectURI, "code-2", testVerifier, "nonce-1")
+	if err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Fatalf("got error %v, want invalid_grant", err)
+	}
+}
+
+func TestExchangeOAuth2(t *testing.T) {
+	idp := newFakeIdP(t)
+
+	p, err := NewProvider("github", Config{
+		Type:        TypeOAuth2,
+		AuthURL:     idp.server.URL + "/authorize",
+		TokenURL:    idp.server.URL + "/token",
+		UserInfoURL: idp.server.URL + "/userinfo",
+		ClientID:    testClientID,
+	}, testClientSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity, err := p.Exchange(context.Background(), testRedirectURI, testCode, testVerifier, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Identity{Subject: "4242", Username: "octocat", Name: "The Octocat", Email: "octocat@example.com"}
+	if *identity != want {
+		t.Errorf("got identity %+v, want %+v", *identity, want)
+	}
+}
+
+func TestVerifyState(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+		state    string
+		ok       bool
+	}{
+		{"matching", "state-1", "state-1", true},
+		{"different", "state-1", "state-2", false},
+		{"missing cookie", "", "state-1", false},
+		{"missing state", "state-1", "", false},
+		{"both missing", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyState(tt.expected, tt.state)
+			if (err == nil) != tt.ok {
+				t.Errorf("VerifyState(%q, %q) = %v", tt.expected, tt.state, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+package federation
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/crewjam/saml"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/spf13/viper"
+)
+
+// SAMLProviderName is the provider linked identities of the SAML IdP are stored under
+const SAMLProviderName = "saml"
+
+type (
+	SAMLConfig struct {
+		Enabled           bool           `mapstructure:"enabled"`
+		EntityID          string         `mapstructure:"entityID"`
+		KeyFile           string         `mapstructure:"keyFile"`
+		CertificateFile   string         `mapstructure:"certificateFile"`
+		IDPMetadataURL    string         `mapstructure:"idpMetadataURL"`
+		IDPMetadataFile   string         `mapstructure:"idpMetadataFile"`
+		NameIDFormat      string         `mapstructure:"nameIDFormat"`
+		SignRequests      bool           `mapstructure:"signRequests"`
+		AllowIDPInitiated bool           `mapstructure:"allowIDPInitiated"`
+		AutoProvision     bool           `mapstructure:"autoProvision"`
+		Attributes        SAMLAttributes `mapstructure:"attributes"`
+	}
+
+	// SAMLAttributes names the assertion attributes mapped to the user.
+	// The NameID is the subject unless Subject is set.
+	SAMLAttributes struct {
+		Subject  string `mapstructure:"subject"`
+		Username string `mapstructure:"username"`
+		Name     string `mapstructure:"name"`
+		Email    string `mapstructure:"email"`
+	}
+
+	// SAMLProvider is a SAML 2.0 service provider for a single identity provider
+	SAMLProvider struct {
+		config SAMLConfig
+		sp     saml.ServiceProvider
+
+		// Ephemeral is set when no key was configured and one was generated
+		Ephemeral bool
+
+		mu          sync.Mutex
+		idpMetadata *saml.EntityDescriptor
+	}
+)
+
+// LoadSAMLProvider reads the saml config section. It returns nil when SAML is disabled.
+// baseURL is the public URL the /saml endpoints are served under.
+func LoadSAMLProvider(baseURL string) (*SAMLProvider, error) {
+	var cfg SAMLConfig
+	if err := viper.UnmarshalKey("saml", &cfg); err != nil {
+		return nil, fmt.Errorf("error reading saml config: %w", err)
+	}
+
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	if cfg.IDPMetadataURL == "" && cfg.IDPMetadataFile == "" {
+		return nil, errors.New("saml: idpMetadataURL or idpMetadataFile is required")
+	}
+
+	metadataURL, err := url.Parse(baseURL + "/saml/metadata")
+	if err != nil {
+		return nil, err
+	}
+
+	acsURL, err := url.Parse(baseURL + "/saml/acs")
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.EntityID == "" {
+		cfg.EntityID = metadataURL.String()
+	}
+
+	// A transient NameID changes on every login and can't be linked to a user
+	if cfg.NameIDFormat == "" {
+		cfg.NameIDFormat = string(saml.PersistentNameIDFormat)
+	}
+
+	p := &SAMLProvider{config: cfg}
+
+	key, cert, err := loadSAMLKeyPair(cfg.KeyFile, cfg.CertificateFile, cfg.EntityID)
+	if err != nil {
+		return nil, err
+	}
+	p.Ephemeral = cfg.KeyFile == ""
+
+	p.sp = saml.ServiceProvider{
+		EntityID:          cfg.EntityID,
+		Key:               key,
+		Certificate:       cert,
+		HTTPClient:        &http.Client{Timeout: 10 * time.Second},
+		MetadataURL:       *metadataURL,
+		AcsURL:            *acsURL,
+		AuthnNameIDFormat: saml.NameIDFormat(cfg.NameIDFormat),
+		AllowIDPInitiated: cfg.AllowIDPInitiated,
+	}
+	if cfg.SignRequests {
+		p.sp.SignatureMethod = dsig.RSASHA256SignatureMethod
+	}
+
+	return p, nil
+}
+
+func (p *SAMLProvider) AutoProvision() bool {
+	return p.config.AutoProvision
+}
+
+// Metadata returns the service provider metadata document
+func (p *SAMLProvider) Metadata() ([]byte, error) {
+	return xml.MarshalIndent(p.sp.Metadata(), "", "  ")
+}
+
+// AuthnRequestURL returns the IdP URL for an AuthnRequest using the redirect
+// binding, and the request ID the response has to refer to
+func (p *SAMLProvider) AuthnRequestURL(ctx context.Context, relayState string) (string, string, error) {
+	sp, err := p.serviceProvider(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	idpURL := sp.GetSSOBindingLocation(saml.HTTPRedirectBinding)
+	if idpURL == "" {
+		return "", "", errors.New("identity provider has no redirect binding")
+	}
+
+	req, err := sp.MakeAuthenticationRequest(idpURL, saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		return "", "", err
+	}
+
+	u, err := req.Redirect(relayState, sp)
+	if err != nil {
+		return "", "", err
+	}
+
+	return u.String(), req.ID, nil
+}
+
+// ParseResponse validates the response posted to the ACS: signature, issuer,
+// audience, destination, validity window and, for SP-initiated logins, that it
+// answers one of requestIDs. It returns the identity the assertion describes.
+func (p *SAMLProvider) ParseResponse(ctx context.Context, r *http.Request, requestIDs []string) (*Identity, error) {
+	sp, err := p.serviceProvider(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+
+	assertion, err := sp.ParseResponse(r, requestIDs)
+	if err != nil {
+		var invalid *saml.InvalidResponseError
+		if errors.As(err, &invalid) && invalid.PrivateErr != nil {
+			err = invalid.PrivateErr
+		}
+		return nil, err
+	}
+
+	i := &Identity{
+		Username: p.attribute(assertion, p.config.Attributes.Username),
+		Name:     p.attribute(assertion, p.config.Attributes.Name),
+		Email:    p.attribute(assertion, p.config.Attributes.Email),
+	}
+
+	if p.config.Attributes.Subject != "" {
+		i.Subject = p.attribute(assertion, p.config.Attributes.Subject)
+	} else if assertion.Subject != nil && assertion.Subject.NameID != nil {
+		i.Subject = assertion.Subject.NameID.Value
+	}
+
+	if i.Subject == "" {
+		return nil, errors.New("assertion has no subject")
+	}
+
+	return i, nil
+}
+
+// attribute returns the first value of the attribute with the given name or friendly name
+func (p *SAMLProvider) attribute(assertion *saml.Assertion, name string) string {
+	if name == "" {
+		return ""
+	}
+
+	for _, statement := range assertion.AttributeStatements {
+		for _, a := range statement.Attributes {
+			if (a.Name == name || a.FriendlyName == name) && len(a.Values) > 0 {
+				return a.Values[0].Value
+			}
+		}
+	}
+
+	return ""
+}
+
+// serviceProvider returns the service provider once the IdP metadata is loaded.
+// Metadata is loaded on first use so an unreachable IdP doesn't stop startup.
+func (p *SAMLProvider) serviceProvider(ctx context.Context) (*saml.ServiceProvider, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.idpMetadata == nil {
+		m, err := p.loadIDPMetadata(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error loading idp metadata: %w", err)
+		}
+		p.idpMetadata = m
+	}
+
+	sp := p.sp
+	sp.IDPMetadata = p.idpMetadata
+
+	return &sp, nil
+}
+
+func (p *SAMLProvider) loadIDPMetadata(ctx context.Context) (*saml.EntityDescriptor, error) {
+	var data []byte
+
+	if p.config.IDPMetadataFile != "" {
+		b, err := os.ReadFile(p.config.IDPMetadataFile)
+		if err != nil {
+			return nil, err
+		}
+		data = b
+	} else {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.config.IDPMetadataURL, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := p.sp.HTTPClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status %d", res.StatusCode)
+		}
+
+		if data, err = io.ReadAll(io.LimitReader(res.Body, 1<<20)); err != nil {
+			return nil, err
+		}
+	}
+
+	var m saml.EntityDescriptor
+	if err := xml.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+
+	if len(m.IDPSSODescriptors) == 0 {
+		return nil, errors.New("metadata has no IDPSSODescriptor")
+	}
+
+	return &m, nil
+}
+
+// loadSAMLKeyPair loads the SP key and certificate, or generates a self-signed
+// pair that only lives as long as the process
+func loadSAMLKeyPair(keyFile, certFile, entityID string) (*rsa.PrivateKey, *x509.Certificate, error) {
+	if keyFile != "" {
+		pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error loading saml key pair: %w", err)
+		}
+
+		key, ok := pair.PrivateKey.(*rsa.PrivateKey)
+		if !ok {
+			return nil, nil, errors.New("saml key is not an RSA key")
+		}
+
+		cert, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return key, cert, nil
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: entityID},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key, cert, nil
+}
@@ -0,0 +1,109 @@
+package federation
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/arrogantworm/jwt_auth/db"
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	ErrIdentityNotLinked = errors.New("no account is linked to this identity")
+	ErrInvalidState      = errors.New("invalid state")
+)
+
+// UserStore is the part of the database upstream identities are resolved against
+type UserStore interface {
+	GetLinkedIdentity(ctx context.Context, provider, subject string) (*db.LinkedIdentity, error)
+	TouchLinkedIdentity(ctx context.Context, i *db.LinkedIdentity) error
+	GetUserById(ctx context.Context, userID int) (*db.User, error)
+	CheckUsername(ctx context.Context, username string) (bool, error)
+	CreateUserWithIdentity(ctx context.Context, u *db.User, i *db.LinkedIdentity) (*db.User, error)
+}
+
+// VerifyState checks the state returned to the callback against the one kept
+// in the browser that started the login
+func VerifyState(expected, state string) error {
+	if expected == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(state)) != 1 {
+		return ErrInvalidState
+	}
+
+	return nil
+}
+
+// ResolveUser returns the user linked to identity, provisioning one when the
+// provider allows it. Existing local accounts are never matched by username or
+// email, they have to link the identity themselves.
+func ResolveUser(ctx context.Context, store UserStore, provider string, autoProvision bool, identity *Identity) (*db.User, error) {
+	linked, err := store.GetLinkedIdentity(ctx, provider, identity.Subject)
+	if err == nil {
+		linked.Username = identity.Username
+		linked.Email = identity.Email
+		if err := store.TouchLinkedIdentity(ctx, linked); err != nil {
+			return nil, err
+		}
+
+		return store.GetUserById(ctx, linked.UserID)
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+
+	if !autoProvision {
+		return nil, ErrIdentityNotLinked
+	}
+
+	username, err := availableUsername(ctx, store, provider, identity)
+	if err != nil {
+		return nil, err
+	}
+
+	name := identity.Name
+	if name == "" {
+		name = username
+	}
+
+	// Provisioned users have no password, they sign in through the provider only
+	return store.CreateUserWithIdentity(ctx, &db.User{
+		Name:     name,
+		Username: username,
+	}, &db.LinkedIdentity{
+		Provider: provider,
+		Subject:  identity.Subject,
+		Username: identity.Username,
+		Email:    identity.Email,
+	})
+}
+
+// availableUsername picks a free local username based on the upstream profile
+func availableUsername(ctx context.Context, store UserStore, provider string, identity *Identity) (string, error) {
+	base := identity.Username
+	if base == "" {
+		base, _, _ = strings.Cut(identity.Email, "@")
+	}
+	if base == "" {
+		base = provider + "-" + identity.Subject
+	}
+
+	for i := 1; i <= 20; i++ {
+		candidate := base
+		if i > 1 {
+			candidate = fmt.Sprintf("%s-%d", base, i)
+		}
+
+		taken, err := store.CheckUsername(ctx, candidate)
+		if err != nil {
+			return "", err
+		}
+
+		if !taken {
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf("no free username for %s", base)
+}
@@ -0,0 +1,147 @@
+package federation
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/arrogantworm/jwt_auth/db"
+	"github.com/jackc/pgx/v5"
+)
+
+// memoryStore keeps users and linked identities in memory
+type memoryStore struct {
+	users      map[int]*db.User
+	identities []*db.LinkedIdentity
+	touched    int
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{users: map[int]*db.User{}}
+}
+
+func (s *memoryStore) GetLinkedIdentity(ctx context.Context, provider, subject string) (*db.LinkedIdentity, error) {
+	for _, i := range s.identities {
+		if i.Provider == provider && i.Subject == subject {
+			linked := *i
+			return &linked, nil
+		}
+	}
+
+	return nil, pgx.ErrNoRows
+}
+
+func (s *memoryStore) TouchLinkedIdentity(ctx context.Context, i *db.LinkedIdentity) error {
+	for _, stored := range s.identities {
+		if stored.ID == i.ID {
+			stored.Username = i.Username
+			stored.Email = i.Email
+			s.touched++
+			return nil
+		}
+	}
+
+	return pgx.ErrNoRows
+}
+
+func (s *memoryStore) GetUserById(ctx context.Context, userID int) (*db.User, error) {
+	u, ok := s.users[userID]
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+
+	return u, nil
+}
+
+func (s *memoryStore) CheckUsername(ctx context.Context, username string) (bool, error) {
+	for _, u := range s.users {
+		if u.Username == username {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (s *memoryStore) CreateUserWithIdentity(ctx context.Context, u *db.User, i *db.LinkedIdentity) (*db.User, error) {
+	u.ID = len(s.users) + 1
+	s.users[u.ID] = u
+
+	i.ID = len(s.identities) + 1
+	i.UserID = u.ID
+	s.identities = append(s.identities, i)
+
+	return u, nil
+}
+
+func TestResolveUserReturningIdentity(t *testing.T) {
+	store := newMemoryStore()
+	store.users[7] = &db.User{ID: 7, Username: "jane"}
+	store.identities = append(store.identities, &db.LinkedIdentity{ID: 1, UserID: 7, Provider: "idp", Subject: "subject-1", Username: "jdoe"})
+
+	identity := &Identity{Subject: "subject-1", Username: "jane.doe", Email: "jane@example.com"}
+
+	for _, autoProvision := range []bool{false, true} {
+		u, err := ResolveUser(context.Background(), store, "idp", autoProvision, identity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.ID != 7 {
+			t.Errorf("autoProvision %v: got user %d, want the linked user 7", autoProvision, u.ID)
+		}
+	}
+
+	if len(store.users) != 1 || len(store.identities) != 1 {
+		t.Errorf("a returning identity created %d users and %d identities", len(store.users)-1, len(store.identities)-1)
+	}
+
+	// The upstream profile is refreshed on every login
+	if store.touched != 2 || store.identities[0].Username != "jane.doe" || store.identities[0].Email != "jane@example.com" {
+		t.Errorf("linked identity was not updated: %+v", *store.identities[0])
+	}
+}
+
+func TestResolveUserSubjectIsPerProvider(t *testing.T) {
+	store := newMemoryStore()
+	store.users[7] = &db.User{ID: 7, Username: "jane"}
+	store.identities = append(store.identities, &db.LinkedIdentity{ID: 1, UserID: 7, Provider: "idp", Subject: "subject-1"})
+
+	_, err := ResolveUser(context.Background(), store, "other", false, &Identity{Subject: "subject-1", Username: "jane"})
+	if !errors.Is(err, ErrIdentityNotLinked) {
+		t.Fatalf("got error %v, want ErrIdentityNotLinked", err)
+	}
+}
+
+func TestResolveUserNotLinked(t *testing.T) {
+	store := newMemoryStore()
+	// A local account with the same username is not matched
+	store.users[7] = &db.User{ID: 7, Username: "jdoe"}
+
+	_, err := ResolveUser(context.Background(), store, "idp", false, &Identity{Subject: "subject-1", Username: "jdoe"})
+	if !errors.Is(err, ErrIdentityNotLinked) {
+		t.Fatalf("got error %v, want ErrIdentityNotLinked", err)
+	}
+}
+
+func TestResolveUserAutoProvision(t *testing.T) {
+	store := newMemoryStore()
+	store.users[1] = &db.User{ID: 1, Username: "jdoe"}
+
+	u, err := ResolveUser(context.Background(), store, "idp", true, &Identity{Subject: "subject-1", Username: "jdoe", Email: "jdoe@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Username != "jdoe-2" || u.Name != "jdoe-2" {
+		t.Errorf("got username %q and name %q, want jdoe-2", u.Username, u.Name)
+	}
+
+	// Signing in again finds the provisioned user instead of creating another
+	again, err := ResolveUser(context.Background(), store, "idp", true, &Identity{Subject: "subject-1", Username: "jdoe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != u.ID || len(store.users) != 2 {
+		t.Errorf("got user %d and %d users, want user %d and 2 users", again.ID, len(store.users), u.ID)
+	}
+}
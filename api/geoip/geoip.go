@@ -0,0 +1,202 @@
+// Package geoip looks up where IP addresses are from in local MaxMind-format
+// databases, such as GeoLite2 City and ASN, and tells when a user would have
+// had to travel impossibly fast between two requests.
+package geoip
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/spf13/viper"
+)
+
+// Actions taken on impossible travel
+const (
+	ActionNotify = "notify"
+	ActionReauth = "reauth"
+	ActionRevoke = "revoke"
+)
+
+const earthRadiusKm = 6371
+
+type Config struct {
+	// Looked up in order, later databases fill in what earlier ones lack
+	Databases        []string     `mapstructure:"databases"`
+	ImpossibleTravel TravelConfig `mapstructure:"impossibleTravel"`
+}
+
+type TravelConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// km/h
+	MaxSpeed float64 `mapstructure:"maxSpeed"`
+	Action   string  `mapstructure:"action"`
+}
+
+// Location is what the databases know about an address. Coordinates are only
+// kept for travel checks and left out of events.
+type Location struct {
+	Country        string   `json:"country,omitempty"`
+	City           string   `json:"city,omitempty"`
+	ASN            int      `json:"asn,omitempty"`
+	ASOrg          string   `json:"asOrg,omitempty"`
+	Latitude       *float64 `json:"-"`
+	Longitude      *float64 `json:"-"`
+	AccuracyRadius int      `json:"-"`
+}
+
+// record holds the fields of the City, Country and ASN databases. A database
+// of one kind leaves the fields of the others empty.
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Location struct {
+		Latitude       *float64 `maxminddb:"latitude"`
+		Longitude      *float64 `maxminddb:"longitude"`
+		AccuracyRadius int      `maxminddb:"accuracy_radius"`
+	} `maxminddb:"location"`
+	ASN   int    `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+// Resolver looks addresses up in the configured databases. Without any, every
+// lookup comes back empty.
+type Resolver struct {
+	readers []*maxminddb.Reader
+	config  Config
+}
+
+// New opens the databases listed in geoip.databases
+func New() (*Resolver, error) {
+	var cfg Config
+	if err := viper.UnmarshalKey("geoip", &cfg); err != nil {
+		return nil, fmt.Errorf("error reading geoip config: %w", err)
+	}
+
+	if cfg.ImpossibleTravel.MaxSpeed == 0 {
+		cfg.ImpossibleTravel.MaxSpeed = 1000
+	}
+
+	switch cfg.ImpossibleTravel.Action {
+	case "":
+		cfg.ImpossibleTravel.Action = ActionNotify
+	case ActionNotify, ActionReauth, ActionRevoke:
+	default:
+		return nil, fmt.Errorf("unknown geoip.impossibleTravel.action %q", cfg.ImpossibleTravel.Action)
+	}
+
+	if cfg.ImpossibleTravel.Enabled && len(cfg.Databases) == 0 {
+		return nil, errors.New("geoip.impossibleTravel needs a city database in geoip.databases")
+	}
+
+	r := &Resolver{config: cfg}
+	for _, path := range cfg.Databases {
+		reader, err := maxminddb.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("error opening geoip database %s: %w", path, err)
+		}
+		r.readers = append(r.readers, reader)
+	}
+
+	return r, nil
+}
+
+// Lookup returns what is known about ip, or nil when nothing is
+func (r *Resolver) Lookup(ip string) *Location {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || len(r.readers) == 0 {
+		return nil
+	}
+
+	var loc Location
+	for _, reader := range r.readers {
+		var rec record
+		// Addresses missing from a database leave rec empty, errors mean a
+		// corrupt file, which is as good as no answer
+		if err := reader.Lookup(parsed, &rec); err != nil {
+			continue
+		}
+
+		if loc.Country == "" {
+			loc.Country = rec.Country.ISOCode
+		}
+		if loc.City == "" {
+			loc.City = rec.City.Names["en"]
+		}
+		if loc.Latitude == nil && rec.Location.Latitude != nil && rec.Location.Longitude != nil {
+			loc.Latitude = rec.Location.Latitude
+			loc.Longitude = rec.Location.Longitude
+			loc.AccuracyRadius = rec.Location.AccuracyRadius
+		}
+		if loc.ASN == 0 {
+			loc.ASN = rec.ASN
+			loc.ASOrg = rec.ASOrg
+		}
+	}
+
+	if loc == (Location{}) {
+		return nil
+	}
+
+	return &loc
+}
+
+// Travel is a move between the locations of two requests
+type Travel struct {
+	// Beyond the accuracy radius of both locations
+	DistanceKm float64
+	Elapsed    time.Duration
+	SpeedKmh   float64
+}
+
+// ImpossibleTravel tells whether getting from `from` at since to `to` at now
+// is faster than geoip.impossibleTravel.maxSpeed. It is always false while the
+// check is disabled or either location has no coordinates.
+func (r *Resolver) ImpossibleTravel(from *Location, since time.Time, to *Location, now time.Time) (Travel, bool) {
+	if !r.config.ImpossibleTravel.Enabled || !from.hasCoordinates() || !to.hasCoordinates() {
+		return Travel{}, false
+	}
+
+	t := Travel{
+		DistanceKm: distanceKm(from, to) - float64(from.AccuracyRadius+to.AccuracyRadius),
+		Elapsed:    now.Sub(since),
+	}
+	if t.DistanceKm <= 0 {
+		return Travel{}, false
+	}
+
+	// Requests at the same moment, or out of order because of clock skew
+	// between replicas, would need infinite speed
+	hours := math.Max(t.Elapsed.Hours(), time.Second.Hours())
+	t.SpeedKmh = t.DistanceKm / hours
+
+	return t, t.SpeedKmh > r.config.ImpossibleTravel.MaxSpeed
+}
+
+// TravelAction is what to do about impossible travel
+func (r *Resolver) TravelAction() string {
+	return r.config.ImpossibleTravel.Action
+}
+
+func (l *Location) hasCoordinates() bool {
+	return l != nil && l.Latitude != nil && l.Longitude != nil
+}
+
+// distanceKm is the great-circle distance between a and b
+func distanceKm(a, b *Location) float64 {
+	lat1 := *a.Latitude * math.Pi / 180
+	lat2 := *b.Latitude * math.Pi / 180
+	dLat := lat2 - lat1
+	dLon := (*b.Longitude - *a.Longitude) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(h)))
+}
@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/arrogantworm/jwt_auth/api/events"
+	"github.com/arrogantworm/jwt_auth/api/geoip"
+	"github.com/arrogantworm/jwt_auth/api/token"
+	"github.com/arrogantworm/jwt_auth/api/utils"
+	"github.com/arrogantworm/jwt_auth/db"
+	"github.com/spf13/viper"
+)
+
+const activityDefaultLimit = 50
+
+// Activity results
+const (
+	activitySucceeded = "succeeded"
+	activityFailed    = "failed"
+)
+
+// activityEventTypes are the audit log events shown to users about themselves
+var activityEventTypes = []string{
+	events.TypeLoginSucceeded,
+	events.TypeLoginFailed,
+	events.TypeSessionIPChanged,
+}
+
+func toActivityRes(e *db.AuditLogEntry) ActivityRes {
+	ua := utils.ParseUserAgent(e.UserAgent)
+
+	res := ActivityRes{
+		Id:        e.ID,
+		Type:      e.EventType,
+		Result:    activitySucceeded,
+		SessionID: e.SessionID,
+		IP:        e.IPAddress,
+		UserAgent: e.UserAgent,
+		Browser:   ua.Family(),
+		OS:        ua.OS,
+		Device:    ua.Device,
+		Time:      e.OccurredAt,
+	}
+
+	// Older entries may lack fields, they are shown with what there is
+	switch e.EventType {
+	case events.TypeLoginSucceeded:
+		var data events.LoginSucceeded
+		if json.Unmarshal(e.Data, &data) == nil {
+			res.Method = data.Method
+			setActivityLocation(&res, data.Location)
+		}
+	case events.TypeLoginFailed:
+		res.Result = activityFailed
+		var data events.LoginFailed
+		if json.Unmarshal(e.Data, &data) == nil {
+			res.Method = data.Method
+			res.Reason = data.Reason
+			setActivityLocation(&res, data.Location)
+		}
+	case events.TypeSessionIPChanged:
+		var data events.SessionIPChanged
+		if json.Unmarshal(e.Data, &data) == nil {
+			res.PreviousIP = data.PreviousIP
+			setActivityLocation(&res, data.Location)
+		}
+	}
+
+	return res
+}
+
+func setActivityLocation(res *ActivityRes, loc *geoip.Location) {
+	if loc != nil {
+		res.Country = loc.Country
+		res.City = loc.City
+	}
+}
+
+// api/user/activity
+// @Summary Account activity
+// @Tags user
+// @Description Recent sign-ins, failed sign-in attempts and sessions renewed from a new IP address, newest first. Country and city are set when GeoIP was enabled at the time. Entries older than activity.retention are left out.
+// @ID user-activity
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {array} ActivityRes
+// @Failure 401,403,500 {object} ErrorRes
+// @Router /api/user/activity [get]
+func (h *Handler) getUserActivity(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
+
+	var since time.Time
+	if retention := viper.GetDuration("activity.retention"); retention > 0 {
+		since = time.Now().Add(-retention)
+	}
+
+	limit := viper.GetInt("activity.limit")
+	if limit < 1 {
+		limit = activityDefaultLimit
+	}
+
+	entries, err := h.db.ListUserAuditLog(h.ctx, claims.ID, activityEventTypes, since, limit)
+	if err != nil {
+		h.sendError(w, "error getting activity", http.StatusInternalServerError)
+		return
+	}
+
+	res := make([]ActivityRes, 0, len(entries))
+	for _, e := range entries {
+		res = append(res, toActivityRes(e))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,420 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+
+	"github.com/arrogantworm/jwt_auth/api/token"
+	"github.com/arrogantworm/jwt_auth/api/utils"
+	"github.com/arrogantworm/jwt_auth/db"
+	"github.com/go-chi/chi/v5"
+)
+
+const roleAdmin = "admin"
+
+// requireRole must run after the auth middleware. Roles are read from the
+// database so that a role change applies without waiting for token expiry.
+func (h *Handler) requireRole(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			claims := r.Context().Value(authKey{}).(*token.UserClaims)
+
+			u, err := h.db.GetUserById(h.ctx, claims.ID)
+			if err != nil {
+				h.sendError(w, "error getting user", http.StatusInternalServerError)
+				return
+			}
+
+			if !slices.Contains(u.Roles, role) {
+				h.sendError(w, "forbidden", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// admin/clients
+// @Summary Create client
+// @Tags admin, clients
+// @Description Register a service account client. A generated secret is only shown once.
+// @ID admin-clients-create
+// @Security BearerAuth
+// @Accept json
+// @Param input body CreateClientReq true "Client info"
+// @Produce json
+// @Success 201 {object} CreateClientRes
+// @Failure 400,401,403,500 {object} ErrorRes
+// @Router /admin/clients [post]
+func (h *Handler) createClient(w http.ResponseWriter, r *http.Request) {
+	var req CreateClientReq
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendError(w, "", http.StatusBadRequest)
+		return
+	}
+
+	if req.Name == "" {
+		h.sendError(w, "name is required", http.StatusBadRequest)
+		return
+	}
+
+	if req.Scopes == nil {
+		req.Scopes = []string{}
+	}
+
+	if !validScopes(req.Scopes) {
+		h.sendError(w, "invalid scope", http.StatusBadRequest)
+		return
+	}
+
+	if req.GrantTypes == nil {
+		req.GrantTypes = []string{grantTypeClientCredentials}
+	}
+
+	if msg := validateGrantTypes(req.GrantTypes); msg != "" {
+		h.sendError(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	clientID, err := utils.RandomHex(16)
+	if err != nil {
+		h.sendError(w, "error creating client", http.StatusInternalServerError)
+		return
+	}
+
+	if req.RedirectURIs == nil {
+		req.RedirectURIs = []string{}
+	}
+
+	c := &db.OAuthClient{
+		ClientID:     clientID,
+		Name:         req.Name,
+		AuthMethod:   req.AuthMethod,
+		Scopes:       req.Scopes,
+		GrantTypes:   req.GrantTypes,
+		RedirectURIs: req.RedirectURIs,
+	}
+
+	if msg := validateClient(c); msg != "" {
+		h.sendError(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	var secret string
+
+	switch req.AuthMethod {
+	case db.ClientAuthSecretBasic, db.ClientAuthSecretPost:
+		secret, err = utils.RandomHex(32)
+		if err != nil {
+			h.sendError(w, "error creating client", http.StatusInternalServerError)
+			return
+		}
+
+		hashed, err := utils.HashClientSecret(secret)
+		if err != nil {
+			h.sendError(w, "error creating client", http.StatusInternalServerError)
+			return
+		}
+		c.SecretHash = &hashed
+	case db.ClientAuthPrivateKeyJWT:
+		if _, err := token.ParsePublicKey(req.PublicKey); err != nil {
+			h.sendError(w, "invalid public key", http.StatusBadRequest)
+			return
+		}
+		c.PublicKey = &req.PublicKey
+	case db.ClientAuthNone:
+	default:
+		h.sendError(w, "unsupported auth method", http.StatusBadRequest)
+		return
+	}
+
+	c, err = h.db.CreateClient(h.ctx, c)
+	if err != nil {
+		h.sendError(w, "error saving client", http.StatusInternalServerError)
+		return
+	}
+
+	res := CreateClientRes{
+		ClientRes:    toClientRes(c),
+		ClientSecret: secret,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(res)
+}
+
+// admin/clients
+// @Summary List clients
+// @Tags admin, clients
+// @Description List registered clients
+// @ID admin-clients-list
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {array} ClientRes
+// @Failure 401,403,500 {object} ErrorRes
+// @Router /admin/clients [get]
+func (h *Handler) listClients(w http.ResponseWriter, r *http.Request) {
+	clients, err := h.db.ListClients(h.ctx)
+	if err != nil {
+		h.sendError(w, "error getting clients", http.StatusInternalServerError)
+		return
+	}
+
+	res := make([]ClientRes, 0, len(clients))
+	for _, c := range clients {
+		res = append(res, toClientRes(c))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// admin/clients/{clientID}
+// @Summary Get client
+// @Tags admin, clients
+// @Description Get a registered client
+// @ID admin-clients-get
+// @Security BearerAuth
+// @Param clientID path string true "Client ID"
+// @Produce json
+// @Success 200 {object} ClientRes
+// @Failure 401,403,404 {object} ErrorRes
+// @Router /admin/clients/{clientID} [get]
+func (h *Handler) getClient(w http.ResponseWriter, r *http.Request) {
+	c, err := h.db.GetClient(h.ctx, chi.URLParam(r, "clientID"))
+	if err != nil {
+		h.sendError(w, "client not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(toClientRes(c))
+}
+
+// admin/clients/{clientID}
+// @Summary Update client
+// @Tags admin, clients
+// @Description Update a client's name, allowed scopes, grant types, redirect URIs, public key or disabled flag
+// @ID admin-clients-update
+// @Security BearerAuth
+// @Param clientID path string true "Client ID"
+// @Accept json
+// @Param input body UpdateClientReq true "Fields to update"
+// @Produce json
+// @Success 200 {object} ClientRes
+// @Failure 400,401,403,404,500 {object} ErrorRes
+// @Router /admin/clients/{clientID} [put]
+func (h *Handler) updateClient(w http.ResponseWriter, r *http.Request) {
+	var req UpdateClientReq
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendError(w, "", http.StatusBadRequest)
+		return
+	}
+
+	c, err := h.db.GetClient(h.ctx, chi.URLParam(r, "clientID"))
+	if err != nil {
+		h.sendError(w, "client not found", http.StatusNotFound)
+		return
+	}
+
+	if req.Name != nil {
+		if *req.Name == "" {
+			h.sendError(w, "name can't be empty", http.StatusBadRequest)
+			return
+		}
+		c.Name = *req.Name
+	}
+
+	if req.Scopes != nil {
+		if !validScopes(req.Scopes) {
+			h.sendError(w, "invalid scope", http.StatusBadRequest)
+			return
+		}
+		c.Scopes = req.Scopes
+	}
+
+	if req.GrantTypes != nil {
+		if msg := validateGrantTypes(req.GrantTypes); msg != "" {
+			h.sendError(w, msg, http.StatusBadRequest)
+			return
+		}
+		c.GrantTypes = req.GrantTypes
+	}
+
+	if req.PublicKey != nil {
+		if c.AuthMethod != db.ClientAuthPrivateKeyJWT {
+			h.sendError(w, "client does not use private_key_jwt", http.StatusBadRequest)
+			return
+		}
+		if _, err := token.ParsePublicKey(*req.PublicKey); err != nil {
+			h.sendError(w, "invalid public key", http.StatusBadRequest)
+			return
+		}
+		c.PublicKey = req.PublicKey
+	}
+
+	if req.RedirectURIs != nil {
+		c.RedirectURIs = req.RedirectURIs
+	}
+
+	if req.IsDisabled != nil {
+		c.IsDisabled = *req.IsDisabled
+	}
+
+	if msg := validateClient(c); msg != "" {
+		h.sendError(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	if err := h.db.UpdateClient(h.ctx, c); err != nil {
+		h.sendError(w, "error updating client", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(toClientRes(c))
+}
+
+// admin/clients/{clientID}/secret
+// @Summary Rotate client secret
+// @Tags admin, clients
+// @Description Generate a new client secret. The old secret stops working immediately.
+// @ID admin-clients-secret
+// @Security BearerAuth
+// @Param clientID path string true "Client ID"
+// @Produce json
+// @Success 200 {object} CreateClientRes
+// @Failure 400,401,403,404,500 {object} ErrorRes
+// @Router /admin/clients/{clientID}/secret [post]
+func (h *Handler) rotateClientSecret(w http.ResponseWriter, r *http.Request) {
+	c, err := h.db.GetClient(h.ctx, chi.URLParam(r, "clientID"))
+	if err != nil {
+		h.sendError(w, "client not found", http.StatusNotFound)
+		return
+	}
+
+	if c.AuthMethod != db.ClientAuthSecretBasic && c.AuthMethod != db.ClientAuthSecretPost {
+		h.sendError(w, "client does not use a secret", http.StatusBadRequest)
+		return
+	}
+
+	secret, err := utils.RandomHex(32)
+	if err != nil {
+		h.sendError(w, "error creating secret", http.StatusInternalServerError)
+		return
+	}
+
+	hashed, err := utils.HashClientSecret(secret)
+	if err != nil {
+		h.sendError(w, "error creating secret", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.db.UpdateClientSecret(h.ctx, c.ClientID, hashed); err != nil {
+		h.sendError(w, "error updating client", http.StatusInternalServerError)
+		return
+	}
+
+	res := CreateClientRes{
+		ClientRes:    toClientRes(c),
+		ClientSecret: secret,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// admin/clients/{clientID}
+// @Summary Delete client
+// @Tags admin, clients
+// @Description Delete a registered client
+// @ID admin-clients-delete
+// @Security BearerAuth
+// @Param clientID path string true "Client ID"
+// @Produce json
+// @Success 200 {object} SuccessRes
+// @Failure 401,403,404,500 {object} ErrorRes
+// @Router /admin/clients/{clientID} [delete]
+func (h *Handler) deleteClient(w http.ResponseWriter, r *http.Request) {
+	found, err := h.db.DeleteClient(h.ctx, chi.URLParam(r, "clientID"))
+	if err != nil {
+		h.sendError(w, "error deleting client", http.StatusInternalServerError)
+		return
+	}
+
+	if !found {
+		h.sendError(w, "client not found", http.StatusNotFound)
+		return
+	}
+
+	h.sendSuccess(w, "client deleted", http.StatusOK)
+}
+
+func validateGrantTypes(grantTypes []string) string {
+	if len(grantTypes) == 0 {
+		return "at least one grant type is required"
+	}
+
+	for _, g := range grantTypes {
+		if !supportedGrantTypes[g] {
+			return "unsupported grant type: " + g
+		}
+	}
+
+	return ""
+}
+
+// validateClient checks that grant types, redirect URIs and auth method fit together
+func validateClient(c *db.OAuthClient) string {
+	if c.AuthMethod == db.ClientAuthNone && slices.Contains(c.GrantTypes, grantTypeClientCredentials) {
+		return "public clients can't use the client_credentials grant"
+	}
+
+	if c.AuthMethod == db.ClientAuthNone && slices.Contains(c.GrantTypes, grantTypeTokenExchange) {
+		return "public clients can't use the token-exchange grant"
+	}
+
+	// Device tokens are limited to what the user approved, which can't be nothing
+	if slices.Contains(c.GrantTypes, grantTypeDeviceCode) && len(c.Scopes) == 0 {
+		return "the device_code grant requires at least one scope"
+	}
+
+	if slices.Contains(c.GrantTypes, grantTypeAuthorizationCode) && len(c.RedirectURIs) == 0 {
+		return "the authorization_code grant requires at least one redirect URI"
+	}
+
+	for _, uri := range c.RedirectURIs {
+		u, err := url.Parse(uri)
+		if err != nil || !u.IsAbs() || u.Fragment != "" {
+			return "invalid redirect URI: " + uri
+		}
+	}
+
+	return ""
+}
+
+func toClientRes(c *db.OAuthClient) ClientRes {
+	return ClientRes{
+		ClientID:     c.ClientID,
+		Name:         c.Name,
+		AuthMethod:   c.AuthMethod,
+		PublicKey:    c.PublicKey,
+		Scopes:       c.Scopes,
+		GrantTypes:   c.GrantTypes,
+		RedirectURIs: c.RedirectURIs,
+		IsDisabled:   c.IsDisabled,
+		CreatedAt:    c.CreatedAt,
+		UpdatedAt:    c.UpdatedAt,
+	}
+}
@@ -0,0 +1,230 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arrogantworm/jwt_auth/api/authn"
+	"github.com/arrogantworm/jwt_auth/api/token"
+	"github.com/arrogantworm/jwt_auth/api/utils"
+	"github.com/arrogantworm/jwt_auth/db"
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Scopes that can be granted to API keys
+var apiKeyScopes = map[string]bool{
+	scopeUserRead: true,
+}
+
+// api/user/keys
+// @Summary Create API key
+// @Tags user, keys
+// @Description Create a personal API key with at least one scope. The key is only shown once.
+// @ID user-keys-create
+// @Security BearerAuth
+// @Accept json
+// @Param input body CreateAPIKeyReq true "API key info"
+// @Produce json
+// @Success 201 {object} CreateAPIKeyRes
+// @Failure 400,401,403,500 {object} ErrorRes
+// @Router /api/user/keys [post]
+func (h *Handler) createAPIKey(w http.ResponseWriter, r *http.Request) {
+
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
+
+	var req CreateAPIKeyReq
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendError(w, "", http.StatusBadRequest)
+		return
+	}
+
+	if req.Name == "" {
+		h.sendError(w, "name is required", http.StatusBadRequest)
+		return
+	}
+
+	// A key without scopes could be used for nothing
+	if len(req.Scopes) == 0 {
+		h.sendError(w, "at least one scope is required", http.StatusBadRequest)
+		return
+	}
+
+	for _, s := range req.Scopes {
+		if !apiKeyScopes[s] {
+			h.sendError(w, fmt.Sprintf("unknown scope: %s", s), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.ExpiresAt != nil && req.ExpiresAt.Before(time.Now()) {
+		h.sendError(w, "expiresAt must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	key, prefix, err := utils.GenerateAPIKey()
+	if err != nil {
+		h.sendError(w, "error creating api key", http.StatusInternalServerError)
+		return
+	}
+
+	k, err := h.db.CreateAPIKey(h.ctx, &db.APIKey{
+		UserID:    claims.ID,
+		Name:      req.Name,
+		Prefix:    prefix,
+		KeyHash:   utils.HashAPIKey(key),
+		Scopes:    req.Scopes,
+		ExpiresAt: req.ExpiresAt,
+	})
+	if err != nil {
+		h.sendError(w, "error saving api key", http.StatusInternalServerError)
+		return
+	}
+
+	res := CreateAPIKeyRes{
+		APIKeyRes: toAPIKeyRes(k),
+		Key:       key,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(res)
+}
+
+// api/user/keys
+// @Summary List API keys
+// @Tags user, keys
+// @Description List personal API keys
+// @ID user-keys-list
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {array} APIKeyRes
+// @Failure 401,403,500 {object} ErrorRes
+// @Router /api/user/keys [get]
+func (h *Handler) listAPIKeys(w http.ResponseWriter, r *http.Request) {
+
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
+
+	keys, err := h.db.ListAPIKeys(h.ctx, claims.ID)
+	if err != nil {
+		h.sendError(w, "error getting api keys", http.StatusInternalServerError)
+		return
+	}
+
+	res := make([]APIKeyRes, 0, len(keys))
+	for _, k := range keys {
+		res = append(res, toAPIKeyRes(k))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// api/user/keys/{keyID}
+// @Summary Revoke API key
+// @Tags user, keys
+// @Description Revoke a personal API key
+// @ID user-keys-revoke
+// @Security BearerAuth
+// @Param keyID path int true "API key ID"
+// @Produce json
+// @Success 200 {object} SuccessRes
+// @Failure 400,401,403,404,500 {object} ErrorRes
+// @Router /api/user/keys/{keyID} [delete]
+func (h *Handler) revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
+
+	keyID, err := strconv.Atoi(chi.URLParam(r, "keyID"))
+	if err != nil {
+		h.sendError(w, "invalid key id", http.StatusBadRequest)
+		return
+	}
+
+	found, err := h.db.RevokeAPIKey(h.ctx, claims.ID, keyID)
+	if err != nil {
+		h.sendError(w, "error revoking api key", http.StatusInternalServerError)
+		return
+	}
+
+	if !found {
+		h.sendError(w, "api key not found", http.StatusNotFound)
+		return
+	}
+
+	h.sendSuccess(w, "api key revoked", http.StatusOK)
+}
+
+// VerifyAPIKey implements APIKeyVerifier. The returned claims carry the key's
+// scopes and an ID that never matches a session.
+func (h *Handler) VerifyAPIKey(ctx context.Context, key string) (*token.UserClaims, error) {
+	prefix, err := utils.ParseAPIKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := h.db.GetAPIKeyByPrefix(ctx, prefix)
+	if err != nil {
+		return nil, utils.ErrInvalidAPIKey
+	}
+
+	if err := utils.CheckAPIKey(key, k.KeyHash); err != nil {
+		return nil, err
+	}
+
+	if k.IsRevoked {
+		return nil, errors.New("api key revoked")
+	}
+
+	if k.ExpiresAt != nil && time.Now().After(*k.ExpiresAt) {
+		return nil, errors.New("api key expired")
+	}
+
+	// Keys created before scopes were required grant nothing
+	if len(k.Scopes) == 0 {
+		return nil, errors.New("api key has no scopes")
+	}
+
+	u, err := h.db.GetUserById(ctx, k.UserID)
+	if err != nil {
+		return nil, errors.New("error getting user")
+	}
+
+	if !u.Active {
+		return nil, authn.ErrUserDisabled
+	}
+
+	if err := h.db.TouchAPIKey(ctx, k.ID); err != nil {
+		return nil, errors.New("error updating api key")
+	}
+
+	return &token.UserClaims{
+		ID:    u.ID,
+		Scope: strings.Join(k.Scopes, " "),
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:      "apikey:" + k.Prefix,
+			Subject: u.Username,
+		},
+	}, nil
+}
+
+func toAPIKeyRes(k *db.APIKey) APIKeyRes {
+	return APIKeyRes{
+		Id:         k.ID,
+		Name:       k.Name,
+		Prefix:     utils.APIKeyPrefix + "_" + k.Prefix,
+		Scopes:     k.Scopes,
+		IsRevoked:  k.IsRevoked,
+		ExpiresAt:  k.ExpiresAt,
+		LastUsedAt: k.LastUsedAt,
+		CreatedAt:  k.CreatedAt,
+	}
+}
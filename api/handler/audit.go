@@ -0,0 +1,257 @@
+package handler
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/arrogantworm/jwt_auth/api/events"
+	"github.com/arrogantworm/jwt_auth/api/token"
+	"github.com/arrogantworm/jwt_auth/db"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+const (
+	auditLogDefaultLimit = 100
+	auditLogMaxLimit     = 1000
+)
+
+// auditAdminActions records an admin.action event for every request that may
+// change something. It runs after authentication, so the caller is known.
+func (h *Handler) auditAdminActions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		action := events.AdminAction{
+			Method: r.Method,
+			Status: ww.Status(),
+		}
+
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			action.Route = rctx.RoutePattern()
+			for i, key := range rctx.URLParams.Keys {
+				if key == "*" {
+					continue
+				}
+				if action.Params == nil {
+					action.Params = map[string]string{}
+				}
+				action.Params[key] = rctx.URLParams.Values[i]
+			}
+		}
+
+		var userID int
+		var sessionID string
+		if claims, ok := r.Context().Value(authKey{}).(*token.UserClaims); ok {
+			if claims.SubjectType == token.SubjectTypeClient {
+				action.ClientID = claims.Subject
+			} else {
+				userID = claims.ID
+				sessionID = claims.RegisteredClaims.ID
+			}
+		}
+
+		h.publishEvent(r, events.TypeAdminAction, userID, sessionID, action)
+	})
+}
+
+// RunAuditCheckpoints signs the head of the audit log chain periodically until
+// ctx is done. It returns at once when there is no signing key.
+func (h *Handler) RunAuditCheckpoints(ctx context.Context) {
+	if h.checkpointer == nil {
+		return
+	}
+
+	h.checkpointer.Run(ctx)
+}
+
+func encodeAuditCursor(id int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(id, 10)))
+}
+
+func decodeAuditCursor(cursor string) (int64, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, false
+	}
+
+	id, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil || id < 1 {
+		return 0, false
+	}
+
+	return id, true
+}
+
+// auditLogFilter reads the query parameters shared by the list and export
+// endpoints. It returns a message describing the first invalid one, or "".
+func auditLogFilter(r *http.Request) (db.AuditLogFilter, string) {
+	var filter db.AuditLogFilter
+	q := r.URL.Query()
+
+	if v := q.Get("userId"); v != "" {
+		userID, err := strconv.Atoi(v)
+		if err != nil {
+			return filter, "invalid user id"
+		}
+		filter.UserID = &userID
+	}
+
+	if v := q.Get("type"); v != "" {
+		filter.EventType = &v
+	}
+
+	if v := q.Get("ip"); v != "" {
+		filter.IPAddress = &v
+	}
+
+	if v := q.Get("from"); v != "" {
+		from, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return filter, "from must be an RFC 3339 time"
+		}
+		filter.From = &from
+	}
+
+	if v := q.Get("to"); v != "" {
+		to, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return filter, "to must be an RFC 3339 time"
+		}
+		filter.To = &to
+	}
+
+	return filter, ""
+}
+
+func toAuditLogRes(e *db.AuditLogEntry) AuditLogRes {
+	return AuditLogRes{
+		Id:         e.ID,
+		EventID:    e.EventID,
+		Type:       e.EventType,
+		UserID:     e.UserID,
+		SessionID:  e.SessionID,
+		IP:         e.IPAddress,
+		UserAgent:  e.UserAgent,
+		Data:       e.Data,
+		Time:       e.OccurredAt,
+		RecordedAt: e.CreatedAt,
+		PrevHash:   e.PrevHash,
+		Hash:       e.Hash,
+	}
+}
+
+// admin/audit-log
+// @Summary Query audit log
+// @Tags admin, audit
+// @Description Authentication and admin events, newest first. Pass nextCursor as cursor to get the following page, it is empty on the last one. Times are RFC 3339, from is inclusive and to exclusive.
+// @ID admin-audit-log-list
+// @Security BearerAuth
+// @Param userId query int false "User the event is about, or the admin for admin.action"
+// @Param type query string false "Event type"
+// @Param ip query string false "IP address of the request"
+// @Param from query string false "Earliest time"
+// @Param to query string false "Latest time"
+// @Param limit query int false "Page size, 100 by default and at most 1000"
+// @Param cursor query string false "Cursor from the previous page"
+// @Produce json
+// @Success 200 {object} AuditLogPageRes
+// @Failure 400,401,403,500 {object} ErrorRes
+// @Router /admin/audit-log [get]
+func (h *Handler) listAuditLog(w http.ResponseWriter, r *http.Request) {
+	filter, msg := auditLogFilter(r)
+	if msg != "" {
+		h.sendError(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		cursor, ok := decodeAuditCursor(v)
+		if !ok {
+			h.sendError(w, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+		filter.Cursor = &cursor
+	}
+
+	limit := auditLogDefaultLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > auditLogMaxLimit {
+			h.sendError(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	// One extra entry tells whether there is another page
+	entries, err := h.db.ListAuditLog(h.ctx, filter, limit+1)
+	if err != nil {
+		h.sendError(w, "error getting audit log", http.StatusInternalServerError)
+		return
+	}
+
+	res := AuditLogPageRes{Entries: make([]AuditLogRes, 0, limit)}
+	if len(entries) > limit {
+		entries = entries[:limit]
+		res.NextCursor = encodeAuditCursor(entries[limit-1].ID)
+	}
+
+	for _, e := range entries {
+		res.Entries = append(res.Entries, toAuditLogRes(e))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// admin/audit-log/export
+// @Summary Export audit log
+// @Tags admin, audit
+// @Description Stream every matching entry as JSON Lines, oldest first. Takes the same filters as /admin/audit-log.
+// @ID admin-audit-log-export
+// @Security BearerAuth
+// @Param userId query int false "User the event is about, or the admin for admin.action"
+// @Param type query string false "Event type"
+// @Param ip query string false "IP address of the request"
+// @Param from query string false "Earliest time"
+// @Param to query string false "Latest time"
+// @Produce application/x-ndjson
+// @Success 200 {object} AuditLogRes "One entry per line"
+// @Failure 400,401,403 {object} ErrorRes
+// @Router /admin/audit-log/export [get]
+func (h *Handler) exportAuditLog(w http.ResponseWriter, r *http.Request) {
+	filter, msg := auditLogFilter(r)
+	if msg != "" {
+		h.sendError(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit-log.jsonl"`)
+	w.WriteHeader(http.StatusOK)
+
+	// Encode ends every value with a newline
+	enc := json.NewEncoder(w)
+
+	err := h.db.ExportAuditLog(r.Context(), filter, func(e *db.AuditLogEntry) error {
+		return enc.Encode(toAuditLogRes(e))
+	})
+	// The status is already sent, a cut-off export is all the client sees
+	if err != nil {
+		log.Println("[AUDIT]", err)
+	}
+}
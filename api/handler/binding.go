@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/arrogantworm/jwt_auth/api/binding"
+	"github.com/arrogantworm/jwt_auth/api/events"
+	"github.com/arrogantworm/jwt_auth/api/geoip"
+	"github.com/arrogantworm/jwt_auth/db"
+)
+
+var bindingMismatchMessages = map[string]string{
+	binding.IP:        "ip address does not match",
+	binding.Subnet:    "ip subnet does not match",
+	binding.ASN:       "network does not match",
+	binding.UserAgent: "user agent does not match",
+}
+
+// checkBinding applies the binding policy to the renewal of s by r with
+// userAgent from loc. It returns the events to record with the renewal, and
+// false when the renewal was refused and the caller has been answered.
+func (h *Handler) checkBinding(w http.ResponseWriter, r *http.Request, s *db.Session, userAgent string, loc *geoip.Location) ([]*db.OutboxEvent, bool) {
+	var clientID string
+	if s.ClientID != nil {
+		clientID = *s.ClientID
+	}
+
+	actual := binding.Context{IP: remoteIP(r), UserAgent: userAgent}
+	if loc != nil {
+		actual.ASN = loc.ASN
+	}
+
+	mismatches := h.binding.Check(clientID, binding.Context{IP: s.IPAddress, ASN: s.Location.ASN, UserAgent: s.UserAgent}, actual)
+	if len(mismatches) == 0 {
+		return nil, true
+	}
+
+	var staged []*db.OutboxEvent
+	for _, m := range mismatches {
+		log.Println("[BINDING]", s.UserID, m.Binding, m.Expected, " -- ", m.Actual, m.Action)
+
+		mismatch, err := h.stageEvent(r, events.TypeBindingMismatch, s.UserID, s.SessionID, events.BindingMismatch{
+			Binding:  m.Binding,
+			Expected: m.Expected,
+			Actual:   m.Actual,
+			Action:   m.Action,
+		})
+		if err != nil {
+			h.sendError(w, "error updating session", http.StatusInternalServerError)
+			return nil, false
+		}
+		staged = append(staged, mismatch)
+	}
+
+	strictest := binding.Strictest(mismatches)
+	switch strictest.Action {
+	case binding.ActionStepUp:
+		h.sendError(w, errSignInAgain.Error(), http.StatusUnauthorized)
+		// The session stays usable from where it is bound to, nothing changes
+		// but the record of the attempt
+		if err := h.db.CreateOutboxEvents(h.ctx, staged...); err != nil {
+			log.Println("[EVENTS]", err)
+		}
+		return nil, false
+	case binding.ActionRevoke:
+		reason := events.ReasonBindingMismatch
+		for _, m := range mismatches {
+			if m.Binding == binding.UserAgent && m.Action == binding.ActionRevoke {
+				reason = events.ReasonUserAgentMismatch
+			}
+		}
+
+		h.sendError(w, bindingMismatchMessages[strictest.Binding], http.StatusUnauthorized)
+		h.endSession(r, s, reason, staged...)
+		return nil, false
+	}
+
+	return staged, true
+}
@@ -0,0 +1,180 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/arrogantworm/jwt_auth/api/utils"
+	"github.com/spf13/viper"
+)
+
+const (
+	accessTokenCookie  = "access_token"
+	refreshTokenCookie = "refresh_token"
+	csrfTokenCookie    = "csrf_token"
+	csrfTokenHeader    = "X-CSRF-Token"
+
+	// The refresh token is only needed to renew, revoke and log out, so the
+	// browser doesn't send it outside /auth
+	refreshTokenCookiePath = "/auth"
+	// Where the refresh token cookie used to live. Browsers send the more
+	// specific path first, so a leftover cookie there would shadow the new one.
+	legacyRefreshTokenCookiePath = "/auth/tokens"
+)
+
+var errCSRFTokenMismatch = errors.New("csrf token is missing or does not match")
+
+// cookieMode reports whether first-party sessions are handed out as cookies
+// instead of in the response body
+func cookieMode() bool {
+	return viper.GetBool("cookies.enabled")
+}
+
+func cookieSameSite() http.SameSite {
+	switch strings.ToLower(viper.GetString("cookies.sameSite")) {
+	case "lax":
+		return http.SameSiteLaxMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteStrictMode
+	}
+}
+
+// setSessionCookies stores the token pair in HttpOnly cookies along with a
+// fresh CSRF token, which is returned. The access token cookie lives as long
+// as the refresh token so that an expired access token can still be renewed.
+func setSessionCookies(w http.ResponseWriter, accessToken string, refreshToken string, expires time.Time) (string, error) {
+	csrfToken, err := utils.RandomHex(32)
+	if err != nil {
+		return "", err
+	}
+
+	domain := viper.GetString("cookies.domain")
+	sameSite := cookieSameSite()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     accessTokenCookie,
+		Value:    accessToken,
+		Path:     "/",
+		Domain:   domain,
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: sameSite,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshTokenCookie,
+		Value:    refreshToken,
+		Path:     refreshTokenCookiePath,
+		Domain:   domain,
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: sameSite,
+	})
+	http.SetCookie(w, &http.Cookie{Name: refreshTokenCookie, Path: legacyRefreshTokenCookiePath, Domain: domain, MaxAge: -1, HttpOnly: true, Secure: true})
+	// Readable by the frontend, which echoes it in the X-CSRF-Token header
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfTokenCookie,
+		Value:    csrfToken,
+		Path:     "/",
+		Domain:   domain,
+		Expires:  expires,
+		Secure:   true,
+		SameSite: sameSite,
+	})
+
+	return csrfToken, nil
+}
+
+func clearSessionCookies(w http.ResponseWriter) {
+	domain := viper.GetString("cookies.domain")
+
+	http.SetCookie(w, &http.Cookie{Name: accessTokenCookie, Path: "/", Domain: domain, MaxAge: -1, HttpOnly: true, Secure: true})
+	http.SetCookie(w, &http.Cookie{Name: refreshTokenCookie, Path: refreshTokenCookiePath, Domain: domain, MaxAge: -1, HttpOnly: true, Secure: true})
+	http.SetCookie(w, &http.Cookie{Name: refreshTokenCookie, Path: legacyRefreshTokenCookiePath, Domain: domain, MaxAge: -1, HttpOnly: true, Secure: true})
+	http.SetCookie(w, &http.Cookie{Name: csrfTokenCookie, Path: "/", Domain: domain, MaxAge: -1, Secure: true})
+}
+
+// checkCSRF enforces the double-submit token on requests that change state.
+// It is only needed when the request is authenticated by a cookie.
+func checkCSRF(r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return nil
+	}
+
+	cookie, err := r.Cookie(csrfTokenCookie)
+	if err != nil || cookie.Value == "" {
+		return errCSRFTokenMismatch
+	}
+
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(csrfTokenHeader)), []byte(cookie.Value)) != 1 {
+		return errCSRFTokenMismatch
+	}
+
+	return nil
+}
+
+// accessTokenFromCookie returns the access token cookie of r in cookie mode
+func accessTokenFromCookie(r *http.Request) (string, error) {
+	if !cookieMode() {
+		return "", errors.New("authorization header is missing")
+	}
+
+	cookie, err := r.Cookie(accessTokenCookie)
+	if err != nil || cookie.Value == "" {
+		return "", errors.New("authorization header is missing")
+	}
+
+	if err := checkCSRF(r); err != nil {
+		return "", err
+	}
+
+	return cookie.Value, nil
+}
+
+// refreshTokenFromCookie returns the refresh token cookie of r in cookie mode,
+// or an empty token when there is none
+func refreshTokenFromCookie(r *http.Request) (string, error) {
+	if !cookieMode() {
+		return "", nil
+	}
+
+	cookie, err := r.Cookie(refreshTokenCookie)
+	if err != nil || cookie.Value == "" {
+		return "", nil
+	}
+
+	if err := checkCSRF(r); err != nil {
+		return "", err
+	}
+
+	return cookie.Value, nil
+}
+
+// sendSession returns a new first-party session. In cookie mode the tokens are
+// set as cookies and left out of the body.
+func (h *Handler) sendSession(w http.ResponseWriter, res *LoginUserRes) {
+	if cookieMode() {
+		csrfToken, err := setSessionCookies(w, res.AccessToken, res.RefreshToken, res.RefreshTokenTTL)
+		if err != nil {
+			h.sendError(w, "error creating csrf token", http.StatusInternalServerError)
+			return
+		}
+
+		res.AccessToken = ""
+		res.RefreshToken = ""
+		res.CSRFToken = csrfToken
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
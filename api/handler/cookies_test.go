@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestRefreshCookieReachesLogout(t *testing.T) {
+	viper.Set("cookies.enabled", true)
+	t.Cleanup(func() { viper.Set("cookies.enabled", false) })
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A refresh token left over from before the cookie moved to /auth
+	renewURL, _ := url.Parse("https://example.com/auth/tokens/renew")
+	jar.SetCookies(renewURL, []*http.Cookie{{Name: refreshTokenCookie, Value: "stale", Path: legacyRefreshTokenCookiePath, Secure: true}})
+
+	rec := httptest.NewRecorder()
+	csrfToken, err := setSessionCookies(rec, "access", "refresh", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loginURL, _ := url.Parse("https://example.com/auth/login")
+	jar.SetCookies(loginURL, rec.Result().Cookies())
+
+	for _, path := range []string{"/auth/logout", "/auth/tokens/renew", "/auth/tokens/revoke"} {
+		target, _ := url.Parse("https://example.com" + path)
+
+		// Only the cookies the browser would send, without the access token,
+		// which may have expired by now
+		req := httptest.NewRequest(http.MethodPost, target.String(), nil)
+		for _, c := range jar.Cookies(target) {
+			if c.Name != accessTokenCookie {
+				req.AddCookie(c)
+			}
+		}
+		req.Header.Set(csrfTokenHeader, csrfToken)
+
+		got, err := refreshTokenFromCookie(req)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if got != "refresh" {
+			t.Errorf("%s: got refresh token %q, want %q", path, got, "refresh")
+		}
+
+		req.Header.Del(csrfTokenHeader)
+		if _, err := refreshTokenFromCookie(req); err == nil {
+			t.Errorf("%s: refresh cookie accepted without the csrf header", path)
+		}
+	}
+
+	target, _ := url.Parse("https://example.com/api/user")
+	for _, c := range jar.Cookies(target) {
+		if c.Name == refreshTokenCookie {
+			t.Errorf("refresh cookie sent to %s", target.Path)
+		}
+	}
+}
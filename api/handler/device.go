@@ -0,0 +1,421 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/arrogantworm/jwt_auth/api/authn"
+	"github.com/arrogantworm/jwt_auth/api/events"
+	"github.com/arrogantworm/jwt_auth/api/token"
+	"github.com/arrogantworm/jwt_auth/api/utils"
+	"github.com/arrogantworm/jwt_auth/db"
+	"github.com/jackc/pgx/v5"
+	"github.com/spf13/viper"
+)
+
+const grantTypeDeviceCode = "urn:ietf:params:oauth:grant-type:device_code"
+
+// User codes avoid vowels and easily confused characters (RFC 8628 section 6.1)
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+// deviceConfirmationTTL is how long the approve and deny buttons of /device work
+const deviceConfirmationTTL = 5 * time.Minute
+
+// generateUserCode returns a code in the form XXXX-XXXX
+func generateUserCode() (string, error) {
+	var b strings.Builder
+
+	for i := 0; i < 8; i++ {
+		if i == 4 {
+			b.WriteByte('-')
+		}
+
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(userCodeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte(userCodeAlphabet[n.Int64()])
+	}
+
+	return b.String(), nil
+}
+
+// normalizeUserCode accepts user input in any case, with or without the dash
+func normalizeUserCode(code string) string {
+	var b strings.Builder
+
+	for _, c := range strings.ToUpper(code) {
+		if strings.ContainsRune(userCodeAlphabet, c) {
+			b.WriteRune(c)
+		}
+	}
+
+	s := b.String()
+	if len(s) != 8 {
+		return s
+	}
+
+	return s[:4] + "-" + s[4:]
+}
+
+// oauth/device_authorization
+// @Summary OAuth2 Device Authorization
+// @Tags oauth
+// @Description RFC 8628 device authorization request. The client needs at least one scope, and its tokens are limited to the granted scopes.
+// @ID oauth-device-authorization
+// @Accept x-www-form-urlencoded
+// @Param client_id formData string false "Client ID (public clients)"
+// @Param scope formData string false "Space separated scopes"
+// @Produce json
+// @Success 200 {object} DeviceAuthorizationRes
+// @Failure 400,401,500 {object} OAuthErrorRes
+// @Router /oauth/device_authorization [post]
+func (h *Handler) deviceAuthorization(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		h.sendOAuthError(w, "invalid_request", "malformed form body", http.StatusBadRequest)
+		return
+	}
+
+	c, err := h.authenticateClient(r)
+	if err != nil {
+		h.sendClientAuthError(w, r)
+		return
+	}
+
+	if !slices.Contains(c.GrantTypes, grantTypeDeviceCode) {
+		h.sendOAuthError(w, "unauthorized_client", "client is not allowed to use this grant type", http.StatusBadRequest)
+		return
+	}
+
+	// The user approves exactly these scopes, a device never gets a first-party token
+	scope, ok := grantedScope(r.PostForm.Get("scope"), c.Scopes)
+	if !ok || scope == "" {
+		h.sendOAuthError(w, "invalid_scope", "requested scope is not allowed", http.StatusBadRequest)
+		return
+	}
+
+	deviceCode, err := utils.RandomHex(32)
+	if err != nil {
+		h.sendOAuthError(w, "server_error", "", http.StatusInternalServerError)
+		return
+	}
+
+	userCode, err := generateUserCode()
+	if err != nil {
+		h.sendOAuthError(w, "server_error", "", http.StatusInternalServerError)
+		return
+	}
+
+	ttl := viper.GetDuration("oauth.deviceCodeTTL")
+	interval := int(viper.GetDuration("oauth.devicePollInterval").Seconds())
+
+	err = h.db.CreateDeviceCode(h.ctx, &db.DeviceCode{
+		DeviceCodeHash: utils.SHA256Hex(deviceCode),
+		UserCode:       userCode,
+		ClientID:       c.ClientID,
+		Scope:          scope,
+		PollInterval:   interval,
+		ExpiresAt:      time.Now().Add(ttl),
+	})
+	if err != nil {
+		h.sendOAuthError(w, "server_error", "error saving device code", http.StatusInternalServerError)
+		return
+	}
+
+	res := DeviceAuthorizationRes{
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationURI:         h.issuer + "/device",
+		VerificationURIComplete: h.issuer + "/device?user_code=" + userCode,
+		ExpiresIn:               int(ttl.Seconds()),
+		Interval:                interval,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+func (h *Handler) deviceCodeGrant(w http.ResponseWriter, r *http.Request) {
+	c, err := h.authenticateClient(r)
+	if err != nil {
+		h.sendClientAuthError(w, r)
+		return
+	}
+
+	if !slices.Contains(c.GrantTypes, grantTypeDeviceCode) {
+		h.sendOAuthError(w, "unauthorized_client", "client is not allowed to use this grant type", http.StatusBadRequest)
+		return
+	}
+
+	deviceCode := r.PostForm.Get("device_code")
+	if deviceCode == "" {
+		h.sendOAuthError(w, "invalid_request", "device_code is required", http.StatusBadRequest)
+		return
+	}
+
+	poll, err := h.db.PollDeviceCode(h.ctx, utils.SHA256Hex(deviceCode))
+	if err != nil || poll.ClientID != c.ClientID {
+		h.sendOAuthError(w, "invalid_grant", "invalid device code", http.StatusBadRequest)
+		return
+	}
+
+	if poll.Expired {
+		h.sendOAuthError(w, "expired_token", "", http.StatusBadRequest)
+		return
+	}
+
+	switch poll.Status {
+	case db.DeviceCodePending:
+		if poll.SlowDown {
+			h.sendOAuthError(w, "slow_down", "", http.StatusBadRequest)
+			return
+		}
+		h.sendOAuthError(w, "authorization_pending", "", http.StatusBadRequest)
+		return
+	case db.DeviceCodeDenied:
+		h.sendOAuthError(w, "access_denied", "", http.StatusBadRequest)
+		return
+	case db.DeviceCodeApproved:
+	default:
+		h.sendOAuthError(w, "invalid_grant", "device code was already used", http.StatusBadRequest)
+		return
+	}
+
+	u, err := h.db.GetUserById(h.ctx, *poll.UserID)
+	if err != nil {
+		h.sendOAuthError(w, "server_error", "error getting user", http.StatusInternalServerError)
+		return
+	}
+
+	consume := func(ctx context.Context, s *db.Session, staged ...*db.OutboxEvent) (*db.Session, error) {
+		return h.db.CreateDeviceCodeSession(ctx, utils.SHA256Hex(deviceCode), s, staged...)
+	}
+
+	session, err := h.createSession(r, u, events.LoginSucceeded{Method: events.MethodOAuth, ClientID: c.ClientID}, poll.Scope, consume)
+	if errors.Is(err, db.ErrDeviceCodeUsed) {
+		h.sendOAuthError(w, "invalid_grant", err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		h.sendOAuthError(w, "server_error", err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.sendOAuthToken(w, OAuthTokenRes{
+		AccessToken:  session.AccessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(time.Until(session.AccessTokenTTL).Seconds()),
+		RefreshToken: session.RefreshToken,
+		Scope:        poll.Scope,
+	})
+}
+
+// decideDeviceCode approves or denies a user code and names the client it belongs to
+func (h *Handler) decideDeviceCode(userCode string, userID int, approve bool) (string, error) {
+	clientID, err := h.db.DecideDeviceCode(h.ctx, normalizeUserCode(userCode), userID, approve)
+	if err != nil {
+		return "", err
+	}
+
+	return h.clientName(clientID), nil
+}
+
+// clientName returns the display name of a client, or its ID when it can't be found
+func (h *Handler) clientName(clientID string) string {
+	c, err := h.db.GetClient(h.ctx, clientID)
+	if err != nil {
+		return clientID
+	}
+
+	return c.Name
+}
+
+func (h *Handler) renderConsent(w http.ResponseWriter, page consentPage, status int) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(status)
+
+	if err := templates.ExecuteTemplate(w, "consent.html", page); err != nil {
+		log.Printf("error rendering consent page: %v", err)
+	}
+}
+
+// device
+// @Summary Device Verification Page
+// @Tags oauth
+// @Description Page where a user signs in with a device user code, and then approves or denies it after seeing the client and the scopes it asks for (RFC 8628 section 5.4). The second step is posted with the confirmation token of the first.
+// @ID device-verification
+// @Param user_code query string false "User code shown on the device"
+// @Param confirmation formData string false "Confirmation token of the signin step"
+// @Param action formData string false "approve or deny, with confirmation"
+// @Produce html
+// @Success 200 {string} string "Verification page"
+// @Failure 400,401 {string} string "Verification page with error"
+// @Router /device [get]
+// @Router /device [post]
+func (h *Handler) deviceVerification(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "malformed request", http.StatusBadRequest)
+		return
+	}
+
+	page := loginPage{
+		Title:        "Connect a device",
+		Message:      "Enter the code shown on your device",
+		Action:       "/device",
+		ShowUserCode: true,
+		UserCode:     r.Form.Get("user_code"),
+	}
+
+	if r.Method == http.MethodGet {
+		h.renderLogin(w, page, http.StatusOK)
+		return
+	}
+
+	if confirmation := r.PostForm.Get("confirmation"); confirmation != "" {
+		h.confirmDevice(w, r, page, confirmation)
+		return
+	}
+
+	username := r.PostForm.Get("username")
+
+	u, err := h.authenticator.Authenticate(h.ctx, username, r.PostForm.Get("password"))
+	if errors.Is(err, authn.ErrWrongPassword) || errors.Is(err, pgx.ErrNoRows) {
+		reason := events.ReasonWrongPassword
+		if errors.Is(err, pgx.ErrNoRows) {
+			reason = events.ReasonUnknownUser
+		}
+		h.loginFailed(r, events.MethodOAuth, username, reason)
+		page.Error = "Invalid username or password"
+		h.renderLogin(w, page, http.StatusUnauthorized)
+		return
+	}
+	if errors.Is(err, authn.ErrUserDisabled) {
+		h.loginFailed(r, events.MethodOAuth, username, events.ReasonUserDisabled)
+		page.Error = "This account is disabled"
+		h.renderLogin(w, page, http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, authn.ErrPasswordResetRequired) {
+		h.loginFailed(r, events.MethodOAuth, username, events.ReasonPasswordResetRequired)
+		page.Error = "Choose a new password through the link in the new sign-in email"
+		h.renderLogin(w, page, http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		page.Error = "Something went wrong, please try again"
+		h.renderLogin(w, page, http.StatusInternalServerError)
+		return
+	}
+
+	d, err := h.db.GetPendingDeviceCode(h.ctx, normalizeUserCode(page.UserCode))
+	if err != nil {
+		page.Error = "Invalid or expired code"
+		h.renderLogin(w, page, http.StatusBadRequest)
+		return
+	}
+
+	confirmation, err := h.TokenMaker.CreateDeviceConfirmationToken(u.ID, d.UserCode, deviceConfirmationTTL)
+	if err != nil {
+		page.Error = "Something went wrong, please try again"
+		h.renderLogin(w, page, http.StatusInternalServerError)
+		return
+	}
+
+	clientName := h.clientName(d.ClientID)
+
+	h.renderConsent(w, consentPage{
+		Title:   "Connect " + clientName + "?",
+		Message: clientName + " asks for access to your account " + u.Username + " with these scopes:",
+		Action:  "/device",
+		Hidden:  map[string]string{"user_code": d.UserCode, "confirmation": confirmation},
+		Scopes:  strings.Fields(d.Scope),
+	}, http.StatusOK)
+}
+
+// confirmDevice approves or denies the user code for the user who signed in
+// on the first step
+func (h *Handler) confirmDevice(w http.ResponseWriter, r *http.Request, page loginPage, confirmation string) {
+	claims, err := h.TokenMaker.VerifyDeviceConfirmationToken(confirmation)
+	if err != nil || claims.UserCode != normalizeUserCode(page.UserCode) {
+		page.Error = "This page has expired, please sign in again"
+		h.renderLogin(w, page, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := claims.UserID()
+	if err != nil {
+		page.Error = "This page has expired, please sign in again"
+		h.renderLogin(w, page, http.StatusBadRequest)
+		return
+	}
+
+	approve := r.PostForm.Get("action") == "approve"
+
+	clientName, err := h.decideDeviceCode(claims.UserCode, userID, approve)
+	if err != nil {
+		page.Error = "Invalid or expired code"
+		h.renderLogin(w, page, http.StatusBadRequest)
+		return
+	}
+
+	if !approve {
+		h.renderMessage(w, messagePage{"Request denied", clientName + " was not given access."}, http.StatusOK)
+		return
+	}
+
+	h.renderMessage(w, messagePage{"Device connected", clientName + " can now access your account. You can close this page."}, http.StatusOK)
+}
+
+// api/user/device
+// @Summary Approve Device
+// @Tags user, oauth
+// @Description Approve or deny a device user code as the signed-in user
+// @ID user-device
+// @Security BearerAuth
+// @Accept json
+// @Param input body DeviceDecisionReq true "User code and decision"
+// @Produce json
+// @Success 200 {object} SuccessRes
+// @Failure 400,401,403,404 {object} ErrorRes
+// @Router /api/user/device [post]
+func (h *Handler) approveDevice(w http.ResponseWriter, r *http.Request) {
+
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
+
+	var req DeviceDecisionReq
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendError(w, "", http.StatusBadRequest)
+		return
+	}
+
+	if req.UserCode == "" {
+		h.sendError(w, "userCode is required", http.StatusBadRequest)
+		return
+	}
+
+	clientName, err := h.decideDeviceCode(req.UserCode, claims.ID, req.Approve)
+	if err != nil {
+		h.sendError(w, "invalid or expired code", http.StatusNotFound)
+		return
+	}
+
+	if !req.Approve {
+		h.sendSuccess(w, "denied access to "+clientName, http.StatusOK)
+		return
+	}
+
+	h.sendSuccess(w, "approved access for "+clientName, http.StatusOK)
+}
@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/arrogantworm/jwt_auth/api/audit"
+	"github.com/arrogantworm/jwt_auth/api/events"
+	"github.com/arrogantworm/jwt_auth/api/geoip"
+	"github.com/arrogantworm/jwt_auth/api/outbox"
+	"github.com/arrogantworm/jwt_auth/api/webhooks"
+	"github.com/arrogantworm/jwt_auth/db"
+	"github.com/spf13/viper"
+)
+
+// newOutboxSinks builds the sinks listed in outbox.sinks
+func newOutboxSinks(pg *db.Postgres) ([]outbox.Sink, error) {
+	var sinks []outbox.Sink
+
+	for _, name := range viper.GetStringSlice("outbox.sinks") {
+		switch name {
+		case webhooks.SinkName:
+			d, err := webhooks.New(pg)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, d)
+		case audit.SinkName:
+			sinks = append(sinks, audit.New(pg))
+		case outbox.LogSink{}.Name():
+			sinks = append(sinks, outbox.LogSink{})
+		default:
+			return nil, fmt.Errorf("unknown outbox sink %q", name)
+		}
+	}
+
+	return sinks, nil
+}
+
+// RunOutbox delivers recorded events to the sinks until ctx is done
+func (h *Handler) RunOutbox(ctx context.Context) {
+	h.outbox.Run(ctx)
+}
+
+// newEvent builds an event about userID and sessionID caused by r
+func newEvent(r *http.Request, eventType string, userID int, sessionID string, data any) (*events.Event, error) {
+	return events.New(eventType, events.Subject{
+		UserID:    userID,
+		SessionID: sessionID,
+		IP:        remoteIP(r),
+		UserAgent: r.UserAgent(),
+	}, data)
+}
+
+// stageEvent builds an event caused by r, to be saved in the transaction of
+// the change it describes
+func (h *Handler) stageEvent(r *http.Request, eventType string, userID int, sessionID string, data any) (*db.OutboxEvent, error) {
+	e, err := newEvent(r, eventType, userID, sessionID, data)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := h.events.Stage(e)
+	if err != nil {
+		return nil, err
+	}
+
+	return rows[0], nil
+}
+
+// publishEvent records an event caused by r that goes with no database
+// change. Failures are only logged.
+func (h *Handler) publishEvent(r *http.Request, eventType string, userID int, sessionID string, data any) {
+	e, err := newEvent(r, eventType, userID, sessionID, data)
+	if err == nil {
+		err = h.events.Publish(h.ctx, e)
+	}
+
+	if err != nil {
+		log.Println("[EVENTS]", eventType, err)
+	}
+}
+
+// loginFailed publishes a failed signin with identifier. The event is about the
+// account identifier belongs to, when there is one, so that it shows up in
+// the account's activity.
+func (h *Handler) loginFailed(r *http.Request, method string, identifier string, reason string) {
+	var u *db.User
+	var err error
+
+	switch method {
+	case events.MethodPassword, events.MethodOAuth:
+		u, err = h.db.GetUserByUsername(h.ctx, identifier)
+	case events.MethodPhone:
+		u, err = h.db.GetUserByPhone(h.ctx, identifier)
+	}
+
+	var userID int
+	if err == nil && u != nil {
+		userID = u.ID
+	}
+
+	h.publishEvent(r, events.TypeLoginFailed, userID, "", events.LoginFailed{
+		Method:     method,
+		Identifier: identifier,
+		Reason:     reason,
+		Location:   h.locate(r),
+	})
+}
+
+// renewEvents describes the renewal of s into newSessionID by r from loc
+func (h *Handler) renewEvents(r *http.Request, s *db.Session, newSessionID string, loc *geoip.Location) ([]*db.OutboxEvent, error) {
+	renewed, err := h.stageEvent(r, events.TypeSessionRenewed, s.UserID, newSessionID, events.SessionRenewed{
+		PreviousSessionID: s.SessionID,
+		Location:          loc,
+	})
+	if err != nil {
+		return nil, err
+	}
+	staged := []*db.OutboxEvent{renewed}
+
+	if remoteIP(r) != s.IPAddress {
+		changed, err := h.stageEvent(r, events.TypeSessionIPChanged, s.UserID, newSessionID, events.SessionIPChanged{
+			PreviousIP:       s.IPAddress,
+			PreviousLocation: toLocation(s.Location),
+			Location:         loc,
+		})
+		if err != nil {
+			return nil, err
+		}
+		staged = append(staged, changed)
+	}
+
+	return staged, nil
+}
+
+// endSession deletes s after a failed renewal and records why, along with
+// staged. The caller has already answered, so failures are only logged.
+func (h *Handler) endSession(r *http.Request, s *db.Session, reason string, staged ...*db.OutboxEvent) {
+	revoked, err := h.stageEvent(r, events.TypeSessionRevoked, s.UserID, s.SessionID, events.SessionRevoked{Reason: reason})
+	if err != nil {
+		log.Println("[EVENTS]", err)
+		return
+	}
+	staged = append(staged, revoked)
+
+	if reason == events.ReasonUserAgentMismatch {
+		mismatch, err := h.stageEvent(r, events.TypeUserAgentMismatch, s.UserID, s.SessionID, events.UserAgentMismatch{ExpectedUserAgent: s.UserAgent})
+		if err != nil {
+			log.Println("[EVENTS]", err)
+			return
+		}
+		staged = append(staged, mismatch)
+	}
+
+	if err := h.db.DeleteSession(h.ctx, s.SessionID, staged...); err != nil {
+		log.Println("[SESSION]", err)
+	}
+}
@@ -0,0 +1,416 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/arrogantworm/jwt_auth/api/authn"
+	"github.com/arrogantworm/jwt_auth/api/events"
+	"github.com/arrogantworm/jwt_auth/api/federation"
+	"github.com/arrogantworm/jwt_auth/api/token"
+	"github.com/arrogantworm/jwt_auth/api/utils"
+	"github.com/arrogantworm/jwt_auth/db"
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/spf13/viper"
+)
+
+// The state cookie binds an upstream login to the browser that started it
+const externalStateCookie = "external_login_state"
+
+func (h *Handler) externalProvider(r *http.Request) (*federation.Provider, bool) {
+	p, ok := h.providers[chi.URLParam(r, "provider")]
+	return p, ok
+}
+
+func (h *Handler) externalRedirectURI(p *federation.Provider) string {
+	return h.issuer + "/auth/external/" + p.Name + "/callback"
+}
+
+// startExternalLogin records the login state, sets the state cookie and
+// returns the upstream authorization URL. linkUserID is set when a signed-in
+// user links a new identity.
+func (h *Handler) startExternalLogin(w http.ResponseWriter, p *federation.Provider, linkUserID *int) (string, error) {
+	state, err := utils.RandomHex(32)
+	if err != nil {
+		return "", err
+	}
+
+	verifier, err := utils.RandomHex(32)
+	if err != nil {
+		return "", err
+	}
+
+	nonce, err := utils.RandomHex(16)
+	if err != nil {
+		return "", err
+	}
+
+	authURL, err := p.AuthCodeURL(h.ctx, h.externalRedirectURI(p), state, nonce, codeChallengeS256(verifier))
+	if err != nil {
+		return "", err
+	}
+
+	ttl := viper.GetDuration("federation.stateTTL")
+
+	err = h.db.CreateExternalLoginState(h.ctx, &db.ExternalLoginState{
+		StateHash:    utils.SHA256Hex(state),
+		Provider:     p.Name,
+		CodeVerifier: verifier,
+		Nonce:        nonce,
+		LinkUserID:   linkUserID,
+		ExpiresAt:    time.Now().Add(ttl),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     externalStateCookie,
+		Value:    state,
+		Path:     "/auth/external",
+		MaxAge:   int(ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(h.issuer, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return authURL, nil
+}
+
+// auth/external
+// @Summary External Providers
+// @Tags auth, federation
+// @Description List the upstream identity providers users can sign in with
+// @ID auth-external-providers
+// @Produce json
+// @Success 200 {array} ExternalProviderRes
+// @Router /auth/external [get]
+func (h *Handler) listExternalProviders(w http.ResponseWriter, r *http.Request) {
+	res := make([]ExternalProviderRes, 0, len(h.providers))
+	for _, p := range h.providers {
+		res = append(res, ExternalProviderRes{Name: p.Name, DisplayName: p.DisplayName()})
+	}
+
+	slices.SortFunc(res, func(a, b ExternalProviderRes) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// auth/external/{provider}/start
+// @Summary External Login
+// @Tags auth, federation
+// @Description Redirect to an upstream identity provider to sign in
+// @ID auth-external-start
+// @Param provider path string true "Provider name"
+// @Success 302
+// @Failure 404,500 {object} ErrorRes
+// @Router /auth/external/{provider}/start [get]
+func (h *Handler) externalLoginStart(w http.ResponseWriter, r *http.Request) {
+	p, ok := h.externalProvider(r)
+	if !ok {
+		h.sendError(w, "unknown identity provider", http.StatusNotFound)
+		return
+	}
+
+	authURL, err := h.startExternalLogin(w, p, nil)
+	if err != nil {
+		h.sendError(w, "error starting external login", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// auth/external/{provider}/callback
+// @Summary External Login Callback
+// @Tags auth, federation
+// @Description Redirect target of the upstream identity provider. Signs the user in, or links the identity when the flow was started from /api/user/identities. When federation.successRedirect is set the result is passed to it in the URL fragment.
+// @ID auth-external-callback
+// @Param provider path string true "Provider name"
+// @Param code query string false "Authorization code"
+// @Param state query string true "State"
+// @Param error query string false "Error reported by the provider"
+// @Produce json
+// @Success 200 {object} LoginUserRes
+// @Success 302
+// @Failure 400,401,403,404,409,500 {object} ErrorRes
+// @Router /auth/external/{provider}/callback [get]
+func (h *Handler) externalLoginCallback(w http.ResponseWriter, r *http.Request) {
+	p, ok := h.externalProvider(r)
+	if !ok {
+		h.sendError(w, "unknown identity provider", http.StatusNotFound)
+		return
+	}
+
+	// The state is single use, whatever the outcome
+	http.SetCookie(w, &http.Cookie{Name: externalStateCookie, Path: "/auth/external", MaxAge: -1})
+
+	q := r.URL.Query()
+
+	if e := q.Get("error"); e != "" {
+		h.sendExternalError(w, r, "identity provider returned "+e, http.StatusUnauthorized)
+		return
+	}
+
+	var expected string
+	if cookie, err := r.Cookie(externalStateCookie); err == nil {
+		expected = cookie.Value
+	}
+
+	if err := federation.VerifyState(expected, q.Get("state")); err != nil {
+		h.sendExternalError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	state, err := h.db.ConsumeExternalLoginState(h.ctx, utils.SHA256Hex(expected), p.Name)
+	if err != nil {
+		h.sendExternalError(w, r, "invalid or expired state", http.StatusBadRequest)
+		return
+	}
+
+	identity, err := p.Exchange(r.Context(), h.externalRedirectURI(p), q.Get("code"), state.CodeVerifier, state.Nonce)
+	if err != nil {
+		h.sendExternalError(w, r, fmt.Sprintf("%s login failed: %v", p.Name, err), http.StatusUnauthorized)
+		return
+	}
+
+	if state.LinkUserID != nil {
+		status, err := h.linkIdentity(*state.LinkUserID, p, identity)
+		if err != nil {
+			h.sendExternalError(w, r, err.Error(), status)
+			return
+		}
+
+		if redirect := viper.GetString("federation.successRedirect"); redirect != "" {
+			http.Redirect(w, r, redirect+"#"+url.Values{"linked": {p.Name}}.Encode(), http.StatusFound)
+			return
+		}
+
+		h.sendSuccess(w, "identity linked", http.StatusOK)
+		return
+	}
+
+	u, err := federation.ResolveUser(h.ctx, h.db, p.Name, p.AutoProvision(), identity)
+	if errors.Is(err, federation.ErrIdentityNotLinked) {
+		h.sendExternalError(w, r, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		h.sendExternalError(w, r, "error getting user", http.StatusInternalServerError)
+		return
+	}
+
+	h.externalLoginSession(w, r, u, events.LoginSucceeded{Method: events.MethodExternal, Provider: p.Name})
+}
+
+// externalLoginSession signs u in after an upstream login and hands the tokens
+// to the frontend when federation.successRedirect is set, or returns them as JSON
+func (h *Handler) externalLoginSession(w http.ResponseWriter, r *http.Request, u *db.User, login events.LoginSucceeded) {
+	res, err := h.newSession(r, u, login, "")
+	if errors.Is(err, authn.ErrUserDisabled) {
+		h.sendExternalError(w, r, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		h.sendExternalError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if redirect := viper.GetString("federation.successRedirect"); redirect != "" {
+		fragment := url.Values{
+			"session_id": {res.SessionID},
+			"expires_at": {res.AccessTokenTTL.Format(time.RFC3339)},
+		}
+
+		// In cookie mode the tokens never reach the frontend
+		if cookieMode() {
+			if _, err := setSessionCookies(w, res.AccessToken, res.RefreshToken, res.RefreshTokenTTL); err != nil {
+				h.sendExternalError(w, r, "error creating csrf token", http.StatusInternalServerError)
+				return
+			}
+		} else {
+			fragment.Set("access_token", res.AccessToken)
+			fragment.Set("refresh_token", res.RefreshToken)
+		}
+
+		http.Redirect(w, r, redirect+"#"+fragment.Encode(), http.StatusFound)
+		return
+	}
+
+	h.sendSession(w, res)
+}
+
+// sendExternalError hands callback errors to the frontend when it is configured
+func (h *Handler) sendExternalError(w http.ResponseWriter, r *http.Request, message string, status int) {
+	if redirect := viper.GetString("federation.successRedirect"); redirect != "" {
+		http.Redirect(w, r, redirect+"#"+url.Values{"error": {message}}.Encode(), http.StatusFound)
+		return
+	}
+
+	h.sendError(w, message, status)
+}
+
+// linkIdentity links identity to userID and returns the status to report on failure
+func (h *Handler) linkIdentity(userID int, p *federation.Provider, identity *federation.Identity) (int, error) {
+	linked, err := h.db.GetLinkedIdentity(h.ctx, p.Name, identity.Subject)
+	if err == nil {
+		if linked.UserID != userID {
+			return http.StatusConflict, errors.New("identity is linked to another account")
+		}
+
+		return http.StatusOK, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return http.StatusInternalServerError, errors.New("error linking identity")
+	}
+
+	identities, err := h.db.ListLinkedIdentities(h.ctx, userID)
+	if err != nil {
+		return http.StatusInternalServerError, errors.New("error linking identity")
+	}
+
+	if slices.ContainsFunc(identities, func(i *db.LinkedIdentity) bool { return i.Provider == p.Name }) {
+		return http.StatusConflict, fmt.Errorf("another %s identity is already linked", p.Name)
+	}
+
+	_, err = h.db.CreateLinkedIdentity(h.ctx, &db.LinkedIdentity{
+		UserID:   userID,
+		Provider: p.Name,
+		Subject:  identity.Subject,
+		Username: identity.Username,
+		Email:    identity.Email,
+	})
+	if err != nil {
+		return http.StatusInternalServerError, errors.New("error linking identity")
+	}
+
+	return http.StatusOK, nil
+}
+
+// api/user/identities
+// @Summary Linked Identities
+// @Tags user, federation
+// @Description List the upstream identities linked to the user
+// @ID user-identities-list
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {array} LinkedIdentityRes
+// @Failure 401,403,500 {object} ErrorRes
+// @Router /api/user/identities [get]
+func (h *Handler) listIdentities(w http.ResponseWriter, r *http.Request) {
+
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
+
+	identities, err := h.db.ListLinkedIdentities(h.ctx, claims.ID)
+	if err != nil {
+		h.sendError(w, "error getting identities", http.StatusInternalServerError)
+		return
+	}
+
+	res := make([]LinkedIdentityRes, 0, len(identities))
+	for _, i := range identities {
+		res = append(res, LinkedIdentityRes{
+			Provider:    i.Provider,
+			Subject:     i.Subject,
+			Username:    i.Username,
+			Email:       i.Email,
+			LastLoginAt: i.LastLoginAt,
+			CreatedAt:   i.CreatedAt,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// api/user/identities/{provider}
+// @Summary Link Identity
+// @Tags user, federation
+// @Description Start linking an upstream identity. The browser must be sent to the returned URL and carry the state cookie set by this response.
+// @ID user-identities-link
+// @Security BearerAuth
+// @Param provider path string true "Provider name"
+// @Produce json
+// @Success 200 {object} LinkIdentityRes
+// @Failure 401,403,404,500 {object} ErrorRes
+// @Router /api/user/identities/{provider} [post]
+func (h *Handler) linkIdentityStart(w http.ResponseWriter, r *http.Request) {
+
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
+
+	p, ok := h.externalProvider(r)
+	if !ok {
+		h.sendError(w, "unknown identity provider", http.StatusNotFound)
+		return
+	}
+
+	authURL, err := h.startExternalLogin(w, p, &claims.ID)
+	if err != nil {
+		h.sendError(w, "error starting external login", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(LinkIdentityRes{authURL})
+}
+
+// api/user/identities/{provider}
+// @Summary Unlink Identity
+// @Tags user, federation
+// @Description Unlink an upstream identity. Users without a password can't unlink their last identity.
+// @ID user-identities-unlink
+// @Security BearerAuth
+// @Param provider path string true "Provider name"
+// @Produce json
+// @Success 200 {object} SuccessRes
+// @Failure 400,401,403,404,500 {object} ErrorRes
+// @Router /api/user/identities/{provider} [delete]
+func (h *Handler) unlinkIdentity(w http.ResponseWriter, r *http.Request) {
+
+	u, err := h.currentUser(r)
+	if err != nil {
+		h.sendError(w, "error getting user", http.StatusInternalServerError)
+		return
+	}
+
+	provider := chi.URLParam(r, "provider")
+
+	if u.Password == "" {
+		identities, err := h.db.ListLinkedIdentities(h.ctx, u.ID)
+		if err != nil {
+			h.sendError(w, "error getting identities", http.StatusInternalServerError)
+			return
+		}
+
+		if len(identities) == 1 && identities[0].Provider == provider {
+			h.sendError(w, "can't unlink the only way to sign in", http.StatusBadRequest)
+			return
+		}
+	}
+
+	found, err := h.db.DeleteLinkedIdentity(h.ctx, u.ID, provider)
+	if err != nil {
+		h.sendError(w, "error unlinking identity", http.StatusInternalServerError)
+		return
+	}
+
+	if !found {
+		h.sendError(w, "identity not found", http.StatusNotFound)
+		return
+	}
+
+	h.sendSuccess(w, "identity unlinked", http.StatusOK)
+}
@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/arrogantworm/jwt_auth/api/events"
+	"github.com/arrogantworm/jwt_auth/api/geoip"
+	"github.com/arrogantworm/jwt_auth/api/mail"
+	"github.com/arrogantworm/jwt_auth/db"
+)
+
+var errImpossibleTravel = errors.New("session was used from too far away in too little time, sign in again")
+
+// locate returns where r comes from, or nil without GeoIP
+func (h *Handler) locate(r *http.Request) *geoip.Location {
+	return h.geoip.Lookup(remoteIP(r))
+}
+
+func toSessionLocation(loc *geoip.Location) db.SessionLocation {
+	if loc == nil {
+		return db.SessionLocation{}
+	}
+
+	return db.SessionLocation{
+		Country:        loc.Country,
+		City:           loc.City,
+		ASN:            loc.ASN,
+		ASOrg:          loc.ASOrg,
+		Latitude:       loc.Latitude,
+		Longitude:      loc.Longitude,
+		AccuracyRadius: loc.AccuracyRadius,
+	}
+}
+
+func toLocation(l db.SessionLocation) *geoip.Location {
+	if l == (db.SessionLocation{}) {
+		return nil
+	}
+
+	return &geoip.Location{
+		Country:        l.Country,
+		City:           l.City,
+		ASN:            l.ASN,
+		ASOrg:          l.ASOrg,
+		Latitude:       l.Latitude,
+		Longitude:      l.Longitude,
+		AccuracyRadius: l.AccuracyRadius,
+	}
+}
+
+// placeName is how a location is shown to people, e.g. "Berlin, DE"
+func placeName(loc *geoip.Location, ip string) string {
+	switch {
+	case loc == nil || loc.Country == "":
+		return ip
+	case loc.City == "":
+		return loc.Country
+	default:
+		return loc.City + ", " + loc.Country
+	}
+}
+
+// checkTravel looks for impossible travel between the last use of s and its
+// renewal by r from loc. It returns the event to record with the renewal, nil
+// when there was nothing to flag, and false when the session was ended
+// instead and the caller has been answered.
+func (h *Handler) checkTravel(w http.ResponseWriter, r *http.Request, s *db.Session, u *db.User, loc *geoip.Location) (*db.OutboxEvent, bool) {
+	lastUsed := s.CreatedAt
+	if s.UpdatedAt != nil {
+		lastUsed = *s.UpdatedAt
+	}
+
+	previous := toLocation(s.Location)
+
+	travel, impossible := h.geoip.ImpossibleTravel(previous, lastUsed, loc, time.Now())
+	if !impossible {
+		return nil, true
+	}
+
+	action := h.geoip.TravelAction()
+	log.Println("[IMPOSSIBLE TRAVEL]", s.UserID, s.IPAddress, " -- ", remoteIP(r), int(travel.SpeedKmh), "km/h", action)
+
+	data := events.ImpossibleTravel{
+		PreviousIP:       s.IPAddress,
+		PreviousLocation: previous,
+		Location:         loc,
+		DistanceKm:       math.Round(travel.DistanceKm),
+		ElapsedSeconds:   math.Round(travel.Elapsed.Seconds()),
+		SpeedKmh:         math.Round(travel.SpeedKmh),
+		Action:           action,
+	}
+
+	flagged, err := h.stageEvent(r, events.TypeImpossibleTravel, s.UserID, s.SessionID, data)
+	if err != nil {
+		h.sendError(w, "error updating session", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	h.sendTravelAlert(r, u, s, loc, action)
+
+	switch action {
+	case geoip.ActionReauth:
+		h.sendError(w, errImpossibleTravel.Error(), http.StatusUnauthorized)
+		h.endSession(r, s, events.ReasonImpossibleTravel, flagged)
+		return nil, false
+	case geoip.ActionRevoke:
+		revoked, err := h.stageEvent(r, events.TypeUserSessionsRevoked, s.UserID, "", events.UserSessionsRevoked{Reason: events.ReasonImpossibleTravel})
+		if err != nil {
+			h.sendError(w, "error revoking sessions", http.StatusInternalServerError)
+			return nil, false
+		}
+
+		if _, err := h.db.RevokeUserSessions(h.ctx, s.UserID, "", revoked, flagged); err != nil {
+			h.sendError(w, "error revoking sessions", http.StatusInternalServerError)
+			return nil, false
+		}
+
+		h.sendError(w, errImpossibleTravel.Error(), http.StatusUnauthorized)
+		return nil, false
+	}
+
+	return flagged, true
+}
+
+// sendTravelAlert emails u about the impossible travel of s, unless u has no
+// email address. Failures are only logged.
+func (h *Handler) sendTravelAlert(r *http.Request, u *db.User, s *db.Session, loc *geoip.Location, action string) {
+	if u.Email == nil {
+		return
+	}
+
+	var outcome string
+	switch action {
+	case geoip.ActionReauth:
+		outcome = "The device has been signed out and has to sign in again. If it wasn't you, change your password."
+	case geoip.ActionRevoke:
+		outcome = "Every device has been signed out. If it wasn't you, change your password."
+	default:
+		outcome = "If it was you, for example through a VPN, there is nothing to do. If it wasn't, sign out of every device and change your password."
+	}
+
+	msg := mail.Message{
+		To:      *u.Email,
+		Subject: "Unusual sign-in location",
+		Text: fmt.Sprintf("Hi %s,\n\nYour account was just used from %s, shortly after being used from %s. The two are farther apart than anyone could travel in between:\n\n"+
+			"Time: %s\nDevice: %s\nIP address: %s\n\n%s\n",
+			u.Name, placeName(loc, remoteIP(r)), placeName(toLocation(s.Location), s.IPAddress),
+			time.Now().UTC().Format(time.RFC1123), describeDevice(r.UserAgent()), remoteIP(r), outcome),
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		if err := h.mailer.Send(ctx, msg); err != nil {
+			log.Println("[MAIL]", err)
+		}
+	}()
+}
@@ -5,20 +5,48 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/arrogantworm/jwt_auth/api/audit"
+	"github.com/arrogantworm/jwt_auth/api/authn"
+	"github.com/arrogantworm/jwt_auth/api/binding"
+	"github.com/arrogantworm/jwt_auth/api/events"
+	"github.com/arrogantworm/jwt_auth/api/federation"
+	"github.com/arrogantworm/jwt_auth/api/geoip"
+	"github.com/arrogantworm/jwt_auth/api/mail"
+	"github.com/arrogantworm/jwt_auth/api/outbox"
+	"github.com/arrogantworm/jwt_auth/api/risk"
+	"github.com/arrogantworm/jwt_auth/api/sms"
 	"github.com/arrogantworm/jwt_auth/api/token"
 	"github.com/arrogantworm/jwt_auth/api/utils"
 	"github.com/arrogantworm/jwt_auth/db"
+	"github.com/jackc/pgx/v5"
+	"github.com/spf13/viper"
 )
 
 type Handler struct {
 	ctx        context.Context
 	db         *db.Postgres
 	TokenMaker *token.JWTMaker
+	issuer     string
+	signer     *token.RSASigner
+	providers  map[string]*federation.Provider
+	saml       *federation.SAMLProvider
+
+	authenticator authn.Authenticator
+	mailer        mail.Sender
+	sms           sms.Sender
+	outbox        *outbox.Dispatcher
+	events        events.Publisher
+	checkpointer  *audit.Checkpointer
+	geoip         *geoip.Resolver
+	risk          *risk.Engine
+	binding       *binding.Policy
 }
 
 func NewHandler(db *db.Postgres, secretKey string) (*Handler, error) {
@@ -27,10 +55,98 @@ func NewHandler(db *db.Postgres, secretKey string) (*Handler, error) {
 		return nil, errors.New("secret key not found")
 	}
 
+	signingKeyFile := viper.GetString("oidc.signingKeyFile")
+	if signingKeyFile == "" {
+		log.Println("oidc.signingKeyFile is not set, using an ephemeral signing key")
+	}
+
+	signer, err := token.NewRSASigner(signingKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	providers, err := federation.LoadProviders()
+	if err != nil {
+		return nil, err
+	}
+
+	samlProvider, err := federation.LoadSAMLProvider(strings.TrimSuffix(viper.GetString("oauth.issuer"), "/"))
+	if err != nil {
+		return nil, err
+	}
+	if samlProvider != nil && samlProvider.Ephemeral {
+		log.Println("saml.keyFile is not set, using an ephemeral SAML key pair")
+	}
+
+	authenticator, err := authn.New(db)
+	if err != nil {
+		return nil, err
+	}
+
+	mailer, err := mail.New()
+	if err != nil {
+		return nil, err
+	}
+
+	smsSender, err := sms.New()
+	if err != nil {
+		return nil, err
+	}
+
+	sinks, err := newOutboxSinks(db)
+	if err != nil {
+		return nil, err
+	}
+
+	dispatcher, err := outbox.New(db, sinks)
+	if err != nil {
+		return nil, err
+	}
+
+	// Checkpoints signed with an ephemeral key could never be verified
+	var checkpointer *audit.Checkpointer
+	if signingKeyFile != "" {
+		checkpointer, err = audit.NewCheckpointer(db, signer)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		log.Println("oidc.signingKeyFile is not set, audit log checkpoints are not signed")
+	}
+
+	resolver, err := geoip.New()
+	if err != nil {
+		return nil, err
+	}
+
+	riskEngine, err := risk.New(db)
+	if err != nil {
+		return nil, err
+	}
+
+	bindingPolicy, err := binding.New()
+	if err != nil {
+		return nil, err
+	}
+
 	return &Handler{
 		ctx:        context.Background(),
 		db:         db,
 		TokenMaker: token.NewJWTMaker(secretKey),
+		issuer:     strings.TrimSuffix(viper.GetString("oauth.issuer"), "/"),
+		signer:     signer,
+		providers:  providers,
+		saml:       samlProvider,
+
+		authenticator: authenticator,
+		mailer:        mailer,
+		sms:           smsSender,
+		outbox:        dispatcher,
+		events:        outbox.NewPublisher(db),
+		checkpointer:  checkpointer,
+		geoip:         resolver,
+		risk:          riskEngine,
+		binding:       bindingPolicy,
 	}, nil
 }
 
@@ -75,15 +191,23 @@ func (h *Handler) testHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // new-ip/
+// Example subscriber for session.ip_changed webhooks
 func (h *Handler) newIpReciever(w http.ResponseWriter, r *http.Request) {
-	var req utils.NewIpNotification
+	var e events.Event
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		h.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var data events.SessionIPChanged
+
+	if err := json.Unmarshal(e.Data, &data); err != nil {
 		h.sendError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	log.Printf("Received IP Change for user %d\nOldIP: %s\nNewIP: %s", req.UserID, req.OldIp, req.NewIp)
+	log.Printf("Received IP Change for user %d\nOldIP: %s\nNewIP: %s", e.UserID, data.PreviousIP, e.IP)
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte{})
@@ -95,15 +219,14 @@ func (h *Handler) newIpReciever(w http.ResponseWriter, r *http.Request) {
 // @Description Get user info
 // @ID user-info
 // @Security BearerAuth
+// @Security ApiKeyAuth
 // @Produce json
 // @Success 200 {object} UserRes
 // @Failure 401,500 {object} ErrorRes
 // @Router /api/user [get]
 func (h *Handler) getUserInfo(w http.ResponseWriter, r *http.Request) {
 
-	claims := r.Context().Value(authKey{}).(*token.UserClaims)
-
-	u, err := h.db.GetUserById(h.ctx, claims.ID)
+	u, err := h.currentUser(r)
 
 	if err != nil {
 		h.sendError(w, "error getting user", http.StatusInternalServerError)
@@ -116,6 +239,76 @@ func (h *Handler) getUserInfo(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// currentUser loads the user the request was authenticated as
+func (h *Handler) currentUser(r *http.Request) (*db.User, error) {
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
+
+	return h.db.GetUserById(h.ctx, claims.ID)
+}
+
+// api/user/password
+// @Summary Change password
+// @Tags user
+// @Description Change the caller's password. Every other session of the user is revoked.
+// @ID user-password
+// @Security BearerAuth
+// @Accept json
+// @Param input body ChangePasswordReq true "Current and new password"
+// @Produce json
+// @Success 200 {object} SuccessRes
+// @Failure 400,401,403,409,500 {object} ErrorRes
+// @Router /api/user/password [put]
+func (h *Handler) changePassword(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
+
+	var req ChangePasswordReq
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendError(w, "", http.StatusBadRequest)
+		return
+	}
+
+	if req.CurrentPassword == "" || req.NewPassword == "" {
+		h.sendError(w, "all fields are required", http.StatusBadRequest)
+		return
+	}
+
+	u, err := h.db.GetUserById(h.ctx, claims.ID)
+	if err != nil {
+		h.sendError(w, "error getting user", http.StatusInternalServerError)
+		return
+	}
+
+	if u.AuthSource == db.AuthSourceLDAP {
+		h.sendError(w, "password is managed by the directory", http.StatusConflict)
+		return
+	}
+
+	if err := utils.CheckPassword(req.CurrentPassword, u.Password); err != nil {
+		h.sendError(w, authn.ErrWrongPassword.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	hashed, err := utils.HashPassword(req.NewPassword)
+	if err != nil {
+		h.sendError(w, "error hashing password", http.StatusInternalServerError)
+		return
+	}
+
+	changed, err := h.stageEvent(r, events.TypePasswordChanged, u.ID, claims.RegisteredClaims.ID, events.PasswordChanged{OtherSessionsRevoked: true})
+	if err != nil {
+		h.sendError(w, "error changing password", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.db.ChangePassword(h.ctx, u.ID, hashed, claims.RegisteredClaims.ID, changed); err != nil {
+		h.sendError(w, "error changing password", http.StatusInternalServerError)
+		return
+	}
+
+	h.sendSuccess(w, "password changed", http.StatusOK)
+}
+
 // auth/signup
 // @Summary SignUp
 // @Tags auth
@@ -177,23 +370,29 @@ func toDBUser(u UserReq) *db.User {
 }
 
 func toUserRes(u *db.User) UserRes {
-	return UserRes{
+	res := UserRes{
 		Id:       u.ID,
 		Name:     u.Name,
 		Username: u.Username,
 	}
+	if u.Phone != nil {
+		res.Phone = *u.Phone
+	}
+
+	return res
 }
 
 // auth/signin
 // @Summary SignIn
 // @Tags auth
-// @Description Login
+// @Description Login. In cookie mode the tokens are set as HttpOnly cookies instead of being returned. With newDeviceAlerts.enabled the device is recognized by the device_id cookie, or the X-Device-ID header of clients without cookies, and signins from a new device are emailed about. With risk.enabled a signin scoring above risk.thresholds.reauth is refused with 401, and has to be made with an emailed link or phone code instead, and one above risk.thresholds.deny with 403.
 // @ID auth-signin
 // @Accept json
 // @Param input body LoginUserReq true "Credentials"
+// @Param X-Device-ID header string false "ID the client keeps for itself"
 // @Produce json
 // @Success 200 {object} LoginUserRes
-// @Failure 400,401,500 {object} ErrorRes
+// @Failure 400,401,403,500 {object} ErrorRes
 // @Router /auth/signin [post]
 func (h *Handler) loginUser(w http.ResponseWriter, r *http.Request) {
 	var u LoginUserReq
@@ -208,109 +407,209 @@ func (h *Handler) loginUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if user exists
-	gu, err := h.db.GetUserByUsername(h.ctx, u.Username)
+	gu, err := h.authenticator.Authenticate(h.ctx, u.Username, u.Password)
+	if errors.Is(err, authn.ErrWrongPassword) {
+		h.loginFailed(r, events.MethodPassword, u.Username, events.ReasonWrongPassword)
+		h.sendError(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if errors.Is(err, authn.ErrUserDisabled) {
+		h.loginFailed(r, events.MethodPassword, u.Username, events.ReasonUserDisabled)
+		h.sendError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	// Set after a signin was reported by the user, the password may be known to someone else
+	if errors.Is(err, authn.ErrPasswordResetRequired) {
+		h.loginFailed(r, events.MethodPassword, u.Username, events.ReasonPasswordResetRequired)
+		h.sendError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		h.loginFailed(r, events.MethodPassword, u.Username, events.ReasonUnknownUser)
+	}
 	if err != nil {
 		h.sendError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Check is password is valid
+	switch h.assessRisk(r, risk.KindSignin, gu.ID, "", h.locate(r)).Decision {
+	case risk.DecisionReauth:
+		h.loginFailed(r, events.MethodPassword, u.Username, events.ReasonRiskReauth)
+		h.sendError(w, errRiskReauth.Error(), http.StatusUnauthorized)
+		return
+	case risk.DecisionDeny:
+		h.loginFailed(r, events.MethodPassword, u.Username, events.ReasonRiskDenied)
+		h.sendError(w, errRiskDenied.Error(), http.StatusForbidden)
+		return
+	}
 
-	err = utils.CheckPassword(u.Password, gu.Password)
+	res, err := h.newSession(r, gu, events.LoginSucceeded{Method: events.MethodPassword}, "")
 	if err != nil {
-		h.sendError(w, "wrong password", http.StatusUnauthorized)
+		h.sendError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	h.recognizeDevice(w, r, gu, res.SessionID)
+
+	h.sendSession(w, res)
+}
+
+// newSession issues an access and refresh token pair for u and records the
+// session backing them. login.ClientID is empty for first-party signins.
+func (h *Handler) newSession(r *http.Request, u *db.User, login events.LoginSucceeded, scope string) (*LoginUserRes, error) {
+	return h.createSession(r, u, login, scope, h.db.CreateOrUpdateSession)
+}
+
+// sessionSaver stores a new session together with its events
+type sessionSaver func(ctx context.Context, s *db.Session, events ...*db.OutboxEvent) (*db.Session, error)
+
+// createSession is newSession with the session stored by save, so that
+// grants can tie other writes to the same transaction. db.ErrDeviceCodeUsed
+// is passed through.
+func (h *Handler) createSession(r *http.Request, u *db.User, login events.LoginSucceeded, scope string, save sessionSaver) (*LoginUserRes, error) {
+	if !u.Active {
+		return nil, authn.ErrUserDisabled
+	}
+
 	userAgent := r.UserAgent()
 	if userAgent == "" {
 		userAgent = "unknown"
 	}
 
-	userIP, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		userIP = r.RemoteAddr
-	}
-
-	accessToken, accessClaims, err := h.TokenMaker.CreateAccessToken(gu.ID, gu.Username)
+	userIP := remoteIP(r)
+	loc := h.locate(r)
+	login.Location = loc
 
+	accessToken, accessClaims, err := h.accessToken(u, login.ClientID, scope)
 	if err != nil {
-		h.sendError(w, "error creating token", http.StatusInternalServerError)
-		return
+		return nil, errors.New("error creating token")
 	}
 
-	// refreshToken, refreshClaims, err := h.TokenMaker.CreateToken(gu.ID, gu.Username)
 	refreshToken, err := h.TokenMaker.CreateRefreshToken()
-
 	if err != nil {
-		h.sendError(w, "error creating token", http.StatusInternalServerError)
-		return
+		return nil, errors.New("error creating token")
 	}
 
 	hashedRefreshToken, err := utils.HashRefreshToken(refreshToken)
 	if err != nil {
-		h.sendError(w, fmt.Sprintf("error encrypting refresh token: %v", err), http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("error encrypting refresh token: %v", err)
 	}
 
 	refreshTTL := time.Now().Add(h.TokenMaker.RefreshTokenTTL)
+	refreshLookup := utils.SHA256Hex(refreshToken)
+
+	session := &db.Session{
+		SessionID:     accessClaims.RegisteredClaims.ID,
+		UserID:        u.ID,
+		RefreshToken:  hashedRefreshToken,
+		UserAgent:     userAgent,
+		IPAddress:     userIP,
+		ExpiresAt:     refreshTTL,
+		Scope:         scope,
+		RefreshLookup: &refreshLookup,
+		Location:      toSessionLocation(loc),
+	}
+	if login.ClientID != "" {
+		session.ClientID = &login.ClientID
+	}
+
+	created, err := h.stageEvent(r, events.TypeSessionCreated, u.ID, session.SessionID, events.SessionCreated{
+		ClientID:  login.ClientID,
+		Scope:     scope,
+		ExpiresAt: refreshTTL,
+		Location:  loc,
+	})
+	if err != nil {
+		return nil, errors.New("error saving session")
+	}
 
-	// Create Session
+	succeeded, err := h.stageEvent(r, events.TypeLoginSucceeded, u.ID, session.SessionID, login)
+	if err != nil {
+		return nil, errors.New("error saving session")
+	}
 
-	s, err := h.db.CreateOrUpdateSession(h.ctx, &db.Session{
-		SessionID:    accessClaims.RegisteredClaims.ID,
-		UserID:       gu.ID,
-		RefreshToken: hashedRefreshToken,
-		UserAgent:    userAgent,
-		IPAddress:    userIP,
-		ExpiresAt:    refreshTTL,
-	})
+	s, err := save(h.ctx, session, created, succeeded)
+	if errors.Is(err, db.ErrDeviceCodeUsed) {
+		return nil, err
+	}
 	if err != nil {
-		h.sendError(w, "error saving session", http.StatusInternalServerError)
-		return
+		return nil, errors.New("error saving session")
 	}
 
-	res := LoginUserRes{
+	return &LoginUserRes{
 		SessionID:       s.SessionID,
 		AccessToken:     accessToken,
 		AccessTokenTTL:  accessClaims.ExpiresAt.Time,
 		RefreshToken:    refreshToken,
 		RefreshTokenTTL: refreshTTL,
-		User:            toUserRes(gu),
+		User:            toUserRes(u),
+	}, nil
+}
+
+// accessToken issues a first-party token for sessions without a client, and
+// one limited to scope for sessions of clientID
+func (h *Handler) accessToken(u *db.User, clientID string, scope string) (string, *token.UserClaims, error) {
+	if clientID == "" {
+		return h.TokenMaker.CreateAccessToken(u.ID, u.Username)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(res)
+	return h.TokenMaker.CreateScopedAccessToken(u.ID, u.Username, scope)
+}
+
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return ip
 }
 
 // auth/logout
 // @Summary LogOut
 // @Tags auth
-// @Description Logout
+// @Description Logout. The session is identified by the refresh token when the body has one, so an expired or lost access token doesn't prevent it.
 // @ID auth-logout
 // @Security BearerAuth
+// @Accept json
+// @Param input body RefreshTokenReq false "Refresh token, instead of the Authorization header"
 // @Produce json
 // @Success 200 {object} SuccessRes
-// @Failure 401,500 {object} ErrorRes
+// @Failure 400,401,500 {object} ErrorRes
 // @Router /auth/logout [post]
 func (h *Handler) logoutUser(w http.ResponseWriter, r *http.Request) {
 
-	claims := r.Context().Value(authKey{}).(*token.UserClaims)
-
-	if err := h.db.DeleteSession(h.ctx, claims.RegisteredClaims.ID); err != nil {
-		h.sendError(w, "error revoking a session", http.StatusInternalServerError)
+	s, status, err := h.sessionToEnd(r)
+	if err != nil {
+		h.sendError(w, err.Error(), status)
 		return
 	}
 
+	// A nil session has already ended, so there is nothing to revoke or announce
+	if s != nil {
+		loggedOut, err := h.stageEvent(r, events.TypeSessionRevoked, s.UserID, s.SessionID, events.SessionRevoked{Reason: events.ReasonLogout})
+		if err != nil {
+			h.sendError(w, "error revoking a session", http.StatusInternalServerError)
+			return
+		}
+
+		if err := h.db.DeleteSession(h.ctx, s.SessionID, loggedOut); err != nil {
+			h.sendError(w, "error revoking a session", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if cookieMode() {
+		clearSessionCookies(w)
+	}
+
 	h.sendSuccess(w, "logged out", http.StatusOK)
 }
 
 // auth/tokens/renew
 // @Summary Renew JWT Token
 // @Tags auth, tokens
-// @Description Renew JWT Token
+// @Description Renew JWT Token. The Authorization header with the old access token is optional, without it the session is looked up by the refresh token alone. In cookie mode the tokens are read from and written to cookies, and the X-CSRF-Token header has to match the csrf_token cookie. With geoip.impossibleTravel enabled, a renewal from farther away than could have been travelled since the last one is flagged, and refused unless the action is notify. A renewal from another IP address, subnet, network or browser than the session was last used from is handled as set in binding: notify records it, step-up refuses the renewal, revoke ends the session. With risk.enabled a renewal scoring above risk.thresholds.reauth ends the session, and one above risk.thresholds.deny every session of the user.
 // @ID auth-renew
 // @Security BearerAuth
 // @Accept json
@@ -321,56 +620,81 @@ func (h *Handler) logoutUser(w http.ResponseWriter, r *http.Request) {
 // @Router /auth/tokens/renew [post]
 func (h *Handler) renewAccessToken(w http.ResponseWriter, r *http.Request) {
 
-	claims := r.Context().Value(authKey{}).(*token.UserClaims)
-
 	var req RenewAccessTokenReq
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	// Cookie clients may send no body at all
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !(cookieMode() && errors.Is(err, io.EOF)) {
 		h.sendError(w, "", http.StatusBadRequest)
 		return
 	}
 
+	if req.RefreshToken == "" {
+		refreshToken, err := refreshTokenFromCookie(r)
+		if err != nil {
+			h.sendError(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		req.RefreshToken = refreshToken
+	}
+
 	// refreshClaims, err := h.TokenMaker.VerifyToken(req.RefreshToken)
 	// if err != nil {
 	// 	http.Error(w, "error verifying token", http.StatusUnauthorized)
 	// 	return
 	// }
 
-	s, err := h.db.GetSession(h.ctx, claims.RegisteredClaims.ID)
-	if err != nil {
-		h.sendError(w, "error getting session", http.StatusInternalServerError)
-		return
-	}
-
-	// Check refresh token
-	if err := utils.CheckRefreshToken(req.RefreshToken, s.RefreshToken); err != nil {
-		h.sendError(w, "refresh token does not match", http.StatusUnauthorized)
-		return
+	var s *db.Session
+
+	if r.Header.Get("Authorization") != "" {
+		claims, err := verifyClaimsFromAuthHeaderNoExp(r, h.TokenMaker)
+		if err != nil {
+			h.sendError(w, fmt.Sprintf("error verifying token: %v", err), http.StatusUnauthorized)
+			return
+		}
+
+		s, err = h.db.GetSession(h.ctx, claims.RegisteredClaims.ID)
+		if err != nil {
+			h.sendError(w, "error getting session", http.StatusInternalServerError)
+			return
+		}
+
+		// Check refresh token
+		if err := utils.CheckRefreshToken(req.RefreshToken, s.RefreshToken); err != nil {
+			h.sendError(w, "refresh token does not match", http.StatusUnauthorized)
+			return
+		}
+
+		if s.UserID != claims.ID {
+			h.sendError(w, "invalid session", http.StatusUnauthorized)
+			return
+		}
+	} else {
+		s = h.sessionByRefreshToken(req.RefreshToken)
+		if s == nil {
+			h.sendError(w, "refresh token does not match", http.StatusUnauthorized)
+			return
+		}
 	}
 
 	// Check refresh token TTL
 	if time.Now().After(s.ExpiresAt) {
 		h.sendError(w, "refresh token expired", http.StatusUnauthorized)
-		h.db.DeleteSession(h.ctx, claims.RegisteredClaims.ID)
+		h.endSession(r, s, events.ReasonExpired)
 		return
 	}
 
-	// UserAgent check
-	if r.UserAgent() != s.UserAgent {
-		h.sendError(w, "user agent does not match", http.StatusUnauthorized)
-		h.db.DeleteSession(h.ctx, claims.RegisteredClaims.ID)
-		return
-	}
+	userIP := remoteIP(r)
+	loc := h.locate(r)
 
-	// IP check
-	userIP, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		userIP = r.RemoteAddr
+	userAgent := r.UserAgent()
+	if userAgent == "" {
+		userAgent = "unknown"
 	}
 
-	if userIP != s.IPAddress {
-		log.Println("[IP NOT MATCH]", s.UserID, s.IPAddress, " -- ", userIP)
-		go utils.ChangedIPRequest(utils.NewIpNotification{UserID: s.UserID, NewIp: userIP, OldIp: s.IPAddress})
+	// IP, network and user agent checks
+	mismatched, ok := h.checkBinding(w, r, s, userAgent, loc)
+	if !ok {
+		return
 	}
 
 	if s.IsRevoked {
@@ -378,23 +702,32 @@ func (h *Handler) renewAccessToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if s.UserID != claims.ID {
-		h.sendError(w, "invalid session", http.StatusUnauthorized)
+	u, err := h.db.GetUserById(h.ctx, s.UserID)
+	if err != nil {
+		h.sendError(w, "error getting user", http.StatusInternalServerError)
 		return
 	}
 
-	// u, err := h.db.GetUserByUsername(h.ctx, refreshClaims.Subject)
-	// if err != nil {
-	// 	http.Error(w, "error getting user", http.StatusInternalServerError)
-	// 	return
-	// }
+	if !u.Active {
+		h.sendError(w, authn.ErrUserDisabled.Error(), http.StatusForbidden)
+		return
+	}
+
+	flagged, ok := h.checkTravel(w, r, s, u, loc)
+	if !ok {
+		return
+	}
 
-	u := db.User{
-		ID:       claims.ID,
-		Username: claims.Subject,
+	if !h.checkRenewalRisk(w, r, s, loc) {
+		return
+	}
+
+	var clientID string
+	if s.ClientID != nil {
+		clientID = *s.ClientID
 	}
 
-	accessToken, accessClaims, err := h.TokenMaker.CreateAccessToken(u.ID, u.Username)
+	accessToken, accessClaims, err := h.accessToken(u, clientID, s.Scope)
 	if err != nil {
 		h.sendError(w, "error creating accessToken", http.StatusInternalServerError)
 		return
@@ -422,7 +755,17 @@ func (h *Handler) renewAccessToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.db.RenewAccessToken(h.ctx, accessClaims.RegisteredClaims.ID, claims.RegisteredClaims.ID, hashedRefreshToken, userIP); err != nil {
+	renewed, err := h.renewEvents(r, s, accessClaims.RegisteredClaims.ID, loc)
+	if err != nil {
+		h.sendError(w, "error updating session", http.StatusInternalServerError)
+		return
+	}
+	renewed = append(renewed, mismatched...)
+	if flagged != nil {
+		renewed = append(renewed, flagged)
+	}
+
+	if err := h.db.RenewAccessToken(h.ctx, accessClaims.RegisteredClaims.ID, s.SessionID, hashedRefreshToken, utils.SHA256Hex(refreshToken), userIP, userAgent, toSessionLocation(loc), renewed...); err != nil {
 		h.sendError(w, "error updating session", http.StatusInternalServerError)
 		return
 	}
@@ -434,7 +777,20 @@ func (h *Handler) renewAccessToken(w http.ResponseWriter, r *http.Request) {
 		RefreshTokenTTL: refreshedTTL,
 	}
 
+	if cookieMode() {
+		csrfToken, err := setSessionCookies(w, accessToken, refreshToken, refreshedTTL)
+		if err != nil {
+			h.sendError(w, "error creating csrf token", http.StatusInternalServerError)
+			return
+		}
+
+		res.AccessToken = ""
+		res.RefreshToken = ""
+		res.CSRFToken = csrfToken
+	}
+
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(res)
 }
@@ -442,21 +798,84 @@ func (h *Handler) renewAccessToken(w http.ResponseWriter, r *http.Request) {
 // auth/tokens/revoke
 // @Summary Revoke JWT Token
 // @Tags auth, tokens
-// @Description Revoke JWT Token
+// @Description Revoke JWT Token. The session is identified by the refresh token when the body has one, or in cookie mode by the refresh token cookie.
 // @ID auth-revoke
 // @Security BearerAuth
+// @Accept json
+// @Param input body RefreshTokenReq false "Refresh token, instead of the Authorization header"
 // @Produce json
 // @Success 200 {object} SuccessRes
-// @Failure 401,500 {object} ErrorRes
+// @Failure 400,401,500 {object} ErrorRes
 // @Router /auth/tokens/revoke [post]
 func (h *Handler) revokeSession(w http.ResponseWriter, r *http.Request) {
 
-	claims := r.Context().Value(authKey{}).(*token.UserClaims)
-
-	if err := h.db.RevokeSession(h.ctx, claims.RegisteredClaims.ID); err != nil {
-		h.sendError(w, "error revoking session", http.StatusInternalServerError)
+	s, status, err := h.sessionToEnd(r)
+	if err != nil {
+		h.sendError(w, err.Error(), status)
 		return
 	}
 
+	// A nil session has already ended, so there is nothing to revoke or announce
+	if s != nil {
+		revoked, err := h.stageEvent(r, events.TypeSessionRevoked, s.UserID, s.SessionID, events.SessionRevoked{Reason: events.ReasonRevoked})
+		if err != nil {
+			h.sendError(w, "error revoking session", http.StatusInternalServerError)
+			return
+		}
+
+		if err := h.db.RevokeSession(h.ctx, s.SessionID, revoked); err != nil {
+			h.sendError(w, "error revoking session", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if cookieMode() {
+		clearSessionCookies(w)
+	}
+
 	h.sendSuccess(w, "session revoked", http.StatusOK)
 }
+
+// sessionToEnd returns the session a logout or revoke request is about. A
+// refresh token in the body, or the refresh token cookie, is enough on its own;
+// without one the access token identifies the session as before. The session is
+// nil when the access token's session has already ended.
+func (h *Handler) sessionToEnd(r *http.Request) (*db.Session, int, error) {
+	var req RefreshTokenReq
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		return nil, http.StatusBadRequest, errors.New("malformed body")
+	}
+
+	if req.RefreshToken == "" && r.Header.Get("Authorization") == "" {
+		refreshToken, err := refreshTokenFromCookie(r)
+		if err != nil {
+			return nil, http.StatusUnauthorized, err
+		}
+		req.RefreshToken = refreshToken
+	}
+
+	if req.RefreshToken != "" {
+		s := h.sessionByRefreshToken(req.RefreshToken)
+		if s == nil {
+			return nil, http.StatusUnauthorized, errors.New("refresh token does not match")
+		}
+
+		return s, 0, nil
+	}
+
+	claims, err := verifyClaimsFromAuthHeader(r, h.TokenMaker, nil)
+	if err != nil {
+		return nil, http.StatusUnauthorized, fmt.Errorf("error verifying token: %w", err)
+	}
+
+	s, err := h.db.GetSession(h.ctx, claims.RegisteredClaims.ID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, errors.New("error getting session")
+	}
+
+	return s, 0, nil
+}
@@ -0,0 +1,242 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/arrogantworm/jwt_auth/api/events"
+	"github.com/arrogantworm/jwt_auth/api/utils"
+	"github.com/arrogantworm/jwt_auth/db"
+)
+
+const tokenTypeHintRefreshToken = "refresh_token"
+
+// sessionByRefreshToken returns the session a refresh token belongs to, or nil
+func (h *Handler) sessionByRefreshToken(refreshToken string) *db.Session {
+	s, err := h.db.GetSessionByRefreshLookup(h.ctx, utils.SHA256Hex(refreshToken))
+	if err != nil {
+		return nil
+	}
+
+	if err := utils.CheckRefreshToken(refreshToken, s.RefreshToken); err != nil {
+		return nil
+	}
+
+	return s
+}
+
+func sessionActive(s *db.Session) bool {
+	return !s.IsRevoked && time.Now().Before(s.ExpiresAt)
+}
+
+// oauth/introspect
+// @Summary OAuth2 Token Introspection
+// @Tags oauth
+// @Description RFC 7662 token introspection. Requires client authentication.
+// @ID oauth-introspect
+// @Accept x-www-form-urlencoded
+// @Param token formData string true "Access or refresh token"
+// @Param token_type_hint formData string false "access_token or refresh_token"
+// @Produce json
+// @Success 200 {object} IntrospectionRes
+// @Failure 400,401 {object} OAuthErrorRes
+// @Router /oauth/introspect [post]
+func (h *Handler) introspectToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		h.sendOAuthError(w, "invalid_request", "malformed form body", http.StatusBadRequest)
+		return
+	}
+
+	c, err := h.authenticateClient(r)
+	if err != nil || c.AuthMethod == db.ClientAuthNone {
+		h.sendClientAuthError(w, r)
+		return
+	}
+
+	tok := r.PostForm.Get("token")
+	if tok == "" {
+		h.sendOAuthError(w, "invalid_request", "token is required", http.StatusBadRequest)
+		return
+	}
+
+	var res IntrospectionRes
+
+	if r.PostForm.Get("token_type_hint") == tokenTypeHintRefreshToken {
+		res = h.introspectRefreshToken(tok)
+		if !res.Active {
+			res = h.introspectAccessToken(tok)
+		}
+	} else {
+		res = h.introspectAccessToken(tok)
+		if !res.Active {
+			res = h.introspectRefreshToken(tok)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// introspectAccessToken combines the JWT claims with the state of the backing
+// session, which exchanged tokens share with their subject token. Client tokens
+// have no session and stay active while the client is enabled.
+func (h *Handler) introspectAccessToken(tok string) IntrospectionRes {
+	claims, err := h.TokenMaker.VerifyToken(tok)
+	if err != nil {
+		return IntrospectionRes{}
+	}
+
+	res := IntrospectionRes{
+		Active:      true,
+		Scope:       claims.Scope,
+		TokenType:   "Bearer",
+		Subject:     claims.Subject,
+		SubjectType: claims.SubjectType,
+		Audience:    claims.Audience,
+		Issuer:      h.issuer,
+		JwtID:       claims.RegisteredClaims.ID,
+	}
+	if claims.ExpiresAt != nil {
+		res.ExpiresAt = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		res.IssuedAt = claims.IssuedAt.Unix()
+	}
+
+	if !claims.IsUser() {
+		c, err := h.db.GetClient(h.ctx, claims.Subject)
+		if err != nil || c.IsDisabled {
+			return IntrospectionRes{}
+		}
+
+		res.ClientID = c.ClientID
+		return res
+	}
+
+	s, err := h.db.GetSession(h.ctx, claims.Session())
+	if err != nil || !sessionActive(s) {
+		return IntrospectionRes{}
+	}
+
+	res.Username = claims.Subject
+	res.Actor = claims.Act
+	res.UserID = claims.ID
+	res.SessionID = s.SessionID
+	if s.ClientID != nil {
+		res.ClientID = *s.ClientID
+	}
+
+	return res
+}
+
+func (h *Handler) introspectRefreshToken(tok string) IntrospectionRes {
+	s := h.sessionByRefreshToken(tok)
+	if s == nil || !sessionActive(s) {
+		return IntrospectionRes{}
+	}
+
+	u, err := h.db.GetUserById(h.ctx, s.UserID)
+	if err != nil {
+		return IntrospectionRes{}
+	}
+
+	res := IntrospectionRes{
+		Active:    true,
+		Scope:     s.Scope,
+		Username:  u.Username,
+		Subject:   u.Username,
+		UserID:    u.ID,
+		ExpiresAt: s.ExpiresAt.Unix(),
+		IssuedAt:  s.CreatedAt.Unix(),
+		Issuer:    h.issuer,
+		SessionID: s.SessionID,
+	}
+	if s.ClientID != nil {
+		res.ClientID = *s.ClientID
+	}
+
+	return res
+}
+
+// oauth/revoke
+// @Summary OAuth2 Token Revocation
+// @Tags oauth
+// @Description RFC 7009 token revocation. Revokes the session behind an access or refresh token issued to the calling client.
+// @ID oauth-revoke
+// @Accept x-www-form-urlencoded
+// @Param token formData string true "Access or refresh token"
+// @Param token_type_hint formData string false "access_token or refresh_token"
+// @Success 200
+// @Failure 400,401,500 {object} OAuthErrorRes
+// @Router /oauth/revoke [post]
+func (h *Handler) revokeToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		h.sendOAuthError(w, "invalid_request", "malformed form body", http.StatusBadRequest)
+		return
+	}
+
+	c, err := h.authenticateClient(r)
+	if err != nil {
+		h.sendClientAuthError(w, r)
+		return
+	}
+
+	tok := r.PostForm.Get("token")
+	if tok == "" {
+		h.sendOAuthError(w, "invalid_request", "token is required", http.StatusBadRequest)
+		return
+	}
+
+	var s *db.Session
+	if r.PostForm.Get("token_type_hint") == tokenTypeHintRefreshToken {
+		if s = h.sessionByRefreshToken(tok); s == nil {
+			s = h.sessionByAccessToken(tok)
+		}
+	} else {
+		if s = h.sessionByAccessToken(tok); s == nil {
+			s = h.sessionByRefreshToken(tok)
+		}
+	}
+
+	// Unknown and already invalid tokens are not an error (RFC 7009 section 2.2)
+	if s == nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if s.ClientID == nil || *s.ClientID != c.ClientID {
+		h.sendOAuthError(w, "unauthorized_client", "token was not issued to this client", http.StatusBadRequest)
+		return
+	}
+
+	revoked, err := h.stageEvent(r, events.TypeSessionRevoked, s.UserID, s.SessionID, events.SessionRevoked{Reason: events.ReasonRevoked})
+	if err != nil {
+		h.sendOAuthError(w, "server_error", "error revoking session", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.db.RevokeSession(h.ctx, s.SessionID, revoked); err != nil {
+		h.sendOAuthError(w, "server_error", "error revoking session", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// sessionByAccessToken returns the session behind a user access token, even an expired one
+func (h *Handler) sessionByAccessToken(tok string) *db.Session {
+	claims, err := h.TokenMaker.VerifyTokenNoExp(tok)
+	if err != nil || !claims.IsUser() {
+		return nil
+	}
+
+	s, err := h.db.GetSession(h.ctx, claims.Session())
+	if err != nil {
+		return nil
+	}
+
+	return s
+}
@@ -0,0 +1,271 @@
+package handler
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/arrogantworm/jwt_auth/api/authn"
+	"github.com/arrogantworm/jwt_auth/api/events"
+	"github.com/arrogantworm/jwt_auth/api/mail"
+	"github.com/arrogantworm/jwt_auth/api/utils"
+	"github.com/arrogantworm/jwt_auth/db"
+	"github.com/jackc/pgx/v5"
+	"github.com/spf13/viper"
+)
+
+const magicLinkBindingCookie = "magic_link_binding"
+
+// requireMagicLink answers 404 while magic links are disabled
+func (h *Handler) requireMagicLink(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !viper.GetBool("magicLink.enabled") {
+			h.sendError(w, "magic links are not enabled", http.StatusNotFound)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// auth/magic-link/request
+// @Summary Request magic link
+// @Tags auth, magic-link
+// @Description Email a single-use signin link to the account with this address. The response is the same whether or not the address belongs to an account. With magicLink.bindBrowser the link only works in the browser that requested it.
+// @ID auth-magic-link-request
+// @Accept json
+// @Param input body MagicLinkReq true "Email address"
+// @Produce json
+// @Success 202 {object} SuccessRes
+// @Failure 400,404,500 {object} ErrorRes
+// @Router /auth/magic-link/request [post]
+func (h *Handler) requestMagicLink(w http.ResponseWriter, r *http.Request) {
+	var req MagicLinkReq
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendError(w, "", http.StatusBadRequest)
+		return
+	}
+
+	if req.Email == "" {
+		h.sendError(w, "email is required", http.StatusBadRequest)
+		return
+	}
+
+	ttl := viper.GetDuration("magicLink.ttl")
+
+	// The cookie is set for unknown addresses too, so it doesn't tell them apart
+	var browser string
+	if viper.GetBool("magicLink.bindBrowser") {
+		binding, err := utils.RandomHex(32)
+		if err != nil {
+			h.sendError(w, "", http.StatusInternalServerError)
+			return
+		}
+		browser = utils.SHA256Hex(binding)
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     magicLinkBindingCookie,
+			Value:    binding,
+			Path:     "/auth/magic-link",
+			MaxAge:   int(ttl.Seconds()),
+			HttpOnly: true,
+			Secure:   strings.HasPrefix(h.issuer, "https://"),
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	if err := h.sendMagicLink(req.Email, browser, ttl); err != nil {
+		log.Println("[MAGIC LINK]", err)
+		h.sendError(w, "error sending link", http.StatusInternalServerError)
+		return
+	}
+
+	h.sendSuccess(w, "if the address belongs to an account, a signin link has been sent", http.StatusAccepted)
+}
+
+func (h *Handler) sendMagicLink(email string, browser string, ttl time.Duration) error {
+	active := true
+
+	users, total, err := h.db.ListUsers(h.ctx, db.UserFilter{Email: &email, Active: &active}, 0, 1)
+	if err != nil {
+		return err
+	}
+
+	// An address shared by several accounts doesn't say which one to sign in
+	if total != 1 {
+		return nil
+	}
+	u := users[0]
+
+	tok, claims, err := h.TokenMaker.CreateMagicLinkToken(u.ID, browser, ttl)
+	if err != nil {
+		return err
+	}
+
+	err = h.db.CreateMagicLink(h.ctx, &db.MagicLink{
+		TokenID:   claims.ID,
+		UserID:    u.ID,
+		ExpiresAt: claims.ExpiresAt.Time,
+	})
+	if err != nil {
+		return err
+	}
+
+	link := viper.GetString("magicLink.linkURL")
+	if link == "" {
+		link = h.issuer + "/auth/magic-link/consume"
+	}
+
+	sep := "?"
+	if strings.Contains(link, "?") {
+		sep = "&"
+	}
+	link += sep + url.Values{"token": {tok}}.Encode()
+
+	msg := mail.Message{
+		To:      *u.Email,
+		Subject: "Your signin link",
+		Text: fmt.Sprintf("Hi %s,\n\nUse this link to sign in. It works once and expires in %s:\n\n%s\n\nIf you didn't ask for it, you can ignore this email.\n",
+			u.Name, ttl, link),
+	}
+
+	// Sent in the background so the response time doesn't reveal whether the address is known
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		if err := h.mailer.Send(ctx, msg); err != nil {
+			log.Println("[MAIL]", err)
+		}
+	}()
+
+	return nil
+}
+
+// auth/magic-link/consume
+// @Summary Confirm magic link
+// @Tags auth, magic-link
+// @Description Opened from the emailed link. Only asks for confirmation, which is posted back to /auth/magic-link/consume, so that mail scanners opening the link don't use it up.
+// @ID auth-magic-link-confirm
+// @Param token query string true "Link token"
+// @Produce html
+// @Success 200 {string} string "HTML page"
+// @Failure 400,404 {string} string "HTML page"
+// @Router /auth/magic-link/consume [get]
+func (h *Handler) confirmMagicLink(w http.ResponseWriter, r *http.Request) {
+	tok := r.URL.Query().Get("token")
+
+	if _, err := h.TokenMaker.VerifyMagicLinkToken(tok); err != nil {
+		h.renderMessage(w, messagePage{"Link expired", "This link is invalid or has expired. Request a new one to sign in."}, http.StatusBadRequest)
+		return
+	}
+
+	h.renderConfirm(w, loginPage{
+		Title:   "Sign in",
+		Message: "Confirm to sign in with this link. It works once.",
+		Action:  "/auth/magic-link/consume",
+		Hidden:  map[string]string{"token": tok},
+		Submit:  "Sign in",
+	}, http.StatusOK)
+}
+
+// auth/magic-link/consume
+// @Summary Consume magic link
+// @Tags auth, magic-link
+// @Description Sign in with the token of an emailed link, like /auth/signin. The token is read from a JSON body, or from the form posted by the page of GET /auth/magic-link/consume.
+// @ID auth-magic-link-consume
+// @Accept json,x-www-form-urlencoded
+// @Param input body MagicLinkConsumeReq true "Link token"
+// @Produce json
+// @Success 200 {object} LoginUserRes
+// @Failure 400,401,403,404,500 {object} ErrorRes
+// @Router /auth/magic-link/consume [post]
+func (h *Handler) consumeMagicLink(w http.ResponseWriter, r *http.Request) {
+	var tok string
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		if err := r.ParseForm(); err != nil {
+			h.sendError(w, "", http.StatusBadRequest)
+			return
+		}
+		tok = r.PostForm.Get("token")
+	} else {
+		var req MagicLinkConsumeReq
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			h.sendError(w, "", http.StatusBadRequest)
+			return
+		}
+		tok = req.Token
+	}
+
+	if tok == "" {
+		h.sendError(w, "token is required", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := h.TokenMaker.VerifyMagicLinkToken(tok)
+	if err != nil {
+		h.sendError(w, "invalid or expired link", http.StatusUnauthorized)
+		return
+	}
+
+	// Checked before the link is used up, so opening it elsewhere doesn't spend it
+	if claims.Browser != "" {
+		cookie, err := r.Cookie(magicLinkBindingCookie)
+		if err != nil || subtle.ConstantTimeCompare([]byte(utils.SHA256Hex(cookie.Value)), []byte(claims.Browser)) != 1 {
+			h.sendError(w, "link has to be opened in the browser it was requested from", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	userID, err := claims.UserID()
+	if err != nil {
+		h.sendError(w, "invalid or expired link", http.StatusUnauthorized)
+		return
+	}
+
+	ok, err := h.db.ConsumeMagicLink(h.ctx, claims.ID, userID)
+	if err != nil {
+		h.sendError(w, "error checking link", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		h.sendError(w, "invalid or expired link", http.StatusUnauthorized)
+		return
+	}
+
+	u, err := h.db.GetUserById(h.ctx, userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		h.sendError(w, "invalid or expired link", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		h.sendError(w, "error getting user", http.StatusInternalServerError)
+		return
+	}
+
+	res, err := h.newSession(r, u, events.LoginSucceeded{Method: events.MethodMagicLink}, "")
+	if errors.Is(err, authn.ErrUserDisabled) {
+		h.sendError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		h.sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if claims.Browser != "" {
+		http.SetCookie(w, &http.Cookie{Name: magicLinkBindingCookie, Path: "/auth/magic-link", MaxAge: -1})
+	}
+
+	h.sendSession(w, res)
+}
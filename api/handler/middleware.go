@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"slices"
 	"strings"
 
 	"github.com/arrogantworm/jwt_auth/api/token"
@@ -13,11 +14,19 @@ import (
 type authKey struct {
 }
 
-func GetAuthMiddlewareFunc(tokenMaker *token.JWTMaker) func(http.Handler) http.Handler {
+// APIKeyVerifier resolves a personal API key to the claims of its owner
+type APIKeyVerifier interface {
+	VerifyAPIKey(ctx context.Context, key string) (*token.UserClaims, error)
+}
+
+// GetAuthMiddlewareFunc accepts a Bearer access token and, when keys is not nil,
+// an "ApiKey" authorization header. In cookie mode the access token cookie is
+// accepted as well.
+func GetAuthMiddlewareFunc(tokenMaker *token.JWTMaker, keys APIKeyVerifier) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-			claims, err := verifyClaimsFromAuthHeader(r, tokenMaker)
+			claims, err := verifyClaimsFromAuthHeader(r, tokenMaker, keys)
 			if err != nil {
 				w.Header().Set("Content-Type", "application/json")
 				w.WriteHeader(http.StatusUnauthorized)
@@ -31,14 +40,31 @@ func GetAuthMiddlewareFunc(tokenMaker *token.JWTMaker) func(http.Handler) http.H
 	}
 }
 
-func verifyClaimsFromAuthHeader(r *http.Request, tokenMaker *token.JWTMaker) (*token.UserClaims, error) {
+func verifyClaimsFromAuthHeader(r *http.Request, tokenMaker *token.JWTMaker, keys APIKeyVerifier) (*token.UserClaims, error) {
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
-		return nil, fmt.Errorf("authorization header is missing")
+		cookieToken, err := accessTokenFromCookie(r)
+		if err != nil {
+			return nil, err
+		}
+		authHeader = "Bearer " + cookieToken
 	}
 
 	fields := strings.Fields(authHeader)
-	if len(fields) != 2 || fields[0] != "Bearer" {
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("invalid authorization header")
+	}
+
+	if fields[0] == "ApiKey" && keys != nil {
+		claims, err := keys.VerifyAPIKey(r.Context(), fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid api key: %w", err)
+		}
+
+		return claims, nil
+	}
+
+	if fields[0] != "Bearer" {
 		return nil, fmt.Errorf("invalid authorization header")
 	}
 
@@ -49,6 +75,14 @@ func verifyClaimsFromAuthHeader(r *http.Request, tokenMaker *token.JWTMaker) (*t
 		return nil, fmt.Errorf("invalid token: %w", err)
 	}
 
+	if !claims.IsUser() {
+		return nil, fmt.Errorf("token was not issued to a user")
+	}
+
+	if len(claims.Audience) > 0 && !slices.Contains(claims.Audience, tokenMaker.Issuer) {
+		return nil, fmt.Errorf("token is not intended for this service")
+	}
+
 	return claims, nil
 }
 
@@ -73,7 +107,11 @@ func GetUserClaimsMiddlewareFunc(tokenMaker *token.JWTMaker) func(http.Handler)
 func verifyClaimsFromAuthHeaderNoExp(r *http.Request, tokenMaker *token.JWTMaker) (*token.UserClaims, error) {
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
-		return nil, fmt.Errorf("authorization header is missing")
+		cookieToken, err := accessTokenFromCookie(r)
+		if err != nil {
+			return nil, err
+		}
+		authHeader = "Bearer " + cookieToken
 	}
 
 	fields := strings.Fields(authHeader)
@@ -88,5 +126,40 @@ func verifyClaimsFromAuthHeaderNoExp(r *http.Request, tokenMaker *token.JWTMaker
 		return nil, fmt.Errorf("invalid token: %w", err)
 	}
 
+	if !claims.IsUser() {
+		return nil, fmt.Errorf("token was not issued to a user")
+	}
+
+	if len(claims.Audience) > 0 && !slices.Contains(claims.Audience, tokenMaker.Issuer) {
+		return nil, fmt.Errorf("token is not intended for this service")
+	}
+
 	return claims, nil
 }
+
+// Scopes of the account and admin endpoints. Unscoped first-party tokens grant
+// them all, a client's token only when it was issued with them.
+const (
+	scopeUserRead  = "user:read"
+	scopeUserWrite = "user:write"
+	scopeUserKeys  = "user:keys"
+	scopeAdmin     = "admin"
+)
+
+// RequireScope rejects requests whose claims do not grant scope
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			claims := r.Context().Value(authKey{}).(*token.UserClaims)
+			if !claims.HasScope(scope) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(ErrorRes{fmt.Sprintf("insufficient scope: %s required", scope)})
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/arrogantworm/jwt_auth/api/token"
+	"github.com/arrogantworm/jwt_auth/api/utils"
+	"github.com/arrogantworm/jwt_auth/db"
+)
+
+const (
+	grantTypeClientCredentials = "client_credentials"
+
+	clientAssertionTypeJWT = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+)
+
+// Grant types a client can be allowed to use
+var supportedGrantTypes = map[string]bool{
+	grantTypeClientCredentials: true,
+	grantTypeAuthorizationCode: true,
+	grantTypeDeviceCode:        true,
+	grantTypeTokenExchange:     true,
+}
+
+var errInvalidClient = errors.New("invalid client")
+
+func (h *Handler) sendOAuthError(w http.ResponseWriter, code string, description string, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(OAuthErrorRes{code, description})
+}
+
+func (h *Handler) sendOAuthToken(w http.ResponseWriter, res OAuthTokenRes) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// sendClientAuthError answers a failed client authentication as required by RFC 6749 section 5.2
+func (h *Handler) sendClientAuthError(w http.ResponseWriter, r *http.Request) {
+	if _, _, ok := r.BasicAuth(); ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+
+	h.sendOAuthError(w, "invalid_client", "client authentication failed", http.StatusUnauthorized)
+}
+
+// oauth/token
+// @Summary OAuth2 Token
+// @Tags oauth
+// @Description OAuth2 token endpoint
+// @ID oauth-token
+// @Accept x-www-form-urlencoded
+// @Param grant_type formData string true "Grant type"
+// @Param scope formData string false "Space separated scopes"
+// @Param client_id formData string false "Client ID (client_secret_post)"
+// @Param client_secret formData string false "Client secret (client_secret_post)"
+// @Param client_assertion_type formData string false "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+// @Param client_assertion formData string false "Signed client assertion (private_key_jwt) with a jti, accepted once"
+// @Param code formData string false "Authorization code (authorization_code)"
+// @Param redirect_uri formData string false "Redirect URI used in the authorization request (authorization_code)"
+// @Param code_verifier formData string false "PKCE code verifier (authorization_code)"
+// @Param device_code formData string false "Device code (urn:ietf:params:oauth:grant-type:device_code)"
+// @Param subject_token formData string false "User access token to exchange (token-exchange)"
+// @Param subject_token_type formData string false "urn:ietf:params:oauth:token-type:access_token (token-exchange)"
+// @Param audience formData string false "Target audience (token-exchange)"
+// @Param resource formData string false "Target resource, used when audience is empty (token-exchange)"
+// @Param requested_token_type formData string false "urn:ietf:params:oauth:token-type:access_token (token-exchange)"
+// @Produce json
+// @Success 200 {object} OAuthTokenRes
+// @Failure 400,401,500 {object} OAuthErrorRes
+// @Router /oauth/token [post]
+func (h *Handler) oauthToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		h.sendOAuthError(w, "invalid_request", "malformed form body", http.StatusBadRequest)
+		return
+	}
+
+	switch grantType := r.PostForm.Get("grant_type"); grantType {
+	case grantTypeClientCredentials:
+		h.clientCredentialsGrant(w, r)
+	case grantTypeAuthorizationCode:
+		h.authorizationCodeGrant(w, r)
+	case grantTypeDeviceCode:
+		h.deviceCodeGrant(w, r)
+	case grantTypeTokenExchange:
+		h.tokenExchangeGrant(w, r)
+	case "":
+		h.sendOAuthError(w, "invalid_request", "grant_type is required", http.StatusBadRequest)
+	default:
+		h.sendOAuthError(w, "unsupported_grant_type", "", http.StatusBadRequest)
+	}
+}
+
+func (h *Handler) clientCredentialsGrant(w http.ResponseWriter, r *http.Request) {
+	c, err := h.authenticateClient(r)
+	if err != nil {
+		h.sendClientAuthError(w, r)
+		return
+	}
+
+	if c.AuthMethod == db.ClientAuthNone || !slices.Contains(c.GrantTypes, grantTypeClientCredentials) {
+		h.sendOAuthError(w, "unauthorized_client", "client is not allowed to use this grant type", http.StatusBadRequest)
+		return
+	}
+
+	scope, ok := grantedScope(r.PostForm.Get("scope"), c.Scopes)
+	if !ok {
+		h.sendOAuthError(w, "invalid_scope", "requested scope is not allowed", http.StatusBadRequest)
+		return
+	}
+
+	accessToken, claims, err := h.TokenMaker.CreateClientToken(c.ClientID, scope)
+	if err != nil {
+		h.sendOAuthError(w, "server_error", "error creating token", http.StatusInternalServerError)
+		return
+	}
+
+	h.sendOAuthToken(w, OAuthTokenRes{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(time.Until(claims.ExpiresAt.Time).Seconds()),
+		Scope:       scope,
+	})
+}
+
+// grantedScope checks the requested scopes against the allowed ones.
+// An empty request is granted every allowed scope.
+func grantedScope(requested string, allowed []string) (string, bool) {
+	scopes := strings.Fields(requested)
+	if len(scopes) == 0 {
+		return strings.Join(allowed, " "), true
+	}
+
+	for _, s := range scopes {
+		if !slices.Contains(allowed, s) {
+			return "", false
+		}
+	}
+
+	return strings.Join(scopes, " "), true
+}
+
+// validScopes reports whether every scope is a valid RFC 6749 scope token
+func validScopes(scopes []string) bool {
+	for _, s := range scopes {
+		if s == "" || strings.ContainsAny(s, " \t\r\n\"\\") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// authenticateClient authenticates the calling client with HTTP Basic,
+// client_secret_post or a private_key_jwt assertion. Public clients only
+// identify themselves with client_id.
+func (h *Handler) authenticateClient(r *http.Request) (*db.OAuthClient, error) {
+	if assertion := r.PostForm.Get("client_assertion"); assertion != "" {
+		return h.authenticateClientAssertion(r, assertion)
+	}
+
+	var clientID, secret, method string
+
+	if id, s, ok := r.BasicAuth(); ok {
+		// RFC 6749 section 2.3.1: credentials are form-encoded before base64
+		var err error
+		if clientID, err = url.QueryUnescape(id); err != nil {
+			return nil, errInvalidClient
+		}
+		if secret, err = url.QueryUnescape(s); err != nil {
+			return nil, errInvalidClient
+		}
+		method = db.ClientAuthSecretBasic
+	} else if r.PostForm.Get("client_secret") != "" {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+		method = db.ClientAuthSecretPost
+	} else if id := r.PostForm.Get("client_id"); id != "" {
+		c, err := h.db.GetClient(h.ctx, id)
+		if err != nil || c.IsDisabled || c.AuthMethod != db.ClientAuthNone {
+			return nil, errInvalidClient
+		}
+
+		return c, nil
+	} else {
+		return nil, errInvalidClient
+	}
+
+	c, err := h.db.GetClient(h.ctx, clientID)
+	if err != nil {
+		return nil, errInvalidClient
+	}
+
+	if c.IsDisabled || c.AuthMethod != method || c.SecretHash == nil {
+		return nil, errInvalidClient
+	}
+
+	if err := utils.CheckClientSecret(secret, *c.SecretHash); err != nil {
+		return nil, errInvalidClient
+	}
+
+	return c, nil
+}
+
+func (h *Handler) authenticateClientAssertion(r *http.Request, assertion string) (*db.OAuthClient, error) {
+	if r.PostForm.Get("client_assertion_type") != clientAssertionTypeJWT {
+		return nil, errInvalidClient
+	}
+
+	clientID, err := token.AssertionIssuer(assertion)
+	if err != nil {
+		return nil, errInvalidClient
+	}
+
+	if id := r.PostForm.Get("client_id"); id != "" && id != clientID {
+		return nil, errInvalidClient
+	}
+
+	c, err := h.db.GetClient(h.ctx, clientID)
+	if err != nil {
+		return nil, errInvalidClient
+	}
+
+	if c.IsDisabled || c.AuthMethod != db.ClientAuthPrivateKeyJWT || c.PublicKey == nil {
+		return nil, errInvalidClient
+	}
+
+	claims, err := token.VerifyClientAssertion(assertion, *c.PublicKey, c.ClientID, h.issuer+"/oauth/token")
+	if err != nil {
+		return nil, errInvalidClient
+	}
+
+	// RFC 7523 section 3: an assertion is only good once
+	fresh, err := h.db.UseClientAssertion(h.ctx, c.ClientID, claims.ID, claims.ExpiresAt.Time)
+	if err != nil || !fresh {
+		return nil, errInvalidClient
+	}
+
+	return c, nil
+}
@@ -0,0 +1,490 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arrogantworm/jwt_auth/api/authn"
+	"github.com/arrogantworm/jwt_auth/api/events"
+	"github.com/arrogantworm/jwt_auth/api/token"
+	"github.com/arrogantworm/jwt_auth/api/utils"
+	"github.com/arrogantworm/jwt_auth/db"
+	"github.com/jackc/pgx/v5"
+	"github.com/spf13/viper"
+)
+
+const grantTypeAuthorizationCode = "authorization_code"
+
+// Scopes defined by OpenID Connect that every client may request
+var oidcScopes = []string{"openid", "profile"}
+
+//go:embed templates/*.html
+var templateFS embed.FS
+
+var templates = template.Must(template.ParseFS(templateFS, "templates/*.html"))
+
+type (
+	loginPage struct {
+		Title        string
+		Message      string
+		Action       string
+		Error        string
+		Hidden       map[string]string
+		Submit       string
+		ShowUserCode bool
+		UserCode     string
+	}
+
+	messagePage struct {
+		Title   string
+		Message string
+	}
+
+	// consentPage asks the user to approve or deny a client's access
+	consentPage struct {
+		Title   string
+		Message string
+		Action  string
+		Hidden  map[string]string
+		Scopes  []string
+	}
+)
+
+func (h *Handler) renderLogin(w http.ResponseWriter, page loginPage, status int) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(status)
+
+	if err := templates.ExecuteTemplate(w, "login.html", page); err != nil {
+		log.Printf("error rendering login page: %v", err)
+	}
+}
+
+func (h *Handler) renderMessage(w http.ResponseWriter, page messagePage, status int) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+
+	if err := templates.ExecuteTemplate(w, "message.html", page); err != nil {
+		log.Printf("error rendering message page: %v", err)
+	}
+}
+
+// authorizeRequest is a validated OpenID Connect authentication request
+type authorizeRequest struct {
+	client              *db.OAuthClient
+	ResponseType        string
+	RedirectURI         string
+	Scope               string
+	State               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	Prompt              string
+}
+
+func (ar *authorizeRequest) hidden() map[string]string {
+	return map[string]string{
+		"client_id":             ar.client.ClientID,
+		"response_type":         ar.ResponseType,
+		"redirect_uri":          ar.RedirectURI,
+		"scope":                 ar.Scope,
+		"state":                 ar.State,
+		"nonce":                 ar.Nonce,
+		"code_challenge":        ar.CodeChallenge,
+		"code_challenge_method": ar.CodeChallengeMethod,
+	}
+}
+
+// parseAuthorizeRequest checks the client and redirect URI. Until both are known
+// to be valid, errors must be shown to the user instead of redirecting.
+func (h *Handler) parseAuthorizeRequest(form url.Values) (*authorizeRequest, error) {
+	c, err := h.db.GetClient(h.ctx, form.Get("client_id"))
+	if err != nil || c.IsDisabled {
+		return nil, errors.New("unknown client")
+	}
+
+	if !slices.Contains(c.GrantTypes, grantTypeAuthorizationCode) {
+		return nil, errors.New("client is not allowed to use the authorization code flow")
+	}
+
+	redirectURI := form.Get("redirect_uri")
+	if redirectURI == "" && len(c.RedirectURIs) == 1 {
+		redirectURI = c.RedirectURIs[0]
+	}
+
+	if !slices.Contains(c.RedirectURIs, redirectURI) {
+		return nil, errors.New("redirect_uri is not registered for this client")
+	}
+
+	return &authorizeRequest{
+		client:              c,
+		ResponseType:        form.Get("response_type"),
+		RedirectURI:         redirectURI,
+		Scope:               form.Get("scope"),
+		State:               form.Get("state"),
+		Nonce:               form.Get("nonce"),
+		CodeChallenge:       form.Get("code_challenge"),
+		CodeChallengeMethod: form.Get("code_challenge_method"),
+		Prompt:              form.Get("prompt"),
+	}, nil
+}
+
+// validate returns an OAuth error code and description for invalid requests
+func (ar *authorizeRequest) validate() (string, string) {
+	if ar.ResponseType != "code" {
+		return "unsupported_response_type", "only the code response type is supported"
+	}
+
+	scopes := strings.Fields(ar.Scope)
+	if !slices.Contains(scopes, "openid") {
+		return "invalid_scope", "the openid scope is required"
+	}
+
+	for _, s := range scopes {
+		if !slices.Contains(oidcScopes, s) && !slices.Contains(ar.client.Scopes, s) {
+			return "invalid_scope", "scope " + s + " is not allowed"
+		}
+	}
+
+	if ar.CodeChallenge == "" {
+		return "invalid_request", "code_challenge is required"
+	}
+
+	if ar.CodeChallengeMethod != "S256" {
+		return "invalid_request", "code_challenge_method must be S256"
+	}
+
+	return "", ""
+}
+
+func (h *Handler) redirectAuthorize(w http.ResponseWriter, r *http.Request, ar *authorizeRequest, params url.Values) {
+	if ar.State != "" {
+		params.Set("state", ar.State)
+	}
+	params.Set("iss", h.issuer)
+
+	target, _ := url.Parse(ar.RedirectURI)
+	q := target.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	target.RawQuery = q.Encode()
+
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+func (h *Handler) redirectAuthorizeError(w http.ResponseWriter, r *http.Request, ar *authorizeRequest, code string, description string) {
+	h.redirectAuthorize(w, r, ar, url.Values{
+		"error":             {code},
+		"error_description": {description},
+	})
+}
+
+// authorize
+// @Summary OpenID Connect Authorization
+// @Tags oidc
+// @Description Authorization code flow with PKCE (S256). GET renders the login page, POST submits credentials.
+// @ID oidc-authorize
+// @Param client_id query string true "Client ID"
+// @Param response_type query string true "Must be code"
+// @Param redirect_uri query string false "Registered redirect URI"
+// @Param scope query string true "Must include openid"
+// @Param state query string false "Opaque client state"
+// @Param nonce query string false "ID token nonce"
+// @Param code_challenge query string true "PKCE code challenge"
+// @Param code_challenge_method query string true "Must be S256"
+// @Produce html
+// @Success 200 {string} string "Login page"
+// @Success 302 {string} string "Redirect to client with code or error"
+// @Failure 400,401 {string} string "Login page with error"
+// @Router /authorize [get]
+// @Router /authorize [post]
+func (h *Handler) authorize(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "malformed request", http.StatusBadRequest)
+		return
+	}
+
+	ar, err := h.parseAuthorizeRequest(r.Form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if code, description := ar.validate(); code != "" {
+		h.redirectAuthorizeError(w, r, ar, code, description)
+		return
+	}
+
+	page := loginPage{
+		Title:   "Sign in",
+		Message: "to continue to " + ar.client.Name,
+		Action:  "/authorize",
+		Hidden:  ar.hidden(),
+	}
+
+	if r.Method == http.MethodGet {
+		// There is no single sign-on cookie, so the user always has to log in
+		if ar.Prompt == "none" {
+			h.redirectAuthorizeError(w, r, ar, "login_required", "")
+			return
+		}
+
+		h.renderLogin(w, page, http.StatusOK)
+		return
+	}
+
+	username := r.PostForm.Get("username")
+
+	u, err := h.authenticator.Authenticate(h.ctx, username, r.PostForm.Get("password"))
+	if errors.Is(err, authn.ErrWrongPassword) || errors.Is(err, pgx.ErrNoRows) {
+		reason := events.ReasonWrongPassword
+		if errors.Is(err, pgx.ErrNoRows) {
+			reason = events.ReasonUnknownUser
+		}
+		h.loginFailed(r, events.MethodOAuth, username, reason)
+		page.Error = "Invalid username or password"
+		h.renderLogin(w, page, http.StatusUnauthorized)
+		return
+	}
+	if errors.Is(err, authn.ErrUserDisabled) {
+		h.loginFailed(r, events.MethodOAuth, username, events.ReasonUserDisabled)
+		page.Error = "This account is disabled"
+		h.renderLogin(w, page, http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, authn.ErrPasswordResetRequired) {
+		h.loginFailed(r, events.MethodOAuth, username, events.ReasonPasswordResetRequired)
+		page.Error = "Choose a new password through the link in the new sign-in email"
+		h.renderLogin(w, page, http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		h.redirectAuthorizeError(w, r, ar, "server_error", "")
+		return
+	}
+
+	code, err := utils.RandomHex(32)
+	if err != nil {
+		h.redirectAuthorizeError(w, r, ar, "server_error", "")
+		return
+	}
+
+	err = h.db.CreateAuthorizationCode(h.ctx, &db.AuthorizationCode{
+		CodeHash:      utils.SHA256Hex(code),
+		ClientID:      ar.client.ClientID,
+		UserID:        u.ID,
+		RedirectURI:   ar.RedirectURI,
+		Scope:         ar.Scope,
+		Nonce:         ar.Nonce,
+		CodeChallenge: ar.CodeChallenge,
+		AuthTime:      time.Now(),
+		ExpiresAt:     time.Now().Add(viper.GetDuration("oidc.authorizationCodeTTL")),
+	})
+	if err != nil {
+		h.redirectAuthorizeError(w, r, ar, "server_error", "")
+		return
+	}
+
+	h.redirectAuthorize(w, r, ar, url.Values{"code": {code}})
+}
+
+func (h *Handler) authorizationCodeGrant(w http.ResponseWriter, r *http.Request) {
+	c, err := h.authenticateClient(r)
+	if err != nil {
+		h.sendClientAuthError(w, r)
+		return
+	}
+
+	if !slices.Contains(c.GrantTypes, grantTypeAuthorizationCode) {
+		h.sendOAuthError(w, "unauthorized_client", "client is not allowed to use this grant type", http.StatusBadRequest)
+		return
+	}
+
+	code := r.PostForm.Get("code")
+	if code == "" {
+		h.sendOAuthError(w, "invalid_request", "code is required", http.StatusBadRequest)
+		return
+	}
+
+	ac, err := h.db.ConsumeAuthorizationCode(h.ctx, utils.SHA256Hex(code))
+	if err != nil {
+		h.sendOAuthError(w, "invalid_grant", "invalid or expired code", http.StatusBadRequest)
+		return
+	}
+
+	if ac.ClientID != c.ClientID || ac.RedirectURI != r.PostForm.Get("redirect_uri") {
+		h.sendOAuthError(w, "invalid_grant", "code was not issued to this client or redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	if !verifyCodeChallenge(r.PostForm.Get("code_verifier"), ac.CodeChallenge) {
+		h.sendOAuthError(w, "invalid_grant", "code_verifier does not match", http.StatusBadRequest)
+		return
+	}
+
+	u, err := h.db.GetUserById(h.ctx, ac.UserID)
+	if err != nil {
+		h.sendOAuthError(w, "server_error", "error getting user", http.StatusInternalServerError)
+		return
+	}
+
+	session, err := h.newSession(r, u, events.LoginSucceeded{Method: events.MethodOAuth, ClientID: c.ClientID}, ac.Scope)
+	if err != nil {
+		h.sendOAuthError(w, "server_error", err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	idClaims := token.NewIDTokenClaims(h.issuer, u.ID, c.ClientID, ac.AuthTime, viper.GetDuration("oidc.idTokenTTL"))
+	idClaims.Nonce = ac.Nonce
+	idClaims.AtHash = token.AccessTokenHash(session.AccessToken)
+	if slices.Contains(strings.Fields(ac.Scope), "profile") {
+		idClaims.Name = u.Name
+		idClaims.PreferredUsername = u.Username
+	}
+
+	idToken, err := h.signer.Sign(idClaims)
+	if err != nil {
+		h.sendOAuthError(w, "server_error", "error creating id token", http.StatusInternalServerError)
+		return
+	}
+
+	h.sendOAuthToken(w, OAuthTokenRes{
+		AccessToken:  session.AccessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(time.Until(session.AccessTokenTTL).Seconds()),
+		RefreshToken: session.RefreshToken,
+		IDToken:      idToken,
+		Scope:        ac.Scope,
+	})
+}
+
+// verifyCodeChallenge checks a PKCE verifier against an S256 challenge (RFC 7636)
+func verifyCodeChallenge(verifier string, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(codeChallengeS256(verifier)), []byte(challenge)) == 1
+}
+
+func codeChallengeS256(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// userinfo
+// @Summary OpenID Connect UserInfo
+// @Tags oidc
+// @Description Claims about the authenticated user
+// @ID oidc-userinfo
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {object} UserInfoRes
+// @Failure 401,403,500 {object} ErrorRes
+// @Router /userinfo [get]
+// @Router /userinfo [post]
+func (h *Handler) userInfo(w http.ResponseWriter, r *http.Request) {
+
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
+
+	u, err := h.currentUser(r)
+	if err != nil {
+		h.sendError(w, "error getting user", http.StatusInternalServerError)
+		return
+	}
+
+	res := UserInfoRes{Subject: strconv.Itoa(u.ID)}
+	if claims.HasScope("profile") {
+		res.Name = u.Name
+		res.PreferredUsername = u.Username
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// .well-known/openid-configuration
+// @Summary OpenID Provider Configuration
+// @Tags oidc
+// @Description OpenID Connect discovery document
+// @ID oidc-configuration
+// @Produce json
+// @Success 200 {object} OpenIDConfigurationRes
+// @Router /.well-known/openid-configuration [get]
+func (h *Handler) openIDConfiguration(w http.ResponseWriter, r *http.Request) {
+	grantTypes := make([]string, 0, len(supportedGrantTypes))
+	for g := range supportedGrantTypes {
+		grantTypes = append(grantTypes, g)
+	}
+	sort.Strings(grantTypes)
+
+	res := OpenIDConfigurationRes{
+		Issuer:                      h.issuer,
+		AuthorizationEndpoint:       h.issuer + "/authorize",
+		TokenEndpoint:               h.issuer + "/oauth/token",
+		UserinfoEndpoint:            h.issuer + "/userinfo",
+		JwksURI:                     h.issuer + "/.well-known/jwks.json",
+		IntrospectionEndpoint:       h.issuer + "/oauth/introspect",
+		RevocationEndpoint:          h.issuer + "/oauth/revoke",
+		DeviceAuthorizationEndpoint: h.issuer + "/oauth/device_authorization",
+		ScopesSupported:             oidcScopes,
+		ResponseTypesSupported: []string{
+			"code",
+		},
+		GrantTypesSupported: grantTypes,
+		SubjectTypesSupported: []string{
+			"public",
+		},
+		IDTokenSigningAlgValuesSupported: []string{
+			"RS256",
+		},
+		TokenEndpointAuthMethodsSupported: []string{
+			db.ClientAuthSecretBasic, db.ClientAuthSecretPost, db.ClientAuthPrivateKeyJWT, db.ClientAuthNone,
+		},
+		TokenEndpointAuthSigningAlgValuesSupported: []string{
+			"RS256", "PS256", "ES256",
+		},
+		CodeChallengeMethodsSupported: []string{
+			"S256",
+		},
+		ClaimsSupported: []string{
+			"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "name", "preferred_username",
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// .well-known/jwks.json
+// @Summary JSON Web Key Set
+// @Tags oidc
+// @Description Public keys used to verify ID tokens
+// @ID oidc-jwks
+// @Produce json
+// @Success 200 {object} token.JWKS
+// @Router /.well-known/jwks.json [get]
+func (h *Handler) jwks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(h.signer.JWKS())
+}
@@ -0,0 +1,402 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/arrogantworm/jwt_auth/api/authn"
+	"github.com/arrogantworm/jwt_auth/api/events"
+	"github.com/arrogantworm/jwt_auth/api/token"
+	"github.com/arrogantworm/jwt_auth/api/utils"
+	"github.com/arrogantworm/jwt_auth/db"
+	"github.com/jackc/pgx/v5"
+	"github.com/spf13/viper"
+)
+
+var (
+	errPhoneThrottled   = errors.New("too many codes requested for this number, try again later")
+	errInvalidPhoneCode = errors.New("invalid or expired code")
+)
+
+// requirePhoneLogin answers 404 while phone login is disabled
+func (h *Handler) requirePhoneLogin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !viper.GetBool("phone.enabled") {
+			h.sendError(w, "phone login is not enabled", http.StatusNotFound)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// auth/phone/start
+// @Summary Start phone login
+// @Tags auth, phone
+// @Description Text a one-time code to the account with this verified phone number. The response is the same whether or not the number belongs to an account. Codes are throttled per number.
+// @ID auth-phone-start
+// @Accept json
+// @Param input body PhoneStartReq true "Phone number in international format"
+// @Produce json
+// @Success 202 {object} SuccessRes
+// @Failure 400,404,429,500 {object} ErrorRes
+// @Router /auth/phone/start [post]
+func (h *Handler) startPhoneLogin(w http.ResponseWriter, r *http.Request) {
+	var req PhoneStartReq
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendError(w, "", http.StatusBadRequest)
+		return
+	}
+
+	phone, err := utils.NormalizePhone(req.Phone)
+	if err != nil {
+		h.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Unknown numbers get a code that is never sent, so they are throttled the same way
+	var userID *int
+
+	u, err := h.db.GetUserByPhone(h.ctx, phone)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		h.sendError(w, "error getting user", http.StatusInternalServerError)
+		return
+	}
+	if err == nil && u.Active {
+		userID = &u.ID
+	}
+
+	if !h.sendPhoneCode(w, phone, db.PhoneOTPLogin, userID) {
+		return
+	}
+
+	h.sendSuccess(w, "if the number belongs to an account, a code has been sent", http.StatusAccepted)
+}
+
+// auth/phone/verify
+// @Summary Verify phone login
+// @Tags auth, phone
+// @Description Sign in with the code texted by /auth/phone/start, like /auth/signin. A code can be tried a limited number of times.
+// @ID auth-phone-verify
+// @Accept json
+// @Param input body PhoneVerifyReq true "Phone number and code"
+// @Produce json
+// @Success 200 {object} LoginUserRes
+// @Failure 400,401,403,404,500 {object} ErrorRes
+// @Router /auth/phone/verify [post]
+func (h *Handler) verifyPhoneLogin(w http.ResponseWriter, r *http.Request) {
+	var req PhoneVerifyReq
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendError(w, "", http.StatusBadRequest)
+		return
+	}
+
+	phone, err := utils.NormalizePhone(req.Phone)
+	if err != nil {
+		h.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Code == "" {
+		h.sendError(w, "code is required", http.StatusBadRequest)
+		return
+	}
+
+	otp, err := h.verifyPhoneCode(phone, db.PhoneOTPLogin, req.Code)
+	if errors.Is(err, errInvalidPhoneCode) || (err == nil && otp.UserID == nil) {
+		h.loginFailed(r, events.MethodPhone, phone, events.ReasonInvalidCode)
+		h.sendError(w, errInvalidPhoneCode.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		h.sendError(w, "error checking code", http.StatusInternalServerError)
+		return
+	}
+
+	u, err := h.db.GetUserById(h.ctx, *otp.UserID)
+	if err != nil {
+		h.sendError(w, "error getting user", http.StatusInternalServerError)
+		return
+	}
+
+	res, err := h.newSession(r, u, events.LoginSucceeded{Method: events.MethodPhone}, "")
+	if errors.Is(err, authn.ErrUserDisabled) {
+		h.loginFailed(r, events.MethodPhone, phone, events.ReasonUserDisabled)
+		h.sendError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		h.sendError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.sendSession(w, res)
+}
+
+// api/user/phone
+// @Summary Add phone number
+// @Tags user, phone
+// @Description Text a code to a phone number to verify it for phone login. The number is saved once /api/user/phone/verify accepts the code. The current password is required, so that an access token alone can't add a number to sign in with.
+// @ID user-phone-add
+// @Security BearerAuth
+// @Accept json
+// @Param input body PhoneAddReq true "Phone number in international format and current password"
+// @Produce json
+// @Success 202 {object} SuccessRes
+// @Failure 400,401,403,404,409,429,500 {object} ErrorRes
+// @Router /api/user/phone [put]
+func (h *Handler) addPhone(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
+
+	var req PhoneAddReq
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendError(w, "", http.StatusBadRequest)
+		return
+	}
+
+	phone, err := utils.NormalizePhone(req.Phone)
+	if err != nil {
+		h.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.CurrentPassword == "" {
+		h.sendError(w, "current password is required", http.StatusBadRequest)
+		return
+	}
+
+	u, err := h.db.GetUserById(h.ctx, claims.ID)
+	if err != nil {
+		h.sendError(w, "error getting user", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = h.authenticator.Authenticate(h.ctx, u.Username, req.CurrentPassword)
+	if errors.Is(err, authn.ErrWrongPassword) || errors.Is(err, pgx.ErrNoRows) {
+		h.sendError(w, authn.ErrWrongPassword.Error(), http.StatusUnauthorized)
+		return
+	}
+	if errors.Is(err, authn.ErrUserDisabled) || errors.Is(err, authn.ErrPasswordResetRequired) {
+		h.sendError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		h.sendError(w, "error checking password", http.StatusInternalServerError)
+		return
+	}
+
+	if !h.checkPhoneAvailable(w, phone, claims.ID) {
+		return
+	}
+
+	if !h.sendPhoneCode(w, phone, db.PhoneOTPEnroll, &claims.ID) {
+		return
+	}
+
+	h.sendSuccess(w, "code sent", http.StatusAccepted)
+}
+
+// api/user/phone/verify
+// @Summary Verify phone number
+// @Tags user, phone
+// @Description Save the phone number the code was sent to by PUT /api/user/phone
+// @ID user-phone-verify
+// @Security BearerAuth
+// @Accept json
+// @Param input body PhoneVerifyReq true "Phone number and code"
+// @Produce json
+// @Success 200 {object} SuccessRes
+// @Failure 400,401,403,404,409,500 {object} ErrorRes
+// @Router /api/user/phone/verify [post]
+func (h *Handler) verifyPhone(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
+
+	var req PhoneVerifyReq
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendError(w, "", http.StatusBadRequest)
+		return
+	}
+
+	phone, err := utils.NormalizePhone(req.Phone)
+	if err != nil {
+		h.sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Code == "" {
+		h.sendError(w, "code is required", http.StatusBadRequest)
+		return
+	}
+
+	otp, err := h.verifyPhoneCode(phone, db.PhoneOTPEnroll, req.Code)
+	if errors.Is(err, errInvalidPhoneCode) || (err == nil && (otp.UserID == nil || *otp.UserID != claims.ID)) {
+		h.sendError(w, errInvalidPhoneCode.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		h.sendError(w, "error checking code", http.StatusInternalServerError)
+		return
+	}
+
+	if !h.checkPhoneAvailable(w, phone, claims.ID) {
+		return
+	}
+
+	enrolled, err := h.stageEvent(r, events.TypeMFAEnrolled, claims.ID, claims.RegisteredClaims.ID, events.MFAEnrolled{Method: events.MethodPhone})
+	if err != nil {
+		h.sendError(w, "error saving phone number", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.db.SetUserPhone(h.ctx, claims.ID, &phone, enrolled); err != nil {
+		h.sendError(w, "error saving phone number", http.StatusInternalServerError)
+		return
+	}
+
+	h.sendSuccess(w, "phone number verified", http.StatusOK)
+}
+
+// api/user/phone
+// @Summary Remove phone number
+// @Tags user, phone
+// @Description Remove the phone number, which turns off phone login for the account
+// @ID user-phone-remove
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {object} SuccessRes
+// @Failure 401,403,404,500 {object} ErrorRes
+// @Router /api/user/phone [delete]
+func (h *Handler) removePhone(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
+
+	if err := h.db.SetUserPhone(h.ctx, claims.ID, nil); err != nil {
+		h.sendError(w, "error removing phone number", http.StatusInternalServerError)
+		return
+	}
+
+	h.sendSuccess(w, "phone number removed", http.StatusOK)
+}
+
+// checkPhoneAvailable rejects a number that is verified on another account
+func (h *Handler) checkPhoneAvailable(w http.ResponseWriter, phone string, userID int) bool {
+	u, err := h.db.GetUserByPhone(h.ctx, phone)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return true
+	}
+	if err != nil {
+		h.sendError(w, "error getting user", http.StatusInternalServerError)
+		return false
+	}
+
+	if u.ID != userID {
+		h.sendError(w, "phone number is already in use", http.StatusConflict)
+		return false
+	}
+
+	return true
+}
+
+// sendPhoneCode records a new code for phone and texts it when userID is set.
+// Requests beyond the per-number limits are answered with 429.
+func (h *Handler) sendPhoneCode(w http.ResponseWriter, phone string, purpose string, userID *int) bool {
+	window := viper.GetDuration("phone.throttleWindow")
+	resendInterval := viper.GetDuration("phone.resendInterval")
+
+	sends, lastAge, err := h.db.PhoneOTPSends(h.ctx, phone, window)
+	if err != nil {
+		h.sendError(w, "error sending code", http.StatusInternalServerError)
+		return false
+	}
+
+	var retryAfter time.Duration
+	if lastAge != nil && *lastAge < resendInterval {
+		retryAfter = resendInterval - *lastAge
+	}
+	if sends >= viper.GetInt("phone.maxSends") {
+		retryAfter = window
+	}
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		h.sendError(w, errPhoneThrottled.Error(), http.StatusTooManyRequests)
+		return false
+	}
+
+	code, err := utils.RandomDigits(viper.GetInt("phone.codeLength"))
+	if err != nil {
+		h.sendError(w, "error sending code", http.StatusInternalServerError)
+		return false
+	}
+
+	hashed, err := utils.HashPassword(code)
+	if err != nil {
+		h.sendError(w, "error sending code", http.StatusInternalServerError)
+		return false
+	}
+
+	ttl := viper.GetDuration("phone.codeTTL")
+
+	err = h.db.CreatePhoneOTP(h.ctx, &db.PhoneOTP{
+		Phone:     phone,
+		Purpose:   purpose,
+		UserID:    userID,
+		CodeHash:  hashed,
+		ExpiresAt: time.Now().Add(ttl),
+	})
+	if err != nil {
+		h.sendError(w, "error sending code", http.StatusInternalServerError)
+		return false
+	}
+
+	if userID == nil {
+		return true
+	}
+
+	message := fmt.Sprintf("Your sign-in code is %s. It expires in %s.", code, ttl)
+	if purpose == db.PhoneOTPEnroll {
+		message = fmt.Sprintf("Your verification code is %s. It expires in %s.", code, ttl)
+	}
+
+	// Sent in the background so the response time doesn't reveal whether the number is known
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		if err := h.sms.Send(ctx, phone, message); err != nil {
+			log.Println("[SMS]", err)
+		}
+	}()
+
+	return true
+}
+
+// verifyPhoneCode counts an attempt against the latest code for phone and, when
+// code matches, uses up every outstanding code for the number
+func (h *Handler) verifyPhoneCode(phone string, purpose string, code string) (*db.PhoneOTP, error) {
+	otp, err := h.db.UsePhoneOTPAttempt(h.ctx, phone, purpose, viper.GetInt("phone.maxAttempts"))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errInvalidPhoneCode
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := utils.CheckPassword(code, otp.CodeHash); err != nil {
+		return nil, errInvalidPhoneCode
+	}
+
+	if err := h.db.ExpirePhoneOTPs(h.ctx, phone, purpose); err != nil {
+		return nil, err
+	}
+
+	return otp, nil
+}
@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/arrogantworm/jwt_auth/api/events"
+	"github.com/arrogantworm/jwt_auth/api/geoip"
+	"github.com/arrogantworm/jwt_auth/api/risk"
+	"github.com/arrogantworm/jwt_auth/db"
+)
+
+var (
+	errRiskReauth  = errors.New("additional verification required, sign in with an emailed link or a phone code")
+	errRiskDenied  = errors.New("sign in refused")
+	errSignInAgain = errors.New("sign in again to continue")
+)
+
+// assessRisk scores a signin or renewal of userID by r from loc, and records
+// the decision in the audit trail. Everything is allowed while the engine is
+// disabled.
+func (h *Handler) assessRisk(r *http.Request, kind string, userID int, sessionID string, loc *geoip.Location) *risk.Assessment {
+	if !h.risk.Enabled() {
+		return &risk.Assessment{Decision: risk.DecisionAllow}
+	}
+
+	var fingerprint string
+	if deviceID := requestDeviceID(r); deviceID != "" {
+		fingerprint = deviceFingerprint(deviceID, r.UserAgent())
+	}
+
+	a := h.risk.Assess(h.ctx, &risk.Attempt{
+		Kind:              kind,
+		UserID:            userID,
+		IP:                remoteIP(r),
+		UserAgent:         r.UserAgent(),
+		DeviceFingerprint: fingerprint,
+		Location:          loc,
+		Time:              time.Now(),
+	})
+
+	signals := make([]events.RiskSignal, 0, len(a.Hits))
+	for _, hit := range a.Hits {
+		signals = append(signals, events.RiskSignal{Name: hit.Name, Score: hit.Score})
+	}
+
+	h.publishEvent(r, events.TypeRiskAssessed, userID, sessionID, events.RiskAssessed{
+		Kind:     kind,
+		Score:    a.Score,
+		Signals:  signals,
+		Decision: a.Decision,
+	})
+
+	return a
+}
+
+// checkRenewalRisk scores the renewal of s by r from loc. It returns false
+// when the session was ended and the caller has been answered: reauth ends
+// the session, deny every session of the user.
+func (h *Handler) checkRenewalRisk(w http.ResponseWriter, r *http.Request, s *db.Session, loc *geoip.Location) bool {
+	a := h.assessRisk(r, risk.KindRenew, s.UserID, s.SessionID, loc)
+
+	switch a.Decision {
+	case risk.DecisionReauth:
+		h.sendError(w, errSignInAgain.Error(), http.StatusUnauthorized)
+		h.endSession(r, s, events.ReasonRiskReauth)
+		return false
+	case risk.DecisionDeny:
+		revoked, err := h.stageEvent(r, events.TypeUserSessionsRevoked, s.UserID, "", events.UserSessionsRevoked{Reason: events.ReasonRiskDenied})
+		if err != nil {
+			h.sendError(w, "error revoking sessions", http.StatusInternalServerError)
+			return false
+		}
+
+		if _, err := h.db.RevokeUserSessions(h.ctx, s.UserID, "", revoked); err != nil {
+			h.sendError(w, "error revoking sessions", http.StatusInternalServerError)
+			return false
+		}
+
+		h.sendError(w, "session revoked", http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
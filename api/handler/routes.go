@@ -4,6 +4,7 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
+	"github.com/spf13/viper"
 	httpSwagger "github.com/swaggo/http-swagger"
 )
 
@@ -11,12 +12,20 @@ func (h *Handler) RegisterRoutes() *chi.Mux {
 	r := chi.NewRouter()
 	r.Use(middleware.StripSlashes)
 
+	// Cookies are only sent cross-origin to the listed frontends
+	allowedOrigins := []string{"*"}
+	allowCredentials := false
+	if origins := viper.GetStringSlice("cookies.allowedOrigins"); cookieMode() && len(origins) > 0 {
+		allowedOrigins = origins
+		allowCredentials = true
+	}
+
 	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
+		AllowedOrigins:   allowedOrigins,
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "X-Device-ID"},
 		ExposedHeaders:   []string{"Link"},
-		AllowCredentials: false,
+		AllowCredentials: allowCredentials,
 		MaxAge:           300,
 	}))
 
@@ -25,17 +34,150 @@ func (h *Handler) RegisterRoutes() *chi.Mux {
 	r.Route("/auth", func(r chi.Router) {
 		r.Post("/signup", h.createUser)
 		r.Post("/signin", h.loginUser)
-		r.With(GetAuthMiddlewareFunc(tokenMaker)).Post("/logout", h.logoutUser)
+		r.Post("/logout", h.logoutUser)
+		r.With(GetAuthMiddlewareFunc(tokenMaker, nil), RequireScope(scopeUserWrite)).Post("/logout-all", h.logoutAll)
+
+		r.Route("/magic-link", func(r chi.Router) {
+			r.Use(h.requireMagicLink)
+			r.Post("/request", h.requestMagicLink)
+			r.Get("/consume", h.confirmMagicLink)
+			r.Post("/consume", h.consumeMagicLink)
+		})
+
+		r.Route("/signin-alert", func(r chi.Router) {
+			r.Use(h.requireNewDeviceAlerts)
+			r.Get("/deny", h.confirmDenySignIn)
+			r.Post("/deny", h.denySignIn)
+			r.Post("/reset", h.resetPasswordAfterSignInAlert)
+		})
+
+		r.Route("/phone", func(r chi.Router) {
+			r.Use(h.requirePhoneLogin)
+			r.Post("/start", h.startPhoneLogin)
+			r.Post("/verify", h.verifyPhoneLogin)
+		})
+
+		r.Get("/external", h.listExternalProviders)
+		r.Get("/external/{provider}/start", h.externalLoginStart)
+		r.Get("/external/{provider}/callback", h.externalLoginCallback)
 
 		r.Route("/tokens", func(r chi.Router) {
-			r.With(GetAuthMiddlewareFunc(tokenMaker)).Post("/revoke", h.revokeSession)
-			r.With(GetUserClaimsMiddlewareFunc(tokenMaker)).Post("/renew", h.renewAccessToken)
+			r.Post("/revoke", h.revokeSession)
+			r.Post("/renew", h.renewAccessToken)
 		})
 	})
 
 	r.Route("/api", func(r chi.Router) {
 		r.Get("/test", h.testHandler)
-		r.With(GetAuthMiddlewareFunc(tokenMaker)).Get("/user", h.getUserInfo)
+		r.With(GetAuthMiddlewareFunc(tokenMaker, h), RequireScope(scopeUserRead)).Get("/user", h.getUserInfo)
+
+		r.Route("/user/keys", func(r chi.Router) {
+			r.Use(GetAuthMiddlewareFunc(tokenMaker, nil), RequireScope(scopeUserKeys))
+			r.Post("/", h.createAPIKey)
+			r.Get("/", h.listAPIKeys)
+			r.Delete("/{keyID}", h.revokeAPIKey)
+		})
+
+		r.With(GetAuthMiddlewareFunc(tokenMaker, nil), RequireScope(scopeUserWrite)).Put("/user/password", h.changePassword)
+		r.With(GetAuthMiddlewareFunc(tokenMaker, nil), RequireScope(scopeUserRead)).Get("/user/activity", h.getUserActivity)
+		r.With(GetAuthMiddlewareFunc(tokenMaker, nil), RequireScope(scopeUserWrite)).Post("/user/device", h.approveDevice)
+
+		r.Route("/user/phone", func(r chi.Router) {
+			r.Use(h.requirePhoneLogin, GetAuthMiddlewareFunc(tokenMaker, nil), RequireScope(scopeUserWrite))
+			r.Put("/", h.addPhone)
+			r.Delete("/", h.removePhone)
+			r.Post("/verify", h.verifyPhone)
+		})
+
+		r.Route("/user/identities", func(r chi.Router) {
+			r.Use(GetAuthMiddlewareFunc(tokenMaker, nil), RequireScope(scopeUserWrite))
+			r.Get("/", h.listIdentities)
+			r.Post("/{provider}", h.linkIdentityStart)
+			r.Delete("/{provider}", h.unlinkIdentity)
+		})
+	})
+
+	r.Route("/oauth", func(r chi.Router) {
+		r.Post("/token", h.oauthToken)
+		r.Post("/introspect", h.introspectToken)
+		r.Post("/revoke", h.revokeToken)
+		r.Post("/device_authorization", h.deviceAuthorization)
+	})
+
+	r.Route("/saml", func(r chi.Router) {
+		r.Use(h.requireSAML)
+		r.Get("/metadata", h.samlMetadata)
+		r.Get("/login", h.samlLogin)
+		r.Post("/acs", h.samlACS)
+	})
+
+	r.Route("/scim/v2", func(r chi.Router) {
+		r.Use(h.requireSCIMClient, h.auditAdminActions)
+		r.Get("/ServiceProviderConfig", h.scimServiceProviderConfig)
+
+		r.Route("/Users", func(r chi.Router) {
+			r.Get("/", h.scimListUsers)
+			r.Post("/", h.scimCreateUser)
+			r.Get("/{id}", h.scimGetUser)
+			r.Put("/{id}", h.scimReplaceUser)
+			r.Patch("/{id}", h.scimPatchUser)
+			r.Delete("/{id}", h.scimDeleteUser)
+		})
+
+		r.Route("/Groups", func(r chi.Router) {
+			r.Get("/", h.scimListGroups)
+			r.Post("/", h.scimCreateGroup)
+			r.Get("/{id}", h.scimGetGroup)
+			r.Put("/{id}", h.scimReplaceGroup)
+			r.Patch("/{id}", h.scimPatchGroup)
+			r.Delete("/{id}", h.scimDeleteGroup)
+		})
+	})
+
+	r.Get("/device", h.deviceVerification)
+	r.Post("/device", h.deviceVerification)
+
+	r.Get("/authorize", h.authorize)
+	r.Post("/authorize", h.authorize)
+
+	r.Group(func(r chi.Router) {
+		r.Use(GetAuthMiddlewareFunc(tokenMaker, nil), RequireScope("openid"))
+		r.Get("/userinfo", h.userInfo)
+		r.Post("/userinfo", h.userInfo)
+	})
+
+	r.Get("/.well-known/openid-configuration", h.openIDConfiguration)
+	r.Get("/.well-known/jwks.json", h.jwks)
+
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(GetAuthMiddlewareFunc(tokenMaker, nil), RequireScope(scopeAdmin), h.requireRole(roleAdmin), h.auditAdminActions)
+
+		r.Route("/clients", func(r chi.Router) {
+			r.Post("/", h.createClient)
+			r.Get("/", h.listClients)
+			r.Get("/{clientID}", h.getClient)
+			r.Put("/{clientID}", h.updateClient)
+			r.Delete("/{clientID}", h.deleteClient)
+			r.Post("/{clientID}/secret", h.rotateClientSecret)
+			r.Get("/{clientID}/exchange-rules", h.listExchangeRules)
+			r.Post("/{clientID}/exchange-rules", h.createExchangeRule)
+			r.Delete("/{clientID}/exchange-rules/{ruleID}", h.deleteExchangeRule)
+		})
+
+		r.Post("/users/{userID}/logout-all", h.adminLogoutAll)
+
+		r.Get("/audit-log", h.listAuditLog)
+		r.Get("/audit-log/export", h.exportAuditLog)
+
+		r.Route("/webhooks", func(r chi.Router) {
+			r.Post("/", h.createWebhook)
+			r.Get("/", h.listWebhooks)
+			r.Get("/{webhookID}", h.getWebhook)
+			r.Put("/{webhookID}", h.updateWebhook)
+			r.Delete("/{webhookID}", h.deleteWebhook)
+			r.Post("/{webhookID}/secret", h.rotateWebhookSecret)
+			r.Get("/{webhookID}/dead-letters", h.listWebhookDeadLetters)
+		})
 	})
 
 	r.Route("/new-ip", func(r chi.Router) {
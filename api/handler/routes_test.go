@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arrogantworm/jwt_auth/api/token"
+	"github.com/spf13/viper"
+)
+
+func TestClientTokensNeedScope(t *testing.T) {
+	tokenMaker := token.NewJWTMaker("secret")
+	tokenMaker.AccessTokenTTL = time.Minute
+
+	h := &Handler{TokenMaker: tokenMaker}
+	router := h.RegisterRoutes()
+
+	// What a relying party gets from the authorization_code grant for an admin
+	rpToken, _, err := tokenMaker.CreateScopedAccessToken(1, "admin", "openid profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+	}{
+		{http.MethodGet, "/admin/clients"},
+		{http.MethodPost, "/admin/clients"},
+		{http.MethodGet, "/admin/audit-log"},
+		{http.MethodPost, "/api/user/keys"},
+		{http.MethodPut, "/api/user/password"},
+		{http.MethodGet, "/api/user/activity"},
+		{http.MethodPost, "/api/user/device"},
+		{http.MethodGet, "/api/user/identities"},
+		{http.MethodPost, "/auth/logout-all"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("Authorization", "Bearer "+rpToken)
+
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusForbidden {
+				t.Errorf("got status %d, want %d: %s", rec.Code, http.StatusForbidden, rec.Body)
+			}
+		})
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	tokenMaker := token.NewJWTMaker("secret")
+	tokenMaker.AccessTokenTTL = time.Minute
+
+	firstParty, _, err := tokenMaker.CreateAccessToken(1, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scoped, _, err := tokenMaker.CreateScopedAccessToken(1, "admin", "openid admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unscoped, _, err := tokenMaker.CreateScopedAccessToken(1, "admin", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	handler := GetAuthMiddlewareFunc(tokenMaker, nil)(RequireScope(scopeAdmin)(next))
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"first-party", firstParty, http.StatusNoContent},
+		{"client with the scope", scoped, http.StatusNoContent},
+		{"client without scopes", unscoped, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/admin/clients", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("got status %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestAddPhoneNeedsPassword(t *testing.T) {
+	viper.Set("phone.enabled", true)
+	t.Cleanup(func() { viper.Set("phone.enabled", false) })
+
+	tokenMaker := token.NewJWTMaker("secret")
+	tokenMaker.AccessTokenTTL = time.Minute
+
+	h := &Handler{TokenMaker: tokenMaker}
+	router := h.RegisterRoutes()
+
+	accessToken, _, err := tokenMaker.CreateAccessToken(1, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPut, "/api/user/phone", strings.NewReader(`{"phone":"+14155550123"}`))
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d: %s", rec.Code, http.StatusBadRequest, rec.Body)
+	}
+}
+
+func TestMagicLinkGetDoesNotConsume(t *testing.T) {
+	viper.Set("magicLink.enabled", true)
+	t.Cleanup(func() { viper.Set("magicLink.enabled", false) })
+
+	tokenMaker := token.NewJWTMaker("secret")
+
+	// Without a database, using up the link would panic
+	h := &Handler{TokenMaker: tokenMaker}
+	router := h.RegisterRoutes()
+
+	tok, _, err := tokenMaker.CreateMagicLinkToken(1, "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/auth/magic-link/consume?token="+tok, nil)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if !strings.Contains(rec.Body.String(), `action="/auth/magic-link/consume"`) {
+		t.Errorf("confirmation page doesn't post back the token: %s", rec.Body)
+	}
+}
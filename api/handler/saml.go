@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/arrogantworm/jwt_auth/api/events"
+	"github.com/arrogantworm/jwt_auth/api/federation"
+	"github.com/arrogantworm/jwt_auth/api/utils"
+	"github.com/arrogantworm/jwt_auth/db"
+	"github.com/spf13/viper"
+)
+
+// requireSAML answers 404 while SAML is disabled
+func (h *Handler) requireSAML(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.saml == nil {
+			h.sendError(w, "saml is not enabled", http.StatusNotFound)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// saml/metadata
+// @Summary SAML Metadata
+// @Tags auth, saml
+// @Description SAML 2.0 service provider metadata for registering this service with the identity provider
+// @ID saml-metadata
+// @Produce xml
+// @Success 200 {string} string "EntityDescriptor"
+// @Failure 404,500 {object} ErrorRes
+// @Router /saml/metadata [get]
+func (h *Handler) samlMetadata(w http.ResponseWriter, r *http.Request) {
+	metadata, err := h.saml.Metadata()
+	if err != nil {
+		h.sendError(w, "error building metadata", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write(metadata)
+}
+
+// saml/login
+// @Summary SAML Login
+// @Tags auth, saml
+// @Description Redirect to the SAML identity provider with an AuthnRequest
+// @ID saml-login
+// @Success 302
+// @Failure 404,500 {object} ErrorRes
+// @Router /saml/login [get]
+func (h *Handler) samlLogin(w http.ResponseWriter, r *http.Request) {
+	relayState, err := utils.RandomHex(16)
+	if err != nil {
+		h.sendError(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	authURL, requestID, err := h.saml.AuthnRequestURL(r.Context(), relayState)
+	if err != nil {
+		log.Println("[SAML]", err)
+		h.sendError(w, "error starting saml login", http.StatusInternalServerError)
+		return
+	}
+
+	// The ACS is reached by a cross-site POST that doesn't carry a Lax cookie,
+	// so the single-use relay state alone ties the response to this request.
+	// The AuthnRequest ID is kept as the state's nonce.
+	err = h.db.CreateExternalLoginState(h.ctx, &db.ExternalLoginState{
+		StateHash: utils.SHA256Hex(relayState),
+		Provider:  federation.SAMLProviderName,
+		Nonce:     requestID,
+		ExpiresAt: time.Now().Add(viper.GetDuration("federation.stateTTL")),
+	})
+	if err != nil {
+		h.sendError(w, "error starting saml login", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// saml/acs
+// @Summary SAML Assertion Consumer Service
+// @Tags auth, saml
+// @Description Receives the identity provider's SAML response and signs the user in like /auth/signin. When federation.successRedirect is set the tokens are passed to it in the URL fragment.
+// @ID saml-acs
+// @Accept x-www-form-urlencoded
+// @Param SAMLResponse formData string true "Base64 encoded SAML response"
+// @Param RelayState formData string false "Relay state of the AuthnRequest"
+// @Produce json
+// @Success 200 {object} LoginUserRes
+// @Success 302
+// @Failure 400,401,403,404,500 {object} ErrorRes
+// @Router /saml/acs [post]
+func (h *Handler) samlACS(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		h.sendExternalError(w, r, "malformed form body", http.StatusBadRequest)
+		return
+	}
+
+	// Without a known relay state only IdP-initiated responses can pass, if they are allowed
+	var requestIDs []string
+	if relayState := r.PostForm.Get("RelayState"); relayState != "" {
+		state, err := h.db.ConsumeExternalLoginState(h.ctx, utils.SHA256Hex(relayState), federation.SAMLProviderName)
+		if err == nil {
+			requestIDs = []string{state.Nonce}
+		}
+	}
+
+	identity, err := h.saml.ParseResponse(r.Context(), r, requestIDs)
+	if err != nil {
+		log.Println("[SAML] invalid response:", err)
+		h.sendExternalError(w, r, "invalid saml response", http.StatusUnauthorized)
+		return
+	}
+
+	u, err := federation.ResolveUser(h.ctx, h.db, federation.SAMLProviderName, h.saml.AutoProvision(), identity)
+	if errors.Is(err, federation.ErrIdentityNotLinked) {
+		h.sendExternalError(w, r, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		h.sendExternalError(w, r, "error getting user", http.StatusInternalServerError)
+		return
+	}
+
+	h.externalLoginSession(w, r, u, events.LoginSucceeded{Method: events.MethodSAML, Provider: federation.SAMLProviderName})
+}
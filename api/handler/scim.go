@@ -0,0 +1,1153 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arrogantworm/jwt_auth/api/events"
+	"github.com/arrogantworm/jwt_auth/api/token"
+	"github.com/arrogantworm/jwt_auth/api/utils"
+	"github.com/arrogantworm/jwt_auth/db"
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	scimUserSchema                  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema                 = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimListSchema                  = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema                 = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimServiceProviderConfigSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+
+	// scimScope is the client scope a provisioning client needs
+	scimScope = "scim"
+
+	scimDefaultCount = 100
+	scimMaxCount     = 1000
+)
+
+var (
+	scimFilterRe         = regexp.MustCompile(`^\s*([A-Za-z][A-Za-z0-9._]*)\s+(?i:eq)\s+(.+?)\s*$`)
+	scimMemberFilterRe   = regexp.MustCompile(`^(?i:members)\[(?i:value)\s+(?i:eq)\s+"([^"]*)"\]$`)
+	scimEmailValuePathRe = regexp.MustCompile(`^(?i:emails)\[[^\]]*\]\.(?i:value)$`)
+)
+
+// scimError is a SCIM error response, see RFC 7644 section 3.12
+type scimError struct {
+	status   int
+	scimType string
+	detail   string
+}
+
+func (h *Handler) sendSCIMError(w http.ResponseWriter, e *scimError) {
+	h.sendSCIM(w, SCIMErrorRes{
+		Schemas:  []string{scimErrorSchema},
+		Status:   strconv.Itoa(e.status),
+		SCIMType: e.scimType,
+		Detail:   e.detail,
+	}, e.status)
+}
+
+func (h *Handler) sendSCIM(w http.ResponseWriter, v any, status int) {
+	w.Header().Set("Content-Type", "application/scim+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// requireSCIMClient accepts client credentials access tokens granted the scim scope
+func (h *Handler) requireSCIMClient(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fields := strings.Fields(r.Header.Get("Authorization"))
+		if len(fields) != 2 || fields[0] != "Bearer" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			h.sendSCIMError(w, &scimError{status: http.StatusUnauthorized, detail: "authorization header is missing"})
+			return
+		}
+
+		claims, err := h.TokenMaker.VerifyToken(fields[1])
+		if err != nil || claims.SubjectType != token.SubjectTypeClient {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			h.sendSCIMError(w, &scimError{status: http.StatusUnauthorized, detail: "invalid token"})
+			return
+		}
+
+		if !claims.HasScope(scimScope) {
+			h.sendSCIMError(w, &scimError{status: http.StatusForbidden, detail: "insufficient scope: scim required"})
+			return
+		}
+
+		c, err := h.db.GetClient(h.ctx, claims.Subject)
+		if err != nil || c.IsDisabled {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			h.sendSCIMError(w, &scimError{status: http.StatusUnauthorized, detail: "client is not active"})
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authKey{}, claims)))
+	})
+}
+
+// scim/v2/ServiceProviderConfig
+// @Summary SCIM service provider config
+// @Tags scim
+// @Description Features of the SCIM 2.0 API
+// @ID scim-service-provider-config
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {object} SCIMServiceProviderConfig
+// @Failure 401,403 {object} SCIMErrorRes
+// @Router /scim/v2/ServiceProviderConfig [get]
+func (h *Handler) scimServiceProviderConfig(w http.ResponseWriter, r *http.Request) {
+	h.sendSCIM(w, SCIMServiceProviderConfig{
+		Schemas:        []string{scimServiceProviderConfigSchema},
+		Patch:          SCIMSupported{Supported: true},
+		Bulk:           SCIMBulk{},
+		Filter:         SCIMFilter{Supported: true, MaxResults: scimMaxCount},
+		ChangePassword: SCIMSupported{Supported: true},
+		Sort:           SCIMSupported{},
+		ETag:           SCIMSupported{},
+		AuthenticationSchemes: []SCIMAuthScheme{{
+			Type:        "oauthbearertoken",
+			Name:        "OAuth Bearer Token",
+			Description: "Access token of a client credentials client granted the scim scope",
+		}},
+	}, http.StatusOK)
+}
+
+// scim/v2/Users
+// @Summary SCIM list users
+// @Tags scim
+// @Description List users. The filter supports a single eq comparison on userName, externalId, emails or active.
+// @ID scim-users-list
+// @Security BearerAuth
+// @Param filter query string false "e.g. userName eq \"alice\""
+// @Param startIndex query int false "1-based index of the first result"
+// @Param count query int false "Page size"
+// @Produce json
+// @Success 200 {object} SCIMListRes
+// @Failure 400,401,403,500 {object} SCIMErrorRes
+// @Router /scim/v2/Users [get]
+func (h *Handler) scimListUsers(w http.ResponseWriter, r *http.Request) {
+	startIndex, count, serr := scimPage(r)
+	if serr != nil {
+		h.sendSCIMError(w, serr)
+		return
+	}
+
+	var filter db.UserFilter
+
+	if f := r.URL.Query().Get("filter"); f != "" {
+		attr, value, serr := parseSCIMFilter(f)
+		if serr != nil {
+			h.sendSCIMError(w, serr)
+			return
+		}
+
+		switch attr {
+		case "username":
+			filter.Username = &value
+		case "externalid":
+			filter.ExternalID = &value
+		case "emails", "emails.value":
+			filter.Email = &value
+		case "active":
+			active, err := strconv.ParseBool(value)
+			if err != nil {
+				h.sendSCIMError(w, &scimError{status: http.StatusBadRequest, scimType: "invalidFilter", detail: "active must be compared to a boolean"})
+				return
+			}
+			filter.Active = &active
+		default:
+			h.sendSCIMError(w, &scimError{status: http.StatusBadRequest, scimType: "invalidFilter", detail: "unsupported filter attribute"})
+			return
+		}
+	}
+
+	users, total, err := h.db.ListUsers(h.ctx, filter, startIndex-1, count)
+	if err != nil {
+		h.sendSCIMError(w, &scimError{status: http.StatusInternalServerError, detail: "error getting users"})
+		return
+	}
+
+	resources := make([]SCIMUser, 0, len(users))
+	for _, u := range users {
+		resources = append(resources, h.toSCIMUser(u))
+	}
+
+	h.sendSCIM(w, SCIMListRes{
+		Schemas:      []string{scimListSchema},
+		TotalResults: total,
+		StartIndex:   startIndex,
+		ItemsPerPage: len(resources),
+		Resources:    resources,
+	}, http.StatusOK)
+}
+
+// scim/v2/Users
+// @Summary SCIM create user
+// @Tags scim
+// @Description Provision a user
+// @ID scim-users-create
+// @Security BearerAuth
+// @Accept json
+// @Param input body SCIMUser true "User"
+// @Produce json
+// @Success 201 {object} SCIMUser
+// @Failure 400,401,403,409,500 {object} SCIMErrorRes
+// @Router /scim/v2/Users [post]
+func (h *Handler) scimCreateUser(w http.ResponseWriter, r *http.Request) {
+	var req SCIMUser
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendSCIMError(w, &scimError{status: http.StatusBadRequest, scimType: "invalidSyntax", detail: "malformed request body"})
+		return
+	}
+
+	u := &db.User{AuthSource: db.AuthSourceSCIM}
+	if serr := fromSCIMUser(req, u); serr != nil {
+		h.sendSCIMError(w, serr)
+		return
+	}
+
+	exists, err := h.db.CheckUsername(h.ctx, u.Username)
+	if err != nil {
+		h.sendSCIMError(w, &scimError{status: http.StatusInternalServerError, detail: "error checking username"})
+		return
+	}
+	if exists {
+		h.sendSCIMError(w, &scimError{status: http.StatusConflict, scimType: "uniqueness", detail: "userName is already taken"})
+		return
+	}
+
+	active := u.Active
+
+	u, err = h.db.CreateUser(h.ctx, u)
+	if err != nil {
+		h.sendSCIMError(w, &scimError{status: http.StatusInternalServerError, detail: "error saving user"})
+		return
+	}
+
+	// Users are created active
+	if !active {
+		u.Active = false
+		if err := h.db.UpdateUser(h.ctx, u); err != nil {
+			h.sendSCIMError(w, &scimError{status: http.StatusInternalServerError, detail: "error saving user"})
+			return
+		}
+	}
+
+	res := h.toSCIMUser(u)
+	w.Header().Set("Location", res.Meta.Location)
+	h.sendSCIM(w, res, http.StatusCreated)
+}
+
+// scim/v2/Users/{id}
+// @Summary SCIM get user
+// @Tags scim
+// @Description Get a user
+// @ID scim-users-get
+// @Security BearerAuth
+// @Param id path string true "User ID"
+// @Produce json
+// @Success 200 {object} SCIMUser
+// @Failure 401,403,404,500 {object} SCIMErrorRes
+// @Router /scim/v2/Users/{id} [get]
+func (h *Handler) scimGetUser(w http.ResponseWriter, r *http.Request) {
+	u, serr := h.scimUser(r)
+	if serr != nil {
+		h.sendSCIMError(w, serr)
+		return
+	}
+
+	h.sendSCIM(w, h.toSCIMUser(u), http.StatusOK)
+}
+
+// scim/v2/Users/{id}
+// @Summary SCIM replace user
+// @Tags scim
+// @Description Replace a user. Setting active to false revokes all of the user's sessions. The password is kept when none is given.
+// @ID scim-users-replace
+// @Security BearerAuth
+// @Accept json
+// @Param id path string true "User ID"
+// @Param input body SCIMUser true "User"
+// @Produce json
+// @Success 200 {object} SCIMUser
+// @Failure 400,401,403,404,409,500 {object} SCIMErrorRes
+// @Router /scim/v2/Users/{id} [put]
+func (h *Handler) scimReplaceUser(w http.ResponseWriter, r *http.Request) {
+	u, serr := h.scimUser(r)
+	if serr != nil {
+		h.sendSCIMError(w, serr)
+		return
+	}
+
+	var req SCIMUser
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendSCIMError(w, &scimError{status: http.StatusBadRequest, scimType: "invalidSyntax", detail: "malformed request body"})
+		return
+	}
+
+	h.saveSCIMUser(w, r, u, req)
+}
+
+// scim/v2/Users/{id}
+// @Summary SCIM patch user
+// @Tags scim
+// @Description Modify a user with add, replace and remove operations. Setting active to false revokes all of the user's sessions.
+// @ID scim-users-patch
+// @Security BearerAuth
+// @Accept json
+// @Param id path string true "User ID"
+// @Param input body SCIMPatchReq true "Patch operations"
+// @Produce json
+// @Success 200 {object} SCIMUser
+// @Failure 400,401,403,404,409,500 {object} SCIMErrorRes
+// @Router /scim/v2/Users/{id} [patch]
+func (h *Handler) scimPatchUser(w http.ResponseWriter, r *http.Request) {
+	u, serr := h.scimUser(r)
+	if serr != nil {
+		h.sendSCIMError(w, serr)
+		return
+	}
+
+	var req SCIMPatchReq
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendSCIMError(w, &scimError{status: http.StatusBadRequest, scimType: "invalidSyntax", detail: "malformed request body"})
+		return
+	}
+
+	s := h.toSCIMUser(u)
+	if serr := applySCIMUserPatch(&s, req.Operations); serr != nil {
+		h.sendSCIMError(w, serr)
+		return
+	}
+
+	h.saveSCIMUser(w, r, u, s)
+}
+
+// saveSCIMUser replaces the attributes of u with s
+func (h *Handler) saveSCIMUser(w http.ResponseWriter, r *http.Request, u *db.User, s SCIMUser) {
+	oldUsername := u.Username
+	wasActive := u.Active
+
+	if serr := fromSCIMUser(s, u); serr != nil {
+		h.sendSCIMError(w, serr)
+		return
+	}
+
+	if u.Username != oldUsername {
+		exists, err := h.db.CheckUsername(h.ctx, u.Username)
+		if err != nil {
+			h.sendSCIMError(w, &scimError{status: http.StatusInternalServerError, detail: "error checking username"})
+			return
+		}
+		if exists {
+			h.sendSCIMError(w, &scimError{status: http.StatusConflict, scimType: "uniqueness", detail: "userName is already taken"})
+			return
+		}
+	}
+
+	var staged []*db.OutboxEvent
+	if wasActive && !u.Active {
+		locked, err := h.stageEvent(r, events.TypeAccountLocked, u.ID, "", events.AccountLocked{Reason: events.ReasonDeactivated})
+		if err != nil {
+			h.sendSCIMError(w, &scimError{status: http.StatusInternalServerError, detail: "error saving user"})
+			return
+		}
+		staged = append(staged, locked)
+	}
+
+	err := h.db.UpdateUser(h.ctx, u, staged...)
+	if errors.Is(err, pgx.ErrNoRows) {
+		h.sendSCIMError(w, &scimError{status: http.StatusNotFound, detail: "user not found"})
+		return
+	}
+	if err != nil {
+		h.sendSCIMError(w, &scimError{status: http.StatusInternalServerError, detail: "error saving user"})
+		return
+	}
+
+	h.sendSCIM(w, h.toSCIMUser(u), http.StatusOK)
+}
+
+// scim/v2/Users/{id}
+// @Summary SCIM delete user
+// @Tags scim
+// @Description Deprovision a user. The user's sessions, API keys and linked identities are deleted with it.
+// @ID scim-users-delete
+// @Security BearerAuth
+// @Param id path string true "User ID"
+// @Success 204
+// @Failure 401,403,404,500 {object} SCIMErrorRes
+// @Router /scim/v2/Users/{id} [delete]
+func (h *Handler) scimDeleteUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		h.sendSCIMError(w, &scimError{status: http.StatusNotFound, detail: "user not found"})
+		return
+	}
+
+	deleted, err := h.db.DeleteUser(h.ctx, userID)
+	if err != nil {
+		h.sendSCIMError(w, &scimError{status: http.StatusInternalServerError, detail: "error deleting user"})
+		return
+	}
+
+	if !deleted {
+		h.sendSCIMError(w, &scimError{status: http.StatusNotFound, detail: "user not found"})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) scimUser(r *http.Request) (*db.User, *scimError) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		return nil, &scimError{status: http.StatusNotFound, detail: "user not found"}
+	}
+
+	u, err := h.db.GetUserById(h.ctx, userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, &scimError{status: http.StatusNotFound, detail: "user not found"}
+	}
+	if err != nil {
+		return nil, &scimError{status: http.StatusInternalServerError, detail: "error getting user"}
+	}
+
+	return u, nil
+}
+
+func (h *Handler) toSCIMUser(u *db.User) SCIMUser {
+	id := strconv.Itoa(u.ID)
+
+	s := SCIMUser{
+		Schemas:     []string{scimUserSchema},
+		ID:          id,
+		UserName:    u.Username,
+		Name:        &SCIMName{Formatted: u.Name},
+		DisplayName: u.Name,
+		Active:      &u.Active,
+		Meta:        h.scimMeta("User", "/scim/v2/Users/"+id, u.CreatedAt, u.UpdatedAt),
+	}
+
+	if u.ExternalID != nil {
+		s.ExternalID = *u.ExternalID
+	}
+
+	if u.Email != nil {
+		s.Emails = []SCIMEmail{{Value: *u.Email, Type: "work", Primary: true}}
+	}
+
+	return s
+}
+
+// fromSCIMUser copies the attributes of s that are stored on users into u
+func fromSCIMUser(s SCIMUser, u *db.User) *scimError {
+	if s.UserName == "" {
+		return &scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: "userName is required"}
+	}
+
+	u.Username = s.UserName
+	u.Name = scimDisplayName(s)
+	u.Active = s.Active == nil || *s.Active
+	u.ExternalID = nil
+	u.Email = nil
+
+	if s.ExternalID != "" {
+		u.ExternalID = &s.ExternalID
+	}
+
+	for _, e := range s.Emails {
+		if e.Value != "" && (u.Email == nil || e.Primary) {
+			u.Email = &e.Value
+		}
+	}
+
+	if s.Password != "" {
+		hashed, err := utils.HashPassword(s.Password)
+		if err != nil {
+			return &scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: "invalid password"}
+		}
+		u.Password = hashed
+	}
+
+	return nil
+}
+
+// scimDisplayName picks the single name users have from the SCIM name attributes
+func scimDisplayName(s SCIMUser) string {
+	if s.DisplayName != "" {
+		return s.DisplayName
+	}
+
+	if s.Name != nil {
+		if s.Name.Formatted != "" {
+			return s.Name.Formatted
+		}
+
+		if name := strings.TrimSpace(s.Name.GivenName + " " + s.Name.FamilyName); name != "" {
+			return name
+		}
+	}
+
+	return s.UserName
+}
+
+// applySCIMUserPatch applies PATCH operations to s. Attributes this service
+// doesn't store are ignored so that clients sending their whole profile work.
+func applySCIMUserPatch(s *SCIMUser, ops []SCIMPatchOp) *scimError {
+	// The stored name is reported as displayName and name.formatted, so a change of
+	// only the name parts has to clear them to take effect
+	var nameParts, fullName bool
+
+	var apply func(op string, path string, value json.RawMessage) *scimError
+	apply = func(op string, path string, value json.RawMessage) *scimError {
+		if path == "" {
+			if op == "remove" {
+				return &scimError{status: http.StatusBadRequest, scimType: "noTarget", detail: "remove requires a path"}
+			}
+
+			var attrs map[string]json.RawMessage
+			if err := json.Unmarshal(value, &attrs); err != nil {
+				return &scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: "value must be an object"}
+			}
+
+			for k, v := range attrs {
+				if serr := apply(op, k, v); serr != nil {
+					return serr
+				}
+			}
+
+			return nil
+		}
+
+		remove := op == "remove"
+
+		switch strings.ToLower(path) {
+		case "username":
+			return scimString(remove, value, &s.UserName)
+		case "displayname":
+			fullName = true
+			return scimString(remove, value, &s.DisplayName)
+		case "externalid":
+			return scimString(remove, value, &s.ExternalID)
+		case "password":
+			return scimString(remove, value, &s.Password)
+		case "active":
+			if remove {
+				return &scimError{status: http.StatusBadRequest, scimType: "mutability", detail: "active can't be removed"}
+			}
+
+			active, err := scimBool(value)
+			if err != nil {
+				return &scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: "active must be a boolean"}
+			}
+			s.Active = &active
+		case "name":
+			if remove {
+				s.Name = nil
+				s.DisplayName = ""
+				fullName = true
+				return nil
+			}
+
+			var name SCIMName
+			if err := json.Unmarshal(value, &name); err != nil {
+				return &scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: "name must be an object"}
+			}
+			s.Name = &name
+			if name.Formatted != "" {
+				fullName = true
+			} else {
+				nameParts = true
+			}
+		case "name.formatted":
+			fullName = true
+			return scimString(remove, value, &s.scimName().Formatted)
+		case "name.givenname":
+			nameParts = true
+			return scimString(remove, value, &s.scimName().GivenName)
+		case "name.familyname":
+			nameParts = true
+			return scimString(remove, value, &s.scimName().FamilyName)
+		case "emails":
+			if remove {
+				s.Emails = nil
+				return nil
+			}
+
+			var emails []SCIMEmail
+			if err := json.Unmarshal(value, &emails); err != nil {
+				return &scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: "emails must be an array"}
+			}
+			s.Emails = emails
+		default:
+			if scimEmailValuePathRe.MatchString(path) {
+				var email string
+				if serr := scimString(remove, value, &email); serr != nil {
+					return serr
+				}
+
+				s.Emails = nil
+				if email != "" {
+					s.Emails = []SCIMEmail{{Value: email, Primary: true}}
+				}
+			}
+		}
+
+		return nil
+	}
+
+	for _, op := range ops {
+		o := strings.ToLower(op.Op)
+		if o != "add" && o != "replace" && o != "remove" {
+			return &scimError{status: http.StatusBadRequest, scimType: "invalidSyntax", detail: "unsupported patch operation"}
+		}
+
+		if serr := apply(o, op.Path, op.Value); serr != nil {
+			return serr
+		}
+	}
+
+	if nameParts && !fullName {
+		s.DisplayName = ""
+		s.scimName().Formatted = ""
+	}
+
+	return nil
+}
+
+func (s *SCIMUser) scimName() *SCIMName {
+	if s.Name == nil {
+		s.Name = &SCIMName{}
+	}
+
+	return s.Name
+}
+
+// scim/v2/Groups
+// @Summary SCIM list groups
+// @Tags scim
+// @Description List groups. The filter supports a single eq comparison on displayName or externalId.
+// @ID scim-groups-list
+// @Security BearerAuth
+// @Param filter query string false "e.g. displayName eq \"Engineering\""
+// @Param startIndex query int false "1-based index of the first result"
+// @Param count query int false "Page size"
+// @Param excludedAttributes query string false "members to leave out the members"
+// @Produce json
+// @Success 200 {object} SCIMListRes
+// @Failure 400,401,403,500 {object} SCIMErrorRes
+// @Router /scim/v2/Groups [get]
+func (h *Handler) scimListGroups(w http.ResponseWriter, r *http.Request) {
+	startIndex, count, serr := scimPage(r)
+	if serr != nil {
+		h.sendSCIMError(w, serr)
+		return
+	}
+
+	var filter db.GroupFilter
+
+	if f := r.URL.Query().Get("filter"); f != "" {
+		attr, value, serr := parseSCIMFilter(f)
+		if serr != nil {
+			h.sendSCIMError(w, serr)
+			return
+		}
+
+		switch attr {
+		case "displayname":
+			filter.DisplayName = &value
+		case "externalid":
+			filter.ExternalID = &value
+		default:
+			h.sendSCIMError(w, &scimError{status: http.StatusBadRequest, scimType: "invalidFilter", detail: "unsupported filter attribute"})
+			return
+		}
+	}
+
+	groups, total, err := h.db.ListGroups(h.ctx, filter, startIndex-1, count)
+	if err != nil {
+		h.sendSCIMError(w, &scimError{status: http.StatusInternalServerError, detail: "error getting groups"})
+		return
+	}
+
+	resources := make([]SCIMGroup, 0, len(groups))
+	for _, g := range groups {
+		resources = append(resources, h.toSCIMGroup(g, r))
+	}
+
+	h.sendSCIM(w, SCIMListRes{
+		Schemas:      []string{scimListSchema},
+		TotalResults: total,
+		StartIndex:   startIndex,
+		ItemsPerPage: len(resources),
+		Resources:    resources,
+	}, http.StatusOK)
+}
+
+// scim/v2/Groups
+// @Summary SCIM create group
+// @Tags scim
+// @Description Create a group
+// @ID scim-groups-create
+// @Security BearerAuth
+// @Accept json
+// @Param input body SCIMGroup true "Group"
+// @Produce json
+// @Success 201 {object} SCIMGroup
+// @Failure 400,401,403,409,500 {object} SCIMErrorRes
+// @Router /scim/v2/Groups [post]
+func (h *Handler) scimCreateGroup(w http.ResponseWriter, r *http.Request) {
+	var req SCIMGroup
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendSCIMError(w, &scimError{status: http.StatusBadRequest, scimType: "invalidSyntax", detail: "malformed request body"})
+		return
+	}
+
+	g := &db.Group{}
+	if serr := fromSCIMGroup(req, g); serr != nil {
+		h.sendSCIMError(w, serr)
+		return
+	}
+
+	exists, err := h.db.CheckGroupName(h.ctx, g.DisplayName)
+	if err != nil {
+		h.sendSCIMError(w, &scimError{status: http.StatusInternalServerError, detail: "error checking group name"})
+		return
+	}
+	if exists {
+		h.sendSCIMError(w, &scimError{status: http.StatusConflict, scimType: "uniqueness", detail: "displayName is already taken"})
+		return
+	}
+
+	g, err = h.db.CreateGroup(h.ctx, g)
+	if errors.Is(err, db.ErrUnknownMember) {
+		h.sendSCIMError(w, &scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: err.Error()})
+		return
+	}
+	if err != nil {
+		h.sendSCIMError(w, &scimError{status: http.StatusInternalServerError, detail: "error saving group"})
+		return
+	}
+
+	res := h.toSCIMGroup(g, r)
+	w.Header().Set("Location", res.Meta.Location)
+	h.sendSCIM(w, res, http.StatusCreated)
+}
+
+// scim/v2/Groups/{id}
+// @Summary SCIM get group
+// @Tags scim
+// @Description Get a group
+// @ID scim-groups-get
+// @Security BearerAuth
+// @Param id path string true "Group ID"
+// @Param excludedAttributes query string false "members to leave out the members"
+// @Produce json
+// @Success 200 {object} SCIMGroup
+// @Failure 401,403,404,500 {object} SCIMErrorRes
+// @Router /scim/v2/Groups/{id} [get]
+func (h *Handler) scimGetGroup(w http.ResponseWriter, r *http.Request) {
+	g, serr := h.scimGroup(r)
+	if serr != nil {
+		h.sendSCIMError(w, serr)
+		return
+	}
+
+	h.sendSCIM(w, h.toSCIMGroup(g, r), http.StatusOK)
+}
+
+// scim/v2/Groups/{id}
+// @Summary SCIM replace group
+// @Tags scim
+// @Description Replace a group and its members
+// @ID scim-groups-replace
+// @Security BearerAuth
+// @Accept json
+// @Param id path string true "Group ID"
+// @Param input body SCIMGroup true "Group"
+// @Produce json
+// @Success 200 {object} SCIMGroup
+// @Failure 400,401,403,404,409,500 {object} SCIMErrorRes
+// @Router /scim/v2/Groups/{id} [put]
+func (h *Handler) scimReplaceGroup(w http.ResponseWriter, r *http.Request) {
+	g, serr := h.scimGroup(r)
+	if serr != nil {
+		h.sendSCIMError(w, serr)
+		return
+	}
+
+	var req SCIMGroup
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendSCIMError(w, &scimError{status: http.StatusBadRequest, scimType: "invalidSyntax", detail: "malformed request body"})
+		return
+	}
+
+	h.saveSCIMGroup(w, r, g, req)
+}
+
+// scim/v2/Groups/{id}
+// @Summary SCIM patch group
+// @Tags scim
+// @Description Modify a group with add, replace and remove operations, e.g. adding members or removing members[value eq "42"]
+// @ID scim-groups-patch
+// @Security BearerAuth
+// @Accept json
+// @Param id path string true "Group ID"
+// @Param input body SCIMPatchReq true "Patch operations"
+// @Produce json
+// @Success 200 {object} SCIMGroup
+// @Failure 400,401,403,404,409,500 {object} SCIMErrorRes
+// @Router /scim/v2/Groups/{id} [patch]
+func (h *Handler) scimPatchGroup(w http.ResponseWriter, r *http.Request) {
+	g, serr := h.scimGroup(r)
+	if serr != nil {
+		h.sendSCIMError(w, serr)
+		return
+	}
+
+	var req SCIMPatchReq
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendSCIMError(w, &scimError{status: http.StatusBadRequest, scimType: "invalidSyntax", detail: "malformed request body"})
+		return
+	}
+
+	s := h.toSCIMGroup(g, nil)
+	if serr := applySCIMGroupPatch(&s, req.Operations); serr != nil {
+		h.sendSCIMError(w, serr)
+		return
+	}
+
+	h.saveSCIMGroup(w, r, g, s)
+}
+
+// saveSCIMGroup replaces the name and members of g with s
+func (h *Handler) saveSCIMGroup(w http.ResponseWriter, r *http.Request, g *db.Group, s SCIMGroup) {
+	oldName := g.DisplayName
+
+	if serr := fromSCIMGroup(s, g); serr != nil {
+		h.sendSCIMError(w, serr)
+		return
+	}
+
+	if g.DisplayName != oldName {
+		exists, err := h.db.CheckGroupName(h.ctx, g.DisplayName)
+		if err != nil {
+			h.sendSCIMError(w, &scimError{status: http.StatusInternalServerError, detail: "error checking group name"})
+			return
+		}
+		if exists {
+			h.sendSCIMError(w, &scimError{status: http.StatusConflict, scimType: "uniqueness", detail: "displayName is already taken"})
+			return
+		}
+	}
+
+	err := h.db.ReplaceGroup(h.ctx, g)
+	if errors.Is(err, pgx.ErrNoRows) {
+		h.sendSCIMError(w, &scimError{status: http.StatusNotFound, detail: "group not found"})
+		return
+	}
+	if errors.Is(err, db.ErrUnknownMember) {
+		h.sendSCIMError(w, &scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: err.Error()})
+		return
+	}
+	if err != nil {
+		h.sendSCIMError(w, &scimError{status: http.StatusInternalServerError, detail: "error saving group"})
+		return
+	}
+
+	h.sendSCIM(w, h.toSCIMGroup(g, r), http.StatusOK)
+}
+
+// scim/v2/Groups/{id}
+// @Summary SCIM delete group
+// @Tags scim
+// @Description Delete a group. Its members are not affected.
+// @ID scim-groups-delete
+// @Security BearerAuth
+// @Param id path string true "Group ID"
+// @Success 204
+// @Failure 401,403,404,500 {object} SCIMErrorRes
+// @Router /scim/v2/Groups/{id} [delete]
+func (h *Handler) scimDeleteGroup(w http.ResponseWriter, r *http.Request) {
+	groupID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		h.sendSCIMError(w, &scimError{status: http.StatusNotFound, detail: "group not found"})
+		return
+	}
+
+	deleted, err := h.db.DeleteGroup(h.ctx, groupID)
+	if err != nil {
+		h.sendSCIMError(w, &scimError{status: http.StatusInternalServerError, detail: "error deleting group"})
+		return
+	}
+
+	if !deleted {
+		h.sendSCIMError(w, &scimError{status: http.StatusNotFound, detail: "group not found"})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) scimGroup(r *http.Request) (*db.Group, *scimError) {
+	groupID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		return nil, &scimError{status: http.StatusNotFound, detail: "group not found"}
+	}
+
+	g, err := h.db.GetGroup(h.ctx, groupID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, &scimError{status: http.StatusNotFound, detail: "group not found"}
+	}
+	if err != nil {
+		return nil, &scimError{status: http.StatusInternalServerError, detail: "error getting group"}
+	}
+
+	return g, nil
+}
+
+// toSCIMGroup leaves out the members when r asks to exclude them
+func (h *Handler) toSCIMGroup(g *db.Group, r *http.Request) SCIMGroup {
+	id := strconv.Itoa(g.ID)
+
+	s := SCIMGroup{
+		Schemas:     []string{scimGroupSchema},
+		ID:          id,
+		DisplayName: g.DisplayName,
+		Members:     []SCIMMemberRef{},
+		Meta:        h.scimMeta("Group", "/scim/v2/Groups/"+id, g.CreatedAt, g.UpdatedAt),
+	}
+
+	if g.ExternalID != nil {
+		s.ExternalID = *g.ExternalID
+	}
+
+	if r != nil && slices.ContainsFunc(strings.Split(r.URL.Query().Get("excludedAttributes"), ","), func(a string) bool {
+		return strings.EqualFold(strings.TrimSpace(a), "members")
+	}) {
+		s.Members = nil
+		return s
+	}
+
+	for _, m := range g.Members {
+		userID := strconv.Itoa(m.UserID)
+		s.Members = append(s.Members, SCIMMemberRef{
+			Value:   userID,
+			Ref:     h.issuer + "/scim/v2/Users/" + userID,
+			Display: m.Username,
+		})
+	}
+
+	return s
+}
+
+func fromSCIMGroup(s SCIMGroup, g *db.Group) *scimError {
+	if s.DisplayName == "" {
+		return &scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: "displayName is required"}
+	}
+
+	g.DisplayName = s.DisplayName
+	g.ExternalID = nil
+	if s.ExternalID != "" {
+		g.ExternalID = &s.ExternalID
+	}
+
+	members := make([]db.GroupMember, 0, len(s.Members))
+	for _, m := range s.Members {
+		userID, err := strconv.Atoi(m.Value)
+		if err != nil {
+			return &scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: db.ErrUnknownMember.Error()}
+		}
+		members = append(members, db.GroupMember{UserID: userID})
+	}
+	g.Members = members
+
+	return nil
+}
+
+func applySCIMGroupPatch(s *SCIMGroup, ops []SCIMPatchOp) *scimError {
+	var apply func(op string, path string, value json.RawMessage) *scimError
+	apply = func(op string, path string, value json.RawMessage) *scimError {
+		if path == "" {
+			if op == "remove" {
+				return &scimError{status: http.StatusBadRequest, scimType: "noTarget", detail: "remove requires a path"}
+			}
+
+			var attrs map[string]json.RawMessage
+			if err := json.Unmarshal(value, &attrs); err != nil {
+				return &scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: "value must be an object"}
+			}
+
+			for k, v := range attrs {
+				if serr := apply(op, k, v); serr != nil {
+					return serr
+				}
+			}
+
+			return nil
+		}
+
+		if m := scimMemberFilterRe.FindStringSubmatch(path); m != nil {
+			if op != "remove" {
+				return &scimError{status: http.StatusBadRequest, scimType: "invalidPath", detail: "member filters can only be removed"}
+			}
+
+			s.Members = slices.DeleteFunc(s.Members, func(ref SCIMMemberRef) bool { return ref.Value == m[1] })
+			return nil
+		}
+
+		switch strings.ToLower(path) {
+		case "displayname":
+			return scimString(op == "remove", value, &s.DisplayName)
+		case "externalid":
+			return scimString(op == "remove", value, &s.ExternalID)
+		case "members":
+			var refs []SCIMMemberRef
+			if len(value) > 0 {
+				if err := json.Unmarshal(value, &refs); err != nil {
+					return &scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: "members must be an array"}
+				}
+			}
+
+			switch op {
+			case "add":
+				s.Members = append(s.Members, refs...)
+			case "replace":
+				s.Members = refs
+			case "remove":
+				// Without a value every member is removed
+				if refs == nil {
+					s.Members = nil
+					return nil
+				}
+
+				s.Members = slices.DeleteFunc(s.Members, func(ref SCIMMemberRef) bool {
+					return slices.ContainsFunc(refs, func(r SCIMMemberRef) bool { return r.Value == ref.Value })
+				})
+			}
+		default:
+			return &scimError{status: http.StatusBadRequest, scimType: "invalidPath", detail: "unsupported path"}
+		}
+
+		return nil
+	}
+
+	for _, op := range ops {
+		o := strings.ToLower(op.Op)
+		if o != "add" && o != "replace" && o != "remove" {
+			return &scimError{status: http.StatusBadRequest, scimType: "invalidSyntax", detail: "unsupported patch operation"}
+		}
+
+		if serr := apply(o, op.Path, op.Value); serr != nil {
+			return serr
+		}
+	}
+
+	return nil
+}
+
+func (h *Handler) scimMeta(resourceType string, path string, created time.Time, updated *time.Time) *SCIMMeta {
+	lastModified := created
+	if updated != nil {
+		lastModified = *updated
+	}
+
+	return &SCIMMeta{
+		ResourceType: resourceType,
+		Created:      created,
+		LastModified: lastModified,
+		Location:     h.issuer + path,
+	}
+}
+
+// scimPage reads the 1-based startIndex and count query parameters
+func scimPage(r *http.Request) (int, int, *scimError) {
+	startIndex, count := 1, scimDefaultCount
+
+	q := r.URL.Query()
+
+	if v := q.Get("startIndex"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, 0, &scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: "invalid startIndex"}
+		}
+		startIndex = max(n, 1)
+	}
+
+	if v := q.Get("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, 0, &scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: "invalid count"}
+		}
+		count = min(max(n, 0), scimMaxCount)
+	}
+
+	return startIndex, count, nil
+}
+
+// parseSCIMFilter parses a single `attribute eq value` comparison. The attribute
+// is returned lowercased; SCIM attribute names are case-insensitive.
+func parseSCIMFilter(filter string) (string, string, *scimError) {
+	m := scimFilterRe.FindStringSubmatch(filter)
+	if m == nil {
+		return "", "", &scimError{status: http.StatusBadRequest, scimType: "invalidFilter", detail: "only eq filters are supported"}
+	}
+
+	attr, raw := strings.ToLower(m[1]), m[2]
+
+	if raw == "true" || raw == "false" {
+		return attr, raw, nil
+	}
+
+	var value string
+	if err := json.Unmarshal([]byte(raw), &value); err != nil {
+		return "", "", &scimError{status: http.StatusBadRequest, scimType: "invalidFilter", detail: "invalid filter value"}
+	}
+
+	return attr, value, nil
+}
+
+// scimString sets or, for remove, clears a string attribute
+func scimString(remove bool, value json.RawMessage, dst *string) *scimError {
+	if remove {
+		*dst = ""
+		return nil
+	}
+
+	if err := json.Unmarshal(value, dst); err != nil {
+		return &scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: "value must be a string"}
+	}
+
+	return nil
+}
+
+// scimBool also accepts "True" and "False" strings, which some clients send
+func scimBool(value json.RawMessage) (bool, error) {
+	var b bool
+	if err := json.Unmarshal(value, &b); err == nil {
+		return b, nil
+	}
+
+	var s string
+	if err := json.Unmarshal(value, &s); err != nil {
+		return false, err
+	}
+
+	return strconv.ParseBool(strings.ToLower(s))
+}
@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/arrogantworm/jwt_auth/api/events"
+	"github.com/arrogantworm/jwt_auth/api/token"
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+// auth/logout-all
+// @Summary Logout from all devices
+// @Tags auth
+// @Description Revoke every session of the caller, optionally keeping the one making the request. Access tokens that were already issued stay valid until they expire.
+// @ID auth-logout-all
+// @Security BearerAuth
+// @Accept json
+// @Param input body LogoutAllReq false "Whether to keep the current session"
+// @Produce json
+// @Success 200 {object} LogoutAllRes
+// @Failure 400,401,403,500 {object} ErrorRes
+// @Router /auth/logout-all [post]
+func (h *Handler) logoutAll(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value(authKey{}).(*token.UserClaims)
+
+	var req LogoutAllReq
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		h.sendError(w, "", http.StatusBadRequest)
+		return
+	}
+
+	var keep string
+	if req.KeepCurrent {
+		keep = claims.RegisteredClaims.ID
+	}
+
+	revoked, err := h.stageEvent(r, events.TypeUserSessionsRevoked, claims.ID, keep, events.UserSessionsRevoked{})
+	if err != nil {
+		h.sendError(w, "error revoking sessions", http.StatusInternalServerError)
+		return
+	}
+
+	n, err := h.db.RevokeUserSessions(h.ctx, claims.ID, keep, revoked)
+	if err != nil {
+		h.sendError(w, "error revoking sessions", http.StatusInternalServerError)
+		return
+	}
+
+	if cookieMode() && !req.KeepCurrent {
+		clearSessionCookies(w)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(LogoutAllRes{Terminated: n})
+}
+
+// admin/users/{userID}/logout-all
+// @Summary Logout user from all devices
+// @Tags admin, users
+// @Description Revoke every session of a user
+// @ID admin-users-logout-all
+// @Security BearerAuth
+// @Param userID path int true "User ID"
+// @Produce json
+// @Success 200 {object} LogoutAllRes
+// @Failure 400,401,403,404,500 {object} ErrorRes
+// @Router /admin/users/{userID}/logout-all [post]
+func (h *Handler) adminLogoutAll(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		h.sendError(w, "invalid user id", http.StatusBadRequest)
+		return
+	}
+
+	revoked, err := h.stageEvent(r, events.TypeUserSessionsRevoked, userID, "", events.UserSessionsRevoked{ByAdmin: true})
+	if err != nil {
+		h.sendError(w, "error revoking sessions", http.StatusInternalServerError)
+		return
+	}
+
+	n, err := h.db.RevokeUserSessions(h.ctx, userID, "", revoked)
+	if errors.Is(err, pgx.ErrNoRows) {
+		h.sendError(w, "user not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.sendError(w, "error revoking sessions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(LogoutAllRes{Terminated: n})
+}
@@ -0,0 +1,422 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/arrogantworm/jwt_auth/api/events"
+	"github.com/arrogantworm/jwt_auth/api/mail"
+	"github.com/arrogantworm/jwt_auth/api/utils"
+	"github.com/arrogantworm/jwt_auth/db"
+	"github.com/jackc/pgx/v5"
+	"github.com/spf13/viper"
+)
+
+const (
+	deviceIDCookie = "device_id"
+	// Sent by clients that don't keep cookies
+	deviceIDHeader = "X-Device-ID"
+
+	deviceIDCookieTTL = 400 * 24 * time.Hour
+)
+
+var errInvalidSignInAlert = errors.New("invalid or expired link")
+
+var (
+	signInAlertExpiredPage = messagePage{"Link expired", "This link is invalid or has expired. Sign in and change your password if you still need to."}
+	signInAlertErrorPage   = messagePage{"Something went wrong", "Please try again later."}
+)
+
+// requireNewDeviceAlerts answers 404 while new device alerts are disabled
+func (h *Handler) requireNewDeviceAlerts(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !viper.GetBool("newDeviceAlerts.enabled") {
+			h.sendError(w, "new device alerts are not enabled", http.StatusNotFound)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestDeviceID returns the ID the client keeps for itself, or "" when it
+// has none yet
+func requestDeviceID(r *http.Request) string {
+	if id := r.Header.Get(deviceIDHeader); id != "" {
+		return id
+	}
+
+	if cookie, err := r.Cookie(deviceIDCookie); err == nil {
+		return cookie.Value
+	}
+
+	return ""
+}
+
+// deviceID returns the ID the client keeps for itself. Browsers without one
+// are given a long-lived cookie, so they are recognized next time.
+func (h *Handler) deviceID(w http.ResponseWriter, r *http.Request) (string, error) {
+	if id := requestDeviceID(r); id != "" {
+		return id, nil
+	}
+
+	id, err := utils.RandomHex(32)
+	if err != nil {
+		return "", err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     deviceIDCookie,
+		Value:    id,
+		Path:     "/auth",
+		MaxAge:   int(deviceIDCookieTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(h.issuer, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return id, nil
+}
+
+// deviceFingerprint combines the device ID with the browser and OS, leaving
+// out versions so that updates don't make a device new
+func deviceFingerprint(deviceID string, userAgent string) string {
+	ua := utils.ParseUserAgent(userAgent)
+	if ua.Browser == "" && ua.OS == "" {
+		return utils.SHA256Hex(deviceID + "\n" + userAgent)
+	}
+
+	return utils.SHA256Hex(deviceID + "\n" + ua.Browser + "\n" + ua.OS)
+}
+
+// recognizeDevice records the device a password signin came from and, with
+// new device alerts, emails the user when it is new. The first device of an
+// account is trusted without an email. Devices are also recorded for the risk
+// engine. Failures are only logged, they don't fail the signin.
+func (h *Handler) recognizeDevice(w http.ResponseWriter, r *http.Request, u *db.User, sessionID string) {
+	alerts := viper.GetBool("newDeviceAlerts.enabled")
+	if !alerts && !h.risk.Enabled() {
+		return
+	}
+
+	deviceID, err := h.deviceID(w, r)
+	if err != nil {
+		log.Println("[DEVICES]", err)
+		return
+	}
+
+	isNew, first, err := h.db.RecordUserDevice(h.ctx, &db.UserDevice{
+		UserID:      u.ID,
+		Fingerprint: deviceFingerprint(deviceID, r.UserAgent()),
+		UserAgent:   r.UserAgent(),
+		IPAddress:   remoteIP(r),
+	})
+	if err != nil {
+		log.Println("[DEVICES]", err)
+		return
+	}
+
+	if !alerts || !isNew || first || u.Email == nil {
+		return
+	}
+
+	if err := h.sendSignInAlert(r, u, sessionID); err != nil {
+		log.Println("[DEVICES]", err)
+	}
+}
+
+// describeDevice is how a user agent is shown in emails, e.g. "Firefox 128 on Linux"
+func describeDevice(userAgent string) string {
+	ua := utils.ParseUserAgent(userAgent)
+	device := ua.Family()
+	switch {
+	case device != "" && ua.OS != "":
+		device += " on " + ua.OS
+	case ua.OS != "":
+		device = ua.OS
+	case device == "":
+		device = "an unknown device"
+	}
+
+	return device
+}
+
+func (h *Handler) sendSignInAlert(r *http.Request, u *db.User, sessionID string) error {
+	ttl := viper.GetDuration("newDeviceAlerts.linkTTL")
+
+	tok, claims, err := h.TokenMaker.CreateSignInAlertToken(u.ID, ttl)
+	if err != nil {
+		return err
+	}
+
+	err = h.db.CreateSignInAlert(h.ctx, &db.SignInAlert{
+		TokenID:   claims.ID,
+		UserID:    u.ID,
+		ExpiresAt: claims.ExpiresAt.Time,
+	}, sessionID)
+	if err != nil {
+		return err
+	}
+
+	link := h.issuer + "/auth/signin-alert/deny?" + url.Values{"token": {tok}}.Encode()
+
+	msg := mail.Message{
+		To:      *u.Email,
+		Subject: "New sign-in to your account",
+		Text: fmt.Sprintf("Hi %s,\n\nYour account was just signed in to from a device it hasn't been used on before:\n\n"+
+			"Time: %s\nDevice: %s\nIP address: %s\n\n"+
+			"If this was you, there is nothing to do. If it wasn't, open this link to sign that device out and choose a new password. It works for %s:\n\n%s\n",
+			u.Name, time.Now().UTC().Format(time.RFC1123), describeDevice(r.UserAgent()), remoteIP(r), ttl, link),
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		if err := h.mailer.Send(ctx, msg); err != nil {
+			log.Println("[MAIL]", err)
+		}
+	}()
+
+	return nil
+}
+
+// signInAlert returns the alert behind a link token
+func (h *Handler) signInAlert(tok string) (*db.SignInAlert, error) {
+	claims, err := h.TokenMaker.VerifySignInAlertToken(tok)
+	if err != nil {
+		return nil, errInvalidSignInAlert
+	}
+
+	userID, err := claims.UserID()
+	if err != nil {
+		return nil, errInvalidSignInAlert
+	}
+
+	a, err := h.db.GetSignInAlert(h.ctx, claims.ID, userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errInvalidSignInAlert
+	}
+
+	return a, err
+}
+
+func (h *Handler) renderPasswordForm(w http.ResponseWriter, page loginPage, status int) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(status)
+
+	if err := templates.ExecuteTemplate(w, "password.html", page); err != nil {
+		log.Printf("error rendering password page: %v", err)
+	}
+}
+
+func passwordResetPage(tok string) loginPage {
+	return loginPage{
+		Title:   "Choose a new password",
+		Message: "The device has been signed out. Choose a new password to sign in with it again.",
+		Action:  "/auth/signin-alert/reset",
+		Hidden:  map[string]string{"token": tok},
+	}
+}
+
+// renderConfirm shows a page with a single button that posts page.Hidden to
+// page.Action
+func (h *Handler) renderConfirm(w http.ResponseWriter, page loginPage, status int) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(status)
+
+	if err := templates.ExecuteTemplate(w, "confirm.html", page); err != nil {
+		log.Printf("error rendering confirm page: %v", err)
+	}
+}
+
+// auth/signin-alert/deny
+// @Summary Confirm a new sign-in report
+// @Tags auth
+// @Description Opened from the "this wasn't me" link of a new sign-in email. Only asks for confirmation, which is posted back to /auth/signin-alert/deny, so that mail scanners opening the link change nothing.
+// @ID auth-signin-alert-deny-confirm
+// @Param token query string true "Link token"
+// @Produce html
+// @Success 200 {string} string "HTML page"
+// @Failure 400,404 {string} string "HTML page"
+// @Router /auth/signin-alert/deny [get]
+func (h *Handler) confirmDenySignIn(w http.ResponseWriter, r *http.Request) {
+	tok := r.URL.Query().Get("token")
+
+	_, err := h.signInAlert(tok)
+	if errors.Is(err, errInvalidSignInAlert) {
+		h.renderMessage(w, signInAlertExpiredPage, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		h.renderMessage(w, signInAlertErrorPage, http.StatusInternalServerError)
+		return
+	}
+
+	h.renderConfirm(w, loginPage{
+		Title:   "Wasn't you?",
+		Message: "Confirm to sign out the device of this sign-in.",
+		Action:  "/auth/signin-alert/deny",
+		Hidden:  map[string]string{"token": tok},
+		Submit:  "Sign out the device",
+	}, http.StatusOK)
+}
+
+// auth/signin-alert/deny
+// @Summary Report a new sign-in
+// @Tags auth
+// @Description Posted by the page of the "this wasn't me" link of a new sign-in email. Revokes the session of that sign-in and, for local accounts, refuses password signin until a new password is chosen on the page it shows.
+// @ID auth-signin-alert-deny
+// @Accept x-www-form-urlencoded
+// @Param token formData string true "Link token"
+// @Produce html
+// @Success 200 {string} string "HTML page"
+// @Failure 400,404 {string} string "HTML page"
+// @Router /auth/signin-alert/deny [post]
+func (h *Handler) denySignIn(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		h.renderMessage(w, messagePage{"Bad request", "The form could not be read."}, http.StatusBadRequest)
+		return
+	}
+
+	tok := r.PostForm.Get("token")
+
+	a, err := h.signInAlert(tok)
+	if errors.Is(err, errInvalidSignInAlert) {
+		h.renderMessage(w, signInAlertExpiredPage, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		h.renderMessage(w, signInAlertErrorPage, http.StatusInternalServerError)
+		return
+	}
+
+	u, err := h.db.GetUserById(h.ctx, a.UserID)
+	if err != nil {
+		h.renderMessage(w, signInAlertErrorPage, http.StatusInternalServerError)
+		return
+	}
+
+	// Passwords of directory and federated accounts are not kept here
+	requireReset := u.AuthSource == db.AuthSourceLocal
+
+	// Confirming again only shows the form
+	if a.DeniedAt == nil {
+		var staged []*db.OutboxEvent
+		if a.SessionID != "" {
+			revoked, err := h.stageEvent(r, events.TypeSessionRevoked, u.ID, a.SessionID, events.SessionRevoked{Reason: events.ReasonNotMe})
+			if err != nil {
+				h.renderMessage(w, signInAlertErrorPage, http.StatusInternalServerError)
+				return
+			}
+			staged = append(staged, revoked)
+		}
+		if requireReset && !u.PasswordResetRequired {
+			locked, err := h.stageEvent(r, events.TypeAccountLocked, u.ID, "", events.AccountLocked{Reason: events.ReasonNotMe})
+			if err != nil {
+				h.renderMessage(w, signInAlertErrorPage, http.StatusInternalServerError)
+				return
+			}
+			staged = append(staged, locked)
+		}
+
+		if err := h.db.DenySignInAlert(h.ctx, a, requireReset, staged...); err != nil {
+			h.renderMessage(w, signInAlertErrorPage, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if !requireReset {
+		h.renderMessage(w, messagePage{"Device signed out", "The device has been signed out. Your password is managed elsewhere, change it there."}, http.StatusOK)
+		return
+	}
+
+	h.renderPasswordForm(w, passwordResetPage(tok), http.StatusOK)
+}
+
+// auth/signin-alert/reset
+// @Summary Reset password after a reported sign-in
+// @Tags auth
+// @Description Form posted by the page of /auth/signin-alert/deny. Sets the new password, which revokes every session and removes the phone number, and uses up the link.
+// @ID auth-signin-alert-reset
+// @Accept x-www-form-urlencoded
+// @Param token formData string true "Link token"
+// @Param password formData string true "New password"
+// @Param password_confirm formData string true "New password again"
+// @Produce html
+// @Success 200 {string} string "HTML page"
+// @Failure 400,404 {string} string "HTML page"
+// @Router /auth/signin-alert/reset [post]
+func (h *Handler) resetPasswordAfterSignInAlert(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		h.renderMessage(w, messagePage{"Bad request", "The form could not be read."}, http.StatusBadRequest)
+		return
+	}
+
+	tok := r.PostForm.Get("token")
+	password := r.PostForm.Get("password")
+
+	page := passwordResetPage(tok)
+	if password == "" {
+		page.Error = "a new password is required"
+		h.renderPasswordForm(w, page, http.StatusBadRequest)
+		return
+	}
+	if password != r.PostForm.Get("password_confirm") {
+		page.Error = "passwords do not match"
+		h.renderPasswordForm(w, page, http.StatusBadRequest)
+		return
+	}
+
+	a, err := h.signInAlert(tok)
+	if err == nil && a.DeniedAt == nil {
+		err = errInvalidSignInAlert
+	}
+	if errors.Is(err, errInvalidSignInAlert) {
+		h.renderMessage(w, signInAlertExpiredPage, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		h.renderMessage(w, signInAlertErrorPage, http.StatusInternalServerError)
+		return
+	}
+
+	hashed, err := utils.HashPassword(password)
+	if err != nil {
+		h.renderMessage(w, signInAlertErrorPage, http.StatusInternalServerError)
+		return
+	}
+
+	ok, err := h.db.ConsumeSignInAlert(h.ctx, a.TokenID, a.UserID)
+	if err != nil {
+		h.renderMessage(w, signInAlertErrorPage, http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		h.renderMessage(w, signInAlertExpiredPage, http.StatusBadRequest)
+		return
+	}
+
+	changed, err := h.stageEvent(r, events.TypePasswordChanged, a.UserID, "", events.PasswordChanged{OtherSessionsRevoked: true})
+	if err != nil {
+		h.renderMessage(w, signInAlertErrorPage, http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.db.ResetPassword(h.ctx, a.UserID, hashed, changed); err != nil {
+		h.renderMessage(w, signInAlertErrorPage, http.StatusInternalServerError)
+		return
+	}
+
+	h.renderMessage(w, messagePage{"Password changed", "Every device has been signed out and the phone number removed. Sign in with your new password, and add your number again if you use phone login."}, http.StatusOK)
+}
@@ -0,0 +1,245 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/arrogantworm/jwt_auth/api/token"
+	"github.com/arrogantworm/jwt_auth/db"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	grantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+
+	tokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// tokenExchangeGrant implements RFC 8693. The authenticated client is the actor;
+// what it may request for each audience is set by its exchange rules.
+func (h *Handler) tokenExchangeGrant(w http.ResponseWriter, r *http.Request) {
+	c, err := h.authenticateClient(r)
+	if err != nil || c.AuthMethod == db.ClientAuthNone {
+		h.sendClientAuthError(w, r)
+		return
+	}
+
+	if !slices.Contains(c.GrantTypes, grantTypeTokenExchange) {
+		h.sendOAuthError(w, "unauthorized_client", "client is not allowed to use this grant type", http.StatusBadRequest)
+		return
+	}
+
+	form := r.PostForm
+
+	if form.Get("subject_token") == "" || form.Get("subject_token_type") != tokenTypeAccessToken {
+		h.sendOAuthError(w, "invalid_request", "an access token subject_token is required", http.StatusBadRequest)
+		return
+	}
+
+	if form.Get("actor_token") != "" {
+		h.sendOAuthError(w, "invalid_request", "actor_token is not supported, the authenticated client is the actor", http.StatusBadRequest)
+		return
+	}
+
+	if t := form.Get("requested_token_type"); t != "" && t != tokenTypeAccessToken {
+		h.sendOAuthError(w, "invalid_request", "only access tokens can be requested", http.StatusBadRequest)
+		return
+	}
+
+	audience := form.Get("audience")
+	if audience == "" {
+		audience = form.Get("resource")
+	}
+
+	rule, err := h.db.GetExchangeRule(h.ctx, c.ClientID, audience)
+	if err != nil {
+		h.sendOAuthError(w, "invalid_target", "client may not exchange tokens for this audience", http.StatusBadRequest)
+		return
+	}
+
+	subject, err := h.TokenMaker.VerifyToken(form.Get("subject_token"))
+	if err != nil || !subject.IsUser() {
+		h.sendOAuthError(w, "invalid_grant", "invalid subject token", http.StatusBadRequest)
+		return
+	}
+
+	s, err := h.db.GetSession(h.ctx, subject.Session())
+	if err != nil || !sessionActive(s) {
+		h.sendOAuthError(w, "invalid_grant", "subject token session is not active", http.StatusBadRequest)
+		return
+	}
+
+	scope, ok := exchangedScope(form.Get("scope"), rule.Scopes, subject)
+	if !ok {
+		h.sendOAuthError(w, "invalid_scope", "requested scope is not allowed", http.StatusBadRequest)
+		return
+	}
+
+	// The new token never outlives the token it was exchanged for
+	ttl := time.Duration(rule.TTLSeconds) * time.Second
+	if remaining := time.Until(subject.ExpiresAt.Time); remaining < ttl {
+		ttl = remaining
+	}
+
+	accessToken, claims, err := h.TokenMaker.CreateExchangedToken(subject, rule.Audience, scope, c.ClientID, ttl)
+	if err != nil {
+		h.sendOAuthError(w, "server_error", "error creating token", http.StatusInternalServerError)
+		return
+	}
+
+	h.sendOAuthToken(w, OAuthTokenRes{
+		AccessToken:     accessToken,
+		TokenType:       "Bearer",
+		ExpiresIn:       int(time.Until(claims.ExpiresAt.Time).Seconds()),
+		IssuedTokenType: tokenTypeAccessToken,
+		Scope:           scope,
+	})
+}
+
+// exchangedScope down-scopes a token: the result is limited to the rule's scopes
+// that the subject token grants. It is never empty, because an exchanged token
+// without scopes would be useless.
+func exchangedScope(requested string, ruleScopes []string, subject *token.UserClaims) (string, bool) {
+	allowed := slices.DeleteFunc(slices.Clone(ruleScopes), func(s string) bool {
+		return !subject.HasScope(s)
+	})
+
+	scope, ok := grantedScope(requested, allowed)
+	if !ok || scope == "" {
+		return "", false
+	}
+
+	return scope, true
+}
+
+// admin/clients/{clientID}/exchange-rules
+// @Summary Create token exchange rule
+// @Tags admin, clients
+// @Description Allow a client to exchange user access tokens for the given audience and scopes
+// @ID admin-exchange-rules-create
+// @Security BearerAuth
+// @Param clientID path string true "Client ID"
+// @Accept json
+// @Param input body CreateExchangeRuleReq true "Rule"
+// @Produce json
+// @Success 201 {object} ExchangeRuleRes
+// @Failure 400,401,403,404,500 {object} ErrorRes
+// @Router /admin/clients/{clientID}/exchange-rules [post]
+func (h *Handler) createExchangeRule(w http.ResponseWriter, r *http.Request) {
+	var req CreateExchangeRuleReq
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendError(w, "", http.StatusBadRequest)
+		return
+	}
+
+	c, err := h.db.GetClient(h.ctx, chi.URLParam(r, "clientID"))
+	if err != nil {
+		h.sendError(w, "client not found", http.StatusNotFound)
+		return
+	}
+
+	if req.Audience == "" {
+		h.sendError(w, "audience is required", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Scopes) == 0 || !validScopes(req.Scopes) {
+		h.sendError(w, "at least one valid scope is required", http.StatusBadRequest)
+		return
+	}
+
+	if req.TTLSeconds <= 0 {
+		h.sendError(w, "ttlSeconds must be positive", http.StatusBadRequest)
+		return
+	}
+
+	e, err := h.db.CreateExchangeRule(h.ctx, &db.ExchangeRule{
+		ClientID:   c.ClientID,
+		Audience:   req.Audience,
+		Scopes:     req.Scopes,
+		TTLSeconds: req.TTLSeconds,
+	})
+	if err != nil {
+		h.sendError(w, "error saving exchange rule", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(toExchangeRuleRes(e))
+}
+
+// admin/clients/{clientID}/exchange-rules
+// @Summary List token exchange rules
+// @Tags admin, clients
+// @Description List a client's token exchange rules
+// @ID admin-exchange-rules-list
+// @Security BearerAuth
+// @Param clientID path string true "Client ID"
+// @Produce json
+// @Success 200 {array} ExchangeRuleRes
+// @Failure 401,403,500 {object} ErrorRes
+// @Router /admin/clients/{clientID}/exchange-rules [get]
+func (h *Handler) listExchangeRules(w http.ResponseWriter, r *http.Request) {
+	rules, err := h.db.ListExchangeRules(h.ctx, chi.URLParam(r, "clientID"))
+	if err != nil {
+		h.sendError(w, "error getting exchange rules", http.StatusInternalServerError)
+		return
+	}
+
+	res := make([]ExchangeRuleRes, 0, len(rules))
+	for _, e := range rules {
+		res = append(res, toExchangeRuleRes(e))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// admin/clients/{clientID}/exchange-rules/{ruleID}
+// @Summary Delete token exchange rule
+// @Tags admin, clients
+// @Description Delete a client's token exchange rule
+// @ID admin-exchange-rules-delete
+// @Security BearerAuth
+// @Param clientID path string true "Client ID"
+// @Param ruleID path int true "Rule ID"
+// @Produce json
+// @Success 200 {object} SuccessRes
+// @Failure 400,401,403,404,500 {object} ErrorRes
+// @Router /admin/clients/{clientID}/exchange-rules/{ruleID} [delete]
+func (h *Handler) deleteExchangeRule(w http.ResponseWriter, r *http.Request) {
+	ruleID, err := strconv.Atoi(chi.URLParam(r, "ruleID"))
+	if err != nil {
+		h.sendError(w, "invalid rule id", http.StatusBadRequest)
+		return
+	}
+
+	found, err := h.db.DeleteExchangeRule(h.ctx, chi.URLParam(r, "clientID"), ruleID)
+	if err != nil {
+		h.sendError(w, "error deleting exchange rule", http.StatusInternalServerError)
+		return
+	}
+
+	if !found {
+		h.sendError(w, "exchange rule not found", http.StatusNotFound)
+		return
+	}
+
+	h.sendSuccess(w, "exchange rule deleted", http.StatusOK)
+}
+
+func toExchangeRuleRes(e *db.ExchangeRule) ExchangeRuleRes {
+	return ExchangeRuleRes{
+		Id:         e.ID,
+		Audience:   e.Audience,
+		Scopes:     e.Scopes,
+		TTLSeconds: e.TTLSeconds,
+		CreatedAt:  e.CreatedAt,
+	}
+}
@@ -1,6 +1,11 @@
 package handler
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/arrogantworm/jwt_auth/api/token"
+)
 
 type (
 	ErrorRes struct {
@@ -23,6 +28,7 @@ type (
 		Id       int    `json:"id"`
 		Name     string `json:"name"`
 		Username string `json:"username"`
+		Phone    string `json:"phone,omitempty"`
 	}
 
 	LoginUserReq struct {
@@ -32,10 +38,11 @@ type (
 
 	LoginUserRes struct {
 		SessionID       string    `json:"sessionID"`
-		AccessToken     string    `json:"accessToken"`
+		AccessToken     string    `json:"accessToken,omitempty"`
 		AccessTokenTTL  time.Time `json:"accessTokenTTL"`
-		RefreshToken    string    `json:"refreshToken"`
+		RefreshToken    string    `json:"refreshToken,omitempty"`
 		RefreshTokenTTL time.Time `json:"refreshTokenTTL"`
+		CSRFToken       string    `json:"csrfToken,omitempty"`
 		User            UserRes   `json:"user"`
 	}
 
@@ -44,10 +51,424 @@ type (
 		RefreshToken string `json:"refreshToken"`
 	}
 
+	RefreshTokenReq struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+
+	ChangePasswordReq struct {
+		CurrentPassword string `json:"currentPassword"`
+		NewPassword     string `json:"newPassword"`
+	}
+
+	LogoutAllReq struct {
+		KeepCurrent bool `json:"keepCurrent"`
+	}
+
+	LogoutAllRes struct {
+		Terminated int64 `json:"terminated"`
+	}
+
 	RenewAccessTokenRes struct {
-		AccessToken     string    `json:"accessToken"`
+		AccessToken     string    `json:"accessToken,omitempty"`
 		AccessTokenTTL  time.Time `json:"accessTokenTTL"`
-		RefreshToken    string    `json:"refreshToken"`
+		RefreshToken    string    `json:"refreshToken,omitempty"`
 		RefreshTokenTTL time.Time `json:"refreshTokenTTL"`
+		CSRFToken       string    `json:"csrfToken,omitempty"`
+	}
+)
+
+type (
+	CreateAPIKeyReq struct {
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	}
+
+	APIKeyRes struct {
+		Id         int        `json:"id"`
+		Name       string     `json:"name"`
+		Prefix     string     `json:"prefix"`
+		Scopes     []string   `json:"scopes"`
+		IsRevoked  bool       `json:"isRevoked"`
+		ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+		LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+		CreatedAt  time.Time  `json:"createdAt"`
+	}
+
+	CreateAPIKeyRes struct {
+		APIKeyRes
+		Key string `json:"key"`
+	}
+)
+
+type (
+	OAuthErrorRes struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description,omitempty"`
+	}
+
+	OAuthTokenRes struct {
+		AccessToken     string `json:"access_token"`
+		TokenType       string `json:"token_type"`
+		ExpiresIn       int    `json:"expires_in"`
+		RefreshToken    string `json:"refresh_token,omitempty"`
+		IDToken         string `json:"id_token,omitempty"`
+		IssuedTokenType string `json:"issued_token_type,omitempty"`
+		Scope           string `json:"scope,omitempty"`
+	}
+)
+
+type (
+	IntrospectionRes struct {
+		Active      bool         `json:"active"`
+		Scope       string       `json:"scope,omitempty"`
+		ClientID    string       `json:"client_id,omitempty"`
+		Username    string       `json:"username,omitempty"`
+		TokenType   string       `json:"token_type,omitempty"`
+		ExpiresAt   int64        `json:"exp,omitempty"`
+		IssuedAt    int64        `json:"iat,omitempty"`
+		Subject     string       `json:"sub,omitempty"`
+		SubjectType string       `json:"sub_type,omitempty"`
+		Audience    []string     `json:"aud,omitempty"`
+		Issuer      string       `json:"iss,omitempty"`
+		JwtID       string       `json:"jti,omitempty"`
+		UserID      int          `json:"user_id,omitempty"`
+		SessionID   string       `json:"sid,omitempty"`
+		Actor       *token.Actor `json:"act,omitempty"`
+	}
+)
+
+type (
+	DeviceAuthorizationRes struct {
+		DeviceCode              string `json:"device_code"`
+		UserCode                string `json:"user_code"`
+		VerificationURI         string `json:"verification_uri"`
+		VerificationURIComplete string `json:"verification_uri_complete"`
+		ExpiresIn               int    `json:"expires_in"`
+		Interval                int    `json:"interval"`
+	}
+
+	DeviceDecisionReq struct {
+		UserCode string `json:"userCode"`
+		Approve  bool   `json:"approve"`
+	}
+)
+
+type (
+	UserInfoRes struct {
+		Subject           string `json:"sub"`
+		Name              string `json:"name,omitempty"`
+		PreferredUsername string `json:"preferred_username,omitempty"`
+	}
+
+	OpenIDConfigurationRes struct {
+		Issuer                                     string   `json:"issuer"`
+		AuthorizationEndpoint                      string   `json:"authorization_endpoint"`
+		TokenEndpoint                              string   `json:"token_endpoint"`
+		UserinfoEndpoint                           string   `json:"userinfo_endpoint"`
+		JwksURI                                    string   `json:"jwks_uri"`
+		IntrospectionEndpoint                      string   `json:"introspection_endpoint"`
+		RevocationEndpoint                         string   `json:"revocation_endpoint"`
+		DeviceAuthorizationEndpoint                string   `json:"device_authorization_endpoint"`
+		ScopesSupported                            []string `json:"scopes_supported"`
+		ResponseTypesSupported                     []string `json:"response_types_supported"`
+		GrantTypesSupported                        []string `json:"grant_types_supported"`
+		SubjectTypesSupported                      []string `json:"subject_types_supported"`
+		IDTokenSigningAlgValuesSupported           []string `json:"id_token_signing_alg_values_supported"`
+		TokenEndpointAuthMethodsSupported          []string `json:"token_endpoint_auth_methods_supported"`
+		TokenEndpointAuthSigningAlgValuesSupported []string `json:"token_endpoint_auth_signing_alg_values_supported"`
+		CodeChallengeMethodsSupported              []string `json:"code_challenge_methods_supported"`
+		ClaimsSupported                            []string `json:"claims_supported"`
+	}
+)
+
+type (
+	CreateClientReq struct {
+		Name         string   `json:"name"`
+		AuthMethod   string   `json:"authMethod" enums:"client_secret_basic,client_secret_post,private_key_jwt,none"`
+		PublicKey    string   `json:"publicKey,omitempty"`
+		Scopes       []string `json:"scopes"`
+		GrantTypes   []string `json:"grantTypes"`
+		RedirectURIs []string `json:"redirectUris"`
+	}
+
+	UpdateClientReq struct {
+		Name         *string  `json:"name,omitempty"`
+		PublicKey    *string  `json:"publicKey,omitempty"`
+		Scopes       []string `json:"scopes,omitempty"`
+		GrantTypes   []string `json:"grantTypes,omitempty"`
+		RedirectURIs []string `json:"redirectUris,omitempty"`
+		IsDisabled   *bool    `json:"isDisabled,omitempty"`
+	}
+
+	ClientRes struct {
+		ClientID     string     `json:"clientId"`
+		Name         string     `json:"name"`
+		AuthMethod   string     `json:"authMethod"`
+		PublicKey    *string    `json:"publicKey,omitempty"`
+		Scopes       []string   `json:"scopes"`
+		GrantTypes   []string   `json:"grantTypes"`
+		RedirectURIs []string   `json:"redirectUris"`
+		IsDisabled   bool       `json:"isDisabled"`
+		CreatedAt    time.Time  `json:"createdAt"`
+		UpdatedAt    *time.Time `json:"updatedAt,omitempty"`
+	}
+
+	CreateClientRes struct {
+		ClientRes
+		ClientSecret string `json:"clientSecret,omitempty"`
+	}
+)
+
+type (
+	CreateExchangeRuleReq struct {
+		Audience   string   `json:"audience"`
+		Scopes     []string `json:"scopes"`
+		TTLSeconds int      `json:"ttlSeconds"`
+	}
+
+	ExchangeRuleRes struct {
+		Id         int       `json:"id"`
+		Audience   string    `json:"audience"`
+		Scopes     []string  `json:"scopes"`
+		TTLSeconds int       `json:"ttlSeconds"`
+		CreatedAt  time.Time `json:"createdAt"`
+	}
+)
+
+type (
+	ExternalProviderRes struct {
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	}
+
+	LinkedIdentityRes struct {
+		Provider    string     `json:"provider"`
+		Subject     string     `json:"subject"`
+		Username    string     `json:"username,omitempty"`
+		Email       string     `json:"email,omitempty"`
+		LastLoginAt *time.Time `json:"lastLoginAt,omitempty"`
+		CreatedAt   time.Time  `json:"createdAt"`
+	}
+
+	LinkIdentityRes struct {
+		AuthorizationURL string `json:"authorizationUrl"`
+	}
+)
+
+type (
+	MagicLinkReq struct {
+		Email string `json:"email"`
+	}
+
+	MagicLinkConsumeReq struct {
+		Token string `json:"token"`
+	}
+)
+
+type (
+	PhoneStartReq struct {
+		Phone string `json:"phone" example:"+14155550123"`
+	}
+
+	PhoneAddReq struct {
+		Phone           string `json:"phone" example:"+14155550123"`
+		CurrentPassword string `json:"currentPassword"`
+	}
+
+	PhoneVerifyReq struct {
+		Phone string `json:"phone" example:"+14155550123"`
+		Code  string `json:"code"`
+	}
+)
+
+type (
+	SCIMUser struct {
+		Schemas     []string        `json:"schemas"`
+		ID          string          `json:"id,omitempty"`
+		ExternalID  string          `json:"externalId,omitempty"`
+		UserName    string          `json:"userName"`
+		Name        *SCIMName       `json:"name,omitempty"`
+		DisplayName string          `json:"displayName,omitempty"`
+		Emails      []SCIMEmail     `json:"emails,omitempty"`
+		Active      *bool           `json:"active,omitempty"`
+		Password    string          `json:"password,omitempty"`
+		Groups      []SCIMMemberRef `json:"groups,omitempty"`
+		Meta        *SCIMMeta       `json:"meta,omitempty"`
+	}
+
+	SCIMName struct {
+		Formatted  string `json:"formatted,omitempty"`
+		GivenName  string `json:"givenName,omitempty"`
+		FamilyName string `json:"familyName,omitempty"`
+	}
+
+	SCIMEmail struct {
+		Value   string `json:"value"`
+		Type    string `json:"type,omitempty"`
+		Primary bool   `json:"primary,omitempty"`
+	}
+
+	SCIMGroup struct {
+		Schemas     []string        `json:"schemas"`
+		ID          string          `json:"id,omitempty"`
+		ExternalID  string          `json:"externalId,omitempty"`
+		DisplayName string          `json:"displayName"`
+		Members     []SCIMMemberRef `json:"members,omitempty"`
+		Meta        *SCIMMeta       `json:"meta,omitempty"`
+	}
+
+	SCIMMemberRef struct {
+		Value   string `json:"value"`
+		Ref     string `json:"$ref,omitempty"`
+		Display string `json:"display,omitempty"`
+	}
+
+	SCIMMeta struct {
+		ResourceType string    `json:"resourceType"`
+		Created      time.Time `json:"created"`
+		LastModified time.Time `json:"lastModified"`
+		Location     string    `json:"location"`
+	}
+
+	SCIMListRes struct {
+		Schemas      []string `json:"schemas"`
+		TotalResults int      `json:"totalResults"`
+		StartIndex   int      `json:"startIndex"`
+		ItemsPerPage int      `json:"itemsPerPage"`
+		Resources    any      `json:"Resources" swaggertype:"array,object"`
+	}
+
+	SCIMPatchReq struct {
+		Schemas    []string      `json:"schemas"`
+		Operations []SCIMPatchOp `json:"Operations"`
+	}
+
+	SCIMPatchOp struct {
+		Op    string          `json:"op" enums:"add,replace,remove"`
+		Path  string          `json:"path,omitempty"`
+		Value json.RawMessage `json:"value,omitempty" swaggertype:"object"`
+	}
+
+	SCIMErrorRes struct {
+		Schemas  []string `json:"schemas"`
+		Status   string   `json:"status"`
+		SCIMType string   `json:"scimType,omitempty"`
+		Detail   string   `json:"detail,omitempty"`
+	}
+
+	SCIMServiceProviderConfig struct {
+		Schemas               []string         `json:"schemas"`
+		Patch                 SCIMSupported    `json:"patch"`
+		Bulk                  SCIMBulk         `json:"bulk"`
+		Filter                SCIMFilter       `json:"filter"`
+		ChangePassword        SCIMSupported    `json:"changePassword"`
+		Sort                  SCIMSupported    `json:"sort"`
+		ETag                  SCIMSupported    `json:"etag"`
+		AuthenticationSchemes []SCIMAuthScheme `json:"authenticationSchemes"`
+	}
+
+	SCIMSupported struct {
+		Supported bool `json:"supported"`
+	}
+
+	SCIMBulk struct {
+		Supported      bool `json:"supported"`
+		MaxOperations  int  `json:"maxOperations"`
+		MaxPayloadSize int  `json:"maxPayloadSize"`
+	}
+
+	SCIMFilter struct {
+		Supported  bool `json:"supported"`
+		MaxResults int  `json:"maxResults"`
+	}
+
+	SCIMAuthScheme struct {
+		Type        string `json:"type"`
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+)
+
+type (
+	CreateWebhookReq struct {
+		URL         string   `json:"url" example:"https://example.com/hooks/auth"`
+		EventTypes  []string `json:"eventTypes" example:"session.ip_changed"`
+		Description string   `json:"description"`
+	}
+
+	UpdateWebhookReq struct {
+		URL         *string  `json:"url,omitempty"`
+		EventTypes  []string `json:"eventTypes,omitempty"`
+		Description *string  `json:"description,omitempty"`
+		IsDisabled  *bool    `json:"isDisabled,omitempty"`
+	}
+
+	WebhookRes struct {
+		Id          int        `json:"id"`
+		URL         string     `json:"url"`
+		EventTypes  []string   `json:"eventTypes"`
+		Description string     `json:"description"`
+		IsDisabled  bool       `json:"isDisabled"`
+		CreatedAt   time.Time  `json:"createdAt"`
+		UpdatedAt   *time.Time `json:"updatedAt,omitempty"`
+	}
+
+	CreateWebhookRes struct {
+		WebhookRes
+		Secret string `json:"secret,omitempty"`
+	}
+
+	WebhookDeadLetterRes struct {
+		Id         int             `json:"id"`
+		EventID    string          `json:"eventId"`
+		EventType  string          `json:"eventType"`
+		Payload    json.RawMessage `json:"payload" swaggertype:"object"`
+		Attempts   int             `json:"attempts"`
+		LastStatus *int            `json:"lastStatus,omitempty"`
+		LastError  string          `json:"lastError"`
+		CreatedAt  time.Time       `json:"createdAt"`
+	}
+)
+
+type (
+	AuditLogRes struct {
+		Id         int64           `json:"id"`
+		EventID    string          `json:"eventId"`
+		Type       string          `json:"type"`
+		UserID     *int            `json:"userId,omitempty"`
+		SessionID  string          `json:"sessionId,omitempty"`
+		IP         string          `json:"ip,omitempty"`
+		UserAgent  string          `json:"userAgent,omitempty"`
+		Data       json.RawMessage `json:"data,omitempty" swaggertype:"object"`
+		Time       time.Time       `json:"time"`
+		RecordedAt time.Time       `json:"recordedAt"`
+		PrevHash   string          `json:"prevHash,omitempty"`
+		Hash       string          `json:"hash,omitempty"`
+	}
+
+	AuditLogPageRes struct {
+		Entries    []AuditLogRes `json:"entries"`
+		NextCursor string        `json:"nextCursor,omitempty"`
+	}
+)
+
+type (
+	ActivityRes struct {
+		Id         int64     `json:"id"`
+		Type       string    `json:"type" example:"auth.login_succeeded"`
+		Result     string    `json:"result" example:"succeeded"`
+		Method     string    `json:"method,omitempty" example:"password"`
+		Reason     string    `json:"reason,omitempty"`
+		SessionID  string    `json:"sessionId,omitempty"`
+		IP         string    `json:"ip"`
+		PreviousIP string    `json:"previousIp,omitempty"`
+		UserAgent  string    `json:"userAgent"`
+		Browser    string    `json:"browser,omitempty" example:"Firefox 128"`
+		OS         string    `json:"os,omitempty" example:"Linux"`
+		Device     string    `json:"device" example:"desktop"`
+		Country    string    `json:"country,omitempty" example:"DE"`
+		City       string    `json:"city,omitempty" example:"Berlin"`
+		Time       time.Time `json:"time"`
 	}
 )
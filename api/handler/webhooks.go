@@ -0,0 +1,325 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/arrogantworm/jwt_auth/api/utils"
+	"github.com/arrogantworm/jwt_auth/api/webhooks"
+	"github.com/arrogantworm/jwt_auth/db"
+	"github.com/go-chi/chi/v5"
+)
+
+const webhookDeadLettersLimit = 100
+
+func toWebhookRes(s *db.WebhookSubscription) WebhookRes {
+	return WebhookRes{
+		Id:          s.ID,
+		URL:         s.URL,
+		EventTypes:  s.EventTypes,
+		Description: s.Description,
+		IsDisabled:  s.IsDisabled,
+		CreatedAt:   s.CreatedAt,
+		UpdatedAt:   s.UpdatedAt,
+	}
+}
+
+// validateWebhook returns a message describing the first invalid field, or ""
+func validateWebhook(s *db.WebhookSubscription) string {
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return "url must be an absolute http or https URL"
+	}
+
+	if len(s.EventTypes) == 0 {
+		return "at least one event type is required"
+	}
+
+	for _, eventType := range s.EventTypes {
+		if !webhooks.KnownEventType(eventType) {
+			return "unknown event type " + eventType
+		}
+	}
+
+	return ""
+}
+
+func (h *Handler) webhookFromURL(w http.ResponseWriter, r *http.Request) (*db.WebhookSubscription, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "webhookID"))
+	if err != nil {
+		h.sendError(w, "invalid webhook id", http.StatusBadRequest)
+		return nil, false
+	}
+
+	s, err := h.db.GetWebhookSubscription(h.ctx, id)
+	if err != nil {
+		h.sendError(w, "webhook not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	return s, true
+}
+
+// admin/webhooks
+// @Summary Create webhook
+// @Tags admin, webhooks
+// @Description Subscribe a URL to events, or to every event with "*". Deliveries are signed with a generated secret that is only shown once: X-Webhook-Signature is "sha256=" and the hex HMAC-SHA256 of the X-Webhook-Timestamp header, a dot and the body.
+// @ID admin-webhooks-create
+// @Security BearerAuth
+// @Accept json
+// @Param input body CreateWebhookReq true "Subscription"
+// @Produce json
+// @Success 201 {object} CreateWebhookRes
+// @Failure 400,401,403,500 {object} ErrorRes
+// @Router /admin/webhooks [post]
+func (h *Handler) createWebhook(w http.ResponseWriter, r *http.Request) {
+	var req CreateWebhookReq
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendError(w, "", http.StatusBadRequest)
+		return
+	}
+
+	secret, err := utils.RandomHex(32)
+	if err != nil {
+		h.sendError(w, "error creating webhook", http.StatusInternalServerError)
+		return
+	}
+
+	s := &db.WebhookSubscription{
+		URL:         req.URL,
+		EventTypes:  req.EventTypes,
+		Secret:      secret,
+		Description: req.Description,
+	}
+
+	if msg := validateWebhook(s); msg != "" {
+		h.sendError(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	s, err = h.db.CreateWebhookSubscription(h.ctx, s)
+	if err != nil {
+		h.sendError(w, "error creating webhook", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreateWebhookRes{WebhookRes: toWebhookRes(s), Secret: secret})
+}
+
+// admin/webhooks
+// @Summary List webhooks
+// @Tags admin, webhooks
+// @Description List webhook subscriptions
+// @ID admin-webhooks-list
+// @Security BearerAuth
+// @Produce json
+// @Success 200 {array} WebhookRes
+// @Failure 401,403,500 {object} ErrorRes
+// @Router /admin/webhooks [get]
+func (h *Handler) listWebhooks(w http.ResponseWriter, r *http.Request) {
+	subs, err := h.db.ListWebhookSubscriptions(h.ctx)
+	if err != nil {
+		h.sendError(w, "error listing webhooks", http.StatusInternalServerError)
+		return
+	}
+
+	res := make([]WebhookRes, 0, len(subs))
+	for _, s := range subs {
+		res = append(res, toWebhookRes(s))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// admin/webhooks/{webhookID}
+// @Summary Get webhook
+// @Tags admin, webhooks
+// @Description Get a webhook subscription
+// @ID admin-webhooks-get
+// @Security BearerAuth
+// @Param webhookID path int true "Webhook ID"
+// @Produce json
+// @Success 200 {object} WebhookRes
+// @Failure 400,401,403,404 {object} ErrorRes
+// @Router /admin/webhooks/{webhookID} [get]
+func (h *Handler) getWebhook(w http.ResponseWriter, r *http.Request) {
+	s, ok := h.webhookFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(toWebhookRes(s))
+}
+
+// admin/webhooks/{webhookID}
+// @Summary Update webhook
+// @Tags admin, webhooks
+// @Description Update a subscription's URL, event types, description or disabled flag
+// @ID admin-webhooks-update
+// @Security BearerAuth
+// @Param webhookID path int true "Webhook ID"
+// @Accept json
+// @Param input body UpdateWebhookReq true "Fields to update"
+// @Produce json
+// @Success 200 {object} WebhookRes
+// @Failure 400,401,403,404,500 {object} ErrorRes
+// @Router /admin/webhooks/{webhookID} [put]
+func (h *Handler) updateWebhook(w http.ResponseWriter, r *http.Request) {
+	var req UpdateWebhookReq
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendError(w, "", http.StatusBadRequest)
+		return
+	}
+
+	s, ok := h.webhookFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	if req.URL != nil {
+		s.URL = *req.URL
+	}
+
+	if req.EventTypes != nil {
+		s.EventTypes = req.EventTypes
+	}
+
+	if req.Description != nil {
+		s.Description = *req.Description
+	}
+
+	if req.IsDisabled != nil {
+		s.IsDisabled = *req.IsDisabled
+	}
+
+	if msg := validateWebhook(s); msg != "" {
+		h.sendError(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	if err := h.db.UpdateWebhookSubscription(h.ctx, s); err != nil {
+		h.sendError(w, "error updating webhook", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(toWebhookRes(s))
+}
+
+// admin/webhooks/{webhookID}
+// @Summary Delete webhook
+// @Tags admin, webhooks
+// @Description Delete a webhook subscription along with its dead letters
+// @ID admin-webhooks-delete
+// @Security BearerAuth
+// @Param webhookID path int true "Webhook ID"
+// @Produce json
+// @Success 200 {object} SuccessRes
+// @Failure 400,401,403,404,500 {object} ErrorRes
+// @Router /admin/webhooks/{webhookID} [delete]
+func (h *Handler) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "webhookID"))
+	if err != nil {
+		h.sendError(w, "invalid webhook id", http.StatusBadRequest)
+		return
+	}
+
+	found, err := h.db.DeleteWebhookSubscription(h.ctx, id)
+	if err != nil {
+		h.sendError(w, "error deleting webhook", http.StatusInternalServerError)
+		return
+	}
+
+	if !found {
+		h.sendError(w, "webhook not found", http.StatusNotFound)
+		return
+	}
+
+	h.sendSuccess(w, "webhook deleted", http.StatusOK)
+}
+
+// admin/webhooks/{webhookID}/secret
+// @Summary Rotate webhook secret
+// @Tags admin, webhooks
+// @Description Generate a new signing secret. Deliveries are signed with it immediately, including retries of earlier events.
+// @ID admin-webhooks-secret
+// @Security BearerAuth
+// @Param webhookID path int true "Webhook ID"
+// @Produce json
+// @Success 200 {object} CreateWebhookRes
+// @Failure 400,401,403,404,500 {object} ErrorRes
+// @Router /admin/webhooks/{webhookID}/secret [post]
+func (h *Handler) rotateWebhookSecret(w http.ResponseWriter, r *http.Request) {
+	s, ok := h.webhookFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	secret, err := utils.RandomHex(32)
+	if err != nil {
+		h.sendError(w, "error rotating secret", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.db.UpdateWebhookSecret(h.ctx, s.ID, secret); err != nil {
+		h.sendError(w, "error rotating secret", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(CreateWebhookRes{WebhookRes: toWebhookRes(s), Secret: secret})
+}
+
+// admin/webhooks/{webhookID}/dead-letters
+// @Summary List webhook dead letters
+// @Tags admin, webhooks
+// @Description List the latest events that could not be delivered to a subscription after every retry
+// @ID admin-webhooks-dead-letters
+// @Security BearerAuth
+// @Param webhookID path int true "Webhook ID"
+// @Produce json
+// @Success 200 {array} WebhookDeadLetterRes
+// @Failure 400,401,403,404,500 {object} ErrorRes
+// @Router /admin/webhooks/{webhookID}/dead-letters [get]
+func (h *Handler) listWebhookDeadLetters(w http.ResponseWriter, r *http.Request) {
+	s, ok := h.webhookFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	letters, err := h.db.ListWebhookDeadLetters(h.ctx, s.ID, webhookDeadLettersLimit)
+	if err != nil {
+		h.sendError(w, "error listing dead letters", http.StatusInternalServerError)
+		return
+	}
+
+	res := make([]WebhookDeadLetterRes, 0, len(letters))
+	for _, d := range letters {
+		res = append(res, WebhookDeadLetterRes{
+			Id:         d.ID,
+			EventID:    d.EventID,
+			EventType:  d.EventType,
+			Payload:    d.Payload,
+			Attempts:   d.Attempts,
+			LastStatus: d.LastStatus,
+			LastError:  d.LastError,
+			CreatedAt:  d.CreatedAt,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,46 @@
+// Package mail sends transactional email through a configured sender.
+package mail
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	DriverLog  = "log"
+	DriverSMTP = "smtp"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+}
+
+type Sender interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// New builds the sender selected by mail.driver. The log sender is used when none is set.
+func New() (Sender, error) {
+	switch driver := viper.GetString("mail.driver"); driver {
+	case "", DriverLog:
+		return LogSender{}, nil
+	case DriverSMTP:
+		return NewSMTPSender()
+	default:
+		return nil, fmt.Errorf("unknown mail driver %q", driver)
+	}
+}
+
+// LogSender writes messages to the log instead of sending them, for local runs
+type LogSender struct{}
+
+func (LogSender) Send(ctx context.Context, msg Message) error {
+	log.Printf("[MAIL] to: %s\nsubject: %s\n\n%s", msg.To, msg.Subject, msg.Text)
+	return nil
+}
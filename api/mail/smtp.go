@@ -0,0 +1,114 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arrogantworm/jwt_auth/api/utils"
+	"github.com/spf13/viper"
+)
+
+type (
+	SMTPConfig struct {
+		Host        string `mapstructure:"host"`
+		Port        int    `mapstructure:"port"`
+		Username    string `mapstructure:"username"`
+		PasswordEnv string `mapstructure:"passwordEnv"`
+	}
+
+	// SMTPSender delivers messages to an SMTP relay. STARTTLS is used when the
+	// server offers it, and credentials are only sent over TLS or to localhost.
+	SMTPSender struct {
+		config   SMTPConfig
+		from     *mail.Address
+		password string
+	}
+)
+
+func NewSMTPSender() (*SMTPSender, error) {
+	var cfg SMTPConfig
+	if err := viper.UnmarshalKey("mail.smtp", &cfg); err != nil {
+		return nil, fmt.Errorf("error reading smtp config: %w", err)
+	}
+
+	if cfg.Host == "" {
+		return nil, errors.New("mail.smtp.host is required")
+	}
+	if cfg.Port == 0 {
+		cfg.Port = 587
+	}
+
+	from, err := mail.ParseAddress(viper.GetString("mail.from"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid mail.from: %w", err)
+	}
+
+	return &SMTPSender{
+		config:   cfg,
+		from:     from,
+		password: os.Getenv(cfg.PasswordEnv),
+	}, nil
+}
+
+func (s *SMTPSender) Send(ctx context.Context, msg Message) error {
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return fmt.Errorf("invalid recipient: %w", err)
+	}
+
+	var auth smtp.Auth
+	if s.config.Username != "" {
+		auth = smtp.PlainAuth("", s.config.Username, s.password, s.config.Host)
+	}
+
+	body, err := s.message(to, msg)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		addr := net.JoinHostPort(s.config.Host, strconv.Itoa(s.config.Port))
+		done <- smtp.SendMail(addr, auth, s.from.Address, []string{to.Address}, body)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *SMTPSender) message(to *mail.Address, msg Message) ([]byte, error) {
+	id, err := utils.RandomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	messageID := "<" + id + "@" + s.from.Address[strings.LastIndex(s.from.Address, "@")+1:] + ">"
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", s.from.String())
+	fmt.Fprintf(&b, "To: %s\r\n", to.String())
+	// Encoded so a subject can't inject headers
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: %s\r\n", messageID)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Text, "\n", "\r\n"))
+
+	return b.Bytes(), nil
+}
@@ -0,0 +1,336 @@
+// Package outbox delivers the events recorded alongside session and account
+// changes to the notification sinks, at least once. Several replicas can run
+// the dispatcher against the same database.
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/arrogantworm/jwt_auth/api/events"
+	"github.com/arrogantworm/jwt_auth/db"
+	"github.com/spf13/viper"
+)
+
+// Publisher records events in the outbox
+type Publisher struct {
+	db *db.Postgres
+}
+
+func NewPublisher(pg *db.Postgres) *Publisher {
+	return &Publisher{db: pg}
+}
+
+func (p *Publisher) Publish(ctx context.Context, evs ...*events.Event) error {
+	rows, err := p.Stage(evs...)
+	if err != nil {
+		return err
+	}
+
+	return p.db.CreateOutboxEvents(ctx, rows...)
+}
+
+// Stage encodes events as outbox rows, to be saved by the database change they describe
+func (p *Publisher) Stage(evs ...*events.Event) ([]*db.OutboxEvent, error) {
+	rows := make([]*db.OutboxEvent, 0, len(evs))
+
+	for _, e := range evs {
+		payload, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+
+		rows = append(rows, &db.OutboxEvent{
+			EventID:   e.ID,
+			EventType: e.Type,
+			Payload:   payload,
+		})
+	}
+
+	return rows, nil
+}
+
+// Sink receives outbox events. An error makes the dispatcher try the event
+// again later, unless it is wrapped with Permanent.
+type Sink interface {
+	Name() string
+	Deliver(ctx context.Context, e *events.Event) error
+}
+
+// MultiSink is implemented by sinks that hand an event to several receivers,
+// such as webhook subscriptions. DeliverRemaining skips the receivers in
+// delivered and returns the ones that accepted the event along with the error
+// for the rest. They are recorded as "<sink>:<receiver>", so later attempts
+// and dead letters only cover the receivers that failed.
+type MultiSink interface {
+	Sink
+	DeliverRemaining(ctx context.Context, e *events.Event, delivered []string) ([]string, error)
+}
+
+// Permanent marks a delivery error that trying again can't fix. The sink is
+// given up on at once and not tried again, while other sinks still are.
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+func isPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+// DeadLetterer is implemented by sinks that keep the events the dispatcher
+// gave up on. err is the last error Deliver returned.
+type DeadLetterer interface {
+	DeadLetter(ctx context.Context, e *events.Event, attempts int, err error)
+}
+
+type Config struct {
+	PollInterval   time.Duration `mapstructure:"pollInterval"`
+	BatchSize      int           `mapstructure:"batchSize"`
+	Lease          time.Duration `mapstructure:"lease"`
+	MaxAttempts    int           `mapstructure:"maxAttempts"`
+	InitialBackoff time.Duration `mapstructure:"initialBackoff"`
+	MaxBackoff     time.Duration `mapstructure:"maxBackoff"`
+	Retention      time.Duration `mapstructure:"retention"`
+}
+
+type Dispatcher struct {
+	db     *db.Postgres
+	sinks  []Sink
+	config Config
+
+	lastCleanup time.Time
+}
+
+func New(pg *db.Postgres, sinks []Sink) (*Dispatcher, error) {
+	var cfg Config
+	if err := viper.UnmarshalKey("outbox", &cfg); err != nil {
+		return nil, fmt.Errorf("error reading outbox config: %w", err)
+	}
+
+	if cfg.PollInterval == 0 {
+		cfg.PollInterval = time.Second
+	}
+	if cfg.BatchSize < 1 {
+		cfg.BatchSize = 50
+	}
+	if cfg.Lease == 0 {
+		cfg.Lease = time.Minute
+	}
+	if cfg.MaxAttempts < 1 {
+		cfg.MaxAttempts = 1
+	}
+	if cfg.InitialBackoff == 0 {
+		cfg.InitialBackoff = time.Second
+	}
+	if cfg.MaxBackoff < cfg.InitialBackoff {
+		cfg.MaxBackoff = cfg.InitialBackoff
+	}
+
+	return &Dispatcher{
+		db:     pg,
+		sinks:  sinks,
+		config: cfg,
+	}, nil
+}
+
+// Run delivers pending events until ctx is done
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.config.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		// A full batch means more events are probably waiting
+		if d.dispatchBatch(ctx) < d.config.BatchSize {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+func (d *Dispatcher) dispatchBatch(ctx context.Context) int {
+	if d.config.Retention > 0 && time.Since(d.lastCleanup) > time.Hour {
+		d.lastCleanup = time.Now()
+		if _, err := d.db.DeleteDeliveredOutboxEvents(ctx, d.config.Retention); err != nil {
+			log.Println("[OUTBOX] error deleting delivered events:", err)
+		}
+	}
+
+	rows, err := d.db.ClaimOutboxEvents(ctx, d.config.BatchSize, d.config.Lease)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Println("[OUTBOX] error claiming events:", err)
+		}
+		return 0
+	}
+
+	for _, row := range rows {
+		ok, err := d.db.StartOutboxAttempt(ctx, row, d.config.Lease)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Println("[OUTBOX] error starting attempt:", err)
+			}
+			continue
+		}
+		// The batch took longer than the lease, another replica may have it now
+		if !ok {
+			continue
+		}
+
+		d.dispatch(ctx, row)
+	}
+
+	return len(rows)
+}
+
+func (d *Dispatcher) dispatch(ctx context.Context, row *db.OutboxEvent) {
+	var e events.Event
+	if err := json.Unmarshal(row.Payload, &e); err != nil {
+		log.Printf("[OUTBOX] event %s: %v", row.EventID, err)
+		if err := d.db.FailOutboxEvent(ctx, row.ID, row.DeliveredSinks, err.Error()); err != nil {
+			log.Println("[OUTBOX] error marking event failed:", err)
+		}
+		return
+	}
+
+	delivered := slices.Clone(row.DeliveredSinks)
+	failures := map[Sink]error{}
+
+	for _, s := range d.sinks {
+		if slices.Contains(delivered, s.Name()) {
+			continue
+		}
+
+		if err := d.deliver(ctx, s, &e, &delivered); err != nil {
+			failures[s] = err
+			continue
+		}
+		delivered = append(delivered, s.Name())
+	}
+
+	if len(failures) == 0 {
+		if err := d.db.MarkOutboxEventDelivered(ctx, row.ID); err != nil {
+			log.Println("[OUTBOX] error marking event delivered:", err)
+		}
+		return
+	}
+
+	var msgs []string
+	for s, err := range failures {
+		msgs = append(msgs, s.Name()+": "+err.Error())
+	}
+	slices.Sort(msgs)
+	lastError := strings.Join(msgs, "; ")
+
+	log.Printf("[OUTBOX] %s %s, attempt %d: %s", e.Type, e.ID, row.Attempts, lastError)
+
+	retry := false
+	for _, err := range failures {
+		if !isPermanent(err) {
+			retry = true
+		}
+	}
+
+	if retry && row.Attempts < d.config.MaxAttempts {
+		// Sinks that failed for good are dead-lettered now and skipped on the
+		// next attempts, like the ones that got the event
+		for s, err := range failures {
+			if !isPermanent(err) {
+				continue
+			}
+			if dl, ok := s.(DeadLetterer); ok {
+				dl.DeadLetter(ctx, &e, row.Attempts, err)
+			}
+			delivered = append(delivered, s.Name())
+		}
+
+		if err := d.db.RetryOutboxEvent(ctx, row.ID, delivered, d.backoff(row.Attempts), lastError); err != nil {
+			log.Println("[OUTBOX] error scheduling retry:", err)
+		}
+		return
+	}
+
+	for s, err := range failures {
+		if dl, ok := s.(DeadLetterer); ok {
+			dl.DeadLetter(ctx, &e, row.Attempts, err)
+		}
+	}
+
+	if err := d.db.FailOutboxEvent(ctx, row.ID, delivered, lastError); err != nil {
+		log.Println("[OUTBOX] error marking event failed:", err)
+	}
+}
+
+// deliver hands e to s. The receivers of a MultiSink that accept it are
+// added to delivered even when others fail.
+func (d *Dispatcher) deliver(ctx context.Context, s Sink, e *events.Event, delivered *[]string) error {
+	ms, ok := s.(MultiSink)
+	if !ok {
+		return s.Deliver(ctx, e)
+	}
+
+	prefix := s.Name() + ":"
+
+	var done []string
+	for _, name := range *delivered {
+		if receiver, ok := strings.CutPrefix(name, prefix); ok {
+			done = append(done, receiver)
+		}
+	}
+
+	accepted, err := ms.DeliverRemaining(ctx, e, done)
+	for _, receiver := range accepted {
+		*delivered = append(*delivered, prefix+receiver)
+	}
+
+	return err
+}
+
+// backoff doubles the wait after every failed attempt, with up to 10% jitter
+func (d *Dispatcher) backoff(attempt int) time.Duration {
+	wait := d.config.InitialBackoff
+	for i := 1; i < attempt && wait < d.config.MaxBackoff; i++ {
+		wait *= 2
+	}
+	wait = min(wait, d.config.MaxBackoff)
+
+	return wait + rand.N(wait/10+1)
+}
+
+// LogSink writes events to the log, for local runs
+type LogSink struct{}
+
+func (LogSink) Name() string {
+	return "log"
+}
+
+func (LogSink) Deliver(ctx context.Context, e *events.Event) error {
+	log.Printf("[EVENT] %s %s user=%d session=%s ip=%s %s", e.Type, e.ID, e.UserID, e.SessionID, e.IP, e.Data)
+	return nil
+}
@@ -0,0 +1,218 @@
+// Package risk scores signin and renewal attempts from independent signals and
+// maps the score to a decision with the thresholds in risk.thresholds. Signals
+// are looked up by name in a registry, so more can be plugged in with
+// Register before the engine is built.
+package risk
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/arrogantworm/jwt_auth/api/geoip"
+	"github.com/arrogantworm/jwt_auth/db"
+	"github.com/spf13/viper"
+)
+
+// Decisions
+const (
+	DecisionAllow  = "allow"
+	DecisionReauth = "reauth"
+	DecisionDeny   = "deny"
+)
+
+// Attempt kinds
+const (
+	KindSignin = "signin"
+	KindRenew  = "renew"
+)
+
+type Config struct {
+	Enabled    bool                    `mapstructure:"enabled"`
+	Thresholds Thresholds              `mapstructure:"thresholds"`
+	Signals    map[string]SignalConfig `mapstructure:"signals"`
+}
+
+// Thresholds are the lowest scores that lead to each decision. Zero turns a
+// decision off.
+type Thresholds struct {
+	Reauth int `mapstructure:"reauth"`
+	Deny   int `mapstructure:"deny"`
+}
+
+// SignalConfig holds the settings of every built-in signal, each uses the
+// ones it needs
+type SignalConfig struct {
+	// Added to the score when the signal fires, zero turns the signal off
+	Weight int `mapstructure:"weight"`
+	// failedAttempts
+	Window time.Duration `mapstructure:"window"`
+	Max    int           `mapstructure:"max"`
+	// torExit, datacenter
+	File string `mapstructure:"file"`
+	// timeOfDay
+	From     int    `mapstructure:"from"`
+	To       int    `mapstructure:"to"`
+	Timezone string `mapstructure:"timezone"`
+}
+
+// Attempt is a signin or renewal to be scored
+type Attempt struct {
+	Kind      string
+	UserID    int
+	IP        string
+	UserAgent string
+	// Derived from the device ID the client keeps, empty when unknown
+	DeviceFingerprint string
+	Location          *geoip.Location
+	Time              time.Time
+	// Earlier sessions and devices of the user, loaded by the engine
+	History *db.RiskHistory
+}
+
+// Signal is one source of risk. Score returns what it adds for a, usually
+// zero or the weight it was built with.
+type Signal interface {
+	Name() string
+	Score(ctx context.Context, a *Attempt) (int, error)
+}
+
+// Factory builds a signal from its config
+type Factory func(pg *db.Postgres, cfg SignalConfig) (Signal, error)
+
+var factories = map[string]Factory{}
+
+// Register makes a signal available under name in risk.signals
+func Register(name string, f Factory) {
+	factories[name] = f
+}
+
+// factory finds the signal registered as key. Config keys are lowercased, so
+// the name is matched without case.
+func factory(key string) (string, Factory) {
+	for name, f := range factories {
+		if strings.EqualFold(name, key) {
+			return name, f
+		}
+	}
+
+	return "", nil
+}
+
+// Hit is a signal that added to a score
+type Hit struct {
+	Name  string `json:"name"`
+	Score int    `json:"score"`
+}
+
+// Assessment is the outcome of scoring an attempt
+type Assessment struct {
+	Score    int
+	Hits     []Hit
+	Decision string
+}
+
+// Engine scores attempts with the signals listed in risk.signals
+type Engine struct {
+	db      *db.Postgres
+	signals []Signal
+	config  Config
+}
+
+func New(pg *db.Postgres) (*Engine, error) {
+	var cfg Config
+	if err := viper.UnmarshalKey("risk", &cfg); err != nil {
+		return nil, fmt.Errorf("error reading risk config: %w", err)
+	}
+
+	e := &Engine{db: pg, config: cfg}
+	if !cfg.Enabled {
+		return e, nil
+	}
+
+	// Sorted, so signals are always scored and reported in the same order
+	keys := make([]string, 0, len(cfg.Signals))
+	for key := range cfg.Signals {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		sc := cfg.Signals[key]
+		if sc.Weight == 0 {
+			continue
+		}
+
+		name, f := factory(key)
+		if f == nil {
+			return nil, fmt.Errorf("unknown risk signal %q", key)
+		}
+
+		s, err := f(pg, sc)
+		if err != nil {
+			return nil, fmt.Errorf("error building risk signal %s: %w", name, err)
+		}
+		e.signals = append(e.signals, s)
+	}
+
+	return e, nil
+}
+
+// Enabled tells whether attempts are scored at all
+func (e *Engine) Enabled() bool {
+	return e.config.Enabled
+}
+
+// Assess scores a and decides what to do about it. A signal that fails is
+// logged and counts as zero, so an outage of one doesn't lock everyone out.
+func (e *Engine) Assess(ctx context.Context, a *Attempt) *Assessment {
+	res := &Assessment{Decision: DecisionAllow, Hits: []Hit{}}
+	if !e.config.Enabled {
+		return res
+	}
+
+	if a.Time.IsZero() {
+		a.Time = time.Now()
+	}
+
+	if a.History == nil {
+		var asn int
+		if a.Location != nil {
+			asn = a.Location.ASN
+		}
+
+		h, err := e.db.GetRiskHistory(ctx, a.UserID, a.IP, asn, a.DeviceFingerprint)
+		if err != nil {
+			log.Println("[RISK]", err)
+			h = &db.RiskHistory{}
+		}
+		a.History = h
+	}
+
+	for _, s := range e.signals {
+		score, err := s.Score(ctx, a)
+		if err != nil {
+			log.Println("[RISK]", s.Name(), err)
+			continue
+		}
+		if score == 0 {
+			continue
+		}
+
+		res.Score += score
+		res.Hits = append(res.Hits, Hit{Name: s.Name(), Score: score})
+	}
+
+	t := e.config.Thresholds
+	switch {
+	case t.Deny > 0 && res.Score >= t.Deny:
+		res.Decision = DecisionDeny
+	case t.Reauth > 0 && res.Score >= t.Reauth:
+		res.Decision = DecisionReauth
+	}
+
+	return res
+}
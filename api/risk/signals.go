@@ -0,0 +1,251 @@
+package risk
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/arrogantworm/jwt_auth/api/events"
+	"github.com/arrogantworm/jwt_auth/db"
+)
+
+// Built-in signals
+const (
+	SignalNewIP          = "newIP"
+	SignalNewASN         = "newASN"
+	SignalNewDevice      = "newDevice"
+	SignalFailedAttempts = "failedAttempts"
+	SignalTorExit        = "torExit"
+	SignalDatacenter     = "datacenter"
+	SignalTimeOfDay      = "timeOfDay"
+)
+
+func init() {
+	Register(SignalNewIP, func(_ *db.Postgres, cfg SignalConfig) (Signal, error) {
+		return historySignal{SignalNewIP, cfg.Weight, func(h *db.RiskHistory) bool { return h.HasSessions && !h.KnownIP }}, nil
+	})
+	Register(SignalNewASN, func(_ *db.Postgres, cfg SignalConfig) (Signal, error) {
+		return historySignal{SignalNewASN, cfg.Weight, func(h *db.RiskHistory) bool { return h.HasSessions && !h.KnownASN }}, nil
+	})
+	Register(SignalNewDevice, newDeviceSignal)
+	Register(SignalFailedAttempts, newFailedAttemptsSignal)
+	Register(SignalTorExit, func(_ *db.Postgres, cfg SignalConfig) (Signal, error) {
+		return newIPListSignal(SignalTorExit, cfg)
+	})
+	Register(SignalDatacenter, func(_ *db.Postgres, cfg SignalConfig) (Signal, error) {
+		return newIPListSignal(SignalDatacenter, cfg)
+	})
+	Register(SignalTimeOfDay, newTimeOfDaySignal)
+}
+
+// historySignal fires when the user has history and the attempt doesn't fit it
+type historySignal struct {
+	name   string
+	weight int
+	fires  func(h *db.RiskHistory) bool
+}
+
+func (s historySignal) Name() string {
+	return s.name
+}
+
+func (s historySignal) Score(ctx context.Context, a *Attempt) (int, error) {
+	if a.History == nil || !s.fires(a.History) {
+		return 0, nil
+	}
+
+	return s.weight, nil
+}
+
+// newDevice only looks at signins, renewals come from the device the session
+// was created on
+type newDevice struct {
+	weight int
+}
+
+func newDeviceSignal(_ *db.Postgres, cfg SignalConfig) (Signal, error) {
+	return newDevice{cfg.Weight}, nil
+}
+
+func (s newDevice) Name() string {
+	return SignalNewDevice
+}
+
+func (s newDevice) Score(ctx context.Context, a *Attempt) (int, error) {
+	if a.Kind != KindSignin || a.History == nil || !a.History.HasDevices || a.History.KnownDevice {
+		return 0, nil
+	}
+
+	return s.weight, nil
+}
+
+// failureReasons are the failed signins that count as guesses. Signins the
+// engine refused are left out, or retrying would only make things worse.
+var failureReasons = []string{events.ReasonWrongPassword, events.ReasonUnknownUser, events.ReasonInvalidCode}
+
+// failedAttempts adds the weight for every failed signin from the attempt's IP
+// within the window, up to max of them. Failures elsewhere are not counted, as
+// anyone who knows a username could add them. Renewals are not scored. It
+// reads the audit log, so it needs the audit outbox sink.
+type failedAttempts struct {
+	db     *db.Postgres
+	weight int
+	window time.Duration
+	max    int
+}
+
+func newFailedAttemptsSignal(pg *db.Postgres, cfg SignalConfig) (Signal, error) {
+	s := &failedAttempts{db: pg, weight: cfg.Weight, window: cfg.Window, max: cfg.Max}
+	if s.window == 0 {
+		s.window = 15 * time.Minute
+	}
+	if s.max == 0 {
+		s.max = 5
+	}
+
+	return s, nil
+}
+
+func (s *failedAttempts) Name() string {
+	return SignalFailedAttempts
+}
+
+func (s *failedAttempts) Score(ctx context.Context, a *Attempt) (int, error) {
+	if a.Kind != KindSignin {
+		return 0, nil
+	}
+
+	n, err := s.db.CountLoginFailures(ctx, a.IP, failureReasons, a.Time.Add(-s.window))
+	if err != nil {
+		return 0, err
+	}
+
+	return min(n, s.max) * s.weight, nil
+}
+
+// ipList fires for addresses in a list of addresses and CIDR ranges, one per
+// line, with # comments. The file is read once at startup.
+type ipList struct {
+	name     string
+	weight   int
+	prefixes []netip.Prefix
+}
+
+func newIPListSignal(name string, cfg SignalConfig) (Signal, error) {
+	if cfg.File == "" {
+		return nil, errors.New("file is required")
+	}
+
+	prefixes, err := loadIPList(cfg.File)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ipList{name: name, weight: cfg.Weight, prefixes: prefixes}, nil
+}
+
+func loadIPList(path string) ([]netip.Prefix, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var prefixes []netip.Prefix
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		entry, _, _ := strings.Cut(scanner.Text(), "#")
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, scanner.Err()
+}
+
+func (s *ipList) Name() string {
+	return s.name
+}
+
+func (s *ipList) Score(ctx context.Context, a *Attempt) (int, error) {
+	addr, err := netip.ParseAddr(a.IP)
+	if err != nil {
+		return 0, nil
+	}
+	addr = addr.Unmap()
+
+	for _, p := range s.prefixes {
+		if p.Contains(addr) {
+			return s.weight, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// timeOfDay fires for attempts from hour From up to hour To in Timezone. From
+// may be after To for a range that spans midnight.
+type timeOfDay struct {
+	weight   int
+	from, to int
+	location *time.Location
+}
+
+func newTimeOfDaySignal(_ *db.Postgres, cfg SignalConfig) (Signal, error) {
+	if cfg.From < 0 || cfg.From > 23 || cfg.To < 0 || cfg.To > 24 {
+		return nil, errors.New("from and to must be hours of the day")
+	}
+
+	location := time.UTC
+	if cfg.Timezone != "" {
+		var err error
+		location, err = time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &timeOfDay{weight: cfg.Weight, from: cfg.From, to: cfg.To, location: location}, nil
+}
+
+func (s *timeOfDay) Name() string {
+	return SignalTimeOfDay
+}
+
+func (s *timeOfDay) Score(ctx context.Context, a *Attempt) (int, error) {
+	hour := a.Time.In(s.location).Hour()
+
+	var inside bool
+	if s.from <= s.to {
+		inside = hour >= s.from && hour < s.to
+	} else {
+		inside = hour >= s.from || hour < s.to
+	}
+
+	if !inside {
+		return 0, nil
+	}
+
+	return s.weight, nil
+}
@@ -0,0 +1,39 @@
+// Package sms delivers one-time codes to phone numbers through a configured gateway.
+package sms
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	DriverLog     = "log"
+	DriverWebhook = "webhook"
+)
+
+type Sender interface {
+	Send(ctx context.Context, phone string, message string) error
+}
+
+// New builds the sender selected by sms.driver. The log sender is used when none is set.
+func New() (Sender, error) {
+	switch driver := viper.GetString("sms.driver"); driver {
+	case "", DriverLog:
+		return LogSender{}, nil
+	case DriverWebhook:
+		return NewWebhookSender()
+	default:
+		return nil, fmt.Errorf("unknown sms driver %q", driver)
+	}
+}
+
+// LogSender writes messages to the log instead of sending them, for local runs
+type LogSender struct{}
+
+func (LogSender) Send(ctx context.Context, phone string, message string) error {
+	log.Printf("[SMS] to: %s: %s", phone, message)
+	return nil
+}
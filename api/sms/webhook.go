@@ -0,0 +1,88 @@
+package sms
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+type (
+	WebhookConfig struct {
+		URL      string        `mapstructure:"url"`
+		TokenEnv string        `mapstructure:"tokenEnv"`
+		Timeout  time.Duration `mapstructure:"timeout"`
+	}
+
+	// WebhookSender posts {"to": phone, "message": text} as JSON to an SMS
+	// gateway, with a bearer token when one is configured. Any 2xx status is
+	// taken as accepted.
+	WebhookSender struct {
+		url    string
+		token  string
+		client *http.Client
+	}
+
+	webhookReq struct {
+		To      string `json:"to"`
+		Message string `json:"message"`
+	}
+)
+
+func NewWebhookSender() (*WebhookSender, error) {
+	var cfg WebhookConfig
+	if err := viper.UnmarshalKey("sms.webhook", &cfg); err != nil {
+		return nil, fmt.Errorf("error reading sms webhook config: %w", err)
+	}
+
+	if cfg.URL == "" {
+		return nil, errors.New("sms.webhook.url is required")
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+
+	return &WebhookSender{
+		url:    cfg.URL,
+		token:  os.Getenv(cfg.TokenEnv),
+		client: &http.Client{Timeout: cfg.Timeout},
+	}, nil
+}
+
+func (s *WebhookSender) Send(ctx context.Context, phone string, message string) error {
+	body, err := json.Marshal(webhookReq{To: phone, Message: message})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error calling sms gateway: %w", err)
+	}
+	defer res.Body.Close()
+
+	// Drained so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(res.Body, 1<<16))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("sms gateway returned status %d", res.StatusCode)
+	}
+
+	return nil
+}
@@ -1,17 +1,39 @@
 package token
 
 import (
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 )
 
+// Subject types. Tokens without a subject type were issued to users.
+const (
+	SubjectTypeUser   = "user"
+	SubjectTypeClient = "client"
+)
+
 type UserClaims struct {
-	ID int `json:"id"`
+	ID          int    `json:"id"`
+	Scope       string `json:"scope,omitempty"`
+	SubjectType string `json:"sub_type,omitempty"`
+	// Session of an exchanged token; other user tokens use their ID as session ID
+	SessionID string `json:"sid,omitempty"`
+	Act       *Actor `json:"act,omitempty"`
+	// Set on tokens of an interactive signin to this service, never on tokens
+	// issued through a client
+	FirstParty bool `json:"first_party,omitempty"`
 	jwt.RegisteredClaims
 }
 
+// Actor is the RFC 8693 "act" claim. Act holds the previous actor in a delegation chain.
+type Actor struct {
+	Subject string `json:"sub"`
+	Act     *Actor `json:"act,omitempty"`
+}
+
 func NewUserClaims(id int, username string, duration time.Duration) (*UserClaims, error) {
 	tokenID, err := uuid.NewRandom()
 	if err != nil {
@@ -28,3 +50,39 @@ func NewUserClaims(id int, username string, duration time.Duration) (*UserClaims
 		},
 	}, nil
 }
+
+// HasScope reports whether the claims grant scope. Unscoped first-party
+// tokens grant everything, any other token only the scopes it lists.
+func (c *UserClaims) HasScope(scope string) bool {
+	if c.FirstParty && c.Scope == "" {
+		return true
+	}
+
+	return slices.Contains(strings.Fields(c.Scope), scope)
+}
+
+// NewClientClaims returns claims for a service account; the subject is the client ID
+func NewClientClaims(clientID string, scope string, duration time.Duration) (*UserClaims, error) {
+	claims, err := NewUserClaims(0, clientID, duration)
+	if err != nil {
+		return nil, err
+	}
+
+	claims.Scope = scope
+	claims.SubjectType = SubjectTypeClient
+
+	return claims, nil
+}
+
+// Session returns the ID of the session backing a user token
+func (c *UserClaims) Session() string {
+	if c.SessionID != "" {
+		return c.SessionID
+	}
+
+	return c.RegisteredClaims.ID
+}
+
+func (c *UserClaims) IsUser() bool {
+	return c.SubjectType == "" || c.SubjectType == SubjectTypeUser
+}
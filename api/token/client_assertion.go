@@ -0,0 +1,84 @@
+package token
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Longest lifetime accepted for a private_key_jwt client assertion
+const maxAssertionLifetime = 10 * time.Minute
+
+// ParsePublicKey parses a PEM encoded RSA or ECDSA public key
+func ParsePublicKey(publicKeyPEM string) (any, error) {
+	block, _ := pem.Decode([]byte(publicKeyPEM))
+	if block == nil {
+		return nil, errors.New("invalid PEM block")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing public key: %w", err)
+	}
+
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	default:
+		return nil, errors.New("unsupported public key type")
+	}
+}
+
+// AssertionIssuer returns the unverified issuer of a client assertion so the client can be looked up
+func AssertionIssuer(assertion string) (string, error) {
+	var claims jwt.RegisteredClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(assertion, &claims); err != nil {
+		return "", fmt.Errorf("error parsing client assertion: %w", err)
+	}
+
+	return claims.Issuer, nil
+}
+
+// VerifyClientAssertion validates a private_key_jwt assertion (RFC 7523) signed
+// by clientID and returns its claims. A jti is required, so that the caller can
+// refuse assertions that are used again.
+func VerifyClientAssertion(assertion, publicKeyPEM, clientID, audience string) (*jwt.RegisteredClaims, error) {
+	key, err := ParsePublicKey(publicKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims jwt.RegisteredClaims
+	_, err = jwt.ParseWithClaims(assertion, &claims, func(t *jwt.Token) (interface{}, error) {
+		switch t.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS, *jwt.SigningMethodECDSA:
+			return key, nil
+		default:
+			return nil, fmt.Errorf("invalid assertion signing method")
+		}
+	}, jwt.WithAudience(audience), jwt.WithIssuer(clientID), jwt.WithSubject(clientID), jwt.WithExpirationRequired())
+
+	if err != nil {
+		return nil, fmt.Errorf("error parsing client assertion: %w", err)
+	}
+
+	if claims.IssuedAt != nil && claims.ExpiresAt.Sub(claims.IssuedAt.Time) > maxAssertionLifetime {
+		return nil, errors.New("client assertion lifetime too long")
+	}
+
+	if claims.IssuedAt == nil && time.Until(claims.ExpiresAt.Time) > maxAssertionLifetime {
+		return nil, errors.New("client assertion lifetime too long")
+	}
+
+	if claims.ID == "" {
+		return nil, errors.New("client assertion has no jti")
+	}
+
+	return &claims, nil
+}
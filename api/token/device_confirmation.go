@@ -0,0 +1,53 @@
+package token
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const deviceConfirmationAudience = "device-confirmation"
+
+// DeviceConfirmationClaims carry a signed-in user from the /device signin to
+// the page where they approve or deny the user code. The subject is the user ID.
+type DeviceConfirmationClaims struct {
+	UserCode string `json:"user_code"`
+	jwt.RegisteredClaims
+}
+
+// CreateDeviceConfirmationToken signs a confirmation token for userID and
+// userCode with a key derived for this purpose
+func (m *JWTMaker) CreateDeviceConfirmationToken(userID int, userCode string, ttl time.Duration) (string, error) {
+	claims := &DeviceConfirmationClaims{
+		UserCode: userCode,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    m.Issuer,
+			Subject:   strconv.Itoa(userID),
+			Audience:  jwt.ClaimStrings{deviceConfirmationAudience},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+		},
+	}
+
+	return jwt.NewWithClaims(jwt.SigningMethodHS512, claims).SignedString(m.purposeKey(deviceConfirmationAudience))
+}
+
+func (m *JWTMaker) VerifyDeviceConfirmationToken(tok string) (*DeviceConfirmationClaims, error) {
+	claims := &DeviceConfirmationClaims{}
+
+	_, err := jwt.ParseWithClaims(tok, claims, func(t *jwt.Token) (interface{}, error) {
+		return m.purposeKey(deviceConfirmationAudience), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS512.Alg()}), jwt.WithAudience(deviceConfirmationAudience), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, fmt.Errorf("error parsing token: %w", err)
+	}
+
+	return claims, nil
+}
+
+// UserID returns the user who signed in
+func (c *DeviceConfirmationClaims) UserID() (int, error) {
+	return strconv.Atoi(c.Subject)
+}
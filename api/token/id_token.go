@@ -0,0 +1,39 @@
+package token
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// IDTokenClaims are the OpenID Connect ID token claims issued by this service
+type IDTokenClaims struct {
+	Nonce             string           `json:"nonce,omitempty"`
+	AuthTime          *jwt.NumericDate `json:"auth_time,omitempty"`
+	AtHash            string           `json:"at_hash,omitempty"`
+	Name              string           `json:"name,omitempty"`
+	PreferredUsername string           `json:"preferred_username,omitempty"`
+	jwt.RegisteredClaims
+}
+
+func NewIDTokenClaims(issuer string, userID int, clientID string, authTime time.Time, duration time.Duration) *IDTokenClaims {
+	return &IDTokenClaims{
+		AuthTime: jwt.NewNumericDate(authTime),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			Subject:   strconv.Itoa(userID),
+			Audience:  jwt.ClaimStrings{clientID},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(duration)),
+		},
+	}
+}
+
+// AccessTokenHash computes the at_hash claim for an RS256 signed ID token
+func AccessTokenHash(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+}
@@ -1,8 +1,9 @@
 package token
 
 import (
+	"crypto/rand"
 	"fmt"
-	"math/rand"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -11,25 +12,60 @@ import (
 
 type JWTMaker struct {
 	secretKey       string
+	Issuer          string
 	AccessTokenTTL  time.Duration
 	RefreshTokenTTL time.Duration
+	ClientTokenTTL  time.Duration
 }
 
 func NewJWTMaker(secretKey string) *JWTMaker {
-	return &JWTMaker{secretKey, viper.GetDuration("auth.accessTokenTTL"), viper.GetDuration("auth.refreshTokenTTL")}
+	return &JWTMaker{
+		secretKey:       secretKey,
+		Issuer:          strings.TrimSuffix(viper.GetString("oauth.issuer"), "/"),
+		AccessTokenTTL:  viper.GetDuration("auth.accessTokenTTL"),
+		RefreshTokenTTL: viper.GetDuration("auth.refreshTokenTTL"),
+		ClientTokenTTL:  viper.GetDuration("oauth.clientTokenTTL"),
+	}
 }
 
+// CreateAccessToken issues a first-party user access token, which grants everything
 func (m *JWTMaker) CreateAccessToken(userID int, username string) (string, *UserClaims, error) {
+	return m.createUserToken(userID, username, "", true)
+}
+
+// CreateScopedAccessToken issues a user access token to a client, limited to
+// scope; an empty scope grants nothing
+func (m *JWTMaker) CreateScopedAccessToken(userID int, username string, scope string) (string, *UserClaims, error) {
+	return m.createUserToken(userID, username, scope, false)
+}
+
+func (m *JWTMaker) createUserToken(userID int, username string, scope string, firstParty bool) (string, *UserClaims, error) {
 
 	claims, err := NewUserClaims(userID, username, m.AccessTokenTTL)
 	if err != nil {
 		return "", nil, err
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS512, claims)
+	claims.Scope = scope
+	claims.FirstParty = firstParty
+
+	accessToken, err := m.SignClaims(claims)
+	if err != nil {
+		return "", nil, err
+	}
 
-	accessToken, err := token.SignedString([]byte(m.secretKey))
+	return accessToken, claims, nil
+}
 
+// CreateClientToken issues an access token to a service account
+func (m *JWTMaker) CreateClientToken(clientID string, scope string) (string, *UserClaims, error) {
+
+	claims, err := NewClientClaims(clientID, scope, m.ClientTokenTTL)
+	if err != nil {
+		return "", nil, err
+	}
+
+	accessToken, err := m.SignClaims(claims)
 	if err != nil {
 		return "", nil, err
 	}
@@ -37,6 +73,36 @@ func (m *JWTMaker) CreateAccessToken(userID int, username string) (string, *User
 	return accessToken, claims, nil
 }
 
+// CreateExchangedToken issues a token on behalf of the subject for another audience (RFC 8693).
+// actor is the client performing the exchange.
+func (m *JWTMaker) CreateExchangedToken(subject *UserClaims, audience string, scope string, actor string, ttl time.Duration) (string, *UserClaims, error) {
+
+	claims, err := NewUserClaims(subject.ID, subject.Subject, ttl)
+	if err != nil {
+		return "", nil, err
+	}
+
+	claims.Issuer = m.Issuer
+	claims.Audience = jwt.ClaimStrings{audience}
+	claims.Scope = scope
+	claims.SubjectType = subject.SubjectType
+	claims.SessionID = subject.Session()
+	claims.Act = &Actor{Subject: actor, Act: subject.Act}
+
+	accessToken, err := m.SignClaims(claims)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return accessToken, claims, nil
+}
+
+func (m *JWTMaker) SignClaims(claims *UserClaims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS512, claims)
+
+	return token.SignedString([]byte(m.secretKey))
+}
+
 // func (m *JWTMaker) CreateRefreshToken(userID int, username string) (string, *UserClaims, error) {
 
 // 	claims, err := NewUserClaims(userID, username, m.accessTokenTTL)
@@ -55,13 +121,12 @@ func (m *JWTMaker) CreateAccessToken(userID int, username string) (string, *User
 // 	return accessToken, claims, nil
 // }
 
+// CreateRefreshToken returns a random refresh token. Refresh tokens are also
+// used to look sessions up, so they come from crypto/rand.
 func (m *JWTMaker) CreateRefreshToken() (string, error) {
 	b := make([]byte, 32)
 
-	s := rand.NewSource(time.Now().Unix())
-	r := rand.New(s)
-
-	_, err := r.Read(b)
+	_, err := rand.Read(b)
 
 	if err != nil {
 		return "", err
@@ -0,0 +1,121 @@
+package token
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// RSASigner signs tokens that third parties verify with the published JWKS,
+// such as OpenID Connect ID tokens
+type RSASigner struct {
+	key   *rsa.PrivateKey
+	KeyID string
+}
+
+type (
+	JWK struct {
+		Kty string `json:"kty"`
+		Use string `json:"use"`
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	}
+
+	JWKS struct {
+		Keys []JWK `json:"keys"`
+	}
+)
+
+// NewRSASigner loads a PEM encoded RSA private key (PKCS#1 or PKCS#8).
+// An empty keyFile generates an ephemeral key that is lost on restart.
+func NewRSASigner(keyFile string) (*RSASigner, error) {
+	if keyFile == "" {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+
+		return newRSASigner(key)
+	}
+
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading signing key: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("invalid signing key PEM block")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return newRSASigner(key)
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing signing key: %w", err)
+	}
+
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("signing key is not an RSA key")
+	}
+
+	return newRSASigner(key)
+}
+
+func newRSASigner(key *rsa.PrivateKey) (*RSASigner, error) {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(der)
+
+	return &RSASigner{
+		key:   key,
+		KeyID: base64.RawURLEncoding.EncodeToString(sum[:12]),
+	}, nil
+}
+
+func (s *RSASigner) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = s.KeyID
+
+	return token.SignedString(s.key)
+}
+
+// SignDigest signs a SHA-256 digest with RSASSA-PKCS1-v1_5
+func (s *RSASigner) SignDigest(digest []byte) ([]byte, error) {
+	return rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest)
+}
+
+func (s *RSASigner) PublicKey() *rsa.PublicKey {
+	return &s.key.PublicKey
+}
+
+func (s *RSASigner) JWKS() JWKS {
+	pub := s.key.PublicKey
+
+	return JWKS{Keys: []JWK{{
+		Kty: "RSA",
+		Use: "sig",
+		Alg: "RS256",
+		Kid: s.KeyID,
+		N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+	}}}
+}
@@ -0,0 +1,63 @@
+package token
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const signInAlertAudience = "signin-alert"
+
+// SignInAlertClaims are carried by the "this wasn't me" link of a new signin
+// email. The subject is the user ID.
+type SignInAlertClaims struct {
+	jwt.RegisteredClaims
+}
+
+// CreateSignInAlertToken signs an alert link token for userID with a key
+// derived for this purpose
+func (m *JWTMaker) CreateSignInAlertToken(userID int, ttl time.Duration) (string, *SignInAlertClaims, error) {
+	tokenID, err := uuid.NewRandom()
+	if err != nil {
+		return "", nil, err
+	}
+
+	claims := &SignInAlertClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        tokenID.String(),
+			Issuer:    m.Issuer,
+			Subject:   strconv.Itoa(userID),
+			Audience:  jwt.ClaimStrings{signInAlertAudience},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+		},
+	}
+
+	tok, err := jwt.NewWithClaims(jwt.SigningMethodHS512, claims).SignedString(m.purposeKey(signInAlertAudience))
+	if err != nil {
+		return "", nil, err
+	}
+
+	return tok, claims, nil
+}
+
+func (m *JWTMaker) VerifySignInAlertToken(tok string) (*SignInAlertClaims, error) {
+	claims := &SignInAlertClaims{}
+
+	_, err := jwt.ParseWithClaims(tok, claims, func(t *jwt.Token) (interface{}, error) {
+		return m.purposeKey(signInAlertAudience), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS512.Alg()}), jwt.WithAudience(signInAlertAudience), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, fmt.Errorf("error parsing token: %w", err)
+	}
+
+	return claims, nil
+}
+
+// UserID returns the user the alert was sent to
+func (c *SignInAlertClaims) UserID() (int, error) {
+	return strconv.Atoi(c.Subject)
+}
@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// APIKeyPrefix marks every personal API key so leaked keys are easy to spot
+const APIKeyPrefix = "jwta"
+
+var ErrInvalidAPIKey = errors.New("invalid api key")
+
+// RandomHex returns n random bytes from crypto/rand encoded as hex
+func RandomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// GenerateAPIKey returns a key in the form jwta_<prefix>_<secret> and its prefix.
+// The prefix is stored in clear text and used to look the key up.
+func GenerateAPIKey() (string, string, error) {
+	prefix, err := RandomHex(6)
+	if err != nil {
+		return "", "", err
+	}
+
+	secret, err := RandomHex(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	return APIKeyPrefix + "_" + prefix + "_" + secret, prefix, nil
+}
+
+// ParseAPIKey returns the lookup prefix of a key
+func ParseAPIKey(key string) (string, error) {
+	parts := strings.Split(key, "_")
+	if len(parts) != 3 || parts[0] != APIKeyPrefix || parts[1] == "" || parts[2] == "" {
+		return "", ErrInvalidAPIKey
+	}
+
+	return parts[1], nil
+}
+
+// HashAPIKey hashes a key for storage. Keys carry 256 bits of entropy,
+// so a fast hash is enough and keeps per-request verification cheap.
+func HashAPIKey(key string) string {
+	return SHA256Hex(key)
+}
+
+func CheckAPIKey(key string, hashedKey string) error {
+	if subtle.ConstantTimeCompare([]byte(HashAPIKey(key)), []byte(hashedKey)) != 1 {
+		return ErrInvalidAPIKey
+	}
+
+	return nil
+}
@@ -0,0 +1,16 @@
+package utils
+
+import "golang.org/x/crypto/bcrypt"
+
+func HashClientSecret(secret string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hashed), nil
+}
+
+func CheckClientSecret(secret string, hashedSecret string) error {
+	return bcrypt.CompareHashAndPassword([]byte(hashedSecret), []byte(secret))
+}
@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrInvalidPhone = errors.New("phone number must be in international format, e.g. +14155550123")
+
+	e164Re = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+)
+
+// NormalizePhone strips the separators people type and checks the number is E.164
+func NormalizePhone(phone string) (string, error) {
+	phone = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '.', '(', ')':
+			return -1
+		}
+		return r
+	}, phone)
+
+	if strings.HasPrefix(phone, "00") {
+		phone = "+" + phone[2:]
+	}
+
+	if !e164Re.MatchString(phone) {
+		return "", ErrInvalidPhone
+	}
+
+	return phone, nil
+}
+
+// RandomDigits returns a uniformly random numeric code of length n
+func RandomDigits(n int) (string, error) {
+	var b strings.Builder
+
+	for range n {
+		d, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte(byte('0' + d.Int64()))
+	}
+
+	return b.String(), nil
+}
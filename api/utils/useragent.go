@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Device types
+const (
+	DeviceDesktop = "desktop"
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceBot     = "bot"
+	DeviceUnknown = "unknown"
+)
+
+// UserAgent is what can be told about a client from its User-Agent header.
+// Unrecognized parts are left empty.
+type UserAgent struct {
+	Browser      string
+	BrowserMajor string
+	OS           string
+	Device       string
+}
+
+// Family is the browser and its major version, e.g. "Chrome 126", which stays
+// the same across minor updates
+func (ua UserAgent) Family() string {
+	if ua.BrowserMajor == "" {
+		return ua.Browser
+	}
+
+	return ua.Browser + " " + ua.BrowserMajor
+}
+
+// Browsers that embed another browser's token come first
+var browserRes = []struct {
+	name string
+	re   *regexp.Regexp
+}{
+	{"Edge", regexp.MustCompile(`Edg(?:e|A|iOS)?/(\d+)`)},
+	{"Opera", regexp.MustCompile(`(?:OPR|Opera)/(\d+)`)},
+	{"Samsung Internet", regexp.MustCompile(`SamsungBrowser/(\d+)`)},
+	{"Firefox", regexp.MustCompile(`(?:Firefox|FxiOS)/(\d+)`)},
+	{"Chrome", regexp.MustCompile(`(?:Chrome|CriOS)/(\d+)`)},
+	{"Safari", regexp.MustCompile(`Version/(\d+).*Safari/`)},
+	{"curl", regexp.MustCompile(`^curl/(\d+)`)},
+}
+
+var osNames = []struct {
+	token string
+	name  string
+}{
+	{"Windows", "Windows"},
+	{"iPhone", "iOS"},
+	{"iPad", "iPadOS"},
+	{"Android", "Android"},
+	{"CrOS", "ChromeOS"},
+	{"Mac OS X", "macOS"},
+	{"Macintosh", "macOS"},
+	{"Linux", "Linux"},
+}
+
+// ParseUserAgent recognizes the common browsers, operating systems and device
+// types. It is meant for showing sessions to people, not for security decisions.
+func ParseUserAgent(header string) UserAgent {
+	ua := UserAgent{Device: DeviceUnknown}
+	if header == "" || header == "unknown" {
+		return ua
+	}
+
+	for _, b := range browserRes {
+		if m := b.re.FindStringSubmatch(header); m != nil {
+			ua.Browser = b.name
+			ua.BrowserMajor = m[1]
+			break
+		}
+	}
+
+	for _, o := range osNames {
+		if strings.Contains(header, o.token) {
+			ua.OS = o.name
+			break
+		}
+	}
+
+	lower := strings.ToLower(header)
+	switch {
+	case strings.Contains(lower, "bot") || strings.Contains(lower, "spider") || strings.Contains(lower, "crawl"):
+		ua.Device = DeviceBot
+	case strings.Contains(header, "iPad") || strings.Contains(header, "Tablet") || (ua.OS == "Android" && !strings.Contains(header, "Mobile")):
+		ua.Device = DeviceTablet
+	case strings.Contains(header, "Mobile") || strings.Contains(header, "iPhone"):
+		ua.Device = DeviceMobile
+	case ua.OS != "":
+		ua.Device = DeviceDesktop
+	}
+
+	return ua
+}
@@ -0,0 +1,246 @@
+// Package webhooks delivers signed event notifications to the subscriptions
+// registered by admins. It is an outbox sink: failed deliveries are retried
+// with exponential back-off by the outbox dispatcher, for each subscription
+// on its own.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arrogantworm/jwt_auth/api/events"
+	"github.com/arrogantworm/jwt_auth/db"
+	"github.com/spf13/viper"
+)
+
+const (
+	HeaderID        = "X-Webhook-ID"
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+
+	// AllEvents subscribes to every event type
+	AllEvents = "*"
+
+	SinkName = "webhooks"
+)
+
+func KnownEventType(eventType string) bool {
+	return eventType == AllEvents || slices.Contains(events.Types, eventType)
+}
+
+type Config struct {
+	Timeout     time.Duration `mapstructure:"timeout"`
+	Concurrency int           `mapstructure:"concurrency"`
+}
+
+// Dispatcher sends events to their subscribers
+type Dispatcher struct {
+	db     *db.Postgres
+	client *http.Client
+	config Config
+}
+
+func New(pg *db.Postgres) (*Dispatcher, error) {
+	var cfg Config
+	if err := viper.UnmarshalKey("webhooks", &cfg); err != nil {
+		return nil, fmt.Errorf("error reading webhooks config: %w", err)
+	}
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.Concurrency < 1 {
+		cfg.Concurrency = 1
+	}
+
+	return &Dispatcher{
+		db:     pg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		config: cfg,
+	}, nil
+}
+
+// failure is a subscription that didn't accept an event
+type failure struct {
+	sub    *db.WebhookSubscription
+	status int
+	err    error
+}
+
+// DeliveryError lists the subscriptions that didn't accept an event
+type DeliveryError struct {
+	failures []failure
+}
+
+func (e *DeliveryError) Error() string {
+	msgs := make([]string, 0, len(e.failures))
+	for _, f := range e.failures {
+		msgs = append(msgs, fmt.Sprintf("subscription %d: %v", f.sub.ID, f.err))
+	}
+
+	return strings.Join(msgs, ", ")
+}
+
+func (d *Dispatcher) Name() string {
+	return SinkName
+}
+
+// Deliver sends e once to every subscriber
+func (d *Dispatcher) Deliver(ctx context.Context, e *events.Event) error {
+	_, err := d.DeliverRemaining(ctx, e, nil)
+	return err
+}
+
+// DeliverRemaining sends e to the subscribers whose IDs are not in delivered
+// and returns the IDs of those that accepted it. Only the ones that failed are
+// retried later. A subscriber may still see an event more than once, for
+// example when a replica stops before recording the delivery, and should drop
+// duplicates by X-Webhook-ID.
+func (d *Dispatcher) DeliverRemaining(ctx context.Context, e *events.Event, delivered []string) ([]string, error) {
+	subs, err := d.db.ListWebhookSubscriptionsForEvent(ctx, e.Type)
+	if err != nil {
+		return nil, fmt.Errorf("error getting subscriptions: %w", err)
+	}
+
+	subs = slices.DeleteFunc(subs, func(s *db.WebhookSubscription) bool {
+		return slices.Contains(delivered, strconv.Itoa(s.ID))
+	})
+
+	if len(subs) == 0 {
+		return nil, nil
+	}
+
+	body, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		accepted []string
+		failures []failure
+		slots    = make(chan struct{}, d.config.Concurrency)
+	)
+
+	for _, s := range subs {
+		wg.Add(1)
+		slots <- struct{}{}
+
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			status, err := d.send(ctx, s, e, body)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				failures = append(failures, failure{sub: s, status: status, err: err})
+				return
+			}
+			accepted = append(accepted, strconv.Itoa(s.ID))
+		}()
+	}
+	wg.Wait()
+
+	if len(failures) > 0 {
+		slices.SortFunc(failures, func(a, b failure) int { return a.sub.ID - b.sub.ID })
+		return accepted, &DeliveryError{failures: failures}
+	}
+
+	return accepted, nil
+}
+
+// DeadLetter records the subscriptions that never accepted e
+func (d *Dispatcher) DeadLetter(ctx context.Context, e *events.Event, attempts int, err error) {
+	var de *DeliveryError
+	if !errors.As(err, &de) {
+		log.Printf("[WEBHOOK] giving up on %s %s: %v", e.Type, e.ID, err)
+		return
+	}
+
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Println("[WEBHOOK]", err)
+		return
+	}
+
+	for _, f := range de.failures {
+		letter := &db.WebhookDeadLetter{
+			SubscriptionID: f.sub.ID,
+			EventID:        e.ID,
+			EventType:      e.Type,
+			Payload:        body,
+			Attempts:       attempts,
+			LastError:      f.err.Error(),
+		}
+		if f.status != 0 {
+			letter.LastStatus = &f.status
+		}
+
+		if err := d.db.CreateWebhookDeadLetter(ctx, letter); err != nil {
+			log.Println("[WEBHOOK] error saving dead letter:", err)
+		}
+	}
+}
+
+// send makes one delivery attempt and returns the response status, if any
+func (d *Dispatcher) send(ctx context.Context, s *db.WebhookSubscription, e *events.Event, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := time.Now().Unix()
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "jwt-auth-webhooks")
+	req.Header.Set(HeaderID, e.ID)
+	req.Header.Set(HeaderEvent, e.Type)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, "sha256="+Sign(s.Secret, timestamp, body))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	// Drained so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("subscriber responded %s", res.Status)
+	}
+
+	return res.StatusCode, nil
+}
+
+// Sign returns the hex HMAC-SHA256 of "timestamp.body" under secret. Receivers
+// recompute it from the X-Webhook-Timestamp header and the raw body, and
+// should reject old timestamps to stop replays.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
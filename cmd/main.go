@@ -24,6 +24,11 @@ import (
 // @in header
 // @name Authorization
 
+// @securityDefinitions.apikey ApiKeyAuth
+// @in header
+// @name Authorization
+// @description Personal API key: "ApiKey jwta_..."
+
 func main() {
 
 	if err := initConfig(); err != nil {
@@ -55,6 +60,9 @@ func main() {
 	}
 	router := handler.RegisterRoutes()
 
+	go handler.RunOutbox(context.Background())
+	go handler.RunAuditCheckpoints(context.Background())
+
 	log.Println("starting server")
 
 	srv := new(server.Server)
@@ -0,0 +1,82 @@
+// Command verify-audit walks the audit log hash chain and checks the signed
+// checkpoints. It reads the same config and env as the server, and exits with
+// status 1 at the first broken link or checkpoint that the configured signing
+// key doesn't verify.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/arrogantworm/jwt_auth/api/audit"
+	"github.com/arrogantworm/jwt_auth/api/token"
+	"github.com/arrogantworm/jwt_auth/db"
+	"github.com/joho/godotenv"
+	"github.com/spf13/viper"
+)
+
+func main() {
+
+	if err := initConfig(); err != nil {
+		log.Fatalf("error initializing configs: %s", err.Error())
+	}
+
+	if err := godotenv.Load(); err != nil {
+		log.Fatalf("error loading env variables: %s", err.Error())
+	}
+
+	postgres, err := db.NewPG(context.Background(), db.Config{
+		Host:    viper.GetString("db.host"),
+		Port:    viper.GetInt("db.port"),
+		User:    viper.GetString("db.user"),
+		Pass:    os.Getenv("DB_PASS"),
+		DBName:  viper.GetString("db.dbname"),
+		SSLMode: viper.GetString("db.sslmode"),
+	})
+	if err != nil {
+		log.Fatalf("failed to initialize db: %s", err.Error())
+	}
+	defer postgres.Close()
+
+	// Without the key file the server signs no checkpoints, and any checkpoint
+	// that is found fails verification
+	var signer *token.RSASigner
+	if keyFile := viper.GetString("oidc.signingKeyFile"); keyFile != "" {
+		signer, err = token.NewRSASigner(keyFile)
+		if err != nil {
+			log.Fatalf("error loading signing key: %s", err.Error())
+		}
+	} else {
+		log.Println("oidc.signingKeyFile is not set, only the hash chain is checked")
+	}
+
+	report, err := verify(postgres, signer)
+	if err != nil {
+		log.Fatalf("error verifying audit log: %s", err.Error())
+	}
+
+	fmt.Printf("%d entries, %d before the chain, %d checkpoints\n", report.Entries, report.Unchained, report.Checkpoints)
+
+	if report.BrokenEntryID != 0 {
+		fmt.Printf("first broken link at entry %d: %s\n", report.BrokenEntryID, report.Problem)
+		os.Exit(1)
+	}
+
+	fmt.Println("audit log is intact")
+}
+
+func verify(pg *db.Postgres, signer *token.RSASigner) (*audit.Report, error) {
+	if signer == nil {
+		return audit.Verify(context.Background(), pg, nil, "")
+	}
+
+	return audit.Verify(context.Background(), pg, signer.PublicKey(), signer.KeyID)
+}
+
+func initConfig() error {
+	viper.AddConfigPath("configs")
+	viper.SetConfigName("config")
+	return viper.ReadInConfig()
+}
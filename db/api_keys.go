@@ -0,0 +1,111 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type APIKey struct {
+	ID         int        `db:"id"`
+	UserID     int        `db:"user_id"`
+	Name       string     `db:"name"`
+	Prefix     string     `db:"prefix"`
+	KeyHash    string     `db:"key_hash"`
+	Scopes     []string   `db:"scopes"`
+	IsRevoked  bool       `db:"is_revoked"`
+	ExpiresAt  *time.Time `db:"expires_at"`
+	LastUsedAt *time.Time `db:"last_used_at"`
+	CreatedAt  time.Time  `db:"created_at"`
+}
+
+const apiKeyColumns = `id, user_id, name, prefix, key_hash, scopes, is_revoked, expires_at, last_used_at, created_at`
+
+func scanAPIKey(row pgx.Row) (*APIKey, error) {
+	var k APIKey
+	if err := row.Scan(&k.ID, &k.UserID, &k.Name, &k.Prefix, &k.KeyHash, &k.Scopes, &k.IsRevoked, &k.ExpiresAt, &k.LastUsedAt, &k.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	return &k, nil
+}
+
+func (pg *Postgres) CreateAPIKey(ctx context.Context, k *APIKey) (*APIKey, error) {
+	query := `INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, expires_at)
+		VALUES (@userID, @name, @prefix, @keyHash, @scopes, @expiresAt)
+		RETURNING id, created_at`
+	args := pgx.NamedArgs{
+		"userID":    k.UserID,
+		"name":      k.Name,
+		"prefix":    k.Prefix,
+		"keyHash":   k.KeyHash,
+		"scopes":    k.Scopes,
+		"expiresAt": k.ExpiresAt,
+	}
+
+	if err := pg.db.QueryRow(ctx, query, args).Scan(&k.ID, &k.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+func (pg *Postgres) GetAPIKeyByPrefix(ctx context.Context, prefix string) (*APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE prefix = @prefix`
+	args := pgx.NamedArgs{
+		"prefix": prefix,
+	}
+
+	return scanAPIKey(pg.db.QueryRow(ctx, query, args))
+}
+
+func (pg *Postgres) ListAPIKeys(ctx context.Context, userID int) ([]*APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE user_id = @userID ORDER BY created_at DESC`
+	args := pgx.NamedArgs{
+		"userID": userID,
+	}
+
+	rows, err := pg.db.Query(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey reports whether a key owned by userID was found and revoked
+func (pg *Postgres) RevokeAPIKey(ctx context.Context, userID, keyID int) (bool, error) {
+	query := `UPDATE api_keys SET is_revoked=true WHERE id = @keyID AND user_id = @userID`
+	args := pgx.NamedArgs{
+		"keyID":  keyID,
+		"userID": userID,
+	}
+
+	tag, err := pg.db.Exec(ctx, query, args)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+func (pg *Postgres) TouchAPIKey(ctx context.Context, keyID int) error {
+	query := `UPDATE api_keys SET last_used_at=now() WHERE id = @keyID`
+	args := pgx.NamedArgs{
+		"keyID": keyID,
+	}
+
+	_, err := pg.db.Exec(ctx, query, args)
+	return err
+}
@@ -0,0 +1,279 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// AuditLogEntry is a security event as it was recorded. The table only
+// accepts inserts, and every entry is chained to the previous one by Hash.
+type AuditLogEntry struct {
+	ID         int64     `db:"id"`
+	EventID    string    `db:"event_id"`
+	EventType  string    `db:"event_type"`
+	UserID     *int      `db:"user_id"`
+	SessionID  string    `db:"session_id"`
+	IPAddress  string    `db:"ip_address"`
+	UserAgent  string    `db:"user_agent"`
+	Data       []byte    `db:"data"`
+	OccurredAt time.Time `db:"occurred_at"`
+	PrevHash   string    `db:"prev_hash"`
+	Hash       string    `db:"hash"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+// AuditCheckpoint is a signature over the hash of an entry, which vouches for
+// the whole chain up to it
+type AuditCheckpoint struct {
+	ID        int       `db:"id"`
+	EntryID   int64     `db:"entry_id"`
+	Hash      string    `db:"hash"`
+	KeyID     string    `db:"key_id"`
+	Signature string    `db:"signature"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// AuditLogFilter narrows down audit log queries, nil fields match everything.
+// Entries after Cursor are the ones with a lower ID.
+type AuditLogFilter struct {
+	UserID    *int
+	EventType *string
+	IPAddress *string
+	From      *time.Time
+	To        *time.Time
+	Cursor    *int64
+}
+
+const auditLogColumns = `id, event_id, event_type, user_id, session_id, ip_address, user_agent, data, occurred_at, prev_hash, hash, created_at`
+
+const auditLogWhere = ` WHERE (@userID::int IS NULL OR user_id = @userID)
+	AND (@eventType::text IS NULL OR event_type = @eventType)
+	AND (@ipAddress::text IS NULL OR ip_address = @ipAddress)
+	AND (@from::timestamp IS NULL OR occurred_at >= @from)
+	AND (@to::timestamp IS NULL OR occurred_at < @to)`
+
+func scanAuditLogEntry(row pgx.Row) (*AuditLogEntry, error) {
+	var e AuditLogEntry
+	if err := row.Scan(&e.ID, &e.EventID, &e.EventType, &e.UserID, &e.SessionID, &e.IPAddress, &e.UserAgent, &e.Data, &e.OccurredAt, &e.PrevHash, &e.Hash, &e.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+func auditLogArgs(filter AuditLogFilter) pgx.NamedArgs {
+	args := pgx.NamedArgs{
+		"userID":    filter.UserID,
+		"eventType": filter.EventType,
+		"ipAddress": filter.IPAddress,
+		"from":      nil,
+		"to":        nil,
+		"cursor":    filter.Cursor,
+	}
+
+	// Stored as UTC without a zone
+	if filter.From != nil {
+		args["from"] = filter.From.UTC()
+	}
+	if filter.To != nil {
+		args["to"] = filter.To.UTC()
+	}
+
+	return args
+}
+
+// AppendAuditLogEntry records e once at the end of the chain, entries that are
+// already recorded are left as they are. Appends are serialized so that hash
+// sees the hash of the entry before e in e.PrevHash.
+func (pg *Postgres) AppendAuditLogEntry(ctx context.Context, e *AuditLogEntry, hash func(*AuditLogEntry) (string, error)) error {
+	tx, err := pg.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Readers are not blocked
+	if _, err := tx.Exec(ctx, `LOCK TABLE audit_log IN EXCLUSIVE MODE`); err != nil {
+		return err
+	}
+
+	var exists bool
+	if err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM audit_log WHERE event_id = @eventID)`, pgx.NamedArgs{"eventID": e.EventID}).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	err = tx.QueryRow(ctx, `SELECT hash FROM audit_log ORDER BY id DESC LIMIT 1`).Scan(&e.PrevHash)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+
+	// Stored without a zone and with microsecond precision, the hash has to
+	// cover what is read back
+	e.OccurredAt = e.OccurredAt.UTC().Truncate(time.Microsecond)
+
+	e.Hash, err = hash(e)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO audit_log (event_id, event_type, user_id, session_id, ip_address, user_agent, data, occurred_at, prev_hash, hash)
+		VALUES (@eventID, @eventType, @userID, @sessionID, @ipAddress, @userAgent, @data, @occurredAt, @prevHash, @hash)
+		RETURNING id, created_at`
+	args := pgx.NamedArgs{
+		"eventID":    e.EventID,
+		"eventType":  e.EventType,
+		"userID":     e.UserID,
+		"sessionID":  e.SessionID,
+		"ipAddress":  e.IPAddress,
+		"userAgent":  e.UserAgent,
+		"data":       nil,
+		"occurredAt": e.OccurredAt,
+		"prevHash":   e.PrevHash,
+		"hash":       e.Hash,
+	}
+	if len(e.Data) > 0 {
+		args["data"] = string(e.Data)
+	}
+
+	if err := tx.QueryRow(ctx, query, args).Scan(&e.ID, &e.CreatedAt); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// LatestAuditLogEntry returns the end of the chain
+func (pg *Postgres) LatestAuditLogEntry(ctx context.Context) (*AuditLogEntry, error) {
+	query := `SELECT ` + auditLogColumns + ` FROM audit_log ORDER BY id DESC LIMIT 1`
+
+	return scanAuditLogEntry(pg.db.QueryRow(ctx, query))
+}
+
+// ListAuditLog returns up to limit entries matching filter, newest first
+func (pg *Postgres) ListAuditLog(ctx context.Context, filter AuditLogFilter, limit int) ([]*AuditLogEntry, error) {
+	query := `SELECT ` + auditLogColumns + ` FROM audit_log` + auditLogWhere + `
+		AND (@cursor::bigint IS NULL OR id < @cursor)
+		ORDER BY id DESC
+		LIMIT @limit`
+	args := auditLogArgs(filter)
+	args["limit"] = limit
+
+	rows, err := pg.db.Query(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*AuditLogEntry{}
+	for rows.Next() {
+		e, err := scanAuditLogEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
+
+// ListUserAuditLog returns up to limit of the user's entries of eventTypes
+// recorded since since, newest first
+func (pg *Postgres) ListUserAuditLog(ctx context.Context, userID int, eventTypes []string, since time.Time, limit int) ([]*AuditLogEntry, error) {
+	query := `SELECT ` + auditLogColumns + ` FROM audit_log
+		WHERE user_id = @userID AND event_type = ANY(@eventTypes) AND occurred_at >= @since
+		ORDER BY id DESC
+		LIMIT @limit`
+	args := pgx.NamedArgs{
+		"userID":     userID,
+		"eventTypes": eventTypes,
+		"since":      since.UTC(),
+		"limit":      limit,
+	}
+
+	rows, err := pg.db.Query(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*AuditLogEntry{}
+	for rows.Next() {
+		e, err := scanAuditLogEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
+
+// ExportAuditLog calls fn with every entry matching filter, oldest first,
+// without holding them all in memory. filter.Cursor is ignored.
+func (pg *Postgres) ExportAuditLog(ctx context.Context, filter AuditLogFilter, fn func(*AuditLogEntry) error) error {
+	query := `SELECT ` + auditLogColumns + ` FROM audit_log` + auditLogWhere + ` ORDER BY id`
+
+	rows, err := pg.db.Query(ctx, query, auditLogArgs(filter))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e, err := scanAuditLogEntry(rows)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// CreateAuditCheckpoint records c unless the entry already has a checkpoint,
+// as another replica may have signed it first
+func (pg *Postgres) CreateAuditCheckpoint(ctx context.Context, c *AuditCheckpoint) error {
+	query := `INSERT INTO audit_log_checkpoints (entry_id, hash, key_id, signature)
+		VALUES (@entryID, @hash, @keyID, @signature)
+		ON CONFLICT (entry_id) DO NOTHING`
+	args := pgx.NamedArgs{
+		"entryID":   c.EntryID,
+		"hash":      c.Hash,
+		"keyID":     c.KeyID,
+		"signature": c.Signature,
+	}
+
+	_, err := pg.db.Exec(ctx, query, args)
+	return err
+}
+
+// ListAuditCheckpoints returns every checkpoint in chain order
+func (pg *Postgres) ListAuditCheckpoints(ctx context.Context) ([]*AuditCheckpoint, error) {
+	query := `SELECT id, entry_id, hash, key_id, signature, created_at FROM audit_log_checkpoints ORDER BY entry_id`
+
+	rows, err := pg.db.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checkpoints := []*AuditCheckpoint{}
+	for rows.Next() {
+		var c AuditCheckpoint
+		if err := rows.Scan(&c.ID, &c.EntryID, &c.Hash, &c.KeyID, &c.Signature, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		checkpoints = append(checkpoints, &c)
+	}
+
+	return checkpoints, rows.Err()
+}
@@ -0,0 +1,62 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type AuthorizationCode struct {
+	ID            int        `db:"id"`
+	CodeHash      string     `db:"code_hash"`
+	ClientID      string     `db:"client_id"`
+	UserID        int        `db:"user_id"`
+	RedirectURI   string     `db:"redirect_uri"`
+	Scope         string     `db:"scope"`
+	Nonce         string     `db:"nonce"`
+	CodeChallenge string     `db:"code_challenge"`
+	AuthTime      time.Time  `db:"auth_time"`
+	ExpiresAt     time.Time  `db:"expires_at"`
+	UsedAt        *time.Time `db:"used_at"`
+	CreatedAt     time.Time  `db:"created_at"`
+}
+
+func (pg *Postgres) CreateAuthorizationCode(ctx context.Context, c *AuthorizationCode) error {
+	query := `INSERT INTO oauth_authorization_codes
+		(code_hash, client_id, user_id, redirect_uri, scope, nonce, code_challenge, auth_time, expires_at)
+		VALUES (@codeHash, @clientID, @userID, @redirectURI, @scope, @nonce, @codeChallenge, @authTime, @expiresAt)
+		RETURNING id`
+	args := pgx.NamedArgs{
+		"codeHash":      c.CodeHash,
+		"clientID":      c.ClientID,
+		"userID":        c.UserID,
+		"redirectURI":   c.RedirectURI,
+		"scope":         c.Scope,
+		"nonce":         c.Nonce,
+		"codeChallenge": c.CodeChallenge,
+		"authTime":      c.AuthTime,
+		"expiresAt":     c.ExpiresAt,
+	}
+
+	return pg.db.QueryRow(ctx, query, args).Scan(&c.ID)
+}
+
+// ConsumeAuthorizationCode marks an unused, unexpired code as used and returns it.
+// A code can only be consumed once; later calls return pgx.ErrNoRows.
+func (pg *Postgres) ConsumeAuthorizationCode(ctx context.Context, codeHash string) (*AuthorizationCode, error) {
+	var c AuthorizationCode
+	query := `UPDATE oauth_authorization_codes SET used_at=now()
+		WHERE code_hash = @codeHash AND used_at IS NULL AND expires_at > now()
+		RETURNING id, code_hash, client_id, user_id, redirect_uri, scope, nonce, code_challenge, auth_time, expires_at, used_at, created_at`
+	args := pgx.NamedArgs{
+		"codeHash": codeHash,
+	}
+
+	row := pg.db.QueryRow(ctx, query, args)
+	if err := row.Scan(&c.ID, &c.CodeHash, &c.ClientID, &c.UserID, &c.RedirectURI, &c.Scope, &c.Nonce, &c.CodeChallenge, &c.AuthTime, &c.ExpiresAt, &c.UsedAt, &c.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
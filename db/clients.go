@@ -0,0 +1,163 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Client authentication methods, named as in RFC 7591
+const (
+	ClientAuthSecretBasic   = "client_secret_basic"
+	ClientAuthSecretPost    = "client_secret_post"
+	ClientAuthPrivateKeyJWT = "private_key_jwt"
+	// Public clients (SPAs, native apps) do not authenticate and must use PKCE
+	ClientAuthNone = "none"
+)
+
+type OAuthClient struct {
+	ID           int        `db:"id"`
+	ClientID     string     `db:"client_id"`
+	Name         string     `db:"name"`
+	AuthMethod   string     `db:"auth_method"`
+	SecretHash   *string    `db:"secret_hash"`
+	PublicKey    *string    `db:"public_key"`
+	Scopes       []string   `db:"scopes"`
+	GrantTypes   []string   `db:"grant_types"`
+	RedirectURIs []string   `db:"redirect_uris"`
+	IsDisabled   bool       `db:"is_disabled"`
+	CreatedAt    time.Time  `db:"created_at"`
+	UpdatedAt    *time.Time `db:"updated_at"`
+}
+
+const clientColumns = `id, client_id, name, auth_method, secret_hash, public_key, scopes, grant_types, redirect_uris, is_disabled, created_at, updated_at`
+
+func scanClient(row pgx.Row) (*OAuthClient, error) {
+	var c OAuthClient
+	if err := row.Scan(&c.ID, &c.ClientID, &c.Name, &c.AuthMethod, &c.SecretHash, &c.PublicKey, &c.Scopes, &c.GrantTypes, &c.RedirectURIs, &c.IsDisabled, &c.CreatedAt, &c.UpdatedAt); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+func (pg *Postgres) CreateClient(ctx context.Context, c *OAuthClient) (*OAuthClient, error) {
+	query := `INSERT INTO oauth_clients (client_id, name, auth_method, secret_hash, public_key, scopes, grant_types, redirect_uris)
+		VALUES (@clientID, @name, @authMethod, @secretHash, @publicKey, @scopes, @grantTypes, @redirectURIs)
+		RETURNING id, created_at`
+	args := pgx.NamedArgs{
+		"clientID":     c.ClientID,
+		"name":         c.Name,
+		"authMethod":   c.AuthMethod,
+		"secretHash":   c.SecretHash,
+		"publicKey":    c.PublicKey,
+		"scopes":       c.Scopes,
+		"grantTypes":   c.GrantTypes,
+		"redirectURIs": c.RedirectURIs,
+	}
+
+	if err := pg.db.QueryRow(ctx, query, args).Scan(&c.ID, &c.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (pg *Postgres) GetClient(ctx context.Context, clientID string) (*OAuthClient, error) {
+	query := `SELECT ` + clientColumns + ` FROM oauth_clients WHERE client_id = @clientID`
+	args := pgx.NamedArgs{
+		"clientID": clientID,
+	}
+
+	return scanClient(pg.db.QueryRow(ctx, query, args))
+}
+
+func (pg *Postgres) ListClients(ctx context.Context) ([]*OAuthClient, error) {
+	query := `SELECT ` + clientColumns + ` FROM oauth_clients ORDER BY id`
+
+	rows, err := pg.db.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []*OAuthClient{}
+	for rows.Next() {
+		c, err := scanClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+
+	return clients, rows.Err()
+}
+
+func (pg *Postgres) UpdateClient(ctx context.Context, c *OAuthClient) error {
+	query := `UPDATE oauth_clients
+		SET name=@name, public_key=@publicKey, scopes=@scopes, grant_types=@grantTypes, redirect_uris=@redirectURIs,
+		is_disabled=@isDisabled, updated_at=now()
+		WHERE client_id = @clientID`
+	args := pgx.NamedArgs{
+		"name":         c.Name,
+		"publicKey":    c.PublicKey,
+		"scopes":       c.Scopes,
+		"grantTypes":   c.GrantTypes,
+		"redirectURIs": c.RedirectURIs,
+		"isDisabled":   c.IsDisabled,
+		"clientID":     c.ClientID,
+	}
+
+	_, err := pg.db.Exec(ctx, query, args)
+	return err
+}
+
+func (pg *Postgres) UpdateClientSecret(ctx context.Context, clientID, secretHash string) error {
+	query := `UPDATE oauth_clients SET secret_hash=@secretHash, updated_at=now() WHERE client_id = @clientID`
+	args := pgx.NamedArgs{
+		"secretHash": secretHash,
+		"clientID":   clientID,
+	}
+
+	_, err := pg.db.Exec(ctx, query, args)
+	return err
+}
+
+// DeleteClient reports whether the client existed
+func (pg *Postgres) DeleteClient(ctx context.Context, clientID string) (bool, error) {
+	query := `DELETE FROM oauth_clients WHERE client_id = @clientID`
+	args := pgx.NamedArgs{
+		"clientID": clientID,
+	}
+
+	tag, err := pg.db.Exec(ctx, query, args)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+// UseClientAssertion records the jti of a client assertion until it expires
+// and reports whether it was new. Expired ones are removed on the way.
+func (pg *Postgres) UseClientAssertion(ctx context.Context, clientID, jti string, expiresAt time.Time) (bool, error) {
+	if _, err := pg.db.Exec(ctx, `DELETE FROM oauth_client_assertions WHERE expires_at <= now()`); err != nil {
+		return false, err
+	}
+
+	query := `INSERT INTO oauth_client_assertions (client_id, jti, expires_at) VALUES (@clientID, @jti, @expiresAt)
+		ON CONFLICT (client_id, jti) DO NOTHING`
+	args := pgx.NamedArgs{
+		"clientID":  clientID,
+		"jti":       jti,
+		"expiresAt": expiresAt,
+	}
+
+	tag, err := pg.db.Exec(ctx, query, args)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
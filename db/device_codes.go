@@ -0,0 +1,158 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Device code states
+const (
+	DeviceCodePending  = "pending"
+	DeviceCodeApproved = "approved"
+	DeviceCodeDenied   = "denied"
+	DeviceCodeConsumed = "consumed"
+)
+
+// ErrDeviceCodeUsed is returned for a device code that is no longer approved
+// and unexpired, most likely because a concurrent poll consumed it
+var ErrDeviceCodeUsed = errors.New("device code was already used")
+
+type (
+	DeviceCode struct {
+		ID             int        `db:"id"`
+		DeviceCodeHash string     `db:"device_code_hash"`
+		UserCode       string     `db:"user_code"`
+		ClientID       string     `db:"client_id"`
+		Scope          string     `db:"scope"`
+		Status         string     `db:"status"`
+		UserID         *int       `db:"user_id"`
+		PollInterval   int        `db:"poll_interval"`
+		LastPolledAt   *time.Time `db:"last_polled_at"`
+		ExpiresAt      time.Time  `db:"expires_at"`
+		CreatedAt      time.Time  `db:"created_at"`
+	}
+
+	// DevicePoll is the outcome of a token request for a device code
+	DevicePoll struct {
+		// Approved codes stay approved until CreateDeviceCodeSession consumes them
+		Status   string
+		SlowDown bool
+		Expired  bool
+		UserID   *int
+		ClientID string
+		Scope    string
+	}
+)
+
+func (pg *Postgres) CreateDeviceCode(ctx context.Context, d *DeviceCode) error {
+	query := `INSERT INTO oauth_device_codes (device_code_hash, user_code, client_id, scope, poll_interval, expires_at)
+		VALUES (@deviceCodeHash, @userCode, @clientID, @scope, @pollInterval, @expiresAt)
+		RETURNING id, status, created_at`
+	args := pgx.NamedArgs{
+		"deviceCodeHash": d.DeviceCodeHash,
+		"userCode":       d.UserCode,
+		"clientID":       d.ClientID,
+		"scope":          d.Scope,
+		"pollInterval":   d.PollInterval,
+		"expiresAt":      d.ExpiresAt,
+	}
+
+	return pg.db.QueryRow(ctx, query, args).Scan(&d.ID, &d.Status, &d.CreatedAt)
+}
+
+// GetPendingDeviceCode returns the pending, unexpired device code with userCode, or pgx.ErrNoRows
+func (pg *Postgres) GetPendingDeviceCode(ctx context.Context, userCode string) (*DeviceCode, error) {
+	query := `SELECT id, user_code, client_id, scope, status, expires_at, created_at FROM oauth_device_codes
+		WHERE user_code = @userCode AND status = 'pending' AND expires_at > now()`
+	args := pgx.NamedArgs{
+		"userCode": userCode,
+	}
+
+	var d DeviceCode
+	if err := pg.db.QueryRow(ctx, query, args).Scan(&d.ID, &d.UserCode, &d.ClientID, &d.Scope, &d.Status, &d.ExpiresAt, &d.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+// DecideDeviceCode approves or denies a pending, unexpired user code on behalf of userID.
+// It returns the client ID the code was issued to, or pgx.ErrNoRows.
+func (pg *Postgres) DecideDeviceCode(ctx context.Context, userCode string, userID int, approve bool) (string, error) {
+	status := DeviceCodeDenied
+	if approve {
+		status = DeviceCodeApproved
+	}
+
+	query := `UPDATE oauth_device_codes SET status=@status, user_id=@userID
+		WHERE user_code = @userCode AND status = 'pending' AND expires_at > now()
+		RETURNING client_id`
+	args := pgx.NamedArgs{
+		"status":   status,
+		"userID":   userID,
+		"userCode": userCode,
+	}
+
+	var clientID string
+	if err := pg.db.QueryRow(ctx, query, args).Scan(&clientID); err != nil {
+		return "", err
+	}
+
+	return clientID, nil
+}
+
+// PollDeviceCode records a token request for a device code. Polling faster than
+// the interval adds 5 seconds to it (RFC 8628 section 3.5).
+func (pg *Postgres) PollDeviceCode(ctx context.Context, deviceCodeHash string) (*DevicePoll, error) {
+	query := `UPDATE oauth_device_codes d SET
+			last_polled_at = now(),
+			poll_interval = CASE WHEN old.too_fast THEN d.poll_interval + 5 ELSE d.poll_interval END
+		FROM (
+			SELECT id, status, COALESCE(last_polled_at > now() - make_interval(secs => poll_interval), false) AS too_fast
+			FROM oauth_device_codes WHERE device_code_hash = @deviceCodeHash FOR UPDATE
+		) old
+		WHERE d.id = old.id
+		RETURNING old.status, old.too_fast, d.expires_at <= now(), d.user_id, d.client_id, d.scope`
+	args := pgx.NamedArgs{
+		"deviceCodeHash": deviceCodeHash,
+	}
+
+	var p DevicePoll
+	row := pg.db.QueryRow(ctx, query, args)
+	if err := row.Scan(&p.Status, &p.SlowDown, &p.Expired, &p.UserID, &p.ClientID, &p.Scope); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// CreateDeviceCodeSession consumes an approved device code and saves the
+// session issued for it in one transaction, with events. ErrDeviceCodeUsed is
+// returned when the code can't be consumed.
+func (pg *Postgres) CreateDeviceCodeSession(ctx context.Context, deviceCodeHash string, s *Session, events ...*OutboxEvent) (*Session, error) {
+	query := `UPDATE oauth_device_codes SET status = 'consumed'
+		WHERE device_code_hash = @deviceCodeHash AND status = 'approved' AND expires_at > now()`
+	args := pgx.NamedArgs{
+		"deviceCodeHash": deviceCodeHash,
+	}
+
+	err := pg.withOutbox(ctx, events, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, query, args)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrDeviceCodeUsed
+		}
+
+		return saveSession(ctx, tx, s)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
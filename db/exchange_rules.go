@@ -0,0 +1,98 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ExchangeRule allows a client to exchange user access tokens for tokens
+// meant for audience, limited to scopes
+type ExchangeRule struct {
+	ID         int       `db:"id"`
+	ClientID   string    `db:"client_id"`
+	Audience   string    `db:"audience"`
+	Scopes     []string  `db:"scopes"`
+	TTLSeconds int       `db:"ttl_seconds"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+const exchangeRuleColumns = `id, client_id, audience, scopes, ttl_seconds, created_at`
+
+func scanExchangeRule(row pgx.Row) (*ExchangeRule, error) {
+	var e ExchangeRule
+	if err := row.Scan(&e.ID, &e.ClientID, &e.Audience, &e.Scopes, &e.TTLSeconds, &e.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+func (pg *Postgres) CreateExchangeRule(ctx context.Context, e *ExchangeRule) (*ExchangeRule, error) {
+	query := `INSERT INTO token_exchange_rules (client_id, audience, scopes, ttl_seconds)
+		VALUES (@clientID, @audience, @scopes, @ttlSeconds)
+		RETURNING id, created_at`
+	args := pgx.NamedArgs{
+		"clientID":   e.ClientID,
+		"audience":   e.Audience,
+		"scopes":     e.Scopes,
+		"ttlSeconds": e.TTLSeconds,
+	}
+
+	if err := pg.db.QueryRow(ctx, query, args).Scan(&e.ID, &e.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (pg *Postgres) GetExchangeRule(ctx context.Context, clientID, audience string) (*ExchangeRule, error) {
+	query := `SELECT ` + exchangeRuleColumns + ` FROM token_exchange_rules WHERE client_id = @clientID AND audience = @audience`
+	args := pgx.NamedArgs{
+		"clientID": clientID,
+		"audience": audience,
+	}
+
+	return scanExchangeRule(pg.db.QueryRow(ctx, query, args))
+}
+
+func (pg *Postgres) ListExchangeRules(ctx context.Context, clientID string) ([]*ExchangeRule, error) {
+	query := `SELECT ` + exchangeRuleColumns + ` FROM token_exchange_rules WHERE client_id = @clientID ORDER BY id`
+	args := pgx.NamedArgs{
+		"clientID": clientID,
+	}
+
+	rows, err := pg.db.Query(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []*ExchangeRule{}
+	for rows.Next() {
+		e, err := scanExchangeRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, e)
+	}
+
+	return rules, rows.Err()
+}
+
+// DeleteExchangeRule reports whether the rule existed
+func (pg *Postgres) DeleteExchangeRule(ctx context.Context, clientID string, ruleID int) (bool, error) {
+	query := `DELETE FROM token_exchange_rules WHERE id = @ruleID AND client_id = @clientID`
+	args := pgx.NamedArgs{
+		"ruleID":   ruleID,
+		"clientID": clientID,
+	}
+
+	tag, err := pg.db.Exec(ctx, query, args)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
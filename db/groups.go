@@ -0,0 +1,282 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type (
+	Group struct {
+		ID          int        `db:"id"`
+		DisplayName string     `db:"display_name"`
+		ExternalID  *string    `db:"external_id"`
+		CreatedAt   time.Time  `db:"created_at"`
+		UpdatedAt   *time.Time `db:"updated_at"`
+		Members     []GroupMember
+	}
+
+	GroupMember struct {
+		UserID   int    `db:"user_id"`
+		Username string `db:"username"`
+	}
+
+	// GroupFilter narrows ListGroups, nil fields match every group
+	GroupFilter struct {
+		DisplayName *string
+		ExternalID  *string
+	}
+)
+
+// ErrUnknownMember is returned when a group member does not reference an existing user
+var ErrUnknownMember = errors.New("unknown group member")
+
+const groupColumns = `id, display_name, external_id, created_at, updated_at`
+
+func scanGroup(row pgx.Row) (*Group, error) {
+	var g Group
+	if err := row.Scan(&g.ID, &g.DisplayName, &g.ExternalID, &g.CreatedAt, &g.UpdatedAt); err != nil {
+		return nil, err
+	}
+
+	g.Members = []GroupMember{}
+	return &g, nil
+}
+
+func (pg *Postgres) CreateGroup(ctx context.Context, g *Group) (*Group, error) {
+	tx, err := pg.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `INSERT INTO groups (display_name, external_id) VALUES (@displayName, @externalID) RETURNING id, created_at`
+	args := pgx.NamedArgs{
+		"displayName": g.DisplayName,
+		"externalID":  g.ExternalID,
+	}
+
+	if err := tx.QueryRow(ctx, query, args).Scan(&g.ID, &g.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	if err := setGroupMembers(ctx, tx, g); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+func (pg *Postgres) GetGroup(ctx context.Context, groupID int) (*Group, error) {
+	query := `SELECT ` + groupColumns + ` FROM groups WHERE id = @groupID`
+	args := pgx.NamedArgs{
+		"groupID": groupID,
+	}
+
+	g, err := scanGroup(pg.db.QueryRow(ctx, query, args))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := pg.loadGroupMembers(ctx, []*Group{g}); err != nil {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+func (pg *Postgres) CheckGroupName(ctx context.Context, displayName string) (bool, error) {
+	query := `SELECT EXISTS(SELECT 1 FROM groups WHERE display_name = @displayName)`
+	args := pgx.NamedArgs{
+		"displayName": displayName,
+	}
+
+	var b bool
+	if err := pg.db.QueryRow(ctx, query, args).Scan(&b); err != nil {
+		return false, err
+	}
+
+	return b, nil
+}
+
+// ListGroups returns a page of groups ordered by ID with their members, and the
+// number of groups matching filter
+func (pg *Postgres) ListGroups(ctx context.Context, filter GroupFilter, offset, limit int) ([]*Group, int, error) {
+	where := ` WHERE (@displayName::text IS NULL OR lower(display_name) = lower(@displayName))
+		AND (@externalID::text IS NULL OR external_id = @externalID)`
+	args := pgx.NamedArgs{
+		"displayName": filter.DisplayName,
+		"externalID":  filter.ExternalID,
+		"offset":      offset,
+		"limit":       limit,
+	}
+
+	var total int
+	if err := pg.db.QueryRow(ctx, `SELECT count(*) FROM groups`+where, args).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := pg.db.Query(ctx, `SELECT `+groupColumns+` FROM groups`+where+` ORDER BY id OFFSET @offset LIMIT @limit`, args)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	groups := []*Group{}
+	for rows.Next() {
+		g, err := scanGroup(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		groups = append(groups, g)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	if err := pg.loadGroupMembers(ctx, groups); err != nil {
+		return nil, 0, err
+	}
+
+	return groups, total, nil
+}
+
+// ReplaceGroup overwrites the name, external ID and members of a group
+func (pg *Postgres) ReplaceGroup(ctx context.Context, g *Group) error {
+	tx, err := pg.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `UPDATE groups SET display_name=@displayName, external_id=@externalID, updated_at=now()
+		WHERE id = @groupID
+		RETURNING updated_at`
+	args := pgx.NamedArgs{
+		"groupID":     g.ID,
+		"displayName": g.DisplayName,
+		"externalID":  g.ExternalID,
+	}
+
+	if err := tx.QueryRow(ctx, query, args).Scan(&g.UpdatedAt); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(ctx, `DELETE FROM group_members WHERE group_id = @groupID`, pgx.NamedArgs{"groupID": g.ID}); err != nil {
+		return err
+	}
+
+	if err := setGroupMembers(ctx, tx, g); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// DeleteGroup reports whether the group existed
+func (pg *Postgres) DeleteGroup(ctx context.Context, groupID int) (bool, error) {
+	query := `DELETE FROM groups WHERE id = @groupID`
+	args := pgx.NamedArgs{
+		"groupID": groupID,
+	}
+
+	tag, err := pg.db.Exec(ctx, query, args)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+// setGroupMembers inserts the members of g and fills in their usernames.
+// It fails with ErrUnknownMember when a user does not exist.
+func setGroupMembers(ctx context.Context, tx pgx.Tx, g *Group) error {
+	userIDs := make([]int, 0, len(g.Members))
+	for _, m := range g.Members {
+		if !slices.Contains(userIDs, m.UserID) {
+			userIDs = append(userIDs, m.UserID)
+		}
+	}
+
+	query := `WITH inserted AS (
+			INSERT INTO group_members (group_id, user_id)
+			SELECT @groupID, id FROM users WHERE id = ANY(@userIDs)
+			RETURNING user_id
+		)
+		SELECT u.id, u.username FROM inserted JOIN users u ON u.id = inserted.user_id ORDER BY u.id`
+	args := pgx.NamedArgs{
+		"groupID": g.ID,
+		"userIDs": userIDs,
+	}
+
+	rows, err := tx.Query(ctx, query, args)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	members := []GroupMember{}
+	for rows.Next() {
+		var m GroupMember
+		if err := rows.Scan(&m.UserID, &m.Username); err != nil {
+			return err
+		}
+		members = append(members, m)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(members) != len(userIDs) {
+		return ErrUnknownMember
+	}
+
+	g.Members = members
+
+	return nil
+}
+
+func (pg *Postgres) loadGroupMembers(ctx context.Context, groups []*Group) error {
+	if len(groups) == 0 {
+		return nil
+	}
+
+	byID := make(map[int]*Group, len(groups))
+	groupIDs := make([]int, 0, len(groups))
+	for _, g := range groups {
+		byID[g.ID] = g
+		groupIDs = append(groupIDs, g.ID)
+	}
+
+	query := `SELECT gm.group_id, u.id, u.username FROM group_members gm
+		JOIN users u ON u.id = gm.user_id
+		WHERE gm.group_id = ANY(@groupIDs)
+		ORDER BY gm.group_id, u.id`
+	args := pgx.NamedArgs{
+		"groupIDs": groupIDs,
+	}
+
+	rows, err := pg.db.Query(ctx, query, args)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var groupID int
+		var m GroupMember
+		if err := rows.Scan(&groupID, &m.UserID, &m.Username); err != nil {
+			return err
+		}
+		byID[groupID].Members = append(byID[groupID].Members, m)
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,206 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type (
+	LinkedIdentity struct {
+		ID          int        `db:"id"`
+		UserID      int        `db:"user_id"`
+		Provider    string     `db:"provider"`
+		Subject     string     `db:"subject"`
+		Username    string     `db:"username"`
+		Email       string     `db:"email"`
+		LastLoginAt *time.Time `db:"last_login_at"`
+		CreatedAt   time.Time  `db:"created_at"`
+	}
+
+	// ExternalLoginState is the server side half of an upstream login in progress
+	ExternalLoginState struct {
+		StateHash    string    `db:"state_hash"`
+		Provider     string    `db:"provider"`
+		CodeVerifier string    `db:"code_verifier"`
+		Nonce        string    `db:"nonce"`
+		LinkUserID   *int      `db:"link_user_id"`
+		ExpiresAt    time.Time `db:"expires_at"`
+		CreatedAt    time.Time `db:"created_at"`
+	}
+)
+
+const linkedIdentityColumns = `id, user_id, provider, subject, username, email, last_login_at, created_at`
+
+func scanLinkedIdentity(row pgx.Row) (*LinkedIdentity, error) {
+	var i LinkedIdentity
+	if err := row.Scan(&i.ID, &i.UserID, &i.Provider, &i.Subject, &i.Username, &i.Email, &i.LastLoginAt, &i.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	return &i, nil
+}
+
+func (pg *Postgres) CreateLinkedIdentity(ctx context.Context, i *LinkedIdentity) (*LinkedIdentity, error) {
+	return createLinkedIdentity(ctx, pg.db, i)
+}
+
+// CreateUserWithIdentity provisions a user for an upstream identity that is not linked yet
+func (pg *Postgres) CreateUserWithIdentity(ctx context.Context, u *User, i *LinkedIdentity) (*User, error) {
+	tx, err := pg.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	u.AuthSource = AuthSourceFederation
+
+	query := `INSERT INTO users (name, username, password, auth_source) VALUES (@name, @username, @password, @authSource) RETURNING id, active, created_at`
+	args := pgx.NamedArgs{
+		"name":       u.Name,
+		"username":   u.Username,
+		"password":   u.Password,
+		"authSource": u.AuthSource,
+	}
+
+	if err := tx.QueryRow(ctx, query, args).Scan(&u.ID, &u.Active, &u.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	i.UserID = u.ID
+	if _, err := createLinkedIdentity(ctx, tx, i); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+type queryRower interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+func createLinkedIdentity(ctx context.Context, q queryRower, i *LinkedIdentity) (*LinkedIdentity, error) {
+	query := `INSERT INTO linked_identities (user_id, provider, subject, username, email, last_login_at)
+		VALUES (@userID, @provider, @subject, @username, @email, now())
+		RETURNING id, last_login_at, created_at`
+	args := pgx.NamedArgs{
+		"userID":   i.UserID,
+		"provider": i.Provider,
+		"subject":  i.Subject,
+		"username": i.Username,
+		"email":    i.Email,
+	}
+
+	if err := q.QueryRow(ctx, query, args).Scan(&i.ID, &i.LastLoginAt, &i.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	return i, nil
+}
+
+func (pg *Postgres) GetLinkedIdentity(ctx context.Context, provider, subject string) (*LinkedIdentity, error) {
+	query := `SELECT ` + linkedIdentityColumns + ` FROM linked_identities WHERE provider = @provider AND subject = @subject`
+	args := pgx.NamedArgs{
+		"provider": provider,
+		"subject":  subject,
+	}
+
+	return scanLinkedIdentity(pg.db.QueryRow(ctx, query, args))
+}
+
+func (pg *Postgres) ListLinkedIdentities(ctx context.Context, userID int) ([]*LinkedIdentity, error) {
+	query := `SELECT ` + linkedIdentityColumns + ` FROM linked_identities WHERE user_id = @userID ORDER BY provider`
+	args := pgx.NamedArgs{
+		"userID": userID,
+	}
+
+	rows, err := pg.db.Query(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []*LinkedIdentity{}
+	for rows.Next() {
+		i, err := scanLinkedIdentity(rows)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, i)
+	}
+
+	return identities, rows.Err()
+}
+
+// TouchLinkedIdentity records a login and refreshes the profile data the provider returned
+func (pg *Postgres) TouchLinkedIdentity(ctx context.Context, i *LinkedIdentity) error {
+	query := `UPDATE linked_identities SET username=@username, email=@email, last_login_at=now() WHERE id = @id`
+	args := pgx.NamedArgs{
+		"id":       i.ID,
+		"username": i.Username,
+		"email":    i.Email,
+	}
+
+	_, err := pg.db.Exec(ctx, query, args)
+	return err
+}
+
+// DeleteLinkedIdentity reports whether the user had an identity at provider that was unlinked
+func (pg *Postgres) DeleteLinkedIdentity(ctx context.Context, userID int, provider string) (bool, error) {
+	query := `DELETE FROM linked_identities WHERE user_id = @userID AND provider = @provider`
+	args := pgx.NamedArgs{
+		"userID":   userID,
+		"provider": provider,
+	}
+
+	tag, err := pg.db.Exec(ctx, query, args)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+func (pg *Postgres) CreateExternalLoginState(ctx context.Context, s *ExternalLoginState) error {
+	query := `INSERT INTO external_login_states (state_hash, provider, code_verifier, nonce, link_user_id, expires_at)
+		VALUES (@stateHash, @provider, @codeVerifier, @nonce, @linkUserID, @expiresAt)`
+	args := pgx.NamedArgs{
+		"stateHash":    s.StateHash,
+		"provider":     s.Provider,
+		"codeVerifier": s.CodeVerifier,
+		"nonce":        s.Nonce,
+		"linkUserID":   s.LinkUserID,
+		"expiresAt":    s.ExpiresAt,
+	}
+
+	_, err := pg.db.Exec(ctx, query, args)
+	return err
+}
+
+// ConsumeExternalLoginState deletes an unexpired state and returns it, so a
+// callback can only be completed once. Expired states are removed on the way.
+func (pg *Postgres) ConsumeExternalLoginState(ctx context.Context, stateHash, provider string) (*ExternalLoginState, error) {
+	if _, err := pg.db.Exec(ctx, `DELETE FROM external_login_states WHERE expires_at <= now()`); err != nil {
+		return nil, err
+	}
+
+	var s ExternalLoginState
+	query := `DELETE FROM external_login_states WHERE state_hash = @stateHash AND provider = @provider AND expires_at > now()
+		RETURNING state_hash, provider, code_verifier, nonce, link_user_id, expires_at, created_at`
+	args := pgx.NamedArgs{
+		"stateHash": stateHash,
+		"provider":  provider,
+	}
+
+	row := pg.db.QueryRow(ctx, query, args)
+	if err := row.Scan(&s.StateHash, &s.Provider, &s.CodeVerifier, &s.Nonce, &s.LinkUserID, &s.ExpiresAt, &s.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
@@ -0,0 +1,49 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// MagicLink records an issued signin link so that it can only be used once
+type MagicLink struct {
+	TokenID   string    `db:"token_id"`
+	UserID    int       `db:"user_id"`
+	ExpiresAt time.Time `db:"expires_at"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+func (pg *Postgres) CreateMagicLink(ctx context.Context, l *MagicLink) error {
+	query := `INSERT INTO magic_links (token_id, user_id, expires_at) VALUES (@tokenID, @userID, @expiresAt)`
+	args := pgx.NamedArgs{
+		"tokenID":   l.TokenID,
+		"userID":    l.UserID,
+		"expiresAt": l.ExpiresAt,
+	}
+
+	_, err := pg.db.Exec(ctx, query, args)
+	return err
+}
+
+// ConsumeMagicLink deletes an unexpired link of userID and reports whether it
+// existed. Expired links are removed on the way.
+func (pg *Postgres) ConsumeMagicLink(ctx context.Context, tokenID string, userID int) (bool, error) {
+	if _, err := pg.db.Exec(ctx, `DELETE FROM magic_links WHERE expires_at <= now()`); err != nil {
+		return false, err
+	}
+
+	query := `DELETE FROM magic_links WHERE token_id = @tokenID AND user_id = @userID AND expires_at > now()`
+	args := pgx.NamedArgs{
+		"tokenID": tokenID,
+		"userID":  userID,
+	}
+
+	tag, err := pg.db.Exec(ctx, query, args)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
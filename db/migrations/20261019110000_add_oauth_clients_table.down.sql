@@ -0,0 +1,2 @@
+DROP TABLE oauth_clients;
+ALTER TABLE users DROP COLUMN roles;
\ No newline at end of file
@@ -0,0 +1,15 @@
+ALTER TABLE users ADD COLUMN roles TEXT[] NOT NULL DEFAULT '{}';
+
+CREATE TABLE oauth_clients (
+    id SERIAL PRIMARY KEY,
+    client_id VARCHAR(64) UNIQUE NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    auth_method VARCHAR(32) NOT NULL,
+    secret_hash VARCHAR(255),
+    public_key TEXT,
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    grant_types TEXT[] NOT NULL DEFAULT '{client_credentials}',
+    is_disabled BOOL NOT NULL DEFAULT false,
+    created_at TIMESTAMP DEFAULT now(),
+    updated_at TIMESTAMP
+);
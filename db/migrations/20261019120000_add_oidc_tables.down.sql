@@ -0,0 +1,4 @@
+DROP TABLE oauth_authorization_codes;
+ALTER TABLE sessions DROP COLUMN scope;
+ALTER TABLE sessions DROP COLUMN client_id;
+ALTER TABLE oauth_clients DROP COLUMN redirect_uris;
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE sessions DROP COLUMN refresh_lookup;
\ No newline at end of file
@@ -0,0 +1,3 @@
+ALTER TABLE sessions ADD COLUMN refresh_lookup VARCHAR(64);
+
+CREATE INDEX sessions_refresh_lookup_idx ON sessions(refresh_lookup);
@@ -0,0 +1 @@
+DROP TABLE oauth_device_codes;
\ No newline at end of file
@@ -0,0 +1,13 @@
+CREATE TABLE oauth_device_codes (
+    id SERIAL PRIMARY KEY,
+    device_code_hash VARCHAR(64) UNIQUE NOT NULL,
+    user_code VARCHAR(16) UNIQUE NOT NULL,
+    client_id VARCHAR(64) NOT NULL REFERENCES oauth_clients(client_id) ON DELETE CASCADE,
+    scope TEXT NOT NULL DEFAULT '',
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    user_id INT REFERENCES users(id) ON DELETE CASCADE,
+    poll_interval INT NOT NULL,
+    last_polled_at TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT now()
+);
@@ -0,0 +1 @@
+DROP TABLE token_exchange_rules;
\ No newline at end of file
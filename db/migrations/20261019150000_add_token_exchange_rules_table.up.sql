@@ -0,0 +1,9 @@
+CREATE TABLE token_exchange_rules (
+    id SERIAL PRIMARY KEY,
+    client_id VARCHAR(64) NOT NULL REFERENCES oauth_clients(client_id) ON DELETE CASCADE,
+    audience VARCHAR(255) NOT NULL,
+    scopes TEXT[] NOT NULL,
+    ttl_seconds INT NOT NULL,
+    created_at TIMESTAMP DEFAULT now(),
+    UNIQUE (client_id, audience)
+);
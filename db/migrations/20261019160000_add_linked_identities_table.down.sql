@@ -0,0 +1,2 @@
+DROP TABLE external_login_states;
+DROP TABLE linked_identities;
\ No newline at end of file
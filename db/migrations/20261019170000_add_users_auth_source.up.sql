@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN auth_source VARCHAR(32) NOT NULL DEFAULT 'local';
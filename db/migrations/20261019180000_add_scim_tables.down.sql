@@ -0,0 +1,6 @@
+DROP TABLE group_members;
+DROP TABLE groups;
+
+ALTER TABLE users DROP COLUMN active;
+ALTER TABLE users DROP COLUMN external_id;
+ALTER TABLE users DROP COLUMN email;
\ No newline at end of file
@@ -0,0 +1,21 @@
+ALTER TABLE users ADD COLUMN email VARCHAR(255);
+ALTER TABLE users ADD COLUMN external_id VARCHAR(255);
+ALTER TABLE users ADD COLUMN active BOOL NOT NULL DEFAULT true;
+
+CREATE INDEX users_external_id_idx ON users(external_id);
+
+CREATE TABLE groups (
+    id SERIAL PRIMARY KEY,
+    display_name VARCHAR(255) NOT NULL UNIQUE,
+    external_id VARCHAR(255),
+    created_at TIMESTAMP DEFAULT now(),
+    updated_at TIMESTAMP
+);
+
+CREATE TABLE group_members (
+    group_id INT NOT NULL REFERENCES groups(id) ON DELETE CASCADE,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    PRIMARY KEY (group_id, user_id)
+);
+
+CREATE INDEX group_members_user_id_idx ON group_members(user_id);
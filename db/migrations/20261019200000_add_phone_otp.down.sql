@@ -0,0 +1,4 @@
+DROP TABLE phone_otps;
+
+ALTER TABLE users DROP COLUMN phone_verified_at;
+ALTER TABLE users DROP COLUMN phone;
\ No newline at end of file
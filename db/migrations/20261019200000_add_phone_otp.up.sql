@@ -0,0 +1,15 @@
+ALTER TABLE users ADD COLUMN phone VARCHAR(32) UNIQUE;
+ALTER TABLE users ADD COLUMN phone_verified_at TIMESTAMP;
+
+CREATE TABLE phone_otps (
+    id SERIAL PRIMARY KEY,
+    phone VARCHAR(32) NOT NULL,
+    purpose VARCHAR(16) NOT NULL,
+    user_id INT REFERENCES users(id) ON DELETE CASCADE,
+    code_hash VARCHAR(255) NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT now()
+);
+
+CREATE INDEX phone_otps_phone_idx ON phone_otps(phone, created_at);
@@ -0,0 +1,30 @@
+CREATE TABLE audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    event_id VARCHAR(64) UNIQUE NOT NULL,
+    event_type VARCHAR(64) NOT NULL,
+    user_id INT,
+    session_id VARCHAR(255) NOT NULL DEFAULT '',
+    ip_address VARCHAR(45) NOT NULL DEFAULT '',
+    user_agent VARCHAR(255) NOT NULL DEFAULT '',
+    data JSONB,
+    occurred_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT now()
+);
+
+CREATE INDEX audit_log_user_id_idx ON audit_log(user_id, id);
+CREATE INDEX audit_log_event_type_idx ON audit_log(event_type, id);
+CREATE INDEX audit_log_ip_address_idx ON audit_log(ip_address, id);
+CREATE INDEX audit_log_occurred_at_idx ON audit_log(occurred_at);
+
+-- Rows are never changed or removed, not even when their user is deleted
+CREATE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_no_update BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+
+CREATE TRIGGER audit_log_no_truncate BEFORE TRUNCATE ON audit_log
+    FOR EACH STATEMENT EXECUTE FUNCTION audit_log_append_only();
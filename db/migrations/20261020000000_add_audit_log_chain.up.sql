@@ -0,0 +1,15 @@
+-- Entries recorded before this have no hash and are not covered by the chain
+ALTER TABLE audit_log ADD COLUMN prev_hash VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE audit_log ADD COLUMN hash VARCHAR(64) NOT NULL DEFAULT '';
+
+CREATE TABLE audit_log_checkpoints (
+    id SERIAL PRIMARY KEY,
+    entry_id BIGINT UNIQUE NOT NULL REFERENCES audit_log(id),
+    hash VARCHAR(64) NOT NULL,
+    key_id VARCHAR(64) NOT NULL,
+    signature TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT now()
+);
+
+CREATE TRIGGER audit_log_checkpoints_no_update BEFORE UPDATE OR DELETE ON audit_log_checkpoints
+    FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
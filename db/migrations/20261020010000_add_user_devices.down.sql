@@ -0,0 +1,3 @@
+DROP TABLE signin_alerts;
+DROP TABLE user_devices;
+ALTER TABLE users DROP COLUMN password_reset_required;
\ No newline at end of file
@@ -0,0 +1,21 @@
+ALTER TABLE users ADD COLUMN password_reset_required BOOL NOT NULL DEFAULT false;
+
+CREATE TABLE user_devices (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    fingerprint VARCHAR(64) NOT NULL,
+    user_agent VARCHAR(255) NOT NULL,
+    ip_address VARCHAR(45) NOT NULL,
+    created_at TIMESTAMP DEFAULT now(),
+    last_seen_at TIMESTAMP DEFAULT now(),
+    UNIQUE (user_id, fingerprint)
+);
+
+CREATE TABLE signin_alerts (
+    token_id VARCHAR(64) PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    session_row_id INT REFERENCES sessions(id) ON DELETE SET NULL,
+    denied_at TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT now()
+);
@@ -0,0 +1,8 @@
+ALTER TABLE sessions
+    DROP COLUMN country,
+    DROP COLUMN city,
+    DROP COLUMN asn,
+    DROP COLUMN as_org,
+    DROP COLUMN latitude,
+    DROP COLUMN longitude,
+    DROP COLUMN accuracy_radius;
\ No newline at end of file
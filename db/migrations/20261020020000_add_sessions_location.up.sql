@@ -0,0 +1,8 @@
+ALTER TABLE sessions
+    ADD COLUMN country VARCHAR(2) NOT NULL DEFAULT '',
+    ADD COLUMN city VARCHAR(255) NOT NULL DEFAULT '',
+    ADD COLUMN asn BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN as_org VARCHAR(255) NOT NULL DEFAULT '',
+    ADD COLUMN latitude DOUBLE PRECISION,
+    ADD COLUMN longitude DOUBLE PRECISION,
+    ADD COLUMN accuracy_radius INT NOT NULL DEFAULT 0;
@@ -0,0 +1 @@
+DROP TABLE oauth_client_assertions;
\ No newline at end of file
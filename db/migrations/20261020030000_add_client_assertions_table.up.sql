@@ -0,0 +1,7 @@
+CREATE TABLE oauth_client_assertions (
+    client_id VARCHAR(64) NOT NULL REFERENCES oauth_clients(client_id) ON DELETE CASCADE,
+    jti VARCHAR(255) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT now(),
+    PRIMARY KEY (client_id, jti)
+);
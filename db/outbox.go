@@ -0,0 +1,195 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// OutboxEvent is an event waiting to be handed to the notification sinks. It
+// is written in the same transaction as the change it describes.
+type OutboxEvent struct {
+	ID             int64      `db:"id"`
+	EventID        string     `db:"event_id"`
+	EventType      string     `db:"event_type"`
+	Payload        []byte     `db:"payload"`
+	Attempts       int        `db:"attempts"`
+	DeliveredSinks []string   `db:"delivered_sinks"`
+	LastError      *string    `db:"last_error"`
+	AvailableAt    time.Time  `db:"available_at"`
+	DeliveredAt    *time.Time `db:"delivered_at"`
+	FailedAt       *time.Time `db:"failed_at"`
+	CreatedAt      time.Time  `db:"created_at"`
+}
+
+const outboxColumns = `id, event_id, event_type, payload, attempts, delivered_sinks, last_error, available_at, delivered_at, failed_at, created_at`
+
+func scanOutboxEvent(row pgx.Row) (*OutboxEvent, error) {
+	var e OutboxEvent
+	if err := row.Scan(&e.ID, &e.EventID, &e.EventType, &e.Payload, &e.Attempts, &e.DeliveredSinks, &e.LastError, &e.AvailableAt, &e.DeliveredAt, &e.FailedAt, &e.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+func insertOutboxEvents(ctx context.Context, e execer, events []*OutboxEvent) error {
+	query := `INSERT INTO outbox (event_id, event_type, payload) VALUES (@eventID, @eventType, @payload)`
+
+	for _, ev := range events {
+		args := pgx.NamedArgs{
+			"eventID":   ev.EventID,
+			"eventType": ev.EventType,
+			"payload":   string(ev.Payload),
+		}
+
+		if _, err := e.Exec(ctx, query, args); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (pg *Postgres) CreateOutboxEvents(ctx context.Context, events ...*OutboxEvent) error {
+	return insertOutboxEvents(ctx, pg.db, events)
+}
+
+// withOutbox runs fn and records events in one transaction
+func (pg *Postgres) withOutbox(ctx context.Context, events []*OutboxEvent, fn func(tx pgx.Tx) error) error {
+	tx, err := pg.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	if err := insertOutboxEvents(ctx, tx, events); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// ClaimOutboxEvents leases up to limit pending events to the caller. Rows
+// locked by another replica are skipped, and a leased row becomes available
+// again once lease has passed, so events of a crashed replica are retried.
+// Claiming isn't an attempt yet, see StartOutboxAttempt.
+func (pg *Postgres) ClaimOutboxEvents(ctx context.Context, limit int, lease time.Duration) ([]*OutboxEvent, error) {
+	query := `UPDATE outbox SET available_at = now() + make_interval(secs => @lease)
+		WHERE id IN (
+			SELECT id FROM outbox
+			WHERE delivered_at IS NULL AND failed_at IS NULL AND available_at <= now()
+			ORDER BY id
+			LIMIT @limit
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + outboxColumns
+	args := pgx.NamedArgs{
+		"limit": limit,
+		"lease": lease.Seconds(),
+	}
+
+	rows, err := pg.db.Query(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*OutboxEvent{}
+	for rows.Next() {
+		e, err := scanOutboxEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+// StartOutboxAttempt counts an attempt at delivering a claimed event and
+// renews its lease, so that the events waiting behind it in a batch don't run
+// out theirs. It reports false, changing nothing, once the claim's lease has
+// passed and the event may have been claimed again by another replica.
+func (pg *Postgres) StartOutboxAttempt(ctx context.Context, e *OutboxEvent, lease time.Duration) (bool, error) {
+	query := `UPDATE outbox SET attempts = attempts + 1, available_at = now() + make_interval(secs => @lease)
+		WHERE id = @id AND available_at = @leasedUntil AND available_at > now()
+		RETURNING attempts, available_at`
+	args := pgx.NamedArgs{
+		"id":          e.ID,
+		"leasedUntil": e.AvailableAt,
+		"lease":       lease.Seconds(),
+	}
+
+	err := pg.db.QueryRow(ctx, query, args).Scan(&e.Attempts, &e.AvailableAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (pg *Postgres) MarkOutboxEventDelivered(ctx context.Context, id int64) error {
+	query := `UPDATE outbox SET delivered_at = now(), last_error = NULL WHERE id = @id`
+	args := pgx.NamedArgs{
+		"id": id,
+	}
+
+	_, err := pg.db.Exec(ctx, query, args)
+	return err
+}
+
+// RetryOutboxEvent schedules another attempt after backoff. deliveredSinks
+// are skipped from then on.
+func (pg *Postgres) RetryOutboxEvent(ctx context.Context, id int64, deliveredSinks []string, backoff time.Duration, lastError string) error {
+	query := `UPDATE outbox SET delivered_sinks = @deliveredSinks, last_error = @lastError,
+		available_at = now() + make_interval(secs => @backoff)
+		WHERE id = @id`
+	args := pgx.NamedArgs{
+		"id":             id,
+		"deliveredSinks": deliveredSinks,
+		"lastError":      lastError,
+		"backoff":        backoff.Seconds(),
+	}
+
+	_, err := pg.db.Exec(ctx, query, args)
+	return err
+}
+
+// FailOutboxEvent gives up on an event
+func (pg *Postgres) FailOutboxEvent(ctx context.Context, id int64, deliveredSinks []string, lastError string) error {
+	query := `UPDATE outbox SET delivered_sinks = @deliveredSinks, last_error = @lastError, failed_at = now() WHERE id = @id`
+	args := pgx.NamedArgs{
+		"id":             id,
+		"deliveredSinks": deliveredSinks,
+		"lastError":      lastError,
+	}
+
+	_, err := pg.db.Exec(ctx, query, args)
+	return err
+}
+
+// DeleteDeliveredOutboxEvents removes delivered events older than retention
+// and returns how many there were. Failed events are kept for inspection.
+func (pg *Postgres) DeleteDeliveredOutboxEvents(ctx context.Context, retention time.Duration) (int64, error) {
+	query := `DELETE FROM outbox WHERE delivered_at < now() - make_interval(secs => @retention)`
+	args := pgx.NamedArgs{
+		"retention": retention.Seconds(),
+	}
+
+	tag, err := pg.db.Exec(ctx, query, args)
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
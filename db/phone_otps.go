@@ -0,0 +1,114 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// What a phone code is for
+const (
+	PhoneOTPLogin  = "login"
+	PhoneOTPEnroll = "enroll"
+)
+
+// PhoneOTP is a one-time code sent to a phone number. UserID is nil for codes
+// requested for unknown numbers, which are recorded only to throttle them.
+type PhoneOTP struct {
+	ID        int       `db:"id"`
+	Phone     string    `db:"phone"`
+	Purpose   string    `db:"purpose"`
+	UserID    *int      `db:"user_id"`
+	CodeHash  string    `db:"code_hash"`
+	Attempts  int       `db:"attempts"`
+	ExpiresAt time.Time `db:"expires_at"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+const phoneOTPColumns = `id, phone, purpose, user_id, code_hash, attempts, expires_at, created_at`
+
+func scanPhoneOTP(row pgx.Row) (*PhoneOTP, error) {
+	var o PhoneOTP
+	if err := row.Scan(&o.ID, &o.Phone, &o.Purpose, &o.UserID, &o.CodeHash, &o.Attempts, &o.ExpiresAt, &o.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	return &o, nil
+}
+
+func (pg *Postgres) CreatePhoneOTP(ctx context.Context, o *PhoneOTP) error {
+	query := `INSERT INTO phone_otps (phone, purpose, user_id, code_hash, expires_at)
+		VALUES (@phone, @purpose, @userID, @codeHash, @expiresAt)
+		RETURNING id, created_at`
+	args := pgx.NamedArgs{
+		"phone":     o.Phone,
+		"purpose":   o.Purpose,
+		"userID":    o.UserID,
+		"codeHash":  o.CodeHash,
+		"expiresAt": o.ExpiresAt,
+	}
+
+	return pg.db.QueryRow(ctx, query, args).Scan(&o.ID, &o.CreatedAt)
+}
+
+// PhoneOTPSends returns how many codes were requested for phone within window
+// and how long ago the last one was. Rows that aged out are removed on the way.
+func (pg *Postgres) PhoneOTPSends(ctx context.Context, phone string, window time.Duration) (int, *time.Duration, error) {
+	args := pgx.NamedArgs{
+		"phone":  phone,
+		"window": window.Seconds(),
+	}
+
+	if _, err := pg.db.Exec(ctx, `DELETE FROM phone_otps WHERE created_at < now() - make_interval(secs => @window) AND expires_at <= now()`, args); err != nil {
+		return 0, nil, err
+	}
+
+	query := `SELECT count(*), EXTRACT(EPOCH FROM now() - max(created_at))::float8 FROM phone_otps
+		WHERE phone = @phone AND created_at >= now() - make_interval(secs => @window)`
+
+	var count int
+	var lastAge *float64
+	if err := pg.db.QueryRow(ctx, query, args).Scan(&count, &lastAge); err != nil {
+		return 0, nil, err
+	}
+
+	if lastAge == nil {
+		return count, nil, nil
+	}
+
+	d := time.Duration(*lastAge * float64(time.Second))
+	return count, &d, nil
+}
+
+// UsePhoneOTPAttempt counts a verification attempt against the latest unexpired
+// code for phone and returns it. pgx.ErrNoRows means there is no such code or
+// its attempts are used up.
+func (pg *Postgres) UsePhoneOTPAttempt(ctx context.Context, phone, purpose string, maxAttempts int) (*PhoneOTP, error) {
+	query := `UPDATE phone_otps SET attempts = attempts + 1
+		WHERE id = (
+			SELECT id FROM phone_otps WHERE phone = @phone AND purpose = @purpose AND expires_at > now()
+			ORDER BY created_at DESC, id DESC LIMIT 1
+		) AND attempts < @maxAttempts
+		RETURNING ` + phoneOTPColumns
+	args := pgx.NamedArgs{
+		"phone":       phone,
+		"purpose":     purpose,
+		"maxAttempts": maxAttempts,
+	}
+
+	return scanPhoneOTP(pg.db.QueryRow(ctx, query, args))
+}
+
+// ExpirePhoneOTPs makes the codes for phone unusable once one was accepted.
+// The rows are kept until they age out so they still count towards throttling.
+func (pg *Postgres) ExpirePhoneOTPs(ctx context.Context, phone, purpose string) error {
+	query := `UPDATE phone_otps SET expires_at = now() WHERE phone = @phone AND purpose = @purpose AND expires_at > now()`
+	args := pgx.NamedArgs{
+		"phone":   phone,
+		"purpose": purpose,
+	}
+
+	_, err := pg.db.Exec(ctx, query, args)
+	return err
+}
@@ -0,0 +1,66 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// RiskHistory is what is known about a user's earlier signins, for telling
+// whether an attempt comes from somewhere new
+type RiskHistory struct {
+	// False for users who have never signed in, nothing is new to them
+	HasSessions bool
+	HasDevices  bool
+	KnownIP     bool
+	KnownASN    bool
+	KnownDevice bool
+}
+
+// GetRiskHistory looks up whether ip, asn and the device fingerprint have been
+// seen on the user's sessions and devices. asn 0 and an empty fingerprint are
+// never known.
+func (pg *Postgres) GetRiskHistory(ctx context.Context, userID int, ip string, asn int, fingerprint string) (*RiskHistory, error) {
+	query := `SELECT
+		EXISTS (SELECT 1 FROM sessions WHERE user_id = @userID),
+		EXISTS (SELECT 1 FROM user_devices WHERE user_id = @userID),
+		EXISTS (SELECT 1 FROM sessions WHERE user_id = @userID AND ip_address = @ip)
+			OR EXISTS (SELECT 1 FROM user_devices WHERE user_id = @userID AND ip_address = @ip),
+		@asn <> 0 AND EXISTS (SELECT 1 FROM sessions WHERE user_id = @userID AND asn = @asn),
+		EXISTS (SELECT 1 FROM user_devices WHERE user_id = @userID AND fingerprint = @fingerprint)`
+	args := pgx.NamedArgs{
+		"userID":      userID,
+		"ip":          ip,
+		"asn":         asn,
+		"fingerprint": fingerprint,
+	}
+
+	var h RiskHistory
+	if err := pg.db.QueryRow(ctx, query, args).Scan(&h.HasSessions, &h.HasDevices, &h.KnownIP, &h.KnownASN, &h.KnownDevice); err != nil {
+		return nil, err
+	}
+
+	return &h, nil
+}
+
+// CountLoginFailures returns how many signins from ip the audit log has
+// recorded as failed for one of reasons since since
+func (pg *Postgres) CountLoginFailures(ctx context.Context, ip string, reasons []string, since time.Time) (int, error) {
+	query := `SELECT count(*) FROM audit_log
+		WHERE event_type = 'auth.login_failed' AND occurred_at >= @since
+		AND ip_address = @ip
+		AND data->>'reason' = ANY(@reasons)`
+	args := pgx.NamedArgs{
+		"ip":      ip,
+		"reasons": reasons,
+		"since":   since.UTC(),
+	}
+
+	var n int
+	if err := pg.db.QueryRow(ctx, query, args).Scan(&n); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 )
 
 type (
@@ -19,22 +20,56 @@ type (
 		CreatedAt    time.Time  `db:"created_at"`
 		UpdatedAt    *time.Time `db:"updated_at"`
 		ExpiresAt    time.Time  `db:"expires_at"`
+		ClientID     *string    `db:"client_id"`
+		Scope        string     `db:"scope"`
+		// SHA-256 of the refresh token, lets a session be found by its refresh token
+		RefreshLookup *string `db:"refresh_lookup"`
+		Location      SessionLocation
+	}
+
+	// SessionLocation is where a session was last used from, as told by GeoIP.
+	// It is empty when GeoIP is off or doesn't know the address.
+	SessionLocation struct {
+		Country        string   `db:"country"`
+		City           string   `db:"city"`
+		ASN            int      `db:"asn"`
+		ASOrg          string   `db:"as_org"`
+		Latitude       *float64 `db:"latitude"`
+		Longitude      *float64 `db:"longitude"`
+		AccuracyRadius int      `db:"accuracy_radius"`
 	}
 )
 
-func (pg *Postgres) GetSession(ctx context.Context, sessionID string) (*Session, error) {
+const sessionColumns = `id, session_id, user_id, refresh_token, is_revoked, user_agent, ip_address, created_at, updated_at, expires_at, client_id, scope, refresh_lookup,
+	country, city, asn, as_org, latitude, longitude, accuracy_radius`
+
+func scanSession(row pgx.Row) (*Session, error) {
 	var s Session
-	query := `SELECT * FROM sessions WHERE session_id = @sessionID`
+	l := &s.Location
+	if err := row.Scan(&s.ID, &s.SessionID, &s.UserID, &s.RefreshToken, &s.IsRevoked, &s.UserAgent, &s.IPAddress, &s.CreatedAt, &s.UpdatedAt, &s.ExpiresAt, &s.ClientID, &s.Scope, &s.RefreshLookup,
+		&l.Country, &l.City, &l.ASN, &l.ASOrg, &l.Latitude, &l.Longitude, &l.AccuracyRadius); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+func (pg *Postgres) GetSession(ctx context.Context, sessionID string) (*Session, error) {
+	query := `SELECT ` + sessionColumns + ` FROM sessions WHERE session_id = @sessionID`
 	args := pgx.NamedArgs{
 		"sessionID": sessionID,
 	}
 
-	sessionRow := pg.db.QueryRow(ctx, query, args)
-	if err := sessionRow.Scan(&s.ID, &s.SessionID, &s.UserID, &s.RefreshToken, &s.IsRevoked, &s.UserAgent, &s.IPAddress, &s.CreatedAt, &s.UpdatedAt, &s.ExpiresAt); err != nil {
-		return nil, err
+	return scanSession(pg.db.QueryRow(ctx, query, args))
+}
+
+func (pg *Postgres) GetSessionByRefreshLookup(ctx context.Context, refreshLookup string) (*Session, error) {
+	query := `SELECT ` + sessionColumns + ` FROM sessions WHERE refresh_lookup = @refreshLookup`
+	args := pgx.NamedArgs{
+		"refreshLookup": refreshLookup,
 	}
 
-	return &s, nil
+	return scanSession(pg.db.QueryRow(ctx, query, args))
 }
 
 func (pg *Postgres) CheckActiveSession(ctx context.Context, userID int) (bool, error) {
@@ -91,11 +126,27 @@ func (pg *Postgres) CreateSession(ctx context.Context, s *Session) (*Session, er
 // 	return s, nil
 // }
 
-func (pg *Postgres) CreateOrUpdateSession(ctx context.Context, s *Session) (*Session, error) {
-	query := `INSERT INTO sessions (session_id, user_id, refresh_token, user_agent, ip_address, expires_at) 
-		VALUES (@SessionID, @UserID, @HashedRefreshToken, @UserAgent, @IPAddress, @ExpiresAt)
+// CreateOrUpdateSession saves s and records events in the same transaction
+func (pg *Postgres) CreateOrUpdateSession(ctx context.Context, s *Session, events ...*OutboxEvent) (*Session, error) {
+	if err := pg.withOutbox(ctx, events, func(tx pgx.Tx) error {
+		return saveSession(ctx, tx, s)
+	}); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func saveSession(ctx context.Context, tx pgx.Tx, s *Session) error {
+	query := `INSERT INTO sessions (session_id, user_id, refresh_token, user_agent, ip_address, expires_at, client_id, scope, refresh_lookup,
+		country, city, asn, as_org, latitude, longitude, accuracy_radius) 
+		VALUES (@SessionID, @UserID, @HashedRefreshToken, @UserAgent, @IPAddress, @ExpiresAt, @ClientID, @Scope, @RefreshLookup,
+		@country, @city, @asn, @asOrg, @latitude, @longitude, @accuracyRadius)
 		ON CONFLICT (session_id) DO UPDATE SET refresh_token=EXCLUDED.refresh_token, is_revoked=false, 
-		user_agent=EXCLUDED.user_agent, ip_address=EXCLUDED.ip_address, updated_at=now(), expires_at=EXCLUDED.expires_at
+		user_agent=EXCLUDED.user_agent, ip_address=EXCLUDED.ip_address, updated_at=now(), expires_at=EXCLUDED.expires_at,
+		client_id=EXCLUDED.client_id, scope=EXCLUDED.scope, refresh_lookup=EXCLUDED.refresh_lookup,
+		country=EXCLUDED.country, city=EXCLUDED.city, asn=EXCLUDED.asn, as_org=EXCLUDED.as_org,
+		latitude=EXCLUDED.latitude, longitude=EXCLUDED.longitude, accuracy_radius=EXCLUDED.accuracy_radius
 		RETURNING id`
 	args := pgx.NamedArgs{
 		"SessionID":          s.SessionID,
@@ -104,52 +155,119 @@ func (pg *Postgres) CreateOrUpdateSession(ctx context.Context, s *Session) (*Ses
 		"UserAgent":          s.UserAgent,
 		"IPAddress":          s.IPAddress,
 		"ExpiresAt":          s.ExpiresAt,
+		"ClientID":           s.ClientID,
+		"Scope":              s.Scope,
+		"RefreshLookup":      s.RefreshLookup,
 	}
-	sessionRow := pg.db.QueryRow(ctx, query, args)
+	locationArgs(args, s.Location)
 
-	if err := sessionRow.Scan(&s.ID); err != nil {
-		return nil, err
-	}
-	return s, nil
+	return tx.QueryRow(ctx, query, args).Scan(&s.ID)
 }
 
-func (pg *Postgres) RenewAccessToken(ctx context.Context, newSessionID, sessionID, hashedRefreshToken, userIP string) error {
+func (pg *Postgres) RenewAccessToken(ctx context.Context, newSessionID, sessionID, hashedRefreshToken, refreshLookup, userIP, userAgent string, loc SessionLocation, events ...*OutboxEvent) error {
 	query := `UPDATE sessions 
-		SET session_id=@newSessionID, refresh_token=@hashedRefreshToken, ip_address=@userIP, updated_at=now() 
+		SET session_id=@newSessionID, refresh_token=@hashedRefreshToken, refresh_lookup=@refreshLookup, ip_address=@userIP, user_agent=@userAgent, updated_at=now(),
+		country=@country, city=@city, asn=@asn, as_org=@asOrg, latitude=@latitude, longitude=@longitude, accuracy_radius=@accuracyRadius
 		WHERE session_id = @sessionID`
 	args := pgx.NamedArgs{
 		"newSessionID":       newSessionID,
 		"hashedRefreshToken": hashedRefreshToken,
+		"refreshLookup":      refreshLookup,
 		"userIP":             userIP,
+		"userAgent":          userAgent,
 		"sessionID":          sessionID,
 	}
-	_, err := pg.db.Exec(ctx, query, args)
-	if err != nil {
+	locationArgs(args, loc)
+
+	return pg.withOutbox(ctx, events, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, query, args)
 		return err
-	}
-	return nil
+	})
+}
+
+func locationArgs(args pgx.NamedArgs, loc SessionLocation) {
+	args["country"] = loc.Country
+	args["city"] = loc.City
+	args["asn"] = loc.ASN
+	args["asOrg"] = loc.ASOrg
+	args["latitude"] = loc.Latitude
+	args["longitude"] = loc.Longitude
+	args["accuracyRadius"] = loc.AccuracyRadius
 }
 
-func (pg *Postgres) RevokeSession(ctx context.Context, sessionID string) error {
+func (pg *Postgres) RevokeSession(ctx context.Context, sessionID string, events ...*OutboxEvent) error {
 	query := `UPDATE sessions SET is_revoked=true WHERE session_id = @sessionID`
 	args := pgx.NamedArgs{
 		"sessionID": sessionID,
 	}
-	_, err := pg.db.Exec(ctx, query, args)
-	if err != nil {
+
+	return pg.withOutbox(ctx, events, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, query, args)
 		return err
+	})
+}
+
+// RevokeUserSessions revokes every active session of a user except
+// keepSessionID, which may be empty, and returns how many there were.
+// pgx.ErrNoRows is returned for an unknown user.
+func (pg *Postgres) RevokeUserSessions(ctx context.Context, userID int, keepSessionID string, events ...*OutboxEvent) (int64, error) {
+	tx, err := pg.db.Begin(ctx)
+	if err != nil {
+		return 0, err
 	}
-	return nil
+	defer tx.Rollback(ctx)
+
+	// Concurrent requests for the same user wait for each other instead of
+	// both reporting the same sessions
+	var id int
+	if err := tx.QueryRow(ctx, `SELECT id FROM users WHERE id = @userID FOR UPDATE`, pgx.NamedArgs{"userID": userID}).Scan(&id); err != nil {
+		return 0, err
+	}
+
+	n, err := revokeUserSessions(ctx, tx, userID, keepSessionID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := insertOutboxEvents(ctx, tx, events); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+type execer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
 }
 
-func (pg *Postgres) DeleteSession(ctx context.Context, sessionID string) error {
+func revokeUserSessions(ctx context.Context, e execer, userID int, keepSessionID string) (int64, error) {
+	query := `UPDATE sessions SET is_revoked=true, updated_at=now()
+		WHERE user_id = @userID AND is_revoked = false AND session_id <> @keepSessionID`
+	args := pgx.NamedArgs{
+		"userID":        userID,
+		"keepSessionID": keepSessionID,
+	}
+
+	tag, err := e.Exec(ctx, query, args)
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+func (pg *Postgres) DeleteSession(ctx context.Context, sessionID string, events ...*OutboxEvent) error {
 	query := `DELETE FROM sessions WHERE session_id = @sessionID`
 	args := pgx.NamedArgs{
 		"sessionID": sessionID,
 	}
-	_, err := pg.db.Exec(ctx, query, args)
-	if err != nil {
+
+	return pg.withOutbox(ctx, events, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, query, args)
 		return err
-	}
-	return nil
+	})
 }
@@ -8,25 +8,72 @@ import (
 )
 
 type User struct {
-	ID        int        `db:"id"`
-	Name      string     `db:"name"`
-	Username  string     `db:"username"`
-	Password  string     `db:"password"`
-	CreatedAt time.Time  `db:"created_at"`
-	UpdatedAt *time.Time `db:"updated_at"`
+	ID              int        `db:"id"`
+	Name            string     `db:"name"`
+	Username        string     `db:"username"`
+	Password        string     `db:"password"`
+	Roles           []string   `db:"roles"`
+	AuthSource      string     `db:"auth_source"`
+	Email           *string    `db:"email"`
+	ExternalID      *string    `db:"external_id"`
+	Active          bool       `db:"active"`
+	Phone           *string    `db:"phone"`
+	PhoneVerifiedAt *time.Time `db:"phone_verified_at"`
+	CreatedAt       time.Time  `db:"created_at"`
+	UpdatedAt       *time.Time `db:"updated_at"`
+	// Set when a signin was reported as not the user's, password signin is refused until it changes
+	PasswordResetRequired bool `db:"password_reset_required"`
+}
+
+// UserFilter narrows ListUsers, nil fields match every user
+type UserFilter struct {
+	Username   *string
+	ExternalID *string
+	Email      *string
+	Active     *bool
+}
+
+// Where a user was provisioned from
+const (
+	AuthSourceLocal      = "local"
+	AuthSourceLDAP       = "ldap"
+	AuthSourceFederation = "federation"
+	AuthSourceSCIM       = "scim"
+)
+
+const userColumns = `id, name, username, password, roles, auth_source, email, external_id, active, phone, phone_verified_at, created_at, updated_at, password_reset_required`
+
+func scanUser(row pgx.Row) (*User, error) {
+	var u User
+	if err := row.Scan(&u.ID, &u.Name, &u.Username, &u.Password, &u.Roles, &u.AuthSource, &u.Email, &u.ExternalID, &u.Active, &u.Phone, &u.PhoneVerifiedAt, &u.CreatedAt, &u.UpdatedAt, &u.PasswordResetRequired); err != nil {
+		return nil, err
+	}
+
+	return &u, nil
 }
 
 func (pg *Postgres) CreateUser(ctx context.Context, u *User) (*User, error) {
-	query := `INSERT INTO users (name, username, password) VALUES (@name, @username, @password) RETURNING id`
+	if u.AuthSource == "" {
+		u.AuthSource = AuthSourceLocal
+	}
+
+	// New users are active, the SCIM client deactivates them with UpdateUser
+	query := `INSERT INTO users (name, username, password, roles, auth_source, email, external_id)
+		VALUES (@name, @username, @password, @roles, @authSource, @email, @externalID)
+		RETURNING id, active, created_at`
 	args := pgx.NamedArgs{
-		"name":     u.Name,
-		"username": u.Username,
-		"password": u.Password,
+		"name":       u.Name,
+		"username":   u.Username,
+		"password":   u.Password,
+		"roles":      nonNilRoles(u.Roles),
+		"authSource": u.AuthSource,
+		"email":      u.Email,
+		"externalID": u.ExternalID,
 	}
 
 	userRow := pg.db.QueryRow(ctx, query, args)
 
-	if err := userRow.Scan(&u.ID); err != nil {
+	if err := userRow.Scan(&u.ID, &u.Active, &u.CreatedAt); err != nil {
 		return nil, err
 	}
 
@@ -34,37 +81,30 @@ func (pg *Postgres) CreateUser(ctx context.Context, u *User) (*User, error) {
 }
 
 func (pg *Postgres) GetUserByUsername(ctx context.Context, username string) (*User, error) {
-	var u User
-
-	query := `SELECT * FROM users WHERE username = @username`
+	query := `SELECT ` + userColumns + ` FROM users WHERE username = @username`
 	args := pgx.NamedArgs{
 		"username": username,
 	}
 
-	userRow := pg.db.QueryRow(ctx, query, args)
-
-	if err := userRow.Scan(&u.ID, &u.Name, &u.Username, &u.Password, &u.CreatedAt, &u.UpdatedAt); err != nil {
-		return nil, err
-	}
-
-	return &u, nil
+	return scanUser(pg.db.QueryRow(ctx, query, args))
 }
 
 func (pg *Postgres) GetUserById(ctx context.Context, userID int) (*User, error) {
-	var u User
-
-	query := `SELECT * FROM users WHERE id = @userID`
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = @userID`
 	args := pgx.NamedArgs{
 		"userID": userID,
 	}
 
-	userRow := pg.db.QueryRow(ctx, query, args)
+	return scanUser(pg.db.QueryRow(ctx, query, args))
+}
 
-	if err := userRow.Scan(&u.ID, &u.Name, &u.Username, &u.Password, &u.CreatedAt, &u.UpdatedAt); err != nil {
-		return nil, err
+func (pg *Postgres) GetUserByPhone(ctx context.Context, phone string) (*User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE phone = @phone`
+	args := pgx.NamedArgs{
+		"phone": phone,
 	}
 
-	return &u, nil
+	return scanUser(pg.db.QueryRow(ctx, query, args))
 }
 
 func (pg *Postgres) CheckUsername(ctx context.Context, username string) (bool, error) {
@@ -81,3 +121,170 @@ func (pg *Postgres) CheckUsername(ctx context.Context, username string) (bool, e
 	return b, nil
 
 }
+
+// UpdateUserProfile overwrites the name and roles synced from an external directory
+func (pg *Postgres) UpdateUserProfile(ctx context.Context, userID int, name string, roles []string) error {
+	query := `UPDATE users SET name=@name, roles=@roles, updated_at=now() WHERE id = @userID`
+	args := pgx.NamedArgs{
+		"userID": userID,
+		"name":   name,
+		"roles":  nonNilRoles(roles),
+	}
+
+	_, err := pg.db.Exec(ctx, query, args)
+	return err
+}
+
+// SetUserPhone stores a phone number the user proved they receive codes on, or
+// removes it when phone is nil, in the same transaction as events
+func (pg *Postgres) SetUserPhone(ctx context.Context, userID int, phone *string, events ...*OutboxEvent) error {
+	query := `UPDATE users SET phone=@phone, phone_verified_at=CASE WHEN @phone::text IS NULL THEN NULL ELSE now() END, updated_at=now()
+		WHERE id = @userID`
+	args := pgx.NamedArgs{
+		"userID": userID,
+		"phone":  phone,
+	}
+
+	return pg.withOutbox(ctx, events, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, query, args)
+		return err
+	})
+}
+
+// ListUsers returns a page of users ordered by ID and the number of users matching filter
+func (pg *Postgres) ListUsers(ctx context.Context, filter UserFilter, offset, limit int) ([]*User, int, error) {
+	where := ` WHERE (@username::text IS NULL OR lower(username) = lower(@username))
+		AND (@externalID::text IS NULL OR external_id = @externalID)
+		AND (@email::text IS NULL OR lower(email) = lower(@email))
+		AND (@active::bool IS NULL OR active = @active)`
+	args := pgx.NamedArgs{
+		"username":   filter.Username,
+		"externalID": filter.ExternalID,
+		"email":      filter.Email,
+		"active":     filter.Active,
+		"offset":     offset,
+		"limit":      limit,
+	}
+
+	var total int
+	if err := pg.db.QueryRow(ctx, `SELECT count(*) FROM users`+where, args).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := pg.db.Query(ctx, `SELECT `+userColumns+` FROM users`+where+` ORDER BY id OFFSET @offset LIMIT @limit`, args)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		users = append(users, u)
+	}
+
+	return users, total, rows.Err()
+}
+
+// UpdateUser overwrites the provisioned attributes of a user. Deactivating a
+// user revokes all of their sessions in the same transaction as events.
+func (pg *Postgres) UpdateUser(ctx context.Context, u *User, events ...*OutboxEvent) error {
+	query := `UPDATE users SET name=@name, username=@username, password=@password, email=@email,
+		external_id=@externalID, active=@active, updated_at=now()
+		WHERE id = @userID
+		RETURNING updated_at`
+	args := pgx.NamedArgs{
+		"userID":     u.ID,
+		"name":       u.Name,
+		"username":   u.Username,
+		"password":   u.Password,
+		"email":      u.Email,
+		"externalID": u.ExternalID,
+		"active":     u.Active,
+	}
+
+	return pg.withOutbox(ctx, events, func(tx pgx.Tx) error {
+		if err := tx.QueryRow(ctx, query, args).Scan(&u.UpdatedAt); err != nil {
+			return err
+		}
+
+		if !u.Active {
+			if _, err := revokeUserSessions(ctx, tx, u.ID, ""); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// ChangePassword stores a new password hash and revokes the user's other
+// sessions, keeping keepSessionID, in the same transaction as events. A
+// required reset stays required, see ResetPassword.
+func (pg *Postgres) ChangePassword(ctx context.Context, userID int, hashedPassword string, keepSessionID string, events ...*OutboxEvent) error {
+	query := `UPDATE users SET password=@password, updated_at=now() WHERE id = @userID`
+
+	return pg.setPassword(ctx, query, userID, hashedPassword, keepSessionID, events)
+}
+
+// ResetPassword is ChangePassword for a password reset through a sign-in
+// alert: it clears password_reset_required and revokes every session. The
+// phone number is removed and pending phone codes are expired too, since
+// whoever signed in could have enrolled their own number to sign in with.
+func (pg *Postgres) ResetPassword(ctx context.Context, userID int, hashedPassword string, events ...*OutboxEvent) error {
+	query := `WITH expired AS (
+			UPDATE phone_otps SET expires_at = now() WHERE user_id = @userID AND expires_at > now()
+		)
+		UPDATE users SET password=@password, password_reset_required=false, phone=NULL, phone_verified_at=NULL, updated_at=now()
+		WHERE id = @userID`
+
+	return pg.setPassword(ctx, query, userID, hashedPassword, "", events)
+}
+
+func (pg *Postgres) setPassword(ctx context.Context, query string, userID int, hashedPassword string, keepSessionID string, events []*OutboxEvent) error {
+	args := pgx.NamedArgs{
+		"userID":   userID,
+		"password": hashedPassword,
+	}
+
+	return pg.withOutbox(ctx, events, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, query, args)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return pgx.ErrNoRows
+		}
+
+		_, err = revokeUserSessions(ctx, tx, userID, keepSessionID)
+		return err
+	})
+}
+
+// DeleteUser reports whether the user existed. Sessions, keys and linked
+// identities are removed with the user.
+func (pg *Postgres) DeleteUser(ctx context.Context, userID int) (bool, error) {
+	query := `DELETE FROM users WHERE id = @userID`
+	args := pgx.NamedArgs{
+		"userID": userID,
+	}
+
+	tag, err := pg.db.Exec(ctx, query, args)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+// nonNilRoles keeps a nil slice from being stored as NULL
+func nonNilRoles(r []string) []string {
+	if r == nil {
+		return []string{}
+	}
+
+	return r
+}
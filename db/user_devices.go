@@ -0,0 +1,162 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// UserDevice is a browser or app a user has signed in from. Fingerprint is
+// derived from the device ID the client keeps and its user agent.
+type UserDevice struct {
+	ID          int       `db:"id"`
+	UserID      int       `db:"user_id"`
+	Fingerprint string    `db:"fingerprint"`
+	UserAgent   string    `db:"user_agent"`
+	IPAddress   string    `db:"ip_address"`
+	CreatedAt   time.Time `db:"created_at"`
+	LastSeenAt  time.Time `db:"last_seen_at"`
+}
+
+// SignInAlert is an emailed notice about a signin from a new device. Its link
+// ends the session when the user says it wasn't them.
+type SignInAlert struct {
+	TokenID      string     `db:"token_id"`
+	UserID       int        `db:"user_id"`
+	SessionRowID *int       `db:"session_row_id"`
+	DeniedAt     *time.Time `db:"denied_at"`
+	ExpiresAt    time.Time  `db:"expires_at"`
+	CreatedAt    time.Time  `db:"created_at"`
+	// Current ID of the session, which changes on every renewal. Empty once it is gone.
+	SessionID string `db:"session_id"`
+}
+
+// RecordUserDevice marks d as seen and reports whether it is new to the user,
+// and whether it is the first device the user has at all
+func (pg *Postgres) RecordUserDevice(ctx context.Context, d *UserDevice) (bool, bool, error) {
+	tx, err := pg.db.Begin(ctx)
+	if err != nil {
+		return false, false, err
+	}
+	defer tx.Rollback(ctx)
+
+	query := `UPDATE user_devices SET user_agent=@userAgent, ip_address=@ipAddress, last_seen_at=now()
+		WHERE user_id = @userID AND fingerprint = @fingerprint`
+	args := pgx.NamedArgs{
+		"userID":      d.UserID,
+		"fingerprint": d.Fingerprint,
+		"userAgent":   d.UserAgent,
+		"ipAddress":   d.IPAddress,
+	}
+
+	tag, err := tx.Exec(ctx, query, args)
+	if err != nil {
+		return false, false, err
+	}
+	if tag.RowsAffected() > 0 {
+		return false, false, tx.Commit(ctx)
+	}
+
+	var first bool
+	if err := tx.QueryRow(ctx, `SELECT NOT EXISTS (SELECT 1 FROM user_devices WHERE user_id = @userID)`, args).Scan(&first); err != nil {
+		return false, false, err
+	}
+
+	// A concurrent signin from the same device may have inserted it first
+	query = `INSERT INTO user_devices (user_id, fingerprint, user_agent, ip_address)
+		VALUES (@userID, @fingerprint, @userAgent, @ipAddress)
+		ON CONFLICT (user_id, fingerprint) DO NOTHING`
+
+	tag, err = tx.Exec(ctx, query, args)
+	if err != nil {
+		return false, false, err
+	}
+
+	return tag.RowsAffected() > 0, first, tx.Commit(ctx)
+}
+
+// CreateSignInAlert records an alert about the session sessionID
+func (pg *Postgres) CreateSignInAlert(ctx context.Context, a *SignInAlert, sessionID string) error {
+	query := `INSERT INTO signin_alerts (token_id, user_id, session_row_id, expires_at)
+		VALUES (@tokenID, @userID, (SELECT id FROM sessions WHERE session_id = @sessionID), @expiresAt)`
+	args := pgx.NamedArgs{
+		"tokenID":   a.TokenID,
+		"userID":    a.UserID,
+		"sessionID": sessionID,
+		"expiresAt": a.ExpiresAt,
+	}
+
+	_, err := pg.db.Exec(ctx, query, args)
+	return err
+}
+
+// GetSignInAlert returns an unexpired alert of userID
+func (pg *Postgres) GetSignInAlert(ctx context.Context, tokenID string, userID int) (*SignInAlert, error) {
+	query := `SELECT a.token_id, a.user_id, a.session_row_id, a.denied_at, a.expires_at, a.created_at, COALESCE(s.session_id, '')
+		FROM signin_alerts a
+		LEFT JOIN sessions s ON s.id = a.session_row_id
+		WHERE a.token_id = @tokenID AND a.user_id = @userID AND a.expires_at > now()`
+	args := pgx.NamedArgs{
+		"tokenID": tokenID,
+		"userID":  userID,
+	}
+
+	var a SignInAlert
+	if err := pg.db.QueryRow(ctx, query, args).Scan(&a.TokenID, &a.UserID, &a.SessionRowID, &a.DeniedAt, &a.ExpiresAt, &a.CreatedAt, &a.SessionID); err != nil {
+		return nil, err
+	}
+
+	return &a, nil
+}
+
+// DenySignInAlert revokes the session of a, and requires a new password when
+// requireReset is set, in one transaction with events
+func (pg *Postgres) DenySignInAlert(ctx context.Context, a *SignInAlert, requireReset bool, events ...*OutboxEvent) error {
+	return pg.withOutbox(ctx, events, func(tx pgx.Tx) error {
+		args := pgx.NamedArgs{
+			"tokenID":      a.TokenID,
+			"userID":       a.UserID,
+			"sessionRowID": a.SessionRowID,
+		}
+
+		if _, err := tx.Exec(ctx, `UPDATE signin_alerts SET denied_at=now() WHERE token_id = @tokenID AND denied_at IS NULL`, args); err != nil {
+			return err
+		}
+
+		if a.SessionRowID != nil {
+			if _, err := tx.Exec(ctx, `UPDATE sessions SET is_revoked=true, updated_at=now() WHERE id = @sessionRowID AND user_id = @userID`, args); err != nil {
+				return err
+			}
+		}
+
+		if requireReset {
+			if _, err := tx.Exec(ctx, `UPDATE users SET password_reset_required=true, updated_at=now() WHERE id = @userID`, args); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// ConsumeSignInAlert deletes a denied, unexpired alert of userID and reports
+// whether it existed. Expired alerts are removed on the way.
+func (pg *Postgres) ConsumeSignInAlert(ctx context.Context, tokenID string, userID int) (bool, error) {
+	if _, err := pg.db.Exec(ctx, `DELETE FROM signin_alerts WHERE expires_at <= now()`); err != nil {
+		return false, err
+	}
+
+	query := `DELETE FROM signin_alerts WHERE token_id = @tokenID AND user_id = @userID AND denied_at IS NOT NULL AND expires_at > now()`
+	args := pgx.NamedArgs{
+		"tokenID": tokenID,
+		"userID":  userID,
+	}
+
+	tag, err := pg.db.Exec(ctx, query, args)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
@@ -0,0 +1,198 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// WebhookSubscription receives the events listed in EventTypes, or every event
+// when it lists "*". Secret signs the deliveries and has to be kept readable.
+type WebhookSubscription struct {
+	ID          int        `db:"id"`
+	URL         string     `db:"url"`
+	EventTypes  []string   `db:"event_types"`
+	Secret      string     `db:"secret"`
+	Description string     `db:"description"`
+	IsDisabled  bool       `db:"is_disabled"`
+	CreatedAt   time.Time  `db:"created_at"`
+	UpdatedAt   *time.Time `db:"updated_at"`
+}
+
+const webhookSubscriptionColumns = `id, url, event_types, secret, description, is_disabled, created_at, updated_at`
+
+func scanWebhookSubscription(row pgx.Row) (*WebhookSubscription, error) {
+	var s WebhookSubscription
+	if err := row.Scan(&s.ID, &s.URL, &s.EventTypes, &s.Secret, &s.Description, &s.IsDisabled, &s.CreatedAt, &s.UpdatedAt); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// WebhookDeadLetter keeps a delivery that failed every attempt
+type WebhookDeadLetter struct {
+	ID             int       `db:"id"`
+	SubscriptionID int       `db:"subscription_id"`
+	EventID        string    `db:"event_id"`
+	EventType      string    `db:"event_type"`
+	Payload        []byte    `db:"payload"`
+	Attempts       int       `db:"attempts"`
+	LastStatus     *int      `db:"last_status"`
+	LastError      string    `db:"last_error"`
+	CreatedAt      time.Time `db:"created_at"`
+}
+
+func (pg *Postgres) CreateWebhookSubscription(ctx context.Context, s *WebhookSubscription) (*WebhookSubscription, error) {
+	query := `INSERT INTO webhook_subscriptions (url, event_types, secret, description, is_disabled)
+		VALUES (@url, @eventTypes, @secret, @description, @isDisabled)
+		RETURNING id, created_at`
+	args := pgx.NamedArgs{
+		"url":         s.URL,
+		"eventTypes":  s.EventTypes,
+		"secret":      s.Secret,
+		"description": s.Description,
+		"isDisabled":  s.IsDisabled,
+	}
+
+	if err := pg.db.QueryRow(ctx, query, args).Scan(&s.ID, &s.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (pg *Postgres) GetWebhookSubscription(ctx context.Context, id int) (*WebhookSubscription, error) {
+	query := `SELECT ` + webhookSubscriptionColumns + ` FROM webhook_subscriptions WHERE id = @id`
+	args := pgx.NamedArgs{
+		"id": id,
+	}
+
+	return scanWebhookSubscription(pg.db.QueryRow(ctx, query, args))
+}
+
+func (pg *Postgres) ListWebhookSubscriptions(ctx context.Context) ([]*WebhookSubscription, error) {
+	query := `SELECT ` + webhookSubscriptionColumns + ` FROM webhook_subscriptions ORDER BY id`
+
+	return pg.queryWebhookSubscriptions(ctx, query, pgx.NamedArgs{})
+}
+
+// ListWebhookSubscriptionsForEvent returns the enabled subscriptions that receive eventType
+func (pg *Postgres) ListWebhookSubscriptionsForEvent(ctx context.Context, eventType string) ([]*WebhookSubscription, error) {
+	query := `SELECT ` + webhookSubscriptionColumns + ` FROM webhook_subscriptions
+		WHERE is_disabled = false AND (@eventType = ANY(event_types) OR '*' = ANY(event_types))
+		ORDER BY id`
+	args := pgx.NamedArgs{
+		"eventType": eventType,
+	}
+
+	return pg.queryWebhookSubscriptions(ctx, query, args)
+}
+
+func (pg *Postgres) queryWebhookSubscriptions(ctx context.Context, query string, args pgx.NamedArgs) ([]*WebhookSubscription, error) {
+	rows, err := pg.db.Query(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subs := []*WebhookSubscription{}
+	for rows.Next() {
+		s, err := scanWebhookSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, s)
+	}
+
+	return subs, rows.Err()
+}
+
+func (pg *Postgres) UpdateWebhookSubscription(ctx context.Context, s *WebhookSubscription) error {
+	query := `UPDATE webhook_subscriptions
+		SET url=@url, event_types=@eventTypes, description=@description, is_disabled=@isDisabled, updated_at=now()
+		WHERE id = @id`
+	args := pgx.NamedArgs{
+		"url":         s.URL,
+		"eventTypes":  s.EventTypes,
+		"description": s.Description,
+		"isDisabled":  s.IsDisabled,
+		"id":          s.ID,
+	}
+
+	_, err := pg.db.Exec(ctx, query, args)
+	return err
+}
+
+func (pg *Postgres) UpdateWebhookSecret(ctx context.Context, id int, secret string) error {
+	query := `UPDATE webhook_subscriptions SET secret=@secret, updated_at=now() WHERE id = @id`
+	args := pgx.NamedArgs{
+		"secret": secret,
+		"id":     id,
+	}
+
+	_, err := pg.db.Exec(ctx, query, args)
+	return err
+}
+
+// DeleteWebhookSubscription reports whether the subscription existed. Its dead
+// letters are removed with it.
+func (pg *Postgres) DeleteWebhookSubscription(ctx context.Context, id int) (bool, error) {
+	query := `DELETE FROM webhook_subscriptions WHERE id = @id`
+	args := pgx.NamedArgs{
+		"id": id,
+	}
+
+	tag, err := pg.db.Exec(ctx, query, args)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+func (pg *Postgres) CreateWebhookDeadLetter(ctx context.Context, d *WebhookDeadLetter) error {
+	query := `INSERT INTO webhook_dead_letters (subscription_id, event_id, event_type, payload, attempts, last_status, last_error)
+		VALUES (@subscriptionID, @eventID, @eventType, @payload, @attempts, @lastStatus, @lastError)`
+	args := pgx.NamedArgs{
+		"subscriptionID": d.SubscriptionID,
+		"eventID":        d.EventID,
+		"eventType":      d.EventType,
+		"payload":        string(d.Payload),
+		"attempts":       d.Attempts,
+		"lastStatus":     d.LastStatus,
+		"lastError":      d.LastError,
+	}
+
+	_, err := pg.db.Exec(ctx, query, args)
+	return err
+}
+
+// ListWebhookDeadLetters returns the latest dead letters of a subscription, newest first
+func (pg *Postgres) ListWebhookDeadLetters(ctx context.Context, subscriptionID int, limit int) ([]*WebhookDeadLetter, error) {
+	query := `SELECT id, subscription_id, event_id, event_type, payload, attempts, last_status, last_error, created_at
+		FROM webhook_dead_letters WHERE subscription_id = @subscriptionID
+		ORDER BY created_at DESC, id DESC LIMIT @limit`
+	args := pgx.NamedArgs{
+		"subscriptionID": subscriptionID,
+		"limit":          limit,
+	}
+
+	rows, err := pg.db.Query(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	letters := []*WebhookDeadLetter{}
+	for rows.Next() {
+		var d WebhookDeadLetter
+		if err := rows.Scan(&d.ID, &d.SubscriptionID, &d.EventID, &d.EventType, &d.Payload, &d.Attempts, &d.LastStatus, &d.LastError, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		letters = append(letters, &d)
+	}
+
+	return letters, rows.Err()
+}
@@ -3,17 +3,26 @@ module github.com/arrogantworm/jwt_auth
 go 1.24.4
 
 require (
+	github.com/crewjam/saml v0.5.1
 	github.com/go-chi/chi/v5 v5.2.2
+	github.com/go-ldap/ldap/v3 v3.4.12
 	github.com/golang-jwt/jwt/v5 v5.2.2
 	github.com/google/uuid v1.6.0
 	github.com/jackc/pgx/v5 v5.7.5
 	github.com/joho/godotenv v1.5.1
+	github.com/oschwald/maxminddb-golang v1.13.1
+	github.com/russellhaering/goxmldsig v1.4.0
 	github.com/spf13/viper v1.20.1
 	golang.org/x/crypto v0.39.0
 )
 
 require (
+	github.com/Azure/go-ntlmssp v0.0.0-20221128193559-754e69321358 // indirect
+	github.com/beevik/etree v1.5.0 // indirect
+	github.com/go-asn1-ber/asn1-ber v1.5.8-0.20250403174932-29230038a667 // indirect
 	github.com/go-chi/cors v1.2.2 // indirect
+	github.com/jonboulle/clockwork v0.2.2 // indirect
+	github.com/mattermost/xml-roundtrip-validator v0.1.0 // indirect
 	github.com/swaggo/files/v2 v2.0.0 // indirect
 )
 